@@ -1,7 +1,11 @@
 package main
 
 import (
+	"context"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/antihax/gambit/internal/conman"
 )
@@ -11,5 +15,10 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	conman.StartConning()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := conman.Run(ctx); err != nil {
+		log.Fatal(err)
+	}
 }
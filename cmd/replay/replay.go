@@ -0,0 +1,27 @@
+// replay feeds stored raw captures through the drivers without touching the network
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/antihax/gambit/internal/conman"
+)
+
+func main() {
+	port := flag.Uint("port", 0, "destination port the capture arrived on")
+	flag.Parse()
+	if flag.NArg() == 0 {
+		log.Fatal("usage: replay [-port n] capture or pcap...")
+	}
+
+	conman, err := conman.NewConMan()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, path := range flag.Args() {
+		if err := conman.Replay(path, uint16(*port)); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
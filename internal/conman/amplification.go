@@ -0,0 +1,81 @@
+package conman
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// amplificationMaxQuery bounds the datagrams classified, reflection relies on
+// a small query drawing a much larger reply
+const amplificationMaxQuery = 512
+
+// amplificationVector is a query which reflectors answer with far more than
+// was sent, abused with a spoofed source to flood the victim
+type amplificationVector struct {
+	name  string
+	port  uint16
+	match func(p []byte) bool
+}
+
+// amplificationVectors are checked in order, add new ones here
+var amplificationVectors = []amplificationVector{
+	{"dns-any", 53, dnsAnyQuery},
+	{"ntp-monlist", 123, func(p []byte) bool {
+		// mode 7 private request for MON_GETLIST or MON_GETLIST_1
+		return len(p) >= 4 && p[0]&0x07 == 7 && (p[3] == 0x14 || p[3] == 0x2a)
+	}},
+	{"memcached-stats", 11211, func(p []byte) bool {
+		// an eight byte frame header precedes the text protocol
+		return len(p) > 8 && (bytes.HasPrefix(p[8:], []byte("stats")) || bytes.HasPrefix(p[8:], []byte("gets ")))
+	}},
+	{"ssdp-msearch", 1900, func(p []byte) bool {
+		return bytes.HasPrefix(p, []byte("M-SEARCH"))
+	}},
+	{"cldap-search", 389, func(p []byte) bool {
+		// a BER sequence asking for the root DSE
+		return len(p) > 0 && p[0] == 0x30 && bytes.Contains(bytes.ToLower(p), []byte("objectclass"))
+	}},
+	{"snmp-getbulk", 161, func(p []byte) bool {
+		return len(p) > 0 && p[0] == 0x30 && bytes.IndexByte(p, 0xa5) > 0
+	}},
+	{"chargen", 19, func(p []byte) bool { return true }},
+	{"qotd", 17, func(p []byte) bool { return true }},
+	{"ws-discovery", 3702, func(p []byte) bool {
+		return bytes.Contains(p, []byte("Probe"))
+	}},
+	{"coap-discovery", 5683, func(p []byte) bool {
+		// a GET of /.well-known/core, the option deltas before it vary
+		return len(p) >= 4 && p[0]>>6 == 1 && p[1] == 0x01 && bytes.Contains(p, []byte("well-known"))
+	}},
+}
+
+// classifyAmplification names the amplification vector a datagram to port
+// looks like, or returns an empty string
+func classifyAmplification(port uint16, p []byte) string {
+	if len(p) == 0 || len(p) > amplificationMaxQuery {
+		return ""
+	}
+	for _, v := range amplificationVectors {
+		if v.port == port && v.match(p) {
+			return v.name
+		}
+	}
+	return ""
+}
+
+// dnsAnyQuery reports if p is a DNS query for type ANY
+func dnsAnyQuery(p []byte) bool {
+	// a query with at least one question
+	if len(p) < 12 || p[2]&0x80 != 0 || binary.BigEndian.Uint16(p[4:6]) == 0 {
+		return false
+	}
+	// walk the labels of the first name
+	i := 12
+	for i < len(p) && p[i] != 0 {
+		if p[i]&0xc0 != 0 {
+			return false
+		}
+		i += int(p[i]) + 1
+	}
+	return i+3 <= len(p) && binary.BigEndian.Uint16(p[i+1:i+3]) == 255
+}
@@ -0,0 +1,34 @@
+package conman
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyAmplification(t *testing.T) {
+	// an ANY query for isc.org, with and without the type
+	dnsAny := []byte("\x12\x34\x01\x00\x00\x01\x00\x00\x00\x00\x00\x00\x03isc\x03org\x00\x00\xff\x00\x01")
+	dnsA := []byte("\x12\x34\x01\x00\x00\x01\x00\x00\x00\x00\x00\x00\x03isc\x03org\x00\x00\x01\x00\x01")
+
+	for _, tc := range []struct {
+		port   uint16
+		query  []byte
+		vector string
+	}{
+		{53, dnsAny, "dns-any"},
+		{53, dnsA, ""},
+		{53, dnsAny[:20], ""},
+		{5353, dnsAny, ""},
+		{123, []byte("\x17\x00\x03\x2a\x00\x00\x00\x00"), "ntp-monlist"},
+		{123, []byte("\x1b\x00\x00\x00"), ""},
+		{11211, []byte("\x00\x00\x00\x00\x00\x01\x00\x00stats\r\n"), "memcached-stats"},
+		{1900, []byte("M-SEARCH * HTTP/1.1\r\nST: ssdp:all\r\n\r\n"), "ssdp-msearch"},
+		{389, []byte("\x30\x25\x02\x01\x01\x63\x20\x04\x00\x0a\x01\x00\x0a\x01\x00\x02\x01\x00\x02\x01\x00\x01\x01\x00\x87\x0bobjectClass\x30\x00"), "cldap-search"},
+		{19, []byte("x"), "chargen"},
+		{19, make([]byte, amplificationMaxQuery+1), ""},
+		{5683, []byte("\x40\x01\x12\x34\xbb.well-known\x04core"), "coap-discovery"},
+	} {
+		assert.Equal(t, tc.vector, classifyAmplification(tc.port, tc.query), "%d %q", tc.port, tc.query)
+	}
+}
@@ -0,0 +1,48 @@
+package conman
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+// runAPI serves the operations API on APIAddress until ctx is done
+func (s *ConnectionManager) runAPI(ctx context.Context) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /events", s.handleEvents)
+	mux.HandleFunc("GET /stream", s.handleStream)
+	s.registerHealth(mux)
+	s.registerBans(mux)
+	if s.config.PprofAddr == s.config.APIAddress {
+		registerProfiling(mux)
+	}
+
+	srv := &http.Server{
+		Addr:              s.config.APIAddress,
+		Handler:           mux,
+		ReadHeaderTimeout: time.Second * 10,
+	}
+	s.logger.Info().Str("address", s.config.APIAddress).Msg("starting api")
+	return serveUntil(ctx, srv)
+}
+
+// serveUntil runs srv until ctx is done then shuts it down, letting requests
+// in flight finish. Requests inherit ctx so streams end with it.
+func serveUntil(ctx context.Context, srv *http.Server) error {
+	srv.BaseContext = func(net.Listener) context.Context {
+		return ctx
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.ListenAndServe()
+	}()
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return srv.Shutdown(shutdownCtx)
+}
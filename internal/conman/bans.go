@@ -0,0 +1,79 @@
+package conman
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// banRequest is the body of POST /bans
+type banRequest struct {
+	// Address is an address or network, such as "198.51.100.0/24"
+	Address string `json:"address"`
+	// Duration is how many seconds the ban lasts, 0 keeps it until removed
+	Duration int `json:"duration"`
+}
+
+// registerBans adds the ban management endpoints to mux, they are only
+// served if an APIToken is set
+func (s *ConnectionManager) registerBans(mux *http.ServeMux) {
+	if s.config.APIToken == "" {
+		return
+	}
+	mux.HandleFunc("GET /bans", s.requireToken(s.handleListBans))
+	mux.HandleFunc("POST /bans", s.requireToken(s.handleAddBan))
+	mux.HandleFunc("DELETE /bans", s.requireToken(s.handleRemoveBan))
+}
+
+// requireToken rejects requests without the APIToken as a bearer token
+func (s *ConnectionManager) requireToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.config.APIToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handleListBans serves the current bans as JSON
+func (s *ConnectionManager) handleListBans(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.banList.Bans()); err != nil {
+		s.logger.Debug().Err(err).Msg("writing bans")
+	}
+}
+
+// handleAddBan bans an address or network by hand
+func (s *ConnectionManager) handleAddBan(w http.ResponseWriter, r *http.Request) {
+	var req banRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Duration < 0 {
+		http.Error(w, "duration may not be negative", http.StatusBadRequest)
+		return
+	}
+	if err := s.banList.AddBan(req.Address, time.Duration(req.Duration)*time.Second); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.logger.Info().Str("address", req.Address).Int("duration", req.Duration).Msg("banned by api")
+	w.WriteHeader(http.StatusCreated)
+}
+
+// handleRemoveBan lifts the ban on ?address=
+func (s *ConnectionManager) handleRemoveBan(w http.ResponseWriter, r *http.Request) {
+	address := r.URL.Query().Get("address")
+	if !s.banList.RemoveBan(address) {
+		http.Error(w, "no such ban", http.StatusNotFound)
+		return
+	}
+	s.logger.Info().Str("address", address).Msg("unbanned by api")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,59 @@
+package conman
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/antihax/gambit/internal/conman/config"
+	"github.com/antihax/gambit/internal/conman/security"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBansAPI(t *testing.T) {
+	s := &ConnectionManager{
+		banList: security.NewBanManager(10, time.Minute, 0),
+		config:  &config.Config{APIToken: "secret"},
+		logger:  zerolog.Nop(),
+	}
+	mux := http.NewServeMux()
+	s.registerBans(mux)
+
+	do := func(method, target, token, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, do("GET", "/bans", "", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, do("GET", "/bans", "wrong", "").Code)
+
+	assert.Equal(t, http.StatusCreated, do("POST", "/bans", "secret", `{"address": "198.51.100.0/24"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, do("POST", "/bans", "secret", `{"address": "nope"}`).Code)
+	assert.True(t, s.banList.IsBanned("198.51.100.9"))
+
+	var bans []security.Ban
+	w := do("GET", "/bans", "secret", "")
+	if assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &bans)) && assert.Len(t, bans, 1) {
+		assert.Equal(t, "198.51.100.0/24", bans[0].Address)
+		assert.True(t, bans[0].Manual)
+	}
+
+	assert.Equal(t, http.StatusNoContent, do("DELETE", "/bans?address=198.51.100.0/24", "secret", "").Code)
+	assert.Equal(t, http.StatusNotFound, do("DELETE", "/bans?address=198.51.100.0/24", "secret", "").Code)
+	assert.False(t, s.banList.IsBanned("198.51.100.9"))
+
+	// nothing is served without a token configured
+	s.config.APIToken = ""
+	mux = http.NewServeMux()
+	s.registerBans(mux)
+	assert.Equal(t, http.StatusNotFound, do("GET", "/bans", "", "").Code)
+}
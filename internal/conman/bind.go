@@ -0,0 +1,120 @@
+package conman
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/antihax/gambit/internal/conman/gctx"
+)
+
+var errNoInterfaceAddress = errors.New("no usable address")
+
+// a port which fails to bind is left alone for bindBackoff, doubling with each
+// failure up to bindBackoffMax, so one held by another service is not retried
+// on every SYN but can be reclaimed once it is freed
+const (
+	bindBackoff    = time.Minute
+	bindBackoffMax = time.Hour
+)
+
+// bindFailures remembers ports which failed to bind, the zero value is ready to use
+type bindFailures struct {
+	mu    sync.Mutex
+	ports map[uint16]bindFailure
+}
+
+type bindFailure struct {
+	until   time.Time
+	backoff time.Duration
+}
+
+// blocked reports if the port failed to bind recently enough to skip it
+func (b *bindFailures) blocked(port uint16, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	f, ok := b.ports[port]
+	return ok && now.Before(f.until)
+}
+
+// failed records a failure to bind, returning how long the port is left alone
+func (b *bindFailures) failed(port uint16, now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.ports == nil {
+		b.ports = make(map[uint16]bindFailure)
+	}
+	backoff := bindBackoff
+	if f, ok := b.ports[port]; ok {
+		backoff = min(f.backoff*2, bindBackoffMax)
+	}
+	b.ports[port] = bindFailure{until: now.Add(backoff), backoff: backoff}
+	return backoff
+}
+
+// succeeded forgets any failures of the port
+func (b *bindFailures) succeeded(port uint16) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.ports, port)
+}
+
+// bindAddress returns the address new listeners bind to. With BindInterface set
+// the interface is looked up each time so address changes are followed.
+func (s *ConnectionManager) bindAddress() (string, error) {
+	if s.config.BindInterface == "" {
+		return gctx.IPAddress, nil
+	}
+	ip, err := interfaceAddress(s.config.BindInterface)
+	if err != nil {
+		return "", fmt.Errorf("bind interface %s: %w", s.config.BindInterface, err)
+	}
+	return ip.String(), nil
+}
+
+// interfaceAddress finds the address to bind on the named interface
+func interfaceAddress(name string) (net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	if iface.Flags&net.FlagUp == 0 {
+		return nil, errors.New("interface is down")
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	return pickAddress(addrs)
+}
+
+// pickAddress prefers the first public IPv4 address, then the first public IPv6,
+// then anything else routable such as the private address of a container
+func pickAddress(addrs []net.Addr) (net.IP, error) {
+	var ips []net.IP
+	for _, addr := range addrs {
+		switch v := addr.(type) {
+		case *net.IPNet:
+			ips = append(ips, v.IP)
+		case *net.IPAddr:
+			ips = append(ips, v.IP)
+		}
+	}
+
+	for _, match := range []func(net.IP) bool{
+		func(ip net.IP) bool { return !privateIP(ip) && ip.To4() != nil },
+		func(ip net.IP) bool { return !privateIP(ip) },
+		func(ip net.IP) bool {
+			return !ip.IsLoopback() && !ip.IsMulticast() && !ip.IsUnspecified() && !ip.IsLinkLocalUnicast()
+		},
+	} {
+		for _, ip := range ips {
+			if match(ip) {
+				return ip, nil
+			}
+		}
+	}
+	return nil, errNoInterfaceAddress
+}
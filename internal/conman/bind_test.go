@@ -0,0 +1,88 @@
+package conman
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/antihax/gambit/internal/conman/config"
+	"github.com/antihax/gambit/internal/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPickAddress(t *testing.T) {
+	addr := func(s string) net.Addr {
+		ip, ipNet, _ := net.ParseCIDR(s)
+		ipNet.IP = ip
+		return ipNet
+	}
+	loopback, private := addr("127.0.0.1/8"), addr("10.0.0.5/24")
+	public4, public6 := addr("203.0.113.7/24"), addr("2001:db8::7/64")
+
+	tests := []struct {
+		addrs []net.Addr
+		want  string
+	}{
+		{[]net.Addr{loopback, private, public6, public4}, "203.0.113.7"},
+		{[]net.Addr{private, public6}, "2001:db8::7"},
+		{[]net.Addr{loopback, addr("fe80::1/64"), private}, "10.0.0.5"},
+	}
+	for _, test := range tests {
+		ip, err := pickAddress(test.addrs)
+		if assert.NoError(t, err) {
+			assert.Equal(t, test.want, ip.String())
+		}
+	}
+
+	_, err := pickAddress([]net.Addr{loopback})
+	assert.ErrorIs(t, err, errNoInterfaceAddress)
+}
+
+func TestInterfaceAddressMissing(t *testing.T) {
+	_, err := interfaceAddress("does-not-exist0")
+	assert.Error(t, err)
+}
+
+func TestBindFailuresBackoff(t *testing.T) {
+	var b bindFailures
+	now := time.Now()
+	assert.False(t, b.blocked(80, now))
+
+	assert.Equal(t, bindBackoff, b.failed(80, now))
+	assert.True(t, b.blocked(80, now.Add(bindBackoff-time.Second)))
+	assert.False(t, b.blocked(81, now))
+
+	// expired so it is tried again, failing again waits longer
+	later := now.Add(bindBackoff)
+	assert.False(t, b.blocked(80, later))
+	assert.Equal(t, bindBackoff*2, b.failed(80, later))
+	for i := 0; i < 10; i++ {
+		b.failed(80, later)
+	}
+	assert.Equal(t, bindBackoffMax, b.failed(80, later))
+
+	b.succeeded(80)
+	assert.False(t, b.blocked(80, later))
+	assert.Equal(t, bindBackoff, b.failed(80, later))
+}
+
+func TestCreateTCPListenerInUse(t *testing.T) {
+	held, err := net.Listen("tcp", ":0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer held.Close()
+	port := uint16(held.Addr().(*net.TCPAddr).Port)
+
+	s := newRunTestManager(&config.Config{})
+	before := metrics.ListenerBindFailures.Value()
+	_, err = s.CreateTCPListener(port)
+	assert.Error(t, err)
+
+	// further SYNs do not try again
+	known, err := s.CreateTCPListener(port)
+	assert.True(t, known)
+	assert.NoError(t, err)
+	assert.Equal(t, before+1, metrics.ListenerBindFailures.Value())
+	assert.Empty(t, s.ActiveListeners())
+}
@@ -0,0 +1,26 @@
+package conman
+
+import "sync"
+
+// readBufferSize is the most read from the start of a connection, the usual MTU
+const readBufferSize = 1500
+
+// readBuffers recycles the buffers the start of each connection is read into,
+// a scan would otherwise allocate one for every connection it opens. Anything
+// which outlives the connection's handling must be copied out.
+var readBuffers = sync.Pool{
+	New: func() any {
+		b := make([]byte, readBufferSize)
+		return &b
+	},
+}
+
+// getReadBuffer takes a buffer from the pool, return it with putReadBuffer
+func getReadBuffer() *[]byte {
+	return readBuffers.Get().(*[]byte)
+}
+
+// putReadBuffer returns a buffer to the pool once nothing refers to it
+func putReadBuffer(b *[]byte) {
+	readBuffers.Put(b)
+}
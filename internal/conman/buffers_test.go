@@ -0,0 +1,46 @@
+package conman
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/antihax/gambit/internal/conman/config"
+	"github.com/antihax/gambit/internal/conman/security"
+)
+
+// BenchmarkHandleConnection measures the allocations of a flood of short
+// connections through handleConnection, where the first read is pooled
+func BenchmarkHandleConnection(b *testing.B) {
+	cfg, err := config.LoadConfig("")
+	if err != nil {
+		b.Fatal(err)
+	}
+	s := newRunTestManager(cfg)
+	s.connCtx = context.Background()
+	s.banList = security.NewBanManager(math.MaxInt, time.Minute, 0)
+	s.rules.Store(s.buildRules(cfg))
+
+	packet := bytes.Repeat([]byte("GET / HTTP/1.1\r\n"), 32)
+	local := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2222}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			client, server := net.Pipe()
+			conn := &replayConn{Conn: server, local: local, remote: replayAttacker, done: make(chan struct{})}
+			var wg sync.WaitGroup
+			wg.Add(1)
+			s.acquireConnection()
+			go s.handleConnection(conn, replayListener{local}, &wg)
+			client.Write(packet)
+			client.Close()
+			wg.Wait()
+		}
+	})
+}
@@ -0,0 +1,131 @@
+package conman
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/antihax/gambit/pkg/lru"
+	fake "github.com/brianvoe/gofakeit/v6"
+	"golang.org/x/sync/singleflight"
+)
+
+// maxMintedCertificates bounds the cache of certificates minted for client server names
+const maxMintedCertificates = 1000
+
+// certificateStore selects certificates by the server name a client asks for
+type certificateStore struct {
+	configured map[string]*tls.Certificate
+	mint       bool
+
+	minted *lru.Cache[string, *tls.Certificate]
+	// minting is shared by concurrent handshakes for the same name
+	minting singleflight.Group
+}
+
+// newCertificateStore loads the configured server name certificates
+func newCertificateStore(files map[string]string, mint bool) (*certificateStore, error) {
+	c := &certificateStore{
+		configured: make(map[string]*tls.Certificate),
+		mint:       mint,
+		minted:     lru.New[string, *tls.Certificate](maxMintedCertificates),
+	}
+	for name, file := range files {
+		cert, err := tls.LoadX509KeyPair(file, file)
+		if err != nil {
+			return nil, err
+		}
+		c.configured[strings.ToLower(name)] = &cert
+	}
+	return c, nil
+}
+
+// GetCertificate returns a configured or minted certificate for the SNI. A nil
+// certificate falls back to the default certificate.
+func (c *certificateStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(hello.ServerName)
+	if name == "" {
+		return nil, nil
+	}
+
+	if cert, ok := c.configured[name]; ok {
+		return cert, nil
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if cert, ok := c.configured["*"+name[i:]]; ok {
+			return cert, nil
+		}
+	}
+
+	if !c.mint {
+		return nil, nil
+	}
+	cert, err := c.mintCertificate(name)
+	if err != nil {
+		return nil, err
+	}
+	// ancient clients may not speak ECDSA, give them the default instead
+	if hello.SupportsCertificate(cert) != nil {
+		return nil, nil
+	}
+	return cert, nil
+}
+
+// mintCertificate creates, or returns the cached, certificate for name.
+// Handshakes for other names are not held up while one is minted.
+func (c *certificateStore) mintCertificate(name string) (*tls.Certificate, error) {
+	if cert, ok := c.minted.Get(name); ok {
+		return cert, nil
+	}
+	v, err, _ := c.minting.Do(name, func() (any, error) {
+		if cert, ok := c.minted.Get(name); ok {
+			return cert, nil
+		}
+		cert, err := newNamedCertificate(name)
+		if err != nil {
+			return nil, err
+		}
+		c.minted.Add(name, cert)
+		return cert, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*tls.Certificate), nil
+}
+
+// newNamedCertificate self signs a certificate for name. ECDSA keeps this cheap
+// as any client may ask for any name.
+func newNamedCertificate(name string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	tml := x509.Certificate{
+		NotBefore:    time.Now().AddDate(0, -1, 0),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		SerialNumber: big.NewInt(int64(fake.Uint32())),
+		Subject: pkix.Name{
+			CommonName:   name,
+			Organization: []string{fake.Company()},
+		},
+		DNSNames:              []string{name},
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tml, &tml, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}, nil
+}
@@ -0,0 +1,115 @@
+package conman
+
+import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeCertificate saves a certificate for name with its key in one PEM file
+func writeCertificate(t *testing.T, name string) string {
+	t.Helper()
+	cert, err := newNamedCertificate(name)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	key, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key})...)
+	path := filepath.Join(t.TempDir(), name+".pem")
+	if !assert.NoError(t, os.WriteFile(path, data, 0600)) {
+		t.FailNow()
+	}
+	return path
+}
+
+// certificateName is the name a certificate was issued for
+func certificateName(t *testing.T, cert *tls.Certificate) string {
+	t.Helper()
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestCertificateStoreSNI(t *testing.T) {
+	c, err := newCertificateStore(map[string]string{
+		"Mail.Example.com": writeCertificate(t, "mail.example.com"),
+		"*.example.org":    writeCertificate(t, "wildcard.example.org"),
+	}, false)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// exact names are matched without regard to case, then wildcards
+	cert, err := c.GetCertificate(&tls.ClientHelloInfo{ServerName: "MAIL.example.com"})
+	if assert.NoError(t, err) && assert.NotNil(t, cert) {
+		assert.Equal(t, "mail.example.com", certificateName(t, cert))
+	}
+	cert, err = c.GetCertificate(&tls.ClientHelloInfo{ServerName: "www.example.org"})
+	if assert.NoError(t, err) && assert.NotNil(t, cert) {
+		assert.Equal(t, "wildcard.example.org", certificateName(t, cert))
+	}
+
+	// anything else falls back to the default without minting
+	for _, name := range []string{"", "example.org", "other.example.net"} {
+		cert, err = c.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+		assert.NoError(t, err)
+		assert.Nil(t, cert, name)
+	}
+
+	_, err = newCertificateStore(map[string]string{"bad": filepath.Join(t.TempDir(), "missing.pem")}, false)
+	assert.Error(t, err)
+}
+
+func TestCertificateStoreMint(t *testing.T) {
+	c, err := newCertificateStore(nil, true)
+	if !assert.NoError(t, err) {
+		return
+	}
+	hello := &tls.ClientHelloInfo{
+		ServerName:        "Target.Example.com",
+		SupportedVersions: []uint16{tls.VersionTLS13},
+		SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+	}
+
+	cert, err := c.GetCertificate(hello)
+	if !assert.NoError(t, err) || !assert.NotNil(t, cert) {
+		return
+	}
+	assert.Equal(t, "target.example.com", certificateName(t, cert))
+
+	// concurrent handshakes for the name share the cached certificate
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			again, err := c.GetCertificate(hello)
+			assert.NoError(t, err)
+			assert.Same(t, cert, again)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1, c.minted.Len())
+
+	// clients which cannot use ECDSA get the default
+	cert, err = c.GetCertificate(&tls.ClientHelloInfo{
+		ServerName:        "rsa.example.com",
+		SupportedVersions: []uint16{tls.VersionTLS12},
+		CipherSuites:      []uint16{tls.TLS_RSA_WITH_AES_128_CBC_SHA},
+	})
+	assert.NoError(t, err)
+	assert.Nil(t, cert)
+}
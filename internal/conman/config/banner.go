@@ -0,0 +1,27 @@
+package config
+
+import "strconv"
+
+// Banner is sent to attackers who do not speak first. It is written with Go
+// escapes so control characters can be set from the environment or a file.
+type Banner []byte
+
+// UnmarshalText decodes escapes such as \r\n and \x00
+func (b *Banner) UnmarshalText(text []byte) error {
+	s := string(text)
+	var out []byte
+	for len(s) > 0 {
+		r, multibyte, tail, err := strconv.UnquoteChar(s, 0)
+		if err != nil {
+			return err
+		}
+		if r < 0x100 && !multibyte {
+			out = append(out, byte(r))
+		} else {
+			out = append(out, string(r)...)
+		}
+		s = tail
+	}
+	*b = out
+	return nil
+}
@@ -2,7 +2,15 @@ package config
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
 
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/sethvargo/go-envconfig"
 )
 
@@ -15,8 +23,40 @@ type Config struct {
 	// SyslogNetwork (CONMAN_SYSLOG_NETWORK) defines the network type for syslog, defaults to "stdout"
 	SyslogNetwork string `env:"CONMAN_SYSLOG_NETWORK,default=stdout"`
 
-	// LogLevel (CONMAN_LOGLEVEL) sets the logging verbosity level, default is 1
-	LogLevel int `env:"CONMAN_LOGLEVEL,default=1"`
+	// SyslogFormat (CONMAN_SYSLOG_FORMAT) is "cee" for the system syslog writer, or "rfc5424" for RFC 5424 messages
+	// carrying the JSON event which reconnect to remote servers if dropped, default is "cee"
+	SyslogFormat string `env:"CONMAN_SYSLOG_FORMAT,default=cee"`
+
+	// SyslogStdout (CONMAN_SYSLOG_STDOUT) also logs to stdout when logging to syslog
+	SyslogStdout bool `env:"CONMAN_SYSLOG_STDOUT"`
+
+	// LogLevel (CONMAN_LOGLEVEL) is the minimum level logged, one of trace, debug, info, warn or error,
+	// zerolog numbers are also accepted, default is info
+	LogLevel LogLevel `env:"CONMAN_LOGLEVEL,default=info"`
+
+	// LogFormat (CONMAN_LOG_FORMAT) is "json" for one event per line, or "console" for readable output when
+	// developing, only affects logs written to stdout or LogFile, default is "json"
+	LogFormat string `env:"CONMAN_LOG_FORMAT,default=json"`
+
+	// LogFile (CONMAN_LOG_FILE) writes the log to this file instead of stdout, rotating it as it grows
+	LogFile string `env:"CONMAN_LOG_FILE"`
+
+	// LogMaxSizeMB (CONMAN_LOG_MAX_SIZE_MB) rotates LogFile once it reaches this many megabytes, default is 100
+	LogMaxSizeMB int `env:"CONMAN_LOG_MAX_SIZE_MB,default=100"`
+
+	// LogMaxBackups (CONMAN_LOG_MAX_BACKUPS) keeps this many rotated log files, 0 keeps them all, default is 10
+	LogMaxBackups int `env:"CONMAN_LOG_MAX_BACKUPS,default=10"`
+
+	// LogMaxAgeDays (CONMAN_LOG_MAX_AGE_DAYS) removes rotated log files older than this many days, 0 keeps them
+	// regardless of age, default is 30
+	LogMaxAgeDays int `env:"CONMAN_LOG_MAX_AGE_DAYS,default=30"`
+
+	// LogRotateHours (CONMAN_LOG_ROTATE_HOURS) also rotates LogFile this often whatever its size, 0 only rotates
+	// by size, default is 0
+	LogRotateHours int `env:"CONMAN_LOG_ROTATE_HOURS"`
+
+	// LogCompress (CONMAN_LOG_COMPRESS) gzips rotated log files
+	LogCompress bool `env:"CONMAN_LOG_COMPRESS"`
 
 	// Preload (CONMAN_PRELOAD) defines the number of ports to preload, default is 10000
 	Preload uint16 `env:"CONMAN_PRELOAD,default=10000"`
@@ -24,21 +64,115 @@ type Config struct {
 	// MaxPort (CONMAN_MAXPORT) specifies the maximum port number to use, default is 45000
 	MaxPort uint16 `env:"CONMAN_MAXPORT,default=45000"`
 
+	// MinPort (CONMAN_MINPORT) specifies the minimum port number to use, default is 1
+	MinPort uint16 `env:"CONMAN_MINPORT,default=1"`
+
+	// Ports (CONMAN_PORTS) lists TCP ports to listen on at startup, alongside any preloaded or started on demand
+	Ports []uint16 `env:"CONMAN_PORTS"`
+
+	// DisableAutoListen (CONMAN_DISABLE_AUTO_LISTEN) skips the raw sockets starting listeners as SYNs arrive,
+	// so only Ports and preloaded ports are served and CAP_NET_RAW is not needed
+	DisableAutoListen bool `env:"CONMAN_DISABLE_AUTO_LISTEN"`
+
 	// IgnorePorts (CONMAN_IGNORE_PORTS) lists ports to exclude from management
 	IgnorePorts []uint16 `env:"CONMAN_IGNORE_PORTS"`
 
-	// BanCount (CONMAN_BAN_COUNT) sets the threshold for banning connections, default is 50
+	// PortAllowList (CONMAN_PORT_ALLOW_LIST) restricts listening to only these ports if set
+	PortAllowList []uint16 `env:"CONMAN_PORT_ALLOW_LIST"`
+
+	// PortDenyList (CONMAN_PORT_DENY_LIST) lists ports to never listen on, such as those of real services
+	PortDenyList []uint16 `env:"CONMAN_PORT_DENY_LIST"`
+
+	// BanThreshold (CONMAN_BAN_THRESHOLD) sets how many connections an address may make within BanWindow before it is banned
+	// for a BanWindow, BanCount is used if not set
+	BanThreshold int `env:"CONMAN_BAN_THRESHOLD"`
+
+	// BanCount (CONMAN_BAN_COUNT) is the previous name of BanThreshold, default is 50
 	BanCount int `env:"CONMAN_BAN_COUNT,default=50"`
 
+	// BanWindow (CONMAN_BAN_WINDOW) sets the seconds connections are counted over and a ban lasts, default is 60
+	BanWindow int `env:"CONMAN_BAN_WINDOW,default=60"`
+
+	// BanSubnetThreshold (CONMAN_BAN_SUBNET_THRESHOLD) bans a whole /24, or /64 for IPv6, for a BanWindow once this many
+	// of its addresses are banned within one, to cut the noise of scanners rotating through a subnet. Disabled if 0
+	BanSubnetThreshold int `env:"CONMAN_BAN_SUBNET_THRESHOLD"`
+
+	// AllowList (CONMAN_ALLOW_LIST) lists networks such as scanners and monitoring which are never banned, stored or logged above trace
+	AllowList []string `env:"CONMAN_ALLOW_LIST"`
+
+	// AllowListDrop (CONMAN_ALLOW_LIST_DROP) closes connections from the AllowList immediately instead of serving them
+	AllowListDrop bool `env:"CONMAN_ALLOW_LIST_DROP"`
+
+	// PerIPConnRate (CONMAN_PER_IP_CONN_RATE) limits the connections, or udp flows, per second from a single address, 0 disables
+	PerIPConnRate float64 `env:"CONMAN_PER_IP_CONN_RATE"`
+
+	// PerIPConnBurst (CONMAN_PER_IP_CONN_BURST) allows bursts above PerIPConnRate, default is 20
+	PerIPConnBurst int `env:"CONMAN_PER_IP_CONN_BURST,default=20"`
+
+	// MaxConcurrentConnections (CONMAN_MAX_CONCURRENT_CONNECTIONS) caps connections being handled at once, 0 is unlimited, default is 10000
+	MaxConcurrentConnections int `env:"CONMAN_MAX_CONCURRENT_CONNECTIONS,default=10000"`
+
+	// ConnectionWorkers (CONMAN_CONNECTION_WORKERS) handles connections on this many goroutines rather than one each.
+	// A worker is held until the connection is matched to a driver, so slow clients hold one for up to KillDelay.
+	// Connections waiting over 100ms for room in the queue are closed, 0 disables the pool, default is 0
+	ConnectionWorkers int `env:"CONMAN_CONNECTION_WORKERS,default=0"`
+
+	// ConnectionQueueSize (CONMAN_CONNECTION_QUEUE_SIZE) is how many accepted connections wait for a worker, default is 1024
+	ConnectionQueueSize int `env:"CONMAN_CONNECTION_QUEUE_SIZE,default=1024"`
+
+	// ObserveOnly (CONMAN_OBSERVE_ONLY) never answers attackers: no banners, TLS handshakes or driver responses.
+	// Connections are still sniffed, matched, logged and stored.
+	ObserveOnly bool `env:"CONMAN_OBSERVE_ONLY"`
+
 	// BannerDelay (CONMAN_BANNER_DELAY) defines the delay for banner display in seconds, default is 3
 	BannerDelay int `env:"CONMAN_BANNER_DELAY,default=3"`
 
+	// Banners (CONMAN_BANNERS) sends a banner on a port when the attacker does not speak first, replacing any from drivers.
+	// Escapes such as \r\n are decoded, e.g. "22:SSH-2.0-OpenSSH_8.9\r\n,25:220 mail ESMTP\r\n"
+	Banners map[uint16]Banner `env:"CONMAN_BANNERS"`
+
+	// CatchAllDriver (CONMAN_CATCHALL_DRIVER) names the driver given TCP connections no other driver matched, e.g. "catchall", disabled if empty
+	CatchAllDriver string `env:"CONMAN_CATCHALL_DRIVER"`
+
 	// KillDelay (CONMAN_KILL_DELAY) sets the delay before killing connections in seconds, default is 10
 	KillDelay int `env:"CONMAN_KILL_DELAY,default=10"`
 
+	// ConnectionTimeout (CONMAN_CONNECTION_TIMEOUT) sets the maximum lifetime of a connection in seconds, 0 disables, default is 300
+	ConnectionTimeout int `env:"CONMAN_CONNECTION_TIMEOUT,default=300"`
+
+	// IdleTimeout (CONMAN_IDLE_TIMEOUT) closes connections with no activity for this many seconds, 0 disables, default is 30
+	IdleTimeout int `env:"CONMAN_IDLE_TIMEOUT,default=30"`
+
+	// KeepAlivePeriod (CONMAN_KEEPALIVE_PERIOD) sends TCP keep-alives on accepted connections after this many idle seconds
+	// so dead peers are noticed by drivers holding connections, 0 disables, default is 30
+	KeepAlivePeriod int `env:"CONMAN_KEEPALIVE_PERIOD,default=30"`
+
+	// Linger (CONMAN_LINGER) sets how many seconds closing a TCP connection waits to send what is left, 0 drops it and resets
+	// the connection freeing the socket at once, default is -1 leaving the operating system default
+	Linger int `env:"CONMAN_LINGER,default=-1"`
+
 	// OutputFolder (CONMAN_OUT_FOLDER) specifies the directory for output files
 	OutputFolder string `env:"CONMAN_OUT_FOLDER"`
 
+	// FileMode (CONMAN_FILE_MODE) sets the permissions, in octal, of captures written to OutputFolder, default is 0644
+	FileMode FileMode `env:"CONMAN_FILE_MODE,default=0644"`
+
+	// DirMode (CONMAN_DIR_MODE) sets the permissions, in octal, of folders created in OutputFolder, default is 0755
+	DirMode FileMode `env:"CONMAN_DIR_MODE,default=0755"`
+
+	// ArchiveFolder (CONMAN_ARCHIVE_FOLDER) keeps a second copy of every capture in this directory, such as an append
+	// only mount. Files already archived are never replaced and failures are logged without affecting other backends
+	ArchiveFolder string `env:"CONMAN_ARCHIVE_FOLDER"`
+
+	// ArchivePrefix (CONMAN_ARCHIVE_PREFIX) partitions ArchiveFolder using the tokens of StoragePrefix, default is {date}
+	ArchivePrefix string `env:"CONMAN_ARCHIVE_PREFIX,default={date}"`
+
+	// ArchiveFileMode (CONMAN_ARCHIVE_FILE_MODE) sets the permissions, in octal, of captures written to ArchiveFolder, default is 0440
+	ArchiveFileMode FileMode `env:"CONMAN_ARCHIVE_FILE_MODE,default=0440"`
+
+	// ArchiveDirMode (CONMAN_ARCHIVE_DIR_MODE) sets the permissions, in octal, of folders created in ArchiveFolder, default is 0750
+	ArchiveDirMode FileMode `env:"CONMAN_ARCHIVE_DIR_MODE,default=0750"`
+
 	// S3Region (CONMAN_S3_REGION) defines the AWS S3 region for storage
 	S3Region string `env:"CONMAN_S3_REGION"`
 
@@ -54,16 +188,245 @@ type Config struct {
 	// S3KeyID (CONMAN_S3_KEYID) provides the S3 key ID for authentication
 	S3KeyID string `env:"CONMAN_S3_KEYID"`
 
+	// S3SSE (CONMAN_S3_SSE) sets server side encryption on uploads, AES256 or aws:kms, the bucket default is used if empty
+	S3SSE string `env:"CONMAN_S3_SSE"`
+
+	// S3ACL (CONMAN_S3_ACL) sets a canned ACL on uploads such as bucket-owner-full-control, the bucket default is used if empty
+	S3ACL string `env:"CONMAN_S3_ACL"`
+
+	// S3CACertFile (CONMAN_S3_CA_CERT_FILE) is a PEM file of extra CAs trusted for the S3 endpoint, such as a private MinIO
+	S3CACertFile string `env:"CONMAN_S3_CA_CERT_FILE"`
+
+	// S3Insecure (CONMAN_S3_INSECURE) skips verifying the S3 endpoint certificate, only for testing
+	S3Insecure bool `env:"CONMAN_S3_INSECURE"`
+
+	// GCSBucket (CONMAN_GCS_BUCKET) defines the Google Cloud Storage bucket name for storage
+	GCSBucket string `env:"CONMAN_GCS_BUCKET"`
+
+	// GCSCredentialsFile (CONMAN_GCS_CREDENTIALS_FILE) provides a service account JSON file, application default credentials are used if empty
+	GCSCredentialsFile string `env:"CONMAN_GCS_CREDENTIALS_FILE"`
+
+	// StoragePrefix (CONMAN_STORAGE_PREFIX) places captures beneath this prefix in every backend, so a fleet can
+	// share a bucket. {hostname}, {date}, {year}, {month} and {day} are filled in as files are written,
+	// e.g. "sensors/{hostname}/{date}/"
+	StoragePrefix string `env:"CONMAN_STORAGE_PREFIX"`
+
+	// AzureAccount (CONMAN_AZURE_ACCOUNT) defines the Azure storage account for Blob Storage
+	AzureAccount string `env:"CONMAN_AZURE_ACCOUNT"`
+
+	// AzureContainer (CONMAN_AZURE_CONTAINER) defines the Blob Storage container captures are uploaded to
+	AzureContainer string `env:"CONMAN_AZURE_CONTAINER"`
+
+	// AzureKey (CONMAN_AZURE_KEY) provides the shared account key for authentication
+	AzureKey string `env:"CONMAN_AZURE_KEY"`
+
+	// AzureSAS (CONMAN_AZURE_SAS) provides a shared access signature token instead of AzureKey
+	AzureSAS string `env:"CONMAN_AZURE_SAS"`
+
+	// AzureEndpoint (CONMAN_AZURE_ENDPOINT) replaces the account's blob service URL, such as for Azurite
+	AzureEndpoint string `env:"CONMAN_AZURE_ENDPOINT"`
+
+	// StoreChanSize (CONMAN_STORE_CHAN_SIZE) sets how many captures may queue for storage before new ones are dropped, default is 1000
+	StoreChanSize int `env:"CONMAN_STORE_CHAN_SIZE,default=1000"`
+
+	// UploadMaxRetries (CONMAN_UPLOAD_MAX_RETRIES) sets how many times a failed upload is retried, default is 3
+	UploadMaxRetries int `env:"CONMAN_UPLOAD_MAX_RETRIES,default=3"`
+
+	// UploadRetryBackoff (CONMAN_UPLOAD_RETRY_BACKOFF) sets the initial delay between upload retries in milliseconds, doubling each attempt, default is 500
+	UploadRetryBackoff int `env:"CONMAN_UPLOAD_RETRY_BACKOFF,default=500"`
+
+	// StoreWorkers (CONMAN_STORE_WORKERS) sets the number of workers saving captures so slow uploads do not stall the pipeline, default is 4
+	StoreWorkers int `env:"CONMAN_STORE_WORKERS,default=4"`
+
+	// DedupUploads (CONMAN_DEDUP_UPLOADS) skips uploading content to remote storage more than once per run, default is true
+	DedupUploads bool `env:"CONMAN_DEDUP_UPLOADS,default=1"`
+
+	// HashCacheSize (CONMAN_HASH_CACHE_SIZE) bounds how many uploaded and notified hashes are each remembered, the oldest are forgotten first, default is 100000
+	HashCacheSize int `env:"CONMAN_HASH_CACHE_SIZE,default=100000"`
+
+	// RedisAddr (CONMAN_REDIS_ADDR) shares seen hashes through this Redis so a fleet stores and uploads each capture once, e.g. "redis:6379"
+	RedisAddr string `env:"CONMAN_REDIS_ADDR"`
+
+	// RedisPassword (CONMAN_REDIS_PASSWORD) authenticates to RedisAddr
+	RedisPassword string `env:"CONMAN_REDIS_PASSWORD"`
+
+	// RedisDB (CONMAN_REDIS_DB) selects the database of RedisAddr, default is 0
+	RedisDB int `env:"CONMAN_REDIS_DB"`
+
+	// RedisDedupTTL (CONMAN_REDIS_DEDUP_TTL) forgets shared hashes after this many hours, 0 keeps them forever, default is 720
+	RedisDedupTTL int `env:"CONMAN_REDIS_DEDUP_TTL,default=720"`
+
+	// HashStateFile (CONMAN_HASH_STATE_FILE) saves the hashes already stored on shutdown and loads them on startup,
+	// so a restart does not store everything again. Disabled if empty
+	HashStateFile string `env:"CONMAN_HASH_STATE_FILE"`
+
+	// HashStateMax (CONMAN_HASH_STATE_MAX) keeps only this many of the most recently stored hashes in HashStateFile, 0 is unlimited, default is 100000
+	HashStateMax int `env:"CONMAN_HASH_STATE_MAX,default=100000"`
+
+	// FileNameTemplate (CONMAN_FILENAME_TEMPLATE) names stored files from the tokens {name}, {hash}, {ts}, {ip}, {port}, {uuid} and {seq}, default is "{name}"
+	FileNameTemplate string `env:"CONMAN_FILENAME_TEMPLATE,default={name}"`
+
+	// MaxCaptureBytes (CONMAN_MAX_CAPTURE_BYTES) truncates anything stored to this many bytes, 0 is unlimited, default is 10485760
+	MaxCaptureBytes int `env:"CONMAN_MAX_CAPTURE_BYTES,default=10485760"`
+
+	// StreamCaptureBytes (CONMAN_STREAM_CAPTURE_BYTES) moves captures larger than this to a temporary file which is
+	// streamed to storage rather than held in memory, 0 keeps everything in memory, default is 1048576
+	StreamCaptureBytes int `env:"CONMAN_STREAM_CAPTURE_BYTES,default=1048576"`
+
+	// CapturePcap (CONMAN_CAPTURE_PCAP) stores a synthetic pcap of each connection matched to a driver in the pcap location,
+	// made from the payload seen at the socket in both directions and bounded by MaxCaptureBytes
+	CapturePcap bool `env:"CONMAN_CAPTURE_PCAP"`
+
+	// CaptureSampleEvery (CONMAN_CAPTURE_SAMPLE_EVERY) stores only 1 in every N identical captures from a driver,
+	// e.g. "http:10,catchall:100", drivers must opt in and currently http and catchall do
+	CaptureSampleEvery map[string]int `env:"CONMAN_CAPTURE_SAMPLE_EVERY"`
+
+	// CaptureRateLimit (CONMAN_CAPTURE_RATE_LIMIT) stores at most this many captures a second from a driver,
+	// e.g. "http:5", for the same drivers as CaptureSampleEvery
+	CaptureRateLimit map[string]float64 `env:"CONMAN_CAPTURE_RATE_LIMIT"`
+
+	// CompressOutput (CONMAN_COMPRESS_OUTPUT) gzips stored data and appends a .gz suffix to the filename
+	CompressOutput bool `env:"CONMAN_COMPRESS_OUTPUT"`
+
+	// TLSCert (CONMAN_TLS_CERT) is a PEM certificate used to unwrap TLS, a self-signed certificate is generated if empty
+	TLSCert string `env:"CONMAN_TLS_CERT"`
+
+	// TLSKey (CONMAN_TLS_KEY) is the PEM private key for TLSCert
+	TLSKey string `env:"CONMAN_TLS_KEY"`
+
+	// TLSCommonName (CONMAN_TLS_COMMON_NAME) sets the CN and SAN of the generated certificate, a random domain is used if empty
+	TLSCommonName string `env:"CONMAN_TLS_COMMON_NAME"`
+
+	// TLSSNICerts (CONMAN_TLS_SNI_CERTS) maps server names to PEM files holding a certificate and key, e.g. "example.com:/certs/example.pem"
+	TLSSNICerts map[string]string `env:"CONMAN_TLS_SNI_CERTS"`
+
+	// TLSMintSNI (CONMAN_TLS_MINT_SNI) mints a certificate for any other server name a client asks for, default is true
+	TLSMintSNI bool `env:"CONMAN_TLS_MINT_SNI,default=1"`
+
+	// ExpectProxyProtocol (CONMAN_PROXY_PROTOCOL) reads PROXY protocol v1/v2 headers to find the real client behind a load balancer
+	ExpectProxyProtocol bool `env:"CONMAN_PROXY_PROTOCOL"`
+
+	// ProxyProtocolStrict (CONMAN_PROXY_PROTOCOL_STRICT) rejects connections without a PROXY header instead of passing them through
+	ProxyProtocolStrict bool `env:"CONMAN_PROXY_PROTOCOL_STRICT"`
+
+	// GeoIPDatabase (CONMAN_GEOIP_DATABASE) is a MaxMind GeoLite2 City database used to tag attackers with their location
+	GeoIPDatabase string `env:"CONMAN_GEOIP_DATABASE"`
+
+	// ASNDatabase (CONMAN_ASN_DATABASE) is a MaxMind GeoLite2 ASN database used to tag attackers with their network
+	ASNDatabase string `env:"CONMAN_ASN_DATABASE"`
+
+	// ReputationFeedFile (CONMAN_REPUTATION_FEED_FILE) is a threat intelligence feed of networks, one per line followed by
+	// an optional confidence from 1 to 100, used to tag attackers with a reputation. It is reloaded when it changes
+	ReputationFeedFile string `env:"CONMAN_REPUTATION_FEED_FILE"`
+
+	// ReputationRefresh (CONMAN_REPUTATION_REFRESH) is how often in seconds ReputationFeedFile is checked for changes, default is 60
+	ReputationRefresh int `env:"CONMAN_REPUTATION_REFRESH,default=60"`
+
+	// ReputationBlockConfidence (CONMAN_REPUTATION_BLOCK_CONFIDENCE) closes connections at once from attackers listed with at
+	// least this confidence, 0 only tags them, default is 0
+	ReputationBlockConfidence int `env:"CONMAN_REPUTATION_BLOCK_CONFIDENCE,default=0"`
+
+	// CorrelationWindow (CONMAN_CORRELATION_WINDOW) groups connections from an address into one session_id for as long as
+	// they arrive within this many seconds of each other, 0 disables, default is 0
+	CorrelationWindow int `env:"CONMAN_CORRELATION_WINDOW,default=0"`
+
+	// EnableReverseDNS (CONMAN_ENABLE_REVERSE_DNS) tags attackers with their PTR record, resolved in the background
+	// so only connections after the first from an address carry it
+	EnableReverseDNS bool `env:"CONMAN_ENABLE_REVERSE_DNS"`
+
+	// ReverseDNSTimeout (CONMAN_REVERSE_DNS_TIMEOUT) gives up on a PTR lookup after this many milliseconds, default is 2000
+	ReverseDNSTimeout int `env:"CONMAN_REVERSE_DNS_TIMEOUT,default=2000"`
+
+	// WebhookURL (CONMAN_WEBHOOK_URL) receives a JSON POST the first time each payload hash is seen
+	WebhookURL string `env:"CONMAN_WEBHOOK_URL"`
+
+	// WebhookTimeout (CONMAN_WEBHOOK_TIMEOUT) sets the timeout for each webhook delivery in seconds, default is 5
+	WebhookTimeout int `env:"CONMAN_WEBHOOK_TIMEOUT,default=5"`
+
+	// ESAddr (CONMAN_ES_ADDR) bulk indexes connection events into Elasticsearch or OpenSearch at this URL, e.g. "http://elastic:9200"
+	ESAddr string `env:"CONMAN_ES_ADDR"`
+
+	// ESIndex (CONMAN_ES_INDEX) names the index events are written to, it is created with a mapping if missing, default is "gambit-events"
+	ESIndex string `env:"CONMAN_ES_INDEX,default=gambit-events"`
+
+	// ESUser (CONMAN_ES_USER) authenticates to ESAddr with ESPass
+	ESUser string `env:"CONMAN_ES_USER"`
+
+	// ESPass (CONMAN_ES_PASS) is the password for ESUser
+	ESPass string `env:"CONMAN_ES_PASS"`
+
+	// ESBatchSize (CONMAN_ES_BATCH_SIZE) sends events once this many are waiting, default is 500
+	ESBatchSize int `env:"CONMAN_ES_BATCH_SIZE,default=500"`
+
+	// ESFlushInterval (CONMAN_ES_FLUSH_INTERVAL) sends waiting events after this many seconds, default is 5
+	ESFlushInterval int `env:"CONMAN_ES_FLUSH_INTERVAL,default=5"`
+
+	// KafkaBrokers (CONMAN_KAFKA_BROKERS) produces connection events as JSON to these Kafka brokers, e.g. "kafka1:9092,kafka2:9092"
+	KafkaBrokers []string `env:"CONMAN_KAFKA_BROKERS"`
+
+	// KafkaTopic (CONMAN_KAFKA_TOPIC) names the topic events are produced to, keyed by attacker, default is "gambit-events"
+	KafkaTopic string `env:"CONMAN_KAFKA_TOPIC,default=gambit-events"`
+
+	// NATSURL (CONMAN_NATS_URL) publishes connection events as JSON to this NATS server, e.g. "nats://nats:4222"
+	NATSURL string `env:"CONMAN_NATS_URL"`
+
+	// NATSSubject (CONMAN_NATS_SUBJECT) is the subject events are published to. {port}, {network} and {driver}
+	// are filled in from the event, e.g. "gambit.events.{port}", default is "gambit.events"
+	NATSSubject string `env:"CONMAN_NATS_SUBJECT,default=gambit.events"`
+
+	// SQLitePath (CONMAN_SQLITE_PATH) indexes the metadata of each finished connection in this SQLite database, created if missing
+	SQLitePath string `env:"CONMAN_SQLITE_PATH"`
+
+	// PostgresDSN (CONMAN_POSTGRES_DSN) indexes the metadata of each finished connection in Postgres instead of SQLite,
+	// e.g. "postgres://gambit:secret@db/gambit?sslmode=disable"
+	PostgresDSN string `env:"CONMAN_POSTGRES_DSN"`
+
+	// FlowFile (CONMAN_FLOW_FILE) appends flow summaries per attacker and port to this file as lines of JSON
+	FlowFile string `env:"CONMAN_FLOW_FILE"`
+
+	// FlowURL (CONMAN_FLOW_URL) POSTs flow summaries per attacker and port to this URL as a JSON array instead of FlowFile
+	FlowURL string `env:"CONMAN_FLOW_URL"`
+
+	// FlowInterval (CONMAN_FLOW_INTERVAL) sets the seconds each flow summary covers, default is 60
+	FlowInterval int `env:"CONMAN_FLOW_INTERVAL,default=60"`
+
+	// APIAddress (CONMAN_API_ADDRESS) serves the operations API on this address, e.g. "127.0.0.1:9901", disabled if empty
+	APIAddress string `env:"CONMAN_API_ADDRESS"`
+
+	// APIToken (CONMAN_API_TOKEN) enables the /bans endpoints of the API, which must be sent it as a bearer token
+	APIToken string `env:"CONMAN_API_TOKEN"`
+
+	// RecentEventsSize (CONMAN_RECENT_EVENTS_SIZE) sets how many recent connections the API keeps in memory, default is 1000
+	RecentEventsSize int `env:"CONMAN_RECENT_EVENTS_SIZE,default=1000"`
+
 	// Sanitize (CONMAN_SANITIZE) enables/disables output sanitization, default is true
 	Sanitize bool `env:"CONMAN_SANITIZE,default=1"`
 
+	// RawSocketOptional (CONMAN_RAW_SOCKET_OPTIONAL) carries on serving only Ports and the preloaded ports if the raw sockets
+	// used to start listeners on demand cannot be opened, such as without CAP_NET_RAW, instead of exiting
+	RawSocketOptional bool `env:"CONMAN_RAW_SOCKET_OPTIONAL"`
+
 	// BindAddress (CONMAN_BIND) specifies the binding address, defaults to "public"
 	BindAddress string `env:"CONMAN_BIND,default=public"`
 
-	// Profile (CONMAN_PPROF) enables/disables profiling
+	// BindInterface (CONMAN_BIND_INTERFACE) binds listeners to an address of this interface, e.g. "eth1", instead of BindAddress.
+	// The first public IPv4 address is preferred, then public IPv6, then any other. It is looked up as each listener is created.
+	BindInterface string `env:"CONMAN_BIND_INTERFACE"`
+
+	// Drivers (CONMAN_DRIVERS) holds settings for individual drivers keyed by driver name, which each driver
+	// reads as it starts, e.g. {"sshd": {"hostKeyFile": "/keys/rsa"}}. The environment takes a JSON object.
+	Drivers DriverConfigs `env:"CONMAN_DRIVERS"`
+
+	// Profile (CONMAN_PPROF) enables/disables profiling on localhost:9900 when PprofAddr is not set
 	Profile bool `env:"CONMAN_PPROF"`
 
+	// PprofAddr (CONMAN_PPROF_ADDR) serves pprof and the expvar metrics on this address, e.g. "localhost:9900",
+	// disabled if empty. Keep it on localhost, profiles reveal a lot. Setting it to APIAddress serves both together.
+	PprofAddr string `env:"CONMAN_PPROF_ADDR"`
+
 	ignoredPortsMap map[uint16]struct{}
+	allowedPortsMap map[uint16]struct{}
+	deniedPortsMap  map[uint16]struct{}
 }
 
 // New creates a new instance of Config by processing environment variables.
@@ -72,14 +435,220 @@ func New(ctx context.Context) (*Config, error) {
 	if err := envconfig.Process(ctx, &c); err != nil {
 		return nil, err
 	}
+	return c.finish()
+}
 
-	// use a map for quicker lookups
-	ignoredPortsMap := make(map[uint16]struct{}, len(c.IgnorePorts))
-	for _, p := range c.IgnorePorts {
-		ignoredPortsMap[p] = struct{}{}
+// LoadConfig reads a JSON config file keyed by field name, e.g. {"MaxPort": 30000}.
+// Environment variables override the file so secrets such as S3Key can be kept out
+// of it, and defaults fill anything missing. An empty path only uses the environment.
+func LoadConfig(path string) (*Config, error) {
+	ctx := context.Background()
+	if path == "" {
+		return New(ctx)
 	}
 
-	return &c, nil
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file map[string]json.RawMessage
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	// defaults and the environment first
+	var c Config
+	if err := envconfig.Process(ctx, &c); err != nil {
+		return nil, err
+	}
+
+	// then anything in the file the environment did not set
+	v := reflect.ValueOf(&c).Elem()
+	t := v.Type()
+	for key, raw := range file {
+		field, ok := t.FieldByNameFunc(func(name string) bool {
+			return strings.EqualFold(name, key)
+		})
+		if !ok || !field.IsExported() {
+			return nil, fmt.Errorf("%s: unknown setting %q", path, key)
+		}
+		if _, set := os.LookupEnv(envName(field)); set {
+			continue
+		}
+		if err := json.Unmarshal(raw, v.FieldByIndex(field.Index).Addr().Interface()); err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", path, key, err)
+		}
+	}
+
+	return c.finish()
+}
+
+// envName returns the environment variable a field is read from
+func envName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("env"), ",")
+	return name
+}
+
+// finish validates the config and prepares lookups
+func (c *Config) finish() (*Config, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	if c.BanThreshold == 0 {
+		c.BanThreshold = c.BanCount
+	}
+	if c.Profile && c.PprofAddr == "" {
+		c.PprofAddr = "localhost:9900"
+	}
+
+	// use maps for quicker lookups
+	c.ignoredPortsMap = portMap(c.IgnorePorts)
+	c.allowedPortsMap = portMap(c.PortAllowList)
+	c.deniedPortsMap = portMap(c.PortDenyList)
+
+	return c, nil
+}
+
+func portMap(ports []uint16) map[uint16]struct{} {
+	m := make(map[uint16]struct{}, len(ports))
+	for _, p := range ports {
+		m[p] = struct{}{}
+	}
+	return m
+}
+
+// Validate rejects settings which cannot work together
+func (c *Config) Validate() error {
+	var errs []error
+	if c.MaxPort == 0 {
+		errs = append(errs, errors.New("MaxPort must be above 0"))
+	}
+	if c.BanThreshold < 0 || c.BanCount < 0 || c.BanSubnetThreshold < 0 {
+		errs = append(errs, errors.New("BanThreshold, BanCount and BanSubnetThreshold may not be negative"))
+	}
+	if c.KeepAlivePeriod < 0 {
+		errs = append(errs, errors.New("KeepAlivePeriod may not be negative"))
+	}
+	if c.Linger < -1 {
+		errs = append(errs, errors.New("Linger must be -1 or above"))
+	}
+	if c.BanWindow < 1 {
+		errs = append(errs, errors.New("BanWindow must be at least 1"))
+	}
+	if c.MinPort > c.MaxPort {
+		errs = append(errs, errors.New("MinPort must not be above MaxPort"))
+	}
+	if c.S3Bucket != "" && (c.S3Key == "" || c.S3KeyID == "") {
+		errs = append(errs, errors.New("S3Bucket requires S3Key and S3KeyID"))
+	}
+	if c.S3Key != "" && c.S3Bucket == "" {
+		errs = append(errs, errors.New("S3Key requires S3Bucket"))
+	}
+	if strings.Contains(c.StoragePrefix, "..") || strings.ContainsAny(c.StoragePrefix, "\\\x00") {
+		errs = append(errs, errors.New("StoragePrefix must not contain .., backslashes or NUL"))
+	}
+	if strings.Contains(c.ArchivePrefix, "..") || strings.ContainsAny(c.ArchivePrefix, "\\\x00") {
+		errs = append(errs, errors.New("ArchivePrefix must not contain .., backslashes or NUL"))
+	}
+	if c.AzureContainer != "" && (c.AzureAccount == "" || (c.AzureKey == "") == (c.AzureSAS == "")) {
+		errs = append(errs, errors.New("AzureContainer requires AzureAccount and one of AzureKey or AzureSAS"))
+	}
+	if c.S3SSE != "" && !slices.Contains(s3.ServerSideEncryption_Values(), c.S3SSE) {
+		errs = append(errs, fmt.Errorf("S3SSE must be one of %s", strings.Join(s3.ServerSideEncryption_Values(), ", ")))
+	}
+	if c.S3ACL != "" && !slices.Contains(s3.ObjectCannedACL_Values(), c.S3ACL) {
+		errs = append(errs, fmt.Errorf("S3ACL must be one of %s", strings.Join(s3.ObjectCannedACL_Values(), ", ")))
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		errs = append(errs, errors.New("TLSCert and TLSKey must be set together"))
+	}
+	if c.ProxyProtocolStrict && !c.ExpectProxyProtocol {
+		errs = append(errs, errors.New("ProxyProtocolStrict requires ExpectProxyProtocol"))
+	}
+	if c.SyslogFormat != "cee" && c.SyslogFormat != "rfc5424" {
+		errs = append(errs, errors.New(`SyslogFormat must be "cee" or "rfc5424"`))
+	}
+	if c.LogFormat != "json" && c.LogFormat != "console" {
+		errs = append(errs, errors.New(`LogFormat must be "json" or "console"`))
+	}
+	if c.LogFile != "" && c.LogMaxSizeMB < 1 {
+		errs = append(errs, errors.New("LogMaxSizeMB must be at least 1"))
+	}
+	if c.LogMaxBackups < 0 || c.LogMaxAgeDays < 0 || c.LogRotateHours < 0 {
+		errs = append(errs, errors.New("LogMaxBackups, LogMaxAgeDays and LogRotateHours cannot be negative"))
+	}
+	if c.PerIPConnRate < 0 {
+		errs = append(errs, errors.New("PerIPConnRate cannot be negative"))
+	}
+	if c.ConnectionWorkers < 0 || c.ConnectionQueueSize < 0 {
+		errs = append(errs, errors.New("ConnectionWorkers and ConnectionQueueSize cannot be negative"))
+	}
+	if c.ReputationFeedFile != "" && c.ReputationRefresh < 1 {
+		errs = append(errs, errors.New("ReputationRefresh must be at least 1"))
+	}
+	if c.ReputationBlockConfidence < 0 || c.ReputationBlockConfidence > 100 {
+		errs = append(errs, errors.New("ReputationBlockConfidence must be from 0 to 100"))
+	}
+	if c.StoreChanSize < 0 {
+		errs = append(errs, errors.New("StoreChanSize cannot be negative"))
+	}
+	if strings.ContainsAny(c.FileNameTemplate, `/\`) || strings.Contains(c.FileNameTemplate, "..") {
+		errs = append(errs, errors.New("FileNameTemplate cannot contain path separators or .."))
+	}
+	if c.MaxCaptureBytes < 0 {
+		errs = append(errs, errors.New("MaxCaptureBytes cannot be negative"))
+	}
+	if c.FileMode.Mode()&^os.ModePerm != 0 || c.DirMode.Mode()&^os.ModePerm != 0 {
+		errs = append(errs, errors.New("FileMode and DirMode may only set permission bits"))
+	}
+	if c.ArchiveFileMode.Mode()&^os.ModePerm != 0 || c.ArchiveDirMode.Mode()&^os.ModePerm != 0 {
+		errs = append(errs, errors.New("ArchiveFileMode and ArchiveDirMode may only set permission bits"))
+	}
+	for driver, every := range c.CaptureSampleEvery {
+		if every < 1 {
+			errs = append(errs, fmt.Errorf("CaptureSampleEvery for %s must be at least 1", driver))
+		}
+	}
+	for driver, limit := range c.CaptureRateLimit {
+		if limit <= 0 {
+			errs = append(errs, fmt.Errorf("CaptureRateLimit for %s must be above 0", driver))
+		}
+	}
+	if c.StreamCaptureBytes < 0 {
+		errs = append(errs, errors.New("StreamCaptureBytes cannot be negative"))
+	}
+	if c.HashStateMax < 0 {
+		errs = append(errs, errors.New("HashStateMax cannot be negative"))
+	}
+	if c.HashCacheSize < 1 {
+		errs = append(errs, errors.New("HashCacheSize must be at least 1"))
+	}
+	if c.RedisDedupTTL < 0 {
+		errs = append(errs, errors.New("RedisDedupTTL cannot be negative"))
+	}
+	if c.ESAddr != "" && (c.ESIndex == "" || c.ESFlushInterval < 1) {
+		errs = append(errs, errors.New("ESAddr requires ESIndex and an ESFlushInterval of at least 1"))
+	}
+	if len(c.KafkaBrokers) > 0 && c.KafkaTopic == "" {
+		errs = append(errs, errors.New("KafkaBrokers requires KafkaTopic"))
+	}
+	if c.NATSURL != "" && c.NATSSubject == "" {
+		errs = append(errs, errors.New("NATSURL requires NATSSubject"))
+	}
+	if c.SQLitePath != "" && c.PostgresDSN != "" {
+		errs = append(errs, errors.New("SQLitePath and PostgresDSN cannot both be set"))
+	}
+	if c.FlowFile != "" && c.FlowURL != "" {
+		errs = append(errs, errors.New("FlowFile and FlowURL cannot both be set"))
+	}
+	if (c.FlowFile != "" || c.FlowURL != "") && c.FlowInterval < 1 {
+		errs = append(errs, errors.New("FlowInterval must be at least 1"))
+	}
+	if c.RecentEventsSize < 0 {
+		errs = append(errs, errors.New("RecentEventsSize cannot be negative"))
+	}
+	return errors.Join(errs...)
 }
 
 // PortIgnored returns true if the port is configured to be ignored, such as for ephemeral ports
@@ -87,3 +656,18 @@ func (c *Config) PortIgnored(port uint16) bool {
 	_, ignored := c.ignoredPortsMap[port]
 	return ignored
 }
+
+// PortAllowed returns true if the port may be listened on, checking MinPort and the allow, deny and ignore lists
+func (c *Config) PortAllowed(port uint16) bool {
+	if port < c.MinPort || c.PortIgnored(port) {
+		return false
+	}
+	if _, denied := c.deniedPortsMap[port]; denied {
+		return false
+	}
+	if len(c.allowedPortsMap) > 0 {
+		_, allowed := c.allowedPortsMap[port]
+		return allowed
+	}
+	return true
+}
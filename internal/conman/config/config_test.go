@@ -0,0 +1,117 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfig(t *testing.T, data string) string {
+	path := filepath.Join(t.TempDir(), "conman.json")
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	t.Setenv("CONMAN_S3_KEY", "secret")
+	t.Setenv("CONMAN_MAXPORT", "20000")
+	path := writeConfig(t, `{
+		"MaxPort": 30000,
+		"bindAddress": "127.0.0.1",
+		"Sanitize": false,
+		"S3Bucket": "captures",
+		"S3KeyID": "id",
+		"S3Key": "not used",
+		"FileMode": "0600",
+		"Drivers": {"sshd": {"hostKeyFile": "/keys/rsa"}}
+	}`)
+
+	c, err := LoadConfig(path)
+	if assert.NoError(t, err) {
+		// environment wins over the file
+		assert.Equal(t, uint16(20000), c.MaxPort)
+		assert.Equal(t, "secret", c.S3Key)
+		// file wins over defaults, even when false
+		assert.Equal(t, "127.0.0.1", c.BindAddress)
+		assert.False(t, c.Sanitize)
+		assert.Equal(t, "captures", c.S3Bucket)
+		assert.Equal(t, os.FileMode(0600), c.FileMode.Mode())
+		assert.JSONEq(t, `{"hostKeyFile": "/keys/rsa"}`, string(c.Drivers["sshd"]))
+		// defaults fill the rest
+		assert.Equal(t, 50, c.BanCount)
+		assert.Equal(t, 50, c.BanThreshold)
+		assert.Equal(t, os.FileMode(0755), c.DirMode.Mode())
+	}
+}
+
+func TestDriverConfigsEnvironment(t *testing.T) {
+	t.Setenv("CONMAN_DRIVERS", `{"relay": {"backends": {"3306": "10.0.0.5:3306"}}}`)
+	c, err := LoadConfig("")
+	if assert.NoError(t, err) {
+		assert.JSONEq(t, `{"backends": {"3306": "10.0.0.5:3306"}}`, string(c.Drivers["relay"]))
+	}
+
+	t.Setenv("CONMAN_DRIVERS", `sshd:yes`)
+	_, err = LoadConfig("")
+	assert.Error(t, err)
+}
+
+func TestLoadConfigUnknown(t *testing.T) {
+	_, err := LoadConfig(writeConfig(t, `{"MaxPorts": 1}`))
+	assert.ErrorContains(t, err, "unknown setting")
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	_, err := LoadConfig(writeConfig(t, `{"MaxPort": 0, "S3Bucket": "captures"}`))
+	assert.ErrorContains(t, err, "MaxPort")
+	assert.ErrorContains(t, err, "S3Bucket requires")
+
+	_, err = LoadConfig(writeConfig(t, `{"FileNameTemplate": "../{hash}"}`))
+	assert.ErrorContains(t, err, "FileNameTemplate")
+
+	_, err = LoadConfig(writeConfig(t, `{"S3SSE": "rot13", "S3ACL": "everyone"}`))
+	assert.ErrorContains(t, err, "S3SSE must be one of AES256")
+	assert.ErrorContains(t, err, "S3ACL must be one of private")
+}
+
+func TestPortAllowed(t *testing.T) {
+	t.Setenv("CONMAN_MINPORT", "20")
+	t.Setenv("CONMAN_IGNORE_PORTS", "25")
+	t.Setenv("CONMAN_PORT_DENY_LIST", "22")
+	c, err := LoadConfig("")
+	if assert.NoError(t, err) {
+		assert.False(t, c.PortAllowed(19))
+		assert.False(t, c.PortAllowed(22))
+		assert.False(t, c.PortAllowed(25))
+		assert.True(t, c.PortAllowed(23))
+	}
+
+	t.Setenv("CONMAN_PORT_ALLOW_LIST", "22,80")
+	c, err = LoadConfig("")
+	if assert.NoError(t, err) {
+		assert.True(t, c.PortAllowed(80))
+		assert.False(t, c.PortAllowed(22))
+		assert.False(t, c.PortAllowed(443))
+	}
+}
+
+func TestBanners(t *testing.T) {
+	path := writeConfig(t, `{"Banners": {"23": "\\xff\\xfd\\x01login: "}}`)
+	c, err := LoadConfig(path)
+	if assert.NoError(t, err) {
+		assert.Equal(t, Banner("\xff\xfd\x01login: "), c.Banners[23])
+	}
+
+	t.Setenv("CONMAN_BANNERS", `22:SSH-2.0-OpenSSH_8.9\r\n,25:220 mail ESMTP\r\n`)
+	c, err = LoadConfig(path)
+	if assert.NoError(t, err) {
+		// the environment replaces the whole map
+		assert.Equal(t, Banner("SSH-2.0-OpenSSH_8.9\r\n"), c.Banners[22])
+		assert.Equal(t, Banner("220 mail ESMTP\r\n"), c.Banners[25])
+		assert.NotContains(t, c.Banners, uint16(23))
+	}
+}
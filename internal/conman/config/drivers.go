@@ -0,0 +1,34 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// DriverConfigs holds the settings of each driver as raw JSON keyed by driver
+// name, each driver decodes its own into whatever it declares
+type DriverConfigs map[string]json.RawMessage
+
+// UnmarshalText parses a JSON object from the environment, such as
+// {"sshd":{"hostKey":"/keys/rsa"}}
+func (d *DriverConfigs) UnmarshalText(text []byte) error {
+	if len(bytes.TrimSpace(text)) == 0 {
+		return nil
+	}
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(text, &m); err != nil {
+		return err
+	}
+	*d = m
+	return nil
+}
+
+// UnmarshalJSON reads the object from a config file
+func (d *DriverConfigs) UnmarshalJSON(data []byte) error {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		return err
+	}
+	*d = m
+	return nil
+}
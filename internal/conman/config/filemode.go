@@ -0,0 +1,34 @@
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"strconv"
+)
+
+// FileMode is a permission set written in octal, such as 0600 or 755
+type FileMode os.FileMode
+
+// UnmarshalText parses the octal permissions
+func (m *FileMode) UnmarshalText(text []byte) error {
+	v, err := strconv.ParseUint(string(text), 8, 32)
+	if err != nil {
+		return err
+	}
+	*m = FileMode(v)
+	return nil
+}
+
+// UnmarshalJSON accepts a string or a bare number, either is read as octal
+func (m *FileMode) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		s = string(data)
+	}
+	return m.UnmarshalText([]byte(s))
+}
+
+// Mode returns the os.FileMode
+func (m FileMode) Mode() os.FileMode {
+	return os.FileMode(m)
+}
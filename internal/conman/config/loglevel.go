@@ -0,0 +1,36 @@
+package config
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/rs/zerolog"
+)
+
+// LogLevel is the minimum level logged. It is set by name, such as "info" or
+// "trace", or by the zerolog number used by older configs.
+type LogLevel zerolog.Level
+
+// UnmarshalText parses a level name or number
+func (l *LogLevel) UnmarshalText(text []byte) error {
+	level, err := zerolog.ParseLevel(strings.ToLower(strings.TrimSpace(string(text))))
+	if err != nil {
+		return err
+	}
+	*l = LogLevel(level)
+	return nil
+}
+
+// UnmarshalJSON accepts a name or a bare number
+func (l *LogLevel) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		s = string(data)
+	}
+	return l.UnmarshalText([]byte(s))
+}
+
+// Level returns the zerolog level
+func (l LogLevel) Level() zerolog.Level {
+	return zerolog.Level(l)
+}
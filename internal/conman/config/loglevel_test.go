@@ -0,0 +1,42 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogLevel(t *testing.T) {
+	for text, want := range map[string]zerolog.Level{
+		"trace": zerolog.TraceLevel,
+		"WARN":  zerolog.WarnLevel,
+		"1":     zerolog.InfoLevel,
+		"-1":    zerolog.TraceLevel,
+	} {
+		var l LogLevel
+		if assert.NoError(t, l.UnmarshalText([]byte(text)), text) {
+			assert.Equal(t, want, l.Level(), text)
+		}
+	}
+	var l LogLevel
+	assert.Error(t, l.UnmarshalText([]byte("loud")))
+
+	path := writeConfig(t, `{"LogLevel": "debug", "LogFormat": "console"}`)
+	c, err := LoadConfig(path)
+	if assert.NoError(t, err) {
+		assert.Equal(t, zerolog.DebugLevel, c.LogLevel.Level())
+		assert.Equal(t, "console", c.LogFormat)
+	}
+	c, err = LoadConfig(writeConfig(t, `{"LogLevel": 2}`))
+	if assert.NoError(t, err) {
+		assert.Equal(t, zerolog.WarnLevel, c.LogLevel.Level())
+	}
+	_, err = LoadConfig(writeConfig(t, `{"LogFormat": "xml"}`))
+	assert.ErrorContains(t, err, "LogFormat")
+
+	_, err = LoadConfig(writeConfig(t, `{"LogFile": "/var/log/conman.log", "LogMaxSizeMB": 0}`))
+	assert.ErrorContains(t, err, "LogMaxSizeMB")
+	_, err = LoadConfig(writeConfig(t, `{"LogRotateHours": -1}`))
+	assert.ErrorContains(t, err, "LogRotateHours")
+}
@@ -4,79 +4,185 @@ package conman
 import (
 	"context"
 	"crypto/tls"
+	"fmt"
+	"io"
 	"log/syslog"
 	"net"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/antihax/gambit/internal/conman/config"
+	"github.com/antihax/gambit/internal/conman/dedup"
+	"github.com/antihax/gambit/internal/conman/enrich"
 	"github.com/antihax/gambit/internal/conman/gctx"
+	"github.com/antihax/gambit/internal/conman/logging"
+	"github.com/antihax/gambit/internal/conman/notify"
 	"github.com/antihax/gambit/internal/conman/security"
+	"github.com/antihax/gambit/internal/conman/sink"
 	"github.com/antihax/gambit/internal/drivers"
+	"github.com/antihax/gambit/internal/metrics"
 	"github.com/antihax/gambit/internal/muxconn"
 	"github.com/antihax/gambit/internal/store"
-	"github.com/antihax/gambit/pkg/searchtree"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/antihax/gambit/pkg/lru"
 	fake "github.com/brianvoe/gofakeit/v6"
 	"github.com/pion/dtls/v2"
 	"github.com/pion/dtls/v2/pkg/crypto/selfsign"
 	"github.com/rs/zerolog"
+	"golang.org/x/sync/errgroup"
 )
 
+// shutdownTimeout bounds how long servers and the store are given to finish
+const shutdownTimeout = time.Second * 10
+
 // ConnectionManager manages listeners
 type ConnectionManager struct {
 	tcpListeners map[uint16]net.Listener
 	udpListeners map[uint16]net.Listener
-	doneCh       chan struct{}
-	tcpRules     searchtree.Tree
-	udpRules     searchtree.Tree
-	banners      map[uint16][]byte
-	addresses    []net.IP
 
-	// if we are saving raw entries, keep a list to save hitting fs
+	// proxies feeding each driver's listener
+	tcpProxies map[drivers.Driver]muxconn.Proxy
+	udpProxies map[drivers.Driver]muxconn.Proxy
+
+	// parent of every connection's context, done as we shut down
+	connCtx context.Context
+
+	// current routing rules and banners, swapped on reload
+	rules atomic.Pointer[ruleSet]
+
+	addresses []net.IP
+
+	// if we are saving raw entries, keep a list to save hitting fs,
+	// valued by when each was stored
 	knownHashes sync.Map
 
-	banList *security.BanManager
+	// content hashes already sent to remote storage
+	uploadedHashes *lru.Cache[string, struct{}]
+
+	// optional record of hashes shared with other honeypots
+	dedup dedup.HashSeen
+
+	banList     *security.BanManager
+	rateLimiter *security.RateLimiter
+	allowList   *security.CIDRSet
+
+	// optional location lookups for attackers
+	geoIP *enrich.GeoIP
+	// resolves attacker PTR records, nil if disabled
+	reverseDNS *enrich.ReverseDNS
+	// groups connections from the same attacker, nil if disabled
+	correlator *enrich.Correlator
+	// threat intelligence feed, nil if disabled
+	reputation *security.Reputation
+
+	// optional notifications of new payloads, and the hashes already notified
+	webhook        *notify.Webhook
+	notifiedHashes *lru.Cache[string, struct{}]
+
+	// last connections for the API, and live subscribers to new ones
+	recentEvents *eventRing
+	eventHub     *eventHub
+
+	// external systems every event is shipped to, and those wanting finished connections
+	sinks      []sink.Sink
+	closeSinks []sink.CloseSink
+	flows      *sink.Flows // exported by Run until it stops
+	// sinks are started by Run so nothing is left running if NewConMan fails,
+	// which closes whatever they hold open
+	sinkStarts  []func()
+	sinkClosers []io.Closer
+
+	// drivers are started by the first replay, for managers which are not run
+	replayOnce sync.Once
+	replayErr  error
+
+	// what is running, for the readiness probe
+	ready readiness
+
+	// semaphore capping connections in flight
+	inFlight chan struct{}
+	// handles connections when set, otherwise each has a goroutine
+	workers *workerPool
 
 	tcpmu sync.Mutex
 	udpmu sync.Mutex
+	// ports which failed to bind, left alone for a while
+	tcpBindFailures bindFailures
 
 	// root logger
 	logger zerolog.Logger
+	// file the logger writes to when LogFile is set
+	logFile *logging.File
 
-	// configurations
+	// configurations, reloading reads configPath again
 	config     *config.Config
+	configPath string
 	tlsConfig  tls.Config
 	dtlsConfig dtls.Config
+	// shared with drivers terminating their own TLS
+	tlsCert *tls.Certificate
+
+	// capture samplers of drivers which have them
+	samplers map[string]*store.Sampler
 
-	uploader  *s3manager.Uploader
+	// storage backends captures are fanned out to
+	storers   []store.Storer
 	storeChan chan store.File
+	// pumps draining storeChan. The channel is never closed as drivers may
+	// still be sending, closing storeDone lets the pumps finish instead.
+	storePumps sync.WaitGroup
+	storeDone  chan struct{}
+	storeOnce  sync.Once
+	// second copy in storers whose failures do not count against the capture
+	archive store.Storer
 }
 
 // NewConMan creates a new ConnectionManager
-func NewConMan() (*ConnectionManager, error) {
+func NewConMan() (_ *ConnectionManager, err error) {
 
-	// load config
-	cfg, err := config.New(context.Background())
+	// load config from the environment, or a file named by CONMAN_CONFIG
+	configPath := os.Getenv("CONMAN_CONFIG")
+	cfg, err := config.LoadConfig(configPath)
 	if err != nil {
 		return nil, err
 	}
 
-	if cfg.Profile {
-		go runPProf()
+	// setup the logger, writing to a rotated file in place of stdout if one is set
+	var stdout io.Writer = os.Stdout
+	var logFile *logging.File
+	if cfg.LogFile != "" {
+		logFile = logging.NewFile(cfg.LogFile, cfg.LogMaxSizeMB, cfg.LogMaxBackups, cfg.LogMaxAgeDays, cfg.LogCompress)
+		stdout = logFile
 	}
-
-	// setup the logger
-	logger := zerolog.New(os.Stdout)
+	if cfg.LogFormat == "console" {
+		stdout = zerolog.ConsoleWriter{Out: stdout, NoColor: logFile != nil, TimeFormat: time.TimeOnly}
+	}
+	logger := zerolog.New(stdout)
 	if cfg.SyslogNetwork != "stdout" {
-		syslogWriter, err := syslog.Dial(cfg.SyslogNetwork, cfg.SyslogAddress, syslog.LOG_DAEMON, "conman")
-		if err != nil {
-			return nil, err
+		var out zerolog.LevelWriter
+		if cfg.SyslogFormat == "rfc5424" {
+			if out, err = logging.NewSyslog(cfg.SyslogNetwork, cfg.SyslogAddress, "conman"); err != nil {
+				return nil, err
+			}
+		} else {
+			syslogWriter, err := syslog.Dial(cfg.SyslogNetwork, cfg.SyslogAddress, syslog.LOG_DAEMON, "conman")
+			if err != nil {
+				return nil, err
+			}
+			out = zerolog.SyslogCEEWriter(syslogWriter)
+		}
+		if cfg.SyslogStdout {
+			out = zerolog.MultiLevelWriter(stdout, out)
 		}
-		logger = zerolog.New(zerolog.SyslogCEEWriter(syslogWriter))
+		logger = zerolog.New(out)
 	}
-	zerolog.SetGlobalLevel(zerolog.Level(cfg.LogLevel))
+	if cfg.LogFormat == "console" {
+		logger = logger.With().Timestamp().Logger()
+	}
+	// loggers derived with With() keep the level of the base logger
+	logger = logger.Level(cfg.LogLevel.Level())
+	zerolog.SetGlobalLevel(cfg.LogLevel.Level())
 
 	// setup the cipher suites
 	suites := []uint16{}
@@ -86,15 +192,21 @@ func NewConMan() (*ConnectionManager, error) {
 
 	// setup the conman
 	s := &ConnectionManager{
-		tcpListeners: make(map[uint16]net.Listener),
-		udpListeners: make(map[uint16]net.Listener),
-		doneCh:       make(chan struct{}),
-		tcpRules:     searchtree.NewTree(),
-		udpRules:     searchtree.NewTree(),
-		banList:      security.NewBanManager(cfg.BanCount),
-		banners:      make(map[uint16][]byte),
-		logger:       logger,
-		config:       cfg,
+		tcpListeners:   make(map[uint16]net.Listener),
+		udpListeners:   make(map[uint16]net.Listener),
+		tcpProxies:     make(map[drivers.Driver]muxconn.Proxy),
+		udpProxies:     make(map[drivers.Driver]muxconn.Proxy),
+		connCtx:        context.Background(),
+		banList:        security.NewBanManager(cfg.BanThreshold, time.Duration(cfg.BanWindow)*time.Second, cfg.BanSubnetThreshold),
+		rateLimiter:    security.NewRateLimiter(cfg.PerIPConnRate, cfg.PerIPConnBurst),
+		uploadedHashes: lru.New[string, struct{}](cfg.HashCacheSize),
+		notifiedHashes: lru.New[string, struct{}](cfg.HashCacheSize),
+		recentEvents:   newEventRing(cfg.RecentEventsSize),
+		eventHub:       newEventHub(),
+		logger:         logger,
+		logFile:        logFile,
+		config:         cfg,
+		configPath:     configPath,
 		tlsConfig: tls.Config{
 			//lint:ignore SA1019 we know; that's the point.
 			MinVersion:   tls.VersionSSL30,
@@ -109,12 +221,117 @@ func NewConMan() (*ConnectionManager, error) {
 		},
 	}
 
-	// setup fake TLS
-	fakeTLSCert, err := s.fakeTLSCertificate()
+	// release what the sinks opened if a later step fails
+	defer func() {
+		if err != nil {
+			for _, c := range s.sinkClosers {
+				c.Close()
+			}
+		}
+	}()
+
+	if s.allowList, err = security.NewCIDRSet(cfg.AllowList); err != nil {
+		return nil, err
+	}
+
+	if cfg.GeoIPDatabase != "" || cfg.ASNDatabase != "" {
+		if s.geoIP, err = enrich.NewGeoIP(cfg.GeoIPDatabase, cfg.ASNDatabase); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.CorrelationWindow > 0 {
+		s.correlator = enrich.NewCorrelator(time.Duration(cfg.CorrelationWindow) * time.Second)
+	}
+	if cfg.ReputationFeedFile != "" {
+		if s.reputation, err = security.NewReputation(cfg.ReputationFeedFile); err != nil {
+			return nil, err
+		}
+		logger.Info().Int("networks", s.reputation.Len()).Msg("loaded reputation feed")
+	}
+	if cfg.EnableReverseDNS {
+		s.reverseDNS = enrich.NewReverseDNS(time.Duration(cfg.ReverseDNSTimeout) * time.Millisecond)
+	}
+
+	if cfg.RedisAddr != "" {
+		s.dedup = dedup.NewRedis(cfg.RedisAddr, cfg.RedisPassword, cfg.RedisDB, time.Duration(cfg.RedisDedupTTL)*time.Hour)
+	}
+
+	if cfg.WebhookURL != "" {
+		s.webhook = notify.NewWebhook(cfg.WebhookURL, time.Duration(cfg.WebhookTimeout)*time.Second, logger)
+		s.sinkStarts = append(s.sinkStarts, s.webhook.Start)
+	}
+
+	if cfg.ESAddr != "" {
+		es := sink.NewElastic(cfg.ESAddr, cfg.ESIndex, cfg.ESUser, cfg.ESPass,
+			cfg.ESBatchSize, time.Duration(cfg.ESFlushInterval)*time.Second, logger)
+		s.sinkStarts = append(s.sinkStarts, es.Start)
+		s.sinks = append(s.sinks, es)
+	}
+
+	if len(cfg.KafkaBrokers) > 0 {
+		k := sink.NewKafka(cfg.KafkaBrokers, cfg.KafkaTopic, logger)
+		s.sinkStarts = append(s.sinkStarts, k.Start)
+		s.sinks = append(s.sinks, k)
+	}
+
+	if cfg.NATSURL != "" {
+		n, err := sink.NewNATS(cfg.NATSURL, cfg.NATSSubject, logger)
+		if err != nil {
+			return nil, err
+		}
+		s.sinkStarts = append(s.sinkStarts, n.Start)
+		s.sinkClosers = append(s.sinkClosers, n)
+		s.sinks = append(s.sinks, n)
+	}
+
+	if cfg.SQLitePath != "" || cfg.PostgresDSN != "" {
+		var db *sink.SQL
+		if cfg.SQLitePath != "" {
+			db, err = sink.NewSQLite(cfg.SQLitePath, logger)
+		} else {
+			db, err = sink.NewPostgres(cfg.PostgresDSN, logger)
+		}
+		if err != nil {
+			return nil, err
+		}
+		s.sinkStarts = append(s.sinkStarts, db.Start)
+		s.sinkClosers = append(s.sinkClosers, db)
+		s.closeSinks = append(s.closeSinks, db)
+	}
+
+	if cfg.FlowFile != "" || cfg.FlowURL != "" {
+		var exporter sink.FlowExporter = sink.FlowFile{Path: cfg.FlowFile}
+		if cfg.FlowURL != "" {
+			exporter = sink.NewFlowHTTP(cfg.FlowURL)
+		}
+		s.flows = sink.NewFlows(time.Duration(cfg.FlowInterval)*time.Second, exporter, logger)
+		s.sinks = append(s.sinks, s.flows)
+		s.closeSinks = append(s.closeSinks, s.flows)
+	}
+
+	if cfg.MaxConcurrentConnections > 0 {
+		s.inFlight = make(chan struct{}, cfg.MaxConcurrentConnections)
+	}
+	if cfg.ConnectionWorkers > 0 {
+		s.workers = newWorkerPool(cfg.ConnectionWorkers, cfg.ConnectionQueueSize)
+	}
+
+	// setup TLS, generating a certificate if one was not provided
+	tlsCert, err := s.loadTLSCertificate()
+	if err != nil {
+		return nil, err
+	}
+	s.tlsConfig.Certificates = []tls.Certificate{*tlsCert}
+	s.tlsCert = tlsCert
+	s.samplers = newSamplers(cfg.CaptureSampleEvery, cfg.CaptureRateLimit)
+
+	// pick certificates by the server name clients ask for
+	certs, err := newCertificateStore(cfg.TLSSNICerts, cfg.TLSMintSNI)
 	if err != nil {
 		return nil, err
 	}
-	s.tlsConfig.Certificates = []tls.Certificate{*fakeTLSCert}
+	s.tlsConfig.GetCertificate = certs.GetCertificate
+	s.tlsConfig.GetConfigForClient = s.negotiateALPN
 
 	fakeDTLSCert, err := selfsign.GenerateSelfSigned()
 	if err != nil {
@@ -126,6 +343,12 @@ func NewConMan() (*ConnectionManager, error) {
 	if err := s.setupStore(); err != nil {
 		return nil, err
 	}
+	s.ready.store.Store(true)
+
+	// remember what previous runs stored
+	if err := s.loadHashState(); err != nil {
+		s.logger.Warn().Err(err).Msg("error loading known hashes")
+	}
 
 	// get a list of addresses
 	ifaces, err := net.Interfaces()
@@ -154,76 +377,247 @@ func NewConMan() (*ConnectionManager, error) {
 
 	// Get our bind address
 	gctx.IPAddress = s.listenAddress()
+	if cfg.BindInterface != "" {
+		ip, err := s.bindAddress()
+		if err != nil {
+			return nil, err
+		}
+		gctx.IPAddress = ip
+	}
+
+	// settings for a driver which does not exist are most likely a typo
+	for name := range cfg.Drivers {
+		if drivers.Get(name) == nil {
+			return nil, fmt.Errorf("settings for unknown driver %q", name)
+		}
+	}
 
-	// find all the TCP drivers and setup multiplexers
-	driverList := drivers.GetDrivers()
-	for _, d := range driverList {
+	// find all the drivers and setup multiplexers
+	drivers.SetLogger(logger)
+	for _, d := range drivers.GetDrivers() {
 		// start listeners for tcp handlers
 		if handler, ok := d.(drivers.TCPDriver); ok {
 			conn := muxconn.NewProxy(100)
 			go handler.ServeTCP(conn)
-			s.NewTCPDriver(d.Patterns(), conn)
+			s.tcpProxies[d] = conn
 		}
 
 		if handler, ok := d.(drivers.UDPDriver); ok {
 			conn := muxconn.NewProxy(100)
 			go handler.ServeUDP(conn)
-			s.NewUDPDriver(d.Patterns(), conn)
+			s.udpProxies[d] = conn
 		}
+	}
+	s.rules.Store(s.buildRules(cfg))
+	s.logger.Info().Strs("drivers", drivers.List()).Msg("loaded drivers")
+
+	return s, nil
+}
 
-		// copy the banners to a map
-		if handler, ok := d.(drivers.TCPBannerDriver); ok {
-			if ports, banner := handler.Banner(); len(ports) > 0 {
-				for _, port := range ports {
-					s.banners[port] = banner
-				}
+// sendBanner tries to hint to an attacker what the port hosts if nothing was sent
+func (s *ConnectionManager) sendBanner(ctx context.Context, rules *ruleSet, muc *muxconn.MuxConn, port uint16) {
+	if s.config.ObserveOnly {
+		return
+	}
+	timer := time.NewTimer(time.Second * time.Duration(rules.config.BannerDelay))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done(): // exit out
+		return
+	case <-timer.C: // send the banner if one exists
+		if banner, ok := rules.banners[port]; ok {
+			if _, err := muc.Write(banner.data); err != nil {
+				gctx.GetGlobalFromContext(muc.Context, "").Logger.Debug().Err(err).Msg("Sent Banner")
+				return
 			}
+			s.storeBanner(muc, port, banner)
 		}
 	}
-	return s, nil
 }
 
-// NewTCPDriver adds a TCP driver to ConMan
-func (s *ConnectionManager) NewTCPDriver(rules [][]byte, driver muxconn.Proxy) {
-	for _, rule := range rules {
-		s.tcpRules.Insert(rule, driver)
+// acquireConnection reserves a slot for a new connection without waiting
+func (s *ConnectionManager) acquireConnection() bool {
+	if s.inFlight == nil {
+		return true
+	}
+	select {
+	case s.inFlight <- struct{}{}:
+		return true
+	default:
+		return false
 	}
 }
 
-// NewUDPDriver adds a UDP driver to ConMan
-func (s *ConnectionManager) NewUDPDriver(rules [][]byte, driver muxconn.Proxy) {
-	for _, rule := range rules {
-		s.udpRules.Insert(rule, driver)
+// releaseConnection frees the slot held by a connection
+func (s *ConnectionManager) releaseConnection() {
+	if s.inFlight != nil {
+		<-s.inFlight
 	}
 }
 
-// sendBanner tries to hint to an attacker what the port hosts if nothing was sent
-func (s *ConnectionManager) sendBanner(ctx context.Context, muc *muxconn.MuxConn, port uint16) {
-	time.Sleep(time.Second * time.Duration(s.config.BannerDelay))
-	select {
-	case <-ctx.Done(): // exit out
-		return
-	default: // send the banner if one exists
-		if banner, ok := s.banners[port]; ok {
-			if _, err := muc.Write(banner); err != nil {
-				gctx.GetGlobalFromContext(muc.Context, "").Logger.Debug().Err(err).Msg("Sent Banner")
+// blockedByReputation closes a connection from an attacker the feed is
+// confident enough about, returning true if it did
+func (s *ConnectionManager) blockedByReputation(conn net.Conn, ip net.IP, network string) bool {
+	if s.config.ReputationBlockConfidence == 0 || s.reputation.Lookup(ip) < s.config.ReputationBlockConfidence {
+		return false
+	}
+	metrics.ReputationBlocked.Add(1)
+	s.logger.Debug().
+		Str("network", network).
+		Str("address", conn.RemoteAddr().String()).
+		Msg("blocked by reputation")
+	conn.Close()
+	return true
+}
+
+// refreshReputation reloads the reputation feed when it changes until ctx is done
+func (s *ConnectionManager) refreshReputation(ctx context.Context) {
+	ticker := time.NewTicker(time.Second * time.Duration(s.config.ReputationRefresh))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if changed, err := s.reputation.Refresh(); err != nil {
+				s.logger.Warn().Err(err).Msg("error reloading reputation feed")
+			} else if changed {
+				s.logger.Info().Int("networks", s.reputation.Len()).Msg("reloaded reputation feed")
 			}
+		case <-ctx.Done():
+			return
 		}
 	}
 }
 
-// timeoutConnection prevents connectings lingering
+// rejectOverloaded closes a connection arriving while we are at capacity
+func (s *ConnectionManager) rejectOverloaded(conn net.Conn, network string) {
+	metrics.OverloadedConnections.Add(1)
+	s.logger.Debug().
+		Str("network", network).
+		Str("address", conn.RemoteAddr().String()).
+		Msg("overloaded")
+	conn.Close()
+}
+
+// timeoutConnection prevents connections lingering before the first bytes arrive
 func (s *ConnectionManager) timeoutConnection(ctx context.Context, muc *muxconn.MuxConn) {
-	time.Sleep(time.Second * time.Duration(s.config.KillDelay))
+	timer := time.NewTimer(time.Second * time.Duration(s.config.KillDelay))
+	defer timer.Stop()
 	select {
 	case <-ctx.Done(): // exit out
 		return
-	default: // kill connections
+	case <-timer.C: // kill connections
 		muc.Conn.Close()
 		muc.Close()
 	}
 }
 
+// enrichLogger tags the logger with the location, name and session of the attacker when configured
+func (s *ConnectionManager) enrichLogger(logger zerolog.Logger, ip, port string) zerolog.Logger {
+	if s.correlator != nil {
+		id, ports := s.correlator.Observe(ip, port)
+		logger = logger.With().Str("session_id", id).Int("session_ports", ports).Logger()
+	}
+	if s.geoIP == nil && s.reverseDNS == nil && s.reputation == nil {
+		return logger
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return logger
+	}
+	ctx := logger.With()
+	if confidence := s.reputation.Lookup(addr); confidence > 0 {
+		ctx = ctx.Int("reputation", confidence)
+	}
+	if s.geoIP != nil {
+		loc := s.geoIP.Lookup(addr)
+		if loc.Country != "" {
+			ctx = ctx.Str("country", loc.Country)
+		}
+		if loc.City != "" {
+			ctx = ctx.Str("city", loc.City)
+		}
+		if loc.ASN != 0 {
+			ctx = ctx.Uint("asn", loc.ASN).Str("as_org", loc.ASOrg)
+		}
+	}
+	if s.reverseDNS != nil {
+		if name := s.reverseDNS.Lookup(addr); name != "" {
+			ctx = ctx.Str("rdns", name)
+		}
+	}
+	return ctx.Logger()
+}
+
+// notifyNewHash sends a webhook the first time a payload hash is seen
+func (s *ConnectionManager) notifyNewHash(e notify.Event) {
+	if s.webhook == nil {
+		return
+	}
+	if _, seen := s.notifiedHashes.LoadOrAdd(e.Hash, struct{}{}); seen {
+		return
+	}
+	s.webhook.Notify(e)
+}
+
+// markDriver tags the logger with the driver a connection was routed to
+func markDriver(g *gctx.GlobalUtils, name string) {
+	g.Logger = g.Logger.With().Str("driver", name).Logger()
+	g.DriverMarked = true
+}
+
+// logClose logs how long the connection lasted and the bytes each way once it closes
+func (s *ConnectionManager) logClose(muc *muxconn.MuxConn, logger zerolog.Logger) {
+	muc.OnClose(func() {
+		logger.Info().
+			Int64("duration_ms", muc.Duration().Milliseconds()).
+			Int64("bytes_read", muc.BytesRead()).
+			Int64("bytes_written", muc.BytesWritten()).
+			Msg("connection closed")
+	})
+}
+
+// allowListed returns true if the address belongs to our own infrastructure
+func (s *ConnectionManager) allowListed(addr net.Addr) bool {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return s.allowList.Contains(a.IP)
+	case *net.UDPAddr:
+		return s.allowList.Contains(a.IP)
+	}
+	return false
+}
+
+// quietGlobals keeps an allow listed connection out of the captures and logs everything at trace only
+func quietGlobals(g *gctx.GlobalUtils) {
+	g.Store = nil
+	g.Logger = g.Logger.Hook(traceOnly{})
+}
+
+// traceOnly discards log events above trace
+type traceOnly struct{}
+
+func (traceOnly) Run(e *zerolog.Event, level zerolog.Level, msg string) {
+	if level > zerolog.TraceLevel {
+		e.Discard()
+	}
+}
+
+// reapConnection closes connections which go quiet or outstay their welcome
+// for the lifetime of the connection, including after a driver takes over.
+func (s *ConnectionManager) reapConnection(muc *muxconn.MuxConn) {
+	muc.SetIdleTimeout(time.Second * time.Duration(s.config.IdleTimeout))
+	muc.SetLifetime(time.Second * time.Duration(s.config.ConnectionTimeout))
+}
+
+// openPorts listens on the configured ports
+func (s *ConnectionManager) openPorts() {
+	for _, port := range s.config.Ports {
+		if _, err := s.CreateTCPListener(port); err != nil {
+			s.logger.Warn().Err(err).Uint16("port", port).Msg("creating socket")
+		}
+	}
+}
+
 // preloadTCPListeners gets an early start on a list of ports
 func (s *ConnectionManager) preloadTCPListeners() {
 	// prelisten everything
@@ -237,13 +631,149 @@ func (s *ConnectionManager) preloadTCPListeners() {
 	}
 }
 
-// StartConning starts conman after configuration is completed
-func (s *ConnectionManager) StartConning() {
+// Run starts conman after configuration is completed and blocks until ctx is
+// done, then shuts down gracefully. It returns the first fatal error, such as
+// the raw sockets failing to open unless RawSocketOptional is set, or the API
+// failing to listen.
+func (s *ConnectionManager) Run(ctx context.Context) error {
+	// stop anything already started if we fail part way
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	g, ctx := errgroup.WithContext(ctx)
+	s.connCtx = ctx
+
+	// the store outlives everything which may still be saving captures
+	defer s.closeStore(shutdownTimeout)
+
+	// let drivers prepare before anything can reach them
+	if err := s.startDrivers(ctx); err != nil {
+		return err
+	}
+	defer drivers.StopDrivers(drivers.GetDrivers())
+
+	// find out if we can see SYNs before anything is listening
+	if s.config.DisableAutoListen {
+		s.ready.autoListenDisabled.Store(true)
+	} else if err := s.startManagers(ctx); err != nil {
+		return err
+	}
+	s.openPorts()
 	s.preloadTCPListeners()
-	s.banList.Start()
-	s.tcpManager()
-	s.udpManager()
-	for range s.doneCh {
-		return
+	s.banList.Start(ctx)
+	for _, start := range s.sinkStarts {
+		start()
+	}
+	if s.reverseDNS != nil {
+		s.reverseDNS.Start(ctx)
+	}
+	if s.correlator != nil {
+		s.correlator.Start(ctx)
+	}
+	if s.config.PerIPConnRate > 0 {
+		s.rateLimiter.Start(ctx)
+	}
+	go s.watchReload(ctx)
+	if s.reputation != nil {
+		go s.refreshReputation(ctx)
+	}
+	if s.logFile != nil && s.config.LogRotateHours > 0 {
+		go s.logFile.RotateEvery(ctx, time.Hour*time.Duration(s.config.LogRotateHours), func(err error) {
+			s.logger.Warn().Err(err).Msg("error rotating log file")
+		})
+	}
+	if s.config.APIAddress != "" {
+		g.Go(func() error { return s.runAPI(ctx) })
+	}
+	if s.config.PprofAddr != "" && s.config.PprofAddr != s.config.APIAddress {
+		g.Go(func() error { return s.runPProf(ctx) })
+	}
+	if s.flows != nil {
+		g.Go(func() error {
+			s.flows.Run(ctx)
+			return nil
+		})
+	}
+	g.Go(func() error {
+		<-ctx.Done()
+		s.shutdown()
+		return nil
+	})
+	return g.Wait()
+}
+
+// shutdown stops accepting connections and saves state, the store is closed
+// once Run has stopped the drivers
+func (s *ConnectionManager) shutdown() {
+	s.logger.Info().Msg("shutting down")
+	s.closeListeners()
+	s.closeProxies()
+	if err := s.saveHashState(); err != nil {
+		s.logger.Warn().Err(err).Msg("error saving known hashes")
+	}
+}
+
+// startDrivers starts every driver with its settings, then rebuilds the rules
+// as drivers may take their ports and patterns from those settings
+func (s *ConnectionManager) startDrivers(ctx context.Context) error {
+	if err := drivers.StartDrivers(ctx, drivers.GetDrivers(), s.driverConfig); err != nil {
+		return err
+	}
+	cfg := s.config
+	if rules := s.rules.Load(); rules != nil {
+		cfg = rules.config
+	}
+	s.rules.Store(s.buildRules(cfg))
+	return nil
+}
+
+// driverConfig is what a driver is given as it starts
+func (s *ConnectionManager) driverConfig(d drivers.Driver) drivers.DriverConfig {
+	return drivers.DriverConfig{
+		Logger: drivers.Logger(d.Name()),
+		Raw:    s.config.Drivers[d.Name()],
+	}
+}
+
+// closeListeners closes every port we opened, connections already accepted
+// run until they finish or their driver sees the manager's context is done
+func (s *ConnectionManager) closeListeners() {
+	s.tcpmu.Lock()
+	for port, ln := range s.tcpListeners {
+		ln.Close()
+		delete(s.tcpListeners, port)
+	}
+	metrics.TCPListeners.Set(0)
+	s.tcpmu.Unlock()
+	s.udpmu.Lock()
+	for port, ln := range s.udpListeners {
+		ln.Close()
+		delete(s.udpListeners, port)
+	}
+	s.udpmu.Unlock()
+}
+
+// closeProxies stops the driver serve loops, their Accept returns net.ErrClosed
+func (s *ConnectionManager) closeProxies() {
+	for _, proxies := range []map[drivers.Driver]muxconn.Proxy{s.tcpProxies, s.udpProxies} {
+		for _, p := range proxies {
+			p.Close()
+		}
+	}
+}
+
+// listenRaw opens the raw sockets which see packets for ports nothing listens on
+var listenRaw = net.ListenIP
+
+// startManagers opens the raw sockets which start listeners on demand, carrying
+// on with only the configured and preloaded ports if that is allowed
+func (s *ConnectionManager) startManagers(ctx context.Context) error {
+	for _, manager := range []func(context.Context) error{s.tcpManager, s.udpManager} {
+		if err := manager(ctx); err != nil {
+			if !s.config.RawSocketOptional {
+				return err
+			}
+			s.logger.Warn().Err(err).Msg("only serving configured and preloaded ports")
+		}
 	}
+	return nil
 }
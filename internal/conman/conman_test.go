@@ -0,0 +1,318 @@
+package conman
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/antihax/gambit/internal/conman/config"
+	"github.com/antihax/gambit/internal/conman/notify"
+	"github.com/antihax/gambit/internal/conman/security"
+	"github.com/antihax/gambit/internal/drivers"
+	"github.com/antihax/gambit/internal/muxconn"
+	"github.com/antihax/gambit/internal/store"
+	"github.com/antihax/gambit/pkg/lru"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+// freePort finds a port nothing is listening on
+func freePort(t *testing.T) uint16 {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer ln.Close()
+	return uint16(ln.Addr().(*net.TCPAddr).Port)
+}
+
+func newRunTestManager(cfg *config.Config) *ConnectionManager {
+	cfg.DisableAutoListen = true
+	cfg.MaxPort = 65535
+	return &ConnectionManager{
+		tcpListeners: make(map[uint16]net.Listener),
+		udpListeners: make(map[uint16]net.Listener),
+		tcpProxies:   map[drivers.Driver]muxconn.Proxy{drivers.Get("rdp"): muxconn.NewProxy(1)},
+		banList:      security.NewBanManager(0, time.Minute, 0),
+		logger:       zerolog.Nop(),
+		config:       cfg,
+	}
+}
+
+func TestRun(t *testing.T) {
+	port := freePort(t)
+	s := newRunTestManager(&config.Config{Ports: []uint16{port}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Run(ctx)
+	}()
+
+	// configured ports are opened before anything arrives
+	assert.Eventually(t, func() bool {
+		s.tcpmu.Lock()
+		defer s.tcpmu.Unlock()
+		return s.tcpListeners[port] != nil
+	}, time.Second*5, time.Millisecond*10)
+
+	assert.Equal(t, []uint16{port}, s.ActiveListeners())
+	assert.Equal(t, 1, s.ActiveListenerCount())
+
+	cancel()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second * 15):
+		t.Fatal("Run did not return after cancel")
+	}
+
+	// and closed again once it returns, along with the drivers and connections
+	assert.Empty(t, s.ActiveListeners())
+	_, err := s.tcpProxies[drivers.Get("rdp")].Accept()
+	assert.ErrorIs(t, err, net.ErrClosed)
+	assert.Error(t, s.connCtx.Err())
+	ln, err := net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(int(port))))
+	if assert.NoError(t, err) {
+		ln.Close()
+	}
+}
+
+func TestRunFatal(t *testing.T) {
+	// the API cannot listen on a port which is taken
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer ln.Close()
+	s := newRunTestManager(&config.Config{APIAddress: ln.Addr().String()})
+	assert.Error(t, s.Run(context.Background()))
+}
+
+func TestRunRawSocketError(t *testing.T) {
+	denied := errors.New("operation not permitted")
+	listenRaw = func(string, *net.IPAddr) (*net.IPConn, error) { return nil, denied }
+	defer func() { listenRaw = net.ListenIP }()
+
+	// without raw sockets Run stops with the reason
+	s := newRunTestManager(&config.Config{})
+	s.config.DisableAutoListen = false
+	assert.ErrorIs(t, s.Run(context.Background()), denied)
+
+	// unless only the configured ports are wanted
+	s = newRunTestManager(&config.Config{RawSocketOptional: true})
+	s.config.DisableAutoListen = false
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Run(ctx)
+	}()
+	cancel()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second * 15):
+		t.Fatal("Run did not return after cancel")
+	}
+}
+
+func TestRunPProf(t *testing.T) {
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(int(freePort(t))))
+	s := newRunTestManager(&config.Config{PprofAddr: addr})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	for _, path := range []string{"/debug/pprof/", "/debug/vars"} {
+		assert.Eventually(t, func() bool {
+			resp, err := http.Get("http://" + addr + path)
+			if err != nil {
+				return false
+			}
+			resp.Body.Close()
+			return resp.StatusCode == http.StatusOK
+		}, time.Second*5, time.Millisecond*10, path)
+	}
+}
+
+func TestSendBannerStored(t *testing.T) {
+	s := &ConnectionManager{config: &config.Config{}, logger: zerolog.Nop(), storeChan: make(chan store.File, 1)}
+	rules := newRuleSet(s.config)
+	rules.banners[2222] = banner{data: []byte("SSH-2.0-OpenSSH_8.9\r\n"), source: "config"}
+	s.rules.Store(rules)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	muc, err := muxconn.NewMuxConn(context.Background(), server)
+	if !assert.NoError(t, err) {
+		return
+	}
+	go s.sendBanner(context.Background(), rules, muc, 2222)
+
+	client.SetDeadline(time.Now().Add(time.Second * 5))
+	buf := make([]byte, 64)
+	n, _ := client.Read(buf)
+	assert.Equal(t, "SSH-2.0-OpenSSH_8.9\r\n", string(buf[:n]))
+
+	select {
+	case f := <-s.storeChan:
+		assert.Equal(t, muc.GetUUID()+".banner.outbound", f.Filename)
+		assert.Equal(t, "sessions", f.Location)
+		assert.Equal(t, "2222", f.DstPort)
+		assert.Equal(t, buf[:n], f.Data)
+	case <-time.After(time.Second * 5):
+		t.Fatal("banner was not stored")
+	}
+}
+
+func TestNotifyNewHash(t *testing.T) {
+	hashes := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e notify.Event
+		json.NewDecoder(r.Body).Decode(&e)
+		hashes <- e.Hash
+	}))
+	defer srv.Close()
+
+	s := &ConnectionManager{
+		webhook:        notify.NewWebhook(srv.URL, time.Second, zerolog.Nop()),
+		notifiedHashes: lru.New[string, struct{}](1),
+	}
+	s.webhook.Start()
+	notified := func() []string {
+		var got []string
+		for {
+			select {
+			case h := <-hashes:
+				got = append(got, h)
+			case <-time.After(time.Millisecond * 200):
+				return got
+			}
+		}
+	}
+
+	// each hash is sent once while it is remembered
+	s.notifyNewHash(notify.Event{Hash: "a"})
+	s.notifyNewHash(notify.Event{Hash: "a"})
+	assert.Equal(t, []string{"a"}, notified())
+
+	// only the newest are remembered
+	s.notifyNewHash(notify.Event{Hash: "b"})
+	s.notifyNewHash(notify.Event{Hash: "a"})
+	assert.ElementsMatch(t, []string{"b", "a"}, notified())
+}
+
+func TestBannerBeforeIdleTimeout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "conman.json")
+	connect := func(bannerDelay int) (net.Conn, time.Time) {
+		data := fmt.Sprintf(`{"Banners": {"2222": "SSH-2.0-banner\r\n"}, "BannerDelay": %d, "IdleTimeout": 1}`, bannerDelay)
+		if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := config.LoadConfig(path)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		s := newRunTestManager(cfg)
+		s.connCtx = context.Background()
+		s.banList = security.NewBanManager(cfg.BanThreshold, time.Duration(cfg.BanWindow)*time.Second, cfg.BanSubnetThreshold)
+		s.rules.Store(s.buildRules(cfg))
+
+		client, server := net.Pipe()
+		t.Cleanup(func() { client.Close() })
+		conn := &replayConn{
+			Conn:   server,
+			local:  &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2222},
+			remote: replayAttacker,
+			done:   make(chan struct{}),
+		}
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go s.handleConnection(conn, replayListener{conn.local}, &wg)
+		return client, time.Now()
+	}
+
+	// a silent attacker is sent the banner before being reaped
+	client, start := connect(0)
+	client.SetReadDeadline(time.Now().Add(time.Second * 5))
+	buf := make([]byte, 64)
+	n, err := client.Read(buf)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "SSH-2.0-banner\r\n", string(buf[:n]))
+	}
+	_, err = client.Read(buf)
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Less(t, time.Since(start), time.Second*3)
+
+	// but the idle timeout wins over a longer banner delay
+	client, start = connect(2)
+	client.SetReadDeadline(time.Now().Add(time.Second * 5))
+	n, err = client.Read(buf)
+	assert.Zero(t, n)
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Less(t, time.Since(start), time.Second*2)
+}
+
+func TestFallbackAfterBannerDelay(t *testing.T) {
+	s := newRunTestManager(&config.Config{BannerDelay: 1, KillDelay: 5, IdleTimeout: 10})
+	s.connCtx = context.Background()
+	s.banList = security.NewBanManager(100, time.Minute, 0)
+	proxy := muxconn.NewProxy(1)
+	rules := newRuleSet(s.config)
+	rules.fallback[2222] = &route{name: "fallback", proxy: &proxy}
+	s.rules.Store(rules)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := &replayConn{
+		Conn:   server,
+		local:  &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2222},
+		remote: replayAttacker,
+		done:   make(chan struct{}),
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	start := time.Now()
+	go s.handleConnection(conn, replayListener{conn.local}, &wg)
+
+	// a silent attacker is handed over once the banner delay passes
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := proxy.Accept()
+		accepted <- c
+	}()
+	select {
+	case c := <-accepted:
+		defer c.Close()
+		assert.GreaterOrEqual(t, time.Since(start), time.Second)
+
+		// and the driver reads what is sent after
+		go client.Write([]byte("hello"))
+		c.SetReadDeadline(time.Now().Add(time.Second * 5))
+		buf := make([]byte, 16)
+		n, err := c.Read(buf)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "hello", string(buf[:n]))
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("fallback driver was not handed the connection")
+	}
+}
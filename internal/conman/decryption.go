@@ -1,6 +1,7 @@
 package conman
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
 	"crypto/rsa"
@@ -8,6 +9,7 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"errors"
 	"io"
 	"math/big"
 	"net"
@@ -15,12 +17,30 @@ import (
 
 	"github.com/antihax/gambit/internal/conman/gctx"
 	"github.com/antihax/gambit/internal/muxconn"
+	"github.com/antihax/gambit/pkg/ja3"
 	fake "github.com/brianvoe/gofakeit/v6"
 	"github.com/pion/dtls/v2"
 )
 
+// loadTLSCertificate loads the configured TLS cert or falls back to generating one
+func (s *ConnectionManager) loadTLSCertificate() (*tls.Certificate, error) {
+	if s.config.TLSCert != "" || s.config.TLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(s.config.TLSCert, s.config.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		return &cert, nil
+	}
+
+	commonName := s.config.TLSCommonName
+	if commonName == "" {
+		commonName = fake.DomainName()
+	}
+	return s.fakeTLSCertificate(commonName)
+}
+
 // fakeTLSCertificate creates a fake TLS cert for decrypting TLS
-func (s *ConnectionManager) fakeTLSCertificate() (*tls.Certificate, error) {
+func (s *ConnectionManager) fakeTLSCertificate(commonName string) (*tls.Certificate, error) {
 	key, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
 		return nil, err
@@ -36,9 +56,10 @@ func (s *ConnectionManager) fakeTLSCertificate() (*tls.Certificate, error) {
 		NotAfter:     time.Now().AddDate(25, 0, 0),
 		SerialNumber: big.NewInt(int64(fake.Uint32())),
 		Subject: pkix.Name{
-			CommonName:   fake.DomainName(),
+			CommonName:   commonName,
 			Organization: []string{fake.Company()},
 		},
+		DNSNames:              []string{commonName},
 		BasicConstraintsValid: true,
 	}
 
@@ -59,25 +80,108 @@ func (s *ConnectionManager) fakeTLSCertificate() (*tls.Certificate, error) {
 	return &tlsCert, nil
 }
 
-func (s *ConnectionManager) getGlobalContext() (context.Context, *gctx.GlobalUtils) {
+func (s *ConnectionManager) getGlobalContext(conn net.Conn) (context.Context, *gctx.GlobalUtils) {
 	g := &gctx.GlobalUtils{
-		Store:  s.storeChan,
-		Logger: s.logger,
+		Store:              s.storeChan,
+		Logger:             s.logger,
+		MaxCaptureBytes:    s.config.MaxCaptureBytes,
+		StreamCaptureBytes: s.config.StreamCaptureBytes,
+		Samplers:           s.samplers,
+		ObserveOnly:        s.config.ObserveOnly,
+		TLSCertificate:     s.tlsCert,
+	}
+	ctx := s.connCtx
+	// replays bring their own store and lifetime
+	if rc, ok := conn.(*replayConn); ok && rc.ctx != nil {
+		g.Store, ctx = rc.store, rc.ctx
+	}
+	return gctx.GlobalUtilsContext(ctx, g), g
+}
+
+// unwrapTLS tries to terminate TLS, or DTLS for udp, on a connection which has
+// just sniffed the start of a handshake. On success the plaintext connection is
+// returned with its first read in buf[:n], which it replays to drivers. On
+// failure muc is rewound so drivers see everything read during the attempt,
+// the handshake included, and ok is false.
+func (s *ConnectionManager) unwrapTLS(ctx context.Context, muc *muxconn.MuxConn, network string) (plain *muxconn.MuxConn, buf []byte, n int, ok bool) {
+	// a handshake answers the attacker
+	if s.config.ObserveOnly {
+		return muc, nil, 0, false
+	}
+	// replay the sniffed bytes to the handshake and keep sniffing, so nothing
+	// is lost if it turns out not to be TLS after all
+	muc.Reset()
+	plain, buf, n, err := s.decryptConn(ctx, muc, network)
+	if err != nil {
+		muc.Reset()
+		return muc, nil, 0, false
+	}
+
+	// the handshake is done with, only the plaintext is read from now on
+	muc.Snapshot()
+	muc.DoneSniffing()
+	return plain, buf, n, true
+}
+
+// maxClientHello bounds how much is read to reassemble a ClientHello which did
+// not arrive in the first read, hellos carrying large key shares span packets
+const maxClientHello = 16 * 1024
+
+// readClientHello keeps reading from the sniffer until the ClientHello which
+// began with first is complete, giving up after maxClientHello bytes or once the
+// connection stops sending. Everything read is replayed by the sniffer.
+func readClientHello(r io.Reader, muc *muxconn.MuxConn, first []byte) (*ja3.ClientHello, error) {
+	muc.SetReadDeadline(time.Now().Add(time.Second * 5))
+	defer muc.SetReadDeadline(time.Time{})
+
+	data := bytes.Clone(first)
+	chunk := make([]byte, readBufferSize)
+	for len(data) < maxClientHello {
+		n, err := r.Read(chunk)
+		data = append(data, chunk[:n]...)
+		hello, parseErr := ja3.Parse(data)
+		if !errors.Is(parseErr, ja3.ErrIncomplete) || err != nil {
+			return hello, parseErr
+		}
+	}
+	return nil, ja3.ErrIncomplete
+}
+
+// negotiateALPN agrees the first protocol offered which a driver claims. The
+// protocol is only advertised when it is shared, a TLS server lists protocols
+// at the risk of refusing clients which offer none of them.
+func (s *ConnectionManager) negotiateALPN(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	rules := s.rules.Load()
+	if rules == nil {
+		return nil, nil
+	}
+	for _, proto := range hello.SupportedProtos {
+		if _, ok := rules.alpn[proto]; ok {
+			cfg := s.tlsConfig.Clone()
+			cfg.NextProtos = []string{proto}
+			return cfg, nil
+		}
 	}
-	return gctx.GlobalUtilsContext(context.Background(), g), g
+	return nil, nil
 }
 
-// decryptConn attempts to return a decrypting connection
+// decryptConn completes a handshake on conn and reads the first plaintext.
+// An error is only returned if the handshake fails, the connection ending
+// before or with the first plaintext is not an error.
 func (s *ConnectionManager) decryptConn(ctx context.Context, conn net.Conn, network string) (*muxconn.MuxConn, []byte, int, error) {
 	var (
 		decryptConn net.Conn
 		err         error
 	)
-	n := 1500
-	buf := make([]byte, n)
+	buf := make([]byte, 1500)
 
 	if network == "tcp" {
-		decryptConn = tls.Server(conn, &s.tlsConfig)
+		tlsConn := tls.Server(conn, &s.tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			s.logger.Trace().Str("network", network).Err(err).Msg("error unwrapping tls")
+			return nil, nil, 0, err
+		}
+		decryptConn = tlsConn
 	} else {
 		decryptConn, err = dtls.Server(conn, &s.dtlsConfig)
 		if err != nil {
@@ -92,15 +196,12 @@ func (s *ConnectionManager) decryptConn(ctx context.Context, conn net.Conn, netw
 		s.logger.Debug().Str("network", network).Err(err).Msg("error building NewMuxConn")
 		return nil, nil, 0, err
 	}
+
+	// data may arrive along with a close, which is still data
 	r := muc.StartSniffing()
-	n, err = r.Read(buf)
-	if err != nil {
-		if err != io.EOF {
-			s.logger.Debug().Str("network", network).Err(err).Msg("error unwrapping tls")
-			muc.Reset()
-			return nil, nil, 0, err
-		}
+	n, err := r.Read(buf)
+	if err != nil && err != io.EOF {
+		s.logger.Trace().Str("network", network).Err(err).Msg("error reading unwrapped tls")
 	}
-
-	return muc, buf, n, err
+	return muc, buf, n, nil
 }
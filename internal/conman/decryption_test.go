@@ -0,0 +1,254 @@
+package conman
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/antihax/gambit/internal/conman/config"
+	"github.com/antihax/gambit/internal/muxconn"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+// coalescingConn holds writes once told to, so records reach the server in one read
+type coalescingConn struct {
+	net.Conn
+	mu   sync.Mutex
+	hold bool
+	buf  bytes.Buffer
+}
+
+func (c *coalescingConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.hold {
+		return c.buf.Write(p)
+	}
+	return c.Conn.Write(p)
+}
+
+// SetWriteDeadline is ignored, closing a TLS connection would stop the flush
+func (c *coalescingConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+func (c *coalescingConn) flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hold = false
+	_, err := c.Conn.Write(c.buf.Bytes())
+	return err
+}
+
+func newUnwrapTestManager(t *testing.T) *ConnectionManager {
+	s := &ConnectionManager{config: &config.Config{}, logger: zerolog.Nop()}
+	cert, err := s.fakeTLSCertificate("example.com")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	s.tlsConfig = tls.Config{Certificates: []tls.Certificate{*cert}, SessionTicketsDisabled: true}
+	return s
+}
+
+// sniff reads the first bytes as handleConnection does
+func sniff(t *testing.T, server net.Conn) (*muxconn.MuxConn, []byte) {
+	muc, _ := muxconn.NewMuxConn(context.Background(), server)
+	muc.SetDeadline(time.Now().Add(time.Second * 10))
+	buf := make([]byte, 1500)
+	n, err := muc.StartSniffing().Read(buf)
+	assert.NoError(t, err)
+	return muc, buf[:n]
+}
+
+func TestUnwrapTLS(t *testing.T) {
+	s := newUnwrapTestManager(t)
+	client, server := net.Pipe()
+	defer server.Close()
+
+	// the request and the close arrive together, which TLS 1.2 reads as the
+	// request with io.EOF and must not lose the request
+	request := []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	go func() {
+		cc := &coalescingConn{Conn: client}
+		tc := tls.Client(cc, &tls.Config{InsecureSkipVerify: true, ServerName: "example.com", MaxVersion: tls.VersionTLS12})
+		if tc.Handshake() != nil {
+			client.Close()
+			return
+		}
+		cc.mu.Lock()
+		cc.hold = true
+		cc.mu.Unlock()
+		tc.Write(request)
+		tc.CloseWrite()
+		cc.flush()
+		io.Copy(io.Discard, client)
+	}()
+
+	muc, first := sniff(t, server)
+	assert.Equal(t, byte(0x16), first[0])
+
+	plain, buf, n, ok := s.unwrapTLS(context.Background(), muc, "tcp")
+	if !assert.True(t, ok) {
+		return
+	}
+	// only the first plaintext, none of the handshake
+	assert.Equal(t, request, buf[:n])
+
+	// and the driver reads it again, then the end
+	plain.Reset()
+	got, err := io.ReadAll(plain)
+	assert.NoError(t, err)
+	assert.Equal(t, request, got)
+}
+
+func TestUnwrapTLSFailed(t *testing.T) {
+	s := newUnwrapTestManager(t)
+	client, server := net.Pipe()
+	defer server.Close()
+
+	// looks like a handshake record but is not one
+	sent := append([]byte{0x16, 0x03, 0x01, 0x00, 0x05}, []byte("hello then more")...)
+	go func() {
+		client.Write(sent)
+		io.Copy(io.Discard, client)
+	}()
+
+	muc, first := sniff(t, server)
+	assert.Equal(t, sent, first)
+
+	got, _, _, ok := s.unwrapTLS(context.Background(), muc, "tcp")
+	assert.False(t, ok)
+	assert.Same(t, muc, got)
+
+	// the driver sees everything that was sent
+	buf := make([]byte, 1500)
+	n, _ := muc.Read(buf)
+	assert.Equal(t, sent, buf[:n])
+}
+
+func TestUnwrapTLSObserveOnly(t *testing.T) {
+	s := newUnwrapTestManager(t)
+	s.config.ObserveOnly = true
+	client, server := net.Pipe()
+	defer server.Close()
+
+	// a real handshake, which must go unanswered
+	go tls.Client(client, &tls.Config{InsecureSkipVerify: true}).Handshake()
+	muc, first := sniff(t, server)
+
+	got, _, _, ok := s.unwrapTLS(context.Background(), muc, "tcp")
+	assert.False(t, ok)
+	assert.Same(t, muc, got)
+	assert.Zero(t, muc.BytesWritten())
+
+	// the hello is still there for the drivers
+	muc.Reset()
+	buf := make([]byte, 1500)
+	n, _ := muc.Read(buf)
+	assert.Equal(t, first, buf[:n])
+	client.Close()
+}
+
+func TestUnwrapTLSALPN(t *testing.T) {
+	s := newUnwrapTestManager(t)
+	s.tlsConfig.GetConfigForClient = s.negotiateALPN
+	rules := newRuleSet(s.config)
+	rules.alpn["h2"] = &route{name: "h2"}
+	s.rules.Store(rules)
+
+	for _, tc := range []struct {
+		offered []string
+		want    string
+	}{
+		{[]string{"imap", "h2"}, "h2"},
+		// a server listing h2 alone would refuse these
+		{[]string{"imap"}, ""},
+		{nil, ""},
+	} {
+		client, server := net.Pipe()
+		go func() {
+			c := tls.Client(client, &tls.Config{InsecureSkipVerify: true, NextProtos: tc.offered})
+			if c.Handshake() == nil {
+				c.Write([]byte("hello"))
+			}
+			io.Copy(io.Discard, client)
+		}()
+
+		muc, _ := sniff(t, server)
+		plain, _, _, ok := s.unwrapTLS(context.Background(), muc, "tcp")
+		if assert.True(t, ok, tc.offered) {
+			assert.Equal(t, tc.want, plain.Conn.(*tls.Conn).ConnectionState().NegotiatedProtocol)
+		}
+		server.Close()
+	}
+}
+
+func TestReadClientHello(t *testing.T) {
+	// capture a hello, then send it in two pieces as if split across packets
+	client, server := net.Pipe()
+	go tls.Client(client, &tls.Config{ServerName: "example.com", NextProtos: []string{"h2"}}).Handshake()
+	server.SetDeadline(time.Now().Add(time.Second * 5))
+	record := make([]byte, 4096)
+	n, err := server.Read(record)
+	if !assert.NoError(t, err) {
+		return
+	}
+	record = record[:n]
+	client.Close()
+	server.Close()
+
+	client, server = net.Pipe()
+	defer client.Close()
+	go func() {
+		client.Write(record[:100])
+		time.Sleep(time.Millisecond * 50)
+		client.Write(record[100:])
+	}()
+	muc, _ := muxconn.NewMuxConn(context.Background(), server)
+	r := muc.StartSniffing()
+	first := make([]byte, 1500)
+	n, err = r.Read(first)
+	if !assert.NoError(t, err) || !assert.Equal(t, record[:100], first[:n]) {
+		return
+	}
+
+	hello, err := readClientHello(r, muc, first[:n])
+	if assert.NoError(t, err) {
+		assert.Equal(t, "example.com", hello.ServerName)
+		assert.Equal(t, []string{"h2"}, hello.ALPN)
+	}
+
+	// the handshake sees the whole hello again
+	muc.Reset()
+	got := make([]byte, len(record))
+	_, err = io.ReadFull(muc, got)
+	assert.NoError(t, err)
+	assert.Equal(t, record, got)
+}
+
+func TestGetGlobalContextSettings(t *testing.T) {
+	cert := &tls.Certificate{}
+	observe := &ConnectionManager{
+		config:  &config.Config{MaxCaptureBytes: 10, StreamCaptureBytes: 5, ObserveOnly: true},
+		tlsCert: cert,
+		connCtx: context.Background(),
+	}
+	engage := &ConnectionManager{config: &config.Config{}, connCtx: context.Background()}
+
+	// each manager hands drivers its own settings
+	_, g := observe.getGlobalContext(nil)
+	assert.Equal(t, 10, g.MaxCaptureBytes)
+	assert.Equal(t, 5, g.StreamCaptureBytes)
+	assert.True(t, g.ObserveOnly)
+	assert.Same(t, cert, g.TLSCertificate)
+
+	_, g = engage.getGlobalContext(nil)
+	assert.False(t, g.ObserveOnly)
+	assert.Nil(t, g.TLSCertificate)
+}
@@ -0,0 +1,64 @@
+// Package dedup shares which captures have been seen between honeypots
+package dedup
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// keyPrefix namespaces our keys in a shared Redis
+const keyPrefix = "gambit:seen:"
+
+// HashSeen records hashes, reporting whether they were recorded before
+type HashSeen interface {
+	// HashSeen records hash and returns true if it had already been recorded
+	HashSeen(hash string) (bool, error)
+	// Forget removes a hash recorded by a capture which then failed to store,
+	// so whichever node sees it next tries again
+	Forget(hash string) error
+}
+
+// Redis records hashes in a Redis server shared by a fleet
+type Redis struct {
+	client  *redis.Client
+	ttl     time.Duration
+	timeout time.Duration
+}
+
+// NewRedis connects to the Redis at addr, forgetting hashes after ttl, 0 keeps them forever
+func NewRedis(addr, password string, db int, ttl time.Duration) *Redis {
+	return &Redis{
+		client: redis.NewClient(&redis.Options{
+			Addr:     addr,
+			Password: password,
+			DB:       db,
+		}),
+		ttl:     ttl,
+		timeout: time.Second,
+	}
+}
+
+// HashSeen sets the key only if it did not exist, so exactly one node sees it first
+func (r *Redis) HashSeen(hash string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	set, err := r.client.SetNX(ctx, keyPrefix+hash, 1, r.ttl).Result()
+	if err != nil {
+		return false, err
+	}
+	return !set, nil
+}
+
+// Forget deletes the key
+func (r *Redis) Forget(hash string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	return r.client.Del(ctx, keyPrefix+hash).Err()
+}
+
+// Close disconnects from Redis
+func (r *Redis) Close() error {
+	return r.client.Close()
+}
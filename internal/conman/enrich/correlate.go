@@ -0,0 +1,80 @@
+package enrich
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Correlator groups connections from the same address into attacker sessions,
+// which last for as long as connections keep arriving within the window
+type Correlator struct {
+	window time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]*attackerSession
+}
+
+type attackerSession struct {
+	id       string
+	lastSeen time.Time
+	ports    map[string]struct{}
+}
+
+// NewCorrelator creates a Correlator ending sessions quiet for longer than window
+func NewCorrelator(window time.Duration) *Correlator {
+	return &Correlator{
+		window:   window,
+		sessions: make(map[string]*attackerSession),
+	}
+}
+
+// Observe records a connection from ip to port, returning the session it
+// belongs to and how many distinct ports the session has touched
+func (c *Correlator) Observe(ip, port string) (string, int) {
+	return c.observe(ip, port, time.Now())
+}
+
+func (c *Correlator) observe(ip, port string, now time.Time) (string, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.sessions[ip]
+	if !ok || now.Sub(e.lastSeen) > c.window {
+		e = &attackerSession{id: uuid.NewString(), ports: make(map[string]struct{})}
+		c.sessions[ip] = e
+	}
+	e.lastSeen = now
+	e.ports[port] = struct{}{}
+	return e.id, len(e.ports)
+}
+
+// collect removes sessions which have ended
+func (c *Correlator) collect(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for ip, e := range c.sessions {
+		if now.Sub(e.lastSeen) > c.window {
+			delete(c.sessions, ip)
+		}
+	}
+}
+
+// Start periodically forgets ended sessions so the map does not grow unbounded,
+// until ctx is done
+func (c *Correlator) Start(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				c.collect(time.Now())
+			}
+		}
+	}()
+}
@@ -0,0 +1,39 @@
+package enrich
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCorrelator(t *testing.T) {
+	c := NewCorrelator(time.Minute)
+	now := time.Now()
+
+	id, ports := c.observe("192.0.2.1", "22", now)
+	assert.Equal(t, 1, ports)
+
+	// the window slides with each connection
+	for i, port := range []string{"23", "22", "80"} {
+		now = now.Add(time.Second * 50)
+		next, n := c.observe("192.0.2.1", port, now)
+		assert.Equal(t, id, next)
+		assert.Equal(t, []int{2, 2, 3}[i], n)
+	}
+
+	// other addresses have their own sessions
+	other, _ := c.observe("192.0.2.2", "22", now)
+	assert.NotEqual(t, id, other)
+
+	// quiet for longer than the window starts again
+	now = now.Add(time.Minute * 2)
+	next, n := c.observe("192.0.2.1", "22", now)
+	assert.NotEqual(t, id, next)
+	assert.Equal(t, 1, n)
+
+	c.collect(now.Add(time.Second))
+	assert.Len(t, c.sessions, 1)
+	c.collect(now.Add(time.Minute * 2))
+	assert.Empty(t, c.sessions)
+}
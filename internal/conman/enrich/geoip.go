@@ -0,0 +1,68 @@
+// Package enrich looks up context about attackers to attach to their connections
+package enrich
+
+import (
+	"net"
+
+	"github.com/antihax/gambit/pkg/lru"
+	"github.com/oschwald/geoip2-golang"
+)
+
+// geoCacheSize bounds how many addresses keep their lookups cached
+const geoCacheSize = 10000
+
+// Location of an address and the network it belongs to
+type Location struct {
+	Country string
+	City    string
+	ASN     uint
+	ASOrg   string
+}
+
+// GeoIP looks up addresses in MaxMind GeoLite2 databases
+type GeoIP struct {
+	city  *geoip2.Reader
+	asn   *geoip2.Reader
+	cache *lru.Cache[string, Location]
+}
+
+// NewGeoIP opens the city and ASN databases, either may be empty to skip it
+func NewGeoIP(cityPath, asnPath string) (*GeoIP, error) {
+	g := &GeoIP{cache: lru.New[string, Location](geoCacheSize)}
+	var err error
+	if cityPath != "" {
+		if g.city, err = geoip2.Open(cityPath); err != nil {
+			return nil, err
+		}
+	}
+	if asnPath != "" {
+		if g.asn, err = geoip2.Open(asnPath); err != nil {
+			return nil, err
+		}
+	}
+	return g, nil
+}
+
+// Lookup returns the location of ip, caching results for chatty scanners
+func (g *GeoIP) Lookup(ip net.IP) Location {
+	key := ip.String()
+	if loc, ok := g.cache.Get(key); ok {
+		return loc
+	}
+
+	var loc Location
+	if g.city != nil {
+		if city, err := g.city.City(ip); err == nil {
+			loc.Country = city.Country.IsoCode
+			loc.City = city.City.Names["en"]
+		}
+	}
+	if g.asn != nil {
+		if asn, err := g.asn.ASN(ip); err == nil {
+			loc.ASN = asn.AutonomousSystemNumber
+			loc.ASOrg = asn.AutonomousSystemOrganization
+		}
+	}
+	g.cache.Add(key, loc)
+	return loc
+}
@@ -0,0 +1,110 @@
+package enrich
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/antihax/gambit/pkg/lru"
+)
+
+const (
+	// rdnsCacheSize bounds how many addresses keep their names cached
+	rdnsCacheSize = 10000
+	// rdnsWorkers is how many lookups run at once
+	rdnsWorkers = 4
+	// rdnsQueue is how many addresses may wait for a worker before new ones are skipped
+	rdnsQueue = 256
+)
+
+// ReverseDNS resolves PTR records for addresses in the background so
+// connections never wait on a slow resolver
+type ReverseDNS struct {
+	timeout time.Duration
+	lookup  func(ctx context.Context, addr string) ([]string, error)
+	cache   *lru.Cache[string, string]
+	queue   chan string
+
+	mu      sync.Mutex
+	pending map[string]struct{}
+}
+
+// NewReverseDNS resolves with the system resolver once started, giving up on
+// each lookup after timeout
+func NewReverseDNS(timeout time.Duration) *ReverseDNS {
+	return newReverseDNS(timeout, net.DefaultResolver.LookupAddr)
+}
+
+func newReverseDNS(timeout time.Duration, lookup func(ctx context.Context, addr string) ([]string, error)) *ReverseDNS {
+	r := &ReverseDNS{
+		timeout: timeout,
+		lookup:  lookup,
+		cache:   lru.New[string, string](rdnsCacheSize),
+		queue:   make(chan string, rdnsQueue),
+		pending: make(map[string]struct{}),
+	}
+	return r
+}
+
+// Start the workers resolving queued addresses until ctx is done
+func (r *ReverseDNS) Start(ctx context.Context) {
+	for i := 0; i < rdnsWorkers; i++ {
+		go r.worker(ctx)
+	}
+}
+
+// Lookup returns the name of ip if it has been resolved. Addresses not seen
+// before are queued and return an empty name, as do those without a PTR.
+func (r *ReverseDNS) Lookup(ip net.IP) string {
+	key := ip.String()
+	if name, ok := r.cache.Get(key); ok {
+		return name
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.pending[key]; ok {
+		return ""
+	}
+	select {
+	case r.queue <- key:
+		r.pending[key] = struct{}{}
+	default:
+		// the resolver is behind, a later connection can try again
+	}
+	return ""
+}
+
+func (r *ReverseDNS) worker(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case key := <-r.queue:
+			r.resolve(ctx, key)
+		}
+	}
+}
+
+// resolve looks up key, caching the name or that there is none. Timeouts and
+// other resolver failures are not cached so a later connection tries again.
+func (r *ReverseDNS) resolve(ctx context.Context, key string) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	names, err := r.lookup(ctx, key)
+	cancel()
+
+	var dnsErr *net.DNSError
+	switch {
+	case err == nil && len(names) > 0:
+		r.cache.Add(key, strings.TrimSuffix(names[0], "."))
+	case err == nil, errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		r.cache.Add(key, "")
+	}
+
+	r.mu.Lock()
+	delete(r.pending, key)
+	r.mu.Unlock()
+}
@@ -0,0 +1,74 @@
+package enrich
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReverseDNS(t *testing.T) {
+	var lookups, flaky atomic.Int32
+	r := newReverseDNS(time.Second, func(ctx context.Context, addr string) ([]string, error) {
+		lookups.Add(1)
+		switch addr {
+		case "192.0.2.1":
+			return []string{"scanner.example.org."}, nil
+		case "192.0.2.3":
+			// times out once, then answers
+			if flaky.Add(1) == 1 {
+				return nil, &net.DNSError{Err: "i/o timeout", IsTimeout: true}
+			}
+			return []string{"retried.example.org."}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", IsNotFound: true}
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r.Start(ctx)
+
+	found, missing, retried := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"), net.ParseIP("192.0.2.3")
+	// nothing is known until the workers have resolved it
+	assert.Empty(t, r.Lookup(found))
+	r.Lookup(missing)
+	assert.Eventually(t, func() bool {
+		return r.Lookup(found) == "scanner.example.org"
+	}, time.Second, time.Millisecond*10)
+	assert.Eventually(t, func() bool {
+		_, ok := r.cache.Get("192.0.2.2")
+		return ok
+	}, time.Second, time.Millisecond*10)
+
+	// answers and missing names are cached
+	assert.Empty(t, r.Lookup(missing))
+	assert.Equal(t, int32(2), lookups.Load())
+
+	// a timeout is not, the next connection tries again
+	assert.Eventually(t, func() bool {
+		return r.Lookup(retried) == "retried.example.org"
+	}, time.Second*5, time.Millisecond*10)
+}
+
+func TestReverseDNSStop(t *testing.T) {
+	looked := make(chan string, 1)
+	r := newReverseDNS(time.Second, func(ctx context.Context, addr string) ([]string, error) {
+		looked <- addr
+		return nil, errors.New("unreachable")
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	r.Start(ctx)
+	cancel()
+
+	// once stopped nothing queued is resolved
+	time.Sleep(time.Millisecond * 50)
+	r.Lookup(net.ParseIP("192.0.2.1"))
+	select {
+	case addr := <-looked:
+		t.Fatalf("resolved %s after stopping", addr)
+	case <-time.After(time.Millisecond * 100):
+	}
+}
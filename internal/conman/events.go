@@ -0,0 +1,106 @@
+package conman
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/antihax/gambit/internal/conman/sink"
+	"github.com/antihax/gambit/internal/muxconn"
+)
+
+// RecentEvent is a connection kept for the recent events API and sent to sinks
+type RecentEvent = sink.Event
+
+// eventRing holds the last size events, overwriting the oldest
+type eventRing struct {
+	sync.Mutex
+	events []RecentEvent
+	next   int
+	full   bool
+}
+
+func newEventRing(size int) *eventRing {
+	return &eventRing{events: make([]RecentEvent, size)}
+}
+
+// Add an event, a nil or empty ring discards it
+func (r *eventRing) Add(e RecentEvent) {
+	if r == nil || len(r.events) == 0 {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.events[r.next] = e
+	r.next = (r.next + 1) % len(r.events)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// Recent returns events newest first which match keep, or all if keep is nil
+func (r *eventRing) Recent(keep func(RecentEvent) bool) []RecentEvent {
+	out := []RecentEvent{}
+	if r == nil || len(r.events) == 0 {
+		return out
+	}
+	r.Lock()
+	defer r.Unlock()
+	count := r.next
+	if r.full {
+		count = len(r.events)
+	}
+	for i := 1; i <= count; i++ {
+		e := r.events[(r.next-i+len(r.events))%len(r.events)]
+		if keep == nil || keep(e) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// recordEvent stamps a connection with the time and location, adds it to the
+// recent events and publishes it to live streams and sinks. Sinks wanting the
+// finished connection get it again once conn closes.
+func (s *ConnectionManager) recordEvent(e RecentEvent, conn *muxconn.MuxConn) {
+	e.Time = time.Now().UTC()
+	if s.geoIP != nil || s.reputation != nil {
+		if addr := net.ParseIP(e.Attacker); addr != nil {
+			if s.geoIP != nil {
+				loc := s.geoIP.Lookup(addr)
+				e.Country, e.City, e.ASN, e.ASOrg = loc.Country, loc.City, loc.ASN, loc.ASOrg
+			}
+			e.Reputation = s.reputation.Lookup(addr)
+		}
+	}
+	s.recentEvents.Add(e)
+	s.eventHub.Publish(e)
+	for _, sk := range s.sinks {
+		sk.Send(e)
+	}
+	if conn != nil && len(s.closeSinks) > 0 {
+		conn.OnClose(func() {
+			e.BytesIn, e.BytesOut = conn.BytesRead(), conn.BytesWritten()
+			e.DurationMS = conn.Duration().Milliseconds()
+			for _, sk := range s.closeSinks {
+				sk.Closed(e)
+			}
+		})
+	}
+}
+
+// handleEvents serves the recent events as JSON, optionally filtered by ?port= and ?ip=
+func (s *ConnectionManager) handleEvents(w http.ResponseWriter, r *http.Request) {
+	port := r.URL.Query().Get("port")
+	ip := r.URL.Query().Get("ip")
+	events := s.recentEvents.Recent(func(e RecentEvent) bool {
+		return (port == "" || e.DstPort == port) && (ip == "" || e.Attacker == ip)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(events); err != nil {
+		s.logger.Debug().Err(err).Msg("writing events")
+	}
+}
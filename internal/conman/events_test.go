@@ -0,0 +1,52 @@
+package conman
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventRing(t *testing.T) {
+	r := newEventRing(3)
+	assert.Empty(t, r.Recent(nil))
+
+	for i := 1; i <= 5; i++ {
+		r.Add(RecentEvent{DstPort: strconv.Itoa(i)})
+	}
+	events := r.Recent(nil)
+	if assert.Len(t, events, 3) {
+		assert.Equal(t, "5", events[0].DstPort)
+		assert.Equal(t, "3", events[2].DstPort)
+	}
+
+	// disabled rings discard everything
+	r = newEventRing(0)
+	r.Add(RecentEvent{})
+	assert.Empty(t, r.Recent(nil))
+}
+
+func TestHandleEvents(t *testing.T) {
+	s := &ConnectionManager{recentEvents: newEventRing(10), eventHub: newEventHub(), logger: zerolog.Nop()}
+	s.recordEvent(RecentEvent{Network: "tcp", Attacker: "192.0.2.1", DstPort: "22", UUID: "a", Driver: "sshd"}, nil)
+	s.recordEvent(RecentEvent{Network: "tcp", Attacker: "192.0.2.2", DstPort: "80", UUID: "b", Hash: "hash", Driver: "http"}, nil)
+	s.recordEvent(RecentEvent{Network: "udp", Attacker: "192.0.2.1", DstPort: "53", UUID: "c", Hash: "hash", Driver: "dns"}, nil)
+
+	get := func(query string) []RecentEvent {
+		w := httptest.NewRecorder()
+		s.handleEvents(w, httptest.NewRequest("GET", "/events"+query, nil))
+		var events []RecentEvent
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &events))
+		return events
+	}
+
+	assert.Len(t, get(""), 3)
+	assert.Equal(t, "c", get("")[0].UUID)
+	assert.Len(t, get("?ip=192.0.2.1"), 2)
+	if events := get("?ip=192.0.2.1&port=22"); assert.Len(t, events, 1) {
+		assert.Equal(t, "sshd", events[0].Driver)
+	}
+}
@@ -3,6 +3,7 @@ package gctx
 
 import (
 	"context"
+	"crypto/tls"
 
 	"github.com/antihax/gambit/internal/muxconn"
 	"github.com/antihax/gambit/internal/store"
@@ -23,10 +24,38 @@ var (
 	IPAddress string
 )
 
+// GlobalUtilsContext returns a context carrying globals, drivers should use this
+// rather than context.WithValue so the accessors below can find them.
 func GlobalUtilsContext(ctx context.Context, globals *GlobalUtils) context.Context {
 	return context.WithValue(ctx, GlobalContextKey, globals)
 }
 
+// GlobalFromContext returns the globals in the context and whether they were present
+func GlobalFromContext(ctx context.Context) (*GlobalUtils, bool) {
+	if ctx == nil {
+		return nil, false
+	}
+	g, ok := ctx.Value(GlobalContextKey).(*GlobalUtils)
+	return g, ok && g != nil
+}
+
+// LoggerFromContext returns the connection logger, or a no-op logger if there is none
+func LoggerFromContext(ctx context.Context) zerolog.Logger {
+	if g, ok := GlobalFromContext(ctx); ok {
+		return g.Logger
+	}
+	return zerolog.Nop()
+}
+
+// StoreFromContext returns the store channel, which is nil if there is none.
+// store.Offer discards files sent to a nil channel.
+func StoreFromContext(ctx context.Context) (chan store.File, bool) {
+	if g, ok := GlobalFromContext(ctx); ok && g.Store != nil {
+		return g.Store, true
+	}
+	return nil, false
+}
+
 // GlobalUtils provides utils for drivers
 type GlobalUtils struct {
 	MuxConn      *muxconn.MuxConn
@@ -34,11 +63,28 @@ type GlobalUtils struct {
 	BaseHash     string
 	Store        chan store.File
 	DriverMarked bool
+
+	// MaxCaptureBytes is the largest capture drivers should accumulate, 0 is unlimited
+	MaxCaptureBytes int
+	// StreamCaptureBytes is the size above which drivers should spool captures to disk, 0 is never
+	StreamCaptureBytes int
+	// Samplers are the capture samplers of drivers which have them
+	Samplers map[string]*store.Sampler
+	// ObserveOnly is set when attackers must not be answered, writes to their
+	// connections are discarded and drivers should skip anything else engaging them
+	ObserveOnly bool
+	// TLSCertificate is the certificate used to unwrap TLS so drivers terminating their own TLS can share it
+	TLSCertificate *tls.Certificate
 }
 
 // GetGlobalFromContext returns store channel from conman context for saving raw packets
+// If the context has none, detached globals with a no-op logger and no store are
+// returned so a misrouted connection cannot panic the driver.
 func GetGlobalFromContext(ctx context.Context, driver string) *GlobalUtils {
-	c := ctx.Value(GlobalContextKey).(*GlobalUtils)
+	c, ok := GlobalFromContext(ctx)
+	if !ok {
+		return &GlobalUtils{Logger: zerolog.Nop(), DriverMarked: true}
+	}
 	// zerolog allows for multiple keys, but we only want to mark the driver once
 	if driver != "" && !c.DriverMarked {
 		c.Logger = c.Logger.With().Str("driver", driver).Logger()
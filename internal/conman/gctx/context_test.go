@@ -0,0 +1,39 @@
+package gctx
+
+import (
+	"context"
+	"testing"
+
+	"github.com/antihax/gambit/internal/store"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMissingGlobals(t *testing.T) {
+	ctx := context.Background()
+
+	_, ok := GlobalFromContext(ctx)
+	assert.False(t, ok)
+	_, ok = StoreFromContext(ctx)
+	assert.False(t, ok)
+	assert.Equal(t, zerolog.Nop(), LoggerFromContext(ctx))
+
+	// drivers get usable globals rather than a panic
+	g := GetGlobalFromContext(ctx, "test")
+	assert.NotNil(t, g)
+	assert.False(t, store.Offer(g.Store, store.File{}))
+	g.NewSession(1, "").LogError(nil)
+}
+
+func TestGlobals(t *testing.T) {
+	ch := make(chan store.File, 1)
+	ctx := GlobalUtilsContext(context.Background(), &GlobalUtils{Store: ch, Logger: zerolog.Nop()})
+
+	g, ok := GlobalFromContext(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, ch, g.Store)
+
+	s, ok := StoreFromContext(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, ch, s)
+}
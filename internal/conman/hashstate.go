@@ -0,0 +1,109 @@
+package conman
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// hashState is a known hash and when it was last stored
+type hashState struct {
+	hash string
+	seen time.Time
+}
+
+// rememberHash marks the hash as stored
+func (s *ConnectionManager) rememberHash(hash string) {
+	s.knownHashes.Store(hash, time.Now())
+}
+
+// newestHashes returns up to max known hashes, most recently stored first
+func (s *ConnectionManager) newestHashes(max int) []hashState {
+	var hashes []hashState
+	s.knownHashes.Range(func(k, v any) bool {
+		seen, _ := v.(time.Time)
+		hashes = append(hashes, hashState{hash: k.(string), seen: seen})
+		return true
+	})
+	sort.Slice(hashes, func(i, j int) bool {
+		return hashes[i].seen.After(hashes[j].seen)
+	})
+	if max > 0 && len(hashes) > max {
+		hashes = hashes[:max]
+	}
+	return hashes
+}
+
+// saveHashState writes the newest known hashes to HashStateFile, replacing it
+// only once the new file is complete
+func (s *ConnectionManager) saveHashState() error {
+	if s.config.HashStateFile == "" {
+		return nil
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.config.HashStateFile), ".hashstate-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	hashes := s.newestHashes(s.config.HashStateMax)
+	for _, h := range hashes {
+		fmt.Fprintf(w, "%s %d\n", h.hash, h.seen.Unix())
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.config.HashStateFile); err != nil {
+		return err
+	}
+	s.logger.Info().Int("hashes", len(hashes)).Str("file", s.config.HashStateFile).Msg("saved known hashes")
+	return nil
+}
+
+// loadHashState reads known hashes saved by a previous run, a missing file is not an error
+func (s *ConnectionManager) loadHashState() error {
+	if s.config.HashStateFile == "" {
+		return nil
+	}
+	f, err := os.Open(s.config.HashStateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	loaded := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if s.config.HashStateMax > 0 && loaded >= s.config.HashStateMax {
+			break
+		}
+		hash, unix, ok := strings.Cut(scanner.Text(), " ")
+		if !ok || hash == "" {
+			continue
+		}
+		sec, err := strconv.ParseInt(unix, 10, 64)
+		if err != nil {
+			continue
+		}
+		s.knownHashes.Store(hash, time.Unix(sec, 0))
+		loaded++
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	s.logger.Info().Int("hashes", loaded).Str("file", s.config.HashStateFile).Msg("loaded known hashes")
+	return nil
+}
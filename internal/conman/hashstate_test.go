@@ -0,0 +1,40 @@
+package conman
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/antihax/gambit/internal/conman/config"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashState(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "hashes")
+	cfg := &config.Config{HashStateFile: file, HashStateMax: 2}
+
+	// nothing saved yet is fine
+	s := &ConnectionManager{config: cfg, logger: zerolog.Nop()}
+	assert.NoError(t, s.loadHashState())
+
+	now := time.Now()
+	s.knownHashes.Store("old", now.Add(-time.Hour))
+	s.knownHashes.Store("new", now)
+	s.knownHashes.Store("newer", now.Add(time.Minute))
+	assert.NoError(t, s.saveHashState())
+
+	// only the newest are kept
+	restarted := &ConnectionManager{config: cfg, logger: zerolog.Nop()}
+	assert.NoError(t, restarted.loadHashState())
+	assert.True(t, restarted.rawHashKnown("new"))
+	assert.True(t, restarted.rawHashKnown("newer"))
+	assert.False(t, restarted.rawHashKnown("old"))
+
+	// garbage lines are skipped
+	assert.NoError(t, os.WriteFile(file, []byte("abc 1\nnonsense\n\ndef x\n"), 0600))
+	restarted = &ConnectionManager{config: cfg, logger: zerolog.Nop()}
+	assert.NoError(t, restarted.loadHashState())
+	assert.Len(t, restarted.newestHashes(0), 1)
+}
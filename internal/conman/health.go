@@ -0,0 +1,60 @@
+package conman
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+)
+
+// readiness tracks what must be working before attackers can be served
+type readiness struct {
+	store      atomic.Bool
+	tcpManager atomic.Bool
+	udpManager atomic.Bool
+
+	// the managers are not needed when listening on demand is turned off
+	autoListenDisabled atomic.Bool
+}
+
+// readyStatus is the body of /readyz
+type readyStatus struct {
+	Ready      bool `json:"ready"`
+	Store      bool `json:"store"`
+	TCPManager bool `json:"tcp_manager"`
+	UDPManager bool `json:"udp_manager"`
+	Listeners  int  `json:"listeners"`
+}
+
+func (r *readiness) status() readyStatus {
+	st := readyStatus{
+		Store:      r.store.Load(),
+		TCPManager: r.tcpManager.Load(),
+		UDPManager: r.udpManager.Load(),
+	}
+	st.Ready = st.Store && (r.autoListenDisabled.Load() || st.TCPManager && st.UDPManager)
+	return st
+}
+
+// registerHealth adds the liveness and readiness probes to mux
+func (s *ConnectionManager) registerHealth(mux *http.ServeMux) {
+	mux.HandleFunc("GET /healthz", s.handleHealthz)
+	mux.HandleFunc("GET /readyz", s.handleReadyz)
+}
+
+// handleHealthz answers as long as the process is serving
+func (s *ConnectionManager) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("ok\n"))
+}
+
+// handleReadyz reports whether storage and the raw socket managers are running,
+// along with how many ports are listening
+func (s *ConnectionManager) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	st := s.ready.status()
+	st.Listeners = s.ActiveListenerCount()
+	w.Header().Set("Content-Type", "application/json")
+	if !st.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(st)
+}
@@ -0,0 +1,46 @@
+package conman
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthProbes(t *testing.T) {
+	s := &ConnectionManager{}
+	mux := http.NewServeMux()
+	s.registerHealth(mux)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	assert.Equal(t, http.StatusOK, get("/healthz").Code)
+
+	// not ready until storage and both managers are up
+	s.ready.store.Store(true)
+	s.ready.tcpManager.Store(true)
+	w := get("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	var st readyStatus
+	if assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &st)) {
+		assert.False(t, st.Ready)
+		assert.False(t, st.UDPManager)
+	}
+
+	s.ready.udpManager.Store(true)
+	assert.Equal(t, http.StatusOK, get("/readyz").Code)
+}
+
+func TestReadyWithoutAutoListen(t *testing.T) {
+	var r readiness
+	r.store.Store(true)
+	assert.False(t, r.status().Ready)
+	r.autoListenDisabled.Store(true)
+	assert.True(t, r.status().Ready)
+}
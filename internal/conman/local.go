@@ -1,10 +1,34 @@
 package conman
 
 import (
+	"context"
+	"expvar"
 	"net/http"
-	_ "net/http/pprof" // Force pprof to load
+	"net/http/pprof"
+	"time"
 )
 
-func runPProf() {
-	http.ListenAndServe("localhost:9900", nil)
+// runPProf serves pprof, expvar metrics and the health probes on PprofAddr
+// until ctx is done
+func (s *ConnectionManager) runPProf(ctx context.Context) error {
+	mux := http.NewServeMux()
+	registerProfiling(mux)
+	s.registerHealth(mux)
+
+	s.logger.Info().Str("address", s.config.PprofAddr).Msg("starting profiling")
+	return serveUntil(ctx, &http.Server{
+		Addr:              s.config.PprofAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: time.Second * 10,
+	})
+}
+
+// registerProfiling adds pprof and the expvar metrics to mux
+func registerProfiling(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
 }
@@ -0,0 +1,45 @@
+package logging
+
+import (
+	"context"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// File writes the log to a file, moving it aside once it grows past a size
+// and removing old copies so a long running sensor does not fill its disk
+type File struct {
+	*lumberjack.Logger
+}
+
+// NewFile logs to path, rotating it at maxSizeMB and keeping maxBackups copies
+// for up to maxAgeDays, 0 keeps them regardless. Rotated copies are gzipped if
+// compress is set.
+func NewFile(path string, maxSizeMB, maxBackups, maxAgeDays int, compress bool) *File {
+	return &File{&lumberjack.Logger{
+		Filename:   path,
+		MaxSize:    maxSizeMB,
+		MaxBackups: maxBackups,
+		MaxAge:     maxAgeDays,
+		LocalTime:  true,
+		Compress:   compress,
+	}}
+}
+
+// RotateEvery also rotates the file each interval whatever its size, until
+// ctx is done. Failures are passed to errs if it is set.
+func (f *File) RotateEvery(ctx context.Context, interval time.Duration, errs func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := f.Rotate(); err != nil && errs != nil {
+				errs(err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
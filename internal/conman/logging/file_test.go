@@ -0,0 +1,38 @@
+package logging
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileRotateEvery(t *testing.T) {
+	dir := t.TempDir()
+	f := NewFile(filepath.Join(dir, "conman.log"), 1, 2, 0, false)
+	defer f.Close()
+	logger := zerolog.New(f)
+	logger.Info().Msg("before")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go f.RotateEvery(ctx, time.Millisecond*10, func(err error) { t.Error(err) })
+
+	// the first rotation moves the log aside
+	assert.Eventually(t, func() bool {
+		entries, _ := os.ReadDir(dir)
+		return len(entries) >= 2
+	}, time.Second*5, time.Millisecond*10)
+	cancel()
+
+	logger.Info().Msg("after")
+	current, err := os.ReadFile(filepath.Join(dir, "conman.log"))
+	if assert.NoError(t, err) {
+		assert.Contains(t, string(current), "after")
+		assert.NotContains(t, string(current), "before")
+	}
+}
@@ -0,0 +1,168 @@
+// Package logging provides writers for the structured logs
+package logging
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/antihax/gambit/internal/metrics"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// facilityDaemon is the syslog facility we log as
+	facilityDaemon = 3
+
+	// minBackoff and maxBackoff bound the wait before reconnecting
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+
+	// writeTimeout bounds each write so a stalled server cannot block logging
+	writeTimeout = time.Second * 5
+)
+
+// Syslog writes each log event as an RFC 5424 message with the JSON event as
+// the body. Remote connections are redialled with backoff if they drop, events
+// logged while disconnected are dropped and counted.
+type Syslog struct {
+	network, addr string
+	hostname      string
+	appName       string
+	pid           string
+
+	mu      sync.Mutex
+	conn    net.Conn
+	timeout time.Duration
+	backoff time.Duration
+	retryAt time.Time
+}
+
+// NewSyslog connects to syslog at addr over network, one of udp, tcp, unix or
+// unixgram. The local /dev/log socket is used if network is unix or unixgram
+// and addr is empty.
+func NewSyslog(network, addr, appName string) (*Syslog, error) {
+	if (network == "unix" || network == "unixgram") && addr == "" {
+		addr = "/dev/log"
+	}
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "-"
+	}
+	w := &Syslog{
+		network:  network,
+		addr:     addr,
+		hostname: hostname,
+		appName:  appName,
+		pid:      strconv.Itoa(os.Getpid()),
+		timeout:  writeTimeout,
+	}
+	// fail early on a bad address, later failures are retried
+	if err := w.dial(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *Syslog) dial() error {
+	conn, err := net.DialTimeout(w.network, w.addr, time.Second*5)
+	if err != nil {
+		return err
+	}
+	w.conn = conn
+	w.backoff = 0
+	return nil
+}
+
+// Write logs p at the info severity
+func (w *Syslog) Write(p []byte) (int, error) {
+	return w.WriteLevel(zerolog.InfoLevel, p)
+}
+
+// WriteLevel logs p with the syslog severity matching level
+func (w *Syslog) WriteLevel(level zerolog.Level, p []byte) (int, error) {
+	msg := w.format(level, time.Now(), bytes.TrimRight(p, "\n"))
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.conn == nil {
+		if time.Now().Before(w.retryAt) {
+			metrics.DroppedLogs.Add(1)
+			return len(p), nil
+		}
+		if err := w.dial(); err != nil {
+			w.failed()
+			metrics.DroppedLogs.Add(1)
+			return len(p), nil
+		}
+	}
+	// a timed out write may have sent part of the frame, so the connection is
+	// dropped and redialled like any other failure
+	w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+	if _, err := w.conn.Write(msg); err != nil {
+		w.conn.Close()
+		w.conn = nil
+		w.failed()
+		metrics.DroppedLogs.Add(1)
+	}
+	return len(p), nil
+}
+
+// failed waits longer before each reconnection attempt
+func (w *Syslog) failed() {
+	w.backoff = min(max(w.backoff*2, minBackoff), maxBackoff)
+	w.retryAt = time.Now().Add(w.backoff)
+}
+
+// format builds the message, TCP streams are framed by octet counting (RFC 6587)
+// and local streams by newlines
+func (w *Syslog) format(level zerolog.Level, t time.Time, body []byte) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %s - - ",
+		facilityDaemon*8+severity(level),
+		t.UTC().Format(time.RFC3339Nano),
+		w.hostname, w.appName, w.pid)
+	b.Write(body)
+
+	switch w.network {
+	case "tcp", "tcp4", "tcp6":
+		return append([]byte(strconv.Itoa(b.Len())+" "), b.Bytes()...)
+	case "unix":
+		b.WriteByte('\n')
+	}
+	return b.Bytes()
+}
+
+// severity maps zerolog levels to syslog severities
+func severity(level zerolog.Level) int {
+	switch level {
+	case zerolog.PanicLevel:
+		return 0 // emergency
+	case zerolog.FatalLevel:
+		return 2 // critical
+	case zerolog.ErrorLevel:
+		return 3
+	case zerolog.WarnLevel:
+		return 4
+	case zerolog.InfoLevel, zerolog.NoLevel:
+		return 6
+	default:
+		return 7 // debug and trace
+	}
+}
+
+// Close disconnects from syslog
+func (w *Syslog) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.conn == nil {
+		return nil
+	}
+	err := w.conn.Close()
+	w.conn = nil
+	return err
+}
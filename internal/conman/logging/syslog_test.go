@@ -0,0 +1,97 @@
+package logging
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSyslogUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer pc.Close()
+
+	w, err := NewSyslog("udp", pc.LocalAddr().String(), "conman")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer w.Close()
+
+	logger := zerolog.New(w)
+	logger.Warn().Str("attacker", "192.0.2.1").Str("dstport", "22").Str("hash", "abc").Msg("driver matched")
+
+	buf := make([]byte, 2048)
+	pc.SetReadDeadline(time.Now().Add(time.Second * 5))
+	n, _, err := pc.ReadFrom(buf)
+	if assert.NoError(t, err) {
+		msg := string(buf[:n])
+		assert.True(t, strings.HasPrefix(msg, "<28>1 "), msg) // daemon.warning
+		assert.Contains(t, msg, " conman ")
+		assert.True(t, strings.HasSuffix(msg, `"attacker":"192.0.2.1","dstport":"22","hash":"abc","message":"driver matched"}`), msg)
+	}
+}
+
+func TestSyslogTCPReconnect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer ln.Close()
+
+	w, err := NewSyslog("tcp", ln.Addr().String(), "conman")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer w.Close()
+
+	// the server drops us, the next write fails and backs off
+	conn, err := ln.Accept()
+	if !assert.NoError(t, err) {
+		return
+	}
+	conn.Close()
+	for i := 0; i < 10 && w.conn != nil; i++ {
+		w.Write([]byte(`{"message":"lost"}`))
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.Nil(t, w.conn)
+
+	// once the backoff passes it dials again and frames by octet count
+	w.retryAt = time.Time{}
+	w.Write([]byte(`{"message":"back"}` + "\n"))
+	conn, err = ln.Accept()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	line, _ := bufio.NewReader(conn).ReadString('}')
+	assert.Regexp(t, `^\d+ <30>1 \S+ \S+ conman \d+ - - \{"message":"back"\}$`, line)
+}
+
+func TestSyslogWriteTimeout(t *testing.T) {
+	// nothing reads the other end of the pipe, so the write stalls
+	client, server := net.Pipe()
+	defer server.Close()
+	w := &Syslog{network: "tcp", conn: client, timeout: time.Millisecond * 50}
+
+	done := make(chan struct{})
+	go func() {
+		w.Write([]byte("stalled\n"))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("write blocked past the deadline")
+	}
+	assert.Nil(t, w.conn)
+	assert.True(t, w.retryAt.After(time.Now()))
+}
@@ -0,0 +1,129 @@
+// Package notify delivers events about interesting traffic to external services
+package notify
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/antihax/gambit/internal/metrics"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// webhookQueueSize bounds events waiting for delivery before new ones are dropped
+	webhookQueueSize = 256
+
+	// webhookWorkers sets how many deliveries may be in flight at once
+	webhookWorkers = 2
+
+	// webhookRetries is how many times a failed delivery is retried
+	webhookRetries = 2
+
+	// SnippetSize is the most payload bytes included in an event
+	SnippetSize = 1024
+)
+
+// Event describes a payload hash seen for the first time
+type Event struct {
+	Time      time.Time `json:"time"`
+	Hash      string    `json:"hash"`
+	Network   string    `json:"network"`
+	Attacker  string    `json:"attacker"`
+	DstPort   string    `json:"dstport"`
+	UUID      string    `json:"uuid"`
+	TLSUnwrap bool      `json:"tlsunwrap"`
+	Payload   string    `json:"payload"`
+}
+
+// NewEvent builds an event, encoding the start of the payload as base64
+func NewEvent(hash, network, attacker, dstPort, uuid string, tlsUnwrap bool, payload []byte) Event {
+	if len(payload) > SnippetSize {
+		payload = payload[:SnippetSize]
+	}
+	return Event{
+		Time:      time.Now().UTC(),
+		Hash:      hash,
+		Network:   network,
+		Attacker:  attacker,
+		DstPort:   dstPort,
+		UUID:      uuid,
+		TLSUnwrap: tlsUnwrap,
+		Payload:   base64.StdEncoding.EncodeToString(payload),
+	}
+}
+
+// Webhook POSTs events as JSON to a URL in the background
+type Webhook struct {
+	url     string
+	client  *http.Client
+	queue   chan Event
+	retries int
+	backoff time.Duration
+	logger  zerolog.Logger
+}
+
+// NewWebhook creates a webhook posting to url, giving up on each request after timeout
+func NewWebhook(url string, timeout time.Duration, logger zerolog.Logger) *Webhook {
+	return &Webhook{
+		url:     url,
+		client:  &http.Client{Timeout: timeout},
+		queue:   make(chan Event, webhookQueueSize),
+		retries: webhookRetries,
+		backoff: time.Second,
+		logger:  logger,
+	}
+}
+
+// Start the delivery workers
+func (w *Webhook) Start() {
+	for i := 0; i < webhookWorkers; i++ {
+		go w.deliver()
+	}
+}
+
+// Notify queues an event without blocking, returning false if it was dropped
+func (w *Webhook) Notify(e Event) bool {
+	select {
+	case w.queue <- e:
+		return true
+	default:
+		metrics.DroppedWebhooks.Add(1)
+		return false
+	}
+}
+
+func (w *Webhook) deliver() {
+	for e := range w.queue {
+		body, err := json.Marshal(e)
+		if err != nil {
+			w.logger.Warn().Err(err).Str("hash", e.Hash).Msg("failed encoding webhook")
+			continue
+		}
+
+		err = w.post(body)
+		for attempt := 0; err != nil && attempt < w.retries; attempt++ {
+			time.Sleep(w.backoff << attempt)
+			err = w.post(body)
+		}
+		if err != nil {
+			metrics.DroppedWebhooks.Add(1)
+			w.logger.Warn().Err(err).Str("hash", e.Hash).Msg("dropped webhook")
+		}
+	}
+}
+
+func (w *Webhook) post(body []byte) error {
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
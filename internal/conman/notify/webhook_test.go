@@ -0,0 +1,45 @@
+package notify
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookRetries(t *testing.T) {
+	var calls atomic.Int32
+	got := make(chan Event, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// fail the first attempt to exercise the retry
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var e Event
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&e))
+		got <- e
+	}))
+	defer srv.Close()
+
+	w := NewWebhook(srv.URL, time.Second, zerolog.Nop())
+	w.backoff = time.Millisecond
+	w.Start()
+
+	assert.True(t, w.Notify(NewEvent("abc", "tcp", "1.2.3.4", "80", "uuid", true, []byte("GET /"))))
+
+	select {
+	case e := <-got:
+		assert.Equal(t, "abc", e.Hash)
+		assert.Equal(t, "R0VUIC8=", e.Payload)
+		assert.True(t, e.TLSUnwrap)
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was not delivered")
+	}
+	assert.Equal(t, int32(2), calls.Load())
+}
@@ -0,0 +1,231 @@
+package conman
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/antihax/gambit/internal/store"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// replayIdle is how long to wait for more of a driver's response before finishing a replay
+const replayIdle = time.Second * 2
+
+// replayAttacker is a documentation address so replays are obvious in the logs
+var replayAttacker = &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 31337}
+
+// replayConn is one end of an in memory pipe pretending to be a TCP connection,
+// carrying the store and context its drivers are given in place of the manager's
+type replayConn struct {
+	net.Conn
+	local  net.Addr
+	remote net.Addr
+	store  chan store.File
+	ctx    context.Context
+	once   sync.Once
+	done   chan struct{}
+}
+
+func (c *replayConn) LocalAddr() net.Addr  { return c.local }
+func (c *replayConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *replayConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { close(c.done) })
+	return err
+}
+
+// replayListener stands in for the port listener the connection arrived on
+type replayListener struct {
+	addr net.Addr
+}
+
+func (l replayListener) Accept() (net.Conn, error) { return nil, errors.New("replay listener") }
+func (l replayListener) Close() error              { return nil }
+func (l replayListener) Addr() net.Addr            { return l.addr }
+
+// replayStorer logs captures instead of saving them
+type replayStorer struct {
+	s *ConnectionManager
+}
+
+func (r replayStorer) Name() string { return "replay" }
+
+func (r replayStorer) Store(filename, location string, data []byte) error {
+	r.s.logger.Info().
+		Str("location", location).
+		Str("filename", filename).
+		Int("size", len(data)).
+		Msg("replay stored")
+	return nil
+}
+
+// Replay feeds a stored raw capture, or a pcap of one connection, through the rules
+// and drivers as if it arrived on port, logging what the drivers respond with and
+// store. Captures are logged instead of stored so it must not be used on a manager
+// which is serving traffic. A port of 0 uses the one in the pcap.
+func (s *ConnectionManager) Replay(path string, port uint16) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return s.replay(data, port, replayStorer{s})
+}
+
+// replay feeds data through the drivers, handing whatever they store to st
+func (s *ConnectionManager) replay(data []byte, port uint16, st store.Storer) error {
+	data, pcapPort, err := replayPayload(data)
+	if err != nil {
+		return err
+	}
+	if port == 0 {
+		port = pcapPort
+	}
+
+	// drivers are prepared once, as Run would
+	s.replayOnce.Do(func() {
+		s.replayErr = s.startDrivers(context.Background())
+	})
+	if s.replayErr != nil {
+		return s.replayErr
+	}
+
+	// captures go to st alone, never the configured backends
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan store.File, 100)
+	stop := make(chan struct{})
+	var pump sync.WaitGroup
+	pump.Add(1)
+	go func() {
+		defer pump.Done()
+		for {
+			select {
+			case f := <-ch:
+				s.replayStore(st, f)
+			case <-stop:
+				for {
+					select {
+					case f := <-ch:
+						s.replayStore(st, f)
+					default:
+						return
+					}
+				}
+			}
+		}
+	}()
+
+	client, server := net.Pipe()
+	conn := &replayConn{
+		Conn:   server,
+		local:  &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(port)},
+		remote: replayAttacker,
+		store:  ch,
+		ctx:    ctx,
+		done:   make(chan struct{}),
+	}
+
+	// handle it exactly as a live connection would be
+	var wg sync.WaitGroup
+	wg.Add(1)
+	s.acquireConnection()
+	go s.handleConnection(conn, replayListener{conn.local}, &wg)
+
+	go func() {
+		// an empty capture is an attacker who never speaks, a pipe would deliver an empty read
+		if len(data) == 0 {
+			return
+		}
+		if _, err := client.Write(data); err != nil {
+			s.logger.Debug().Err(err).Msg("error writing replay")
+		}
+	}()
+
+	// read whatever the driver sends back until it goes quiet
+	buf := make([]byte, 1500)
+	for {
+		client.SetReadDeadline(time.Now().Add(replayIdle))
+		n, err := client.Read(buf)
+		if n > 0 {
+			s.logger.Info().Hex("response", buf[:n]).Msg("replay response")
+		}
+		if err != nil {
+			break
+		}
+	}
+	client.Close()
+	wg.Wait()
+
+	// the driver sees the attacker hang up and closes, the reaper closes it otherwise
+	<-conn.done
+	cancel()
+
+	// the pump saves everything queued before it finishes, the channel is left
+	// open as nothing stops a driver storing late
+	close(stop)
+	pump.Wait()
+	return nil
+}
+
+// replayStore hands the whole capture to st
+func (s *ConnectionManager) replayStore(st store.Storer, f store.File) {
+	defer f.Release()
+	r, err := f.Reader()
+	if err != nil {
+		s.logger.Warn().Err(err).Str("filename", f.Filename).Msg("error reading replay capture")
+		return
+	}
+	data, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		s.logger.Warn().Err(err).Str("filename", f.Filename).Msg("error reading replay capture")
+		return
+	}
+	if err := st.Store(f.Filename, f.Location, data); err != nil {
+		s.logger.Warn().Err(err).Str("filename", f.Filename).Msg("error storing replay capture")
+	}
+}
+
+// replayPayload returns what the attacker sent and the port it was sent to when
+// data is a pcap, such as those saved by CapturePcap, otherwise data is already
+// what was sent. The attacker is whoever sent the first packet.
+func replayPayload(data []byte) ([]byte, uint16, error) {
+	r, err := pcapgo.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return data, 0, nil
+	}
+	var payload []byte
+	var attacker gopacket.Endpoint
+	var port uint16
+	for {
+		pkt, _, err := r.ReadPacketData()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, 0, err
+		}
+		p := gopacket.NewPacket(pkt, r.LinkType(), gopacket.Default)
+		transport := p.TransportLayer()
+		if transport == nil {
+			continue
+		}
+		flow := transport.TransportFlow()
+		if port == 0 {
+			attacker = flow.Src()
+			port = binary.BigEndian.Uint16(flow.Dst().Raw())
+		}
+		if flow.Src() == attacker {
+			payload = append(payload, transport.LayerPayload()...)
+		}
+	}
+	return payload, port, nil
+}
@@ -0,0 +1,97 @@
+package conman
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/antihax/gambit/internal/conman/config"
+	"github.com/antihax/gambit/internal/conman/security"
+	"github.com/antihax/gambit/internal/drivers"
+	"github.com/antihax/gambit/internal/muxconn"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordPcap records a pcap of one loopback connection carrying request
+func recordPcap(t *testing.T, request string) []byte {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	muc, _ := muxconn.NewMuxConn(context.Background(), server)
+	muc.CapturePcap(0)
+
+	client.Write([]byte(request))
+	if _, err := io.ReadFull(muc, make([]byte, len(request))); err != nil {
+		t.Fatal(err)
+	}
+	muc.Write([]byte("ok\r\n"))
+	muc.Close()
+	data, _ := muc.Pcap()
+	return data
+}
+
+func TestReplayPcap(t *testing.T) {
+	request := "hello from a replay\r\n"
+	data := recordPcap(t, request)
+
+	payload, port, err := replayPayload(data)
+	if assert.NoError(t, err) {
+		assert.Equal(t, request, string(payload))
+		assert.NotZero(t, port)
+	}
+
+	// raw captures are replayed as they are
+	payload, port, err = replayPayload([]byte(request))
+	assert.NoError(t, err)
+	assert.Equal(t, request, string(payload))
+	assert.Zero(t, port)
+
+	catchAll := drivers.Get("catchall")
+	proxy := muxconn.NewProxy(10)
+	defer proxy.Close()
+	go catchAll.(drivers.TCPDriver).ServeTCP(proxy)
+	cfg, err := config.LoadConfig("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	cfg.CatchAllDriver = "catchall"
+	s := newRunTestManager(cfg)
+	s.connCtx = context.Background()
+	s.banList = security.NewBanManager(cfg.BanThreshold, time.Duration(cfg.BanWindow)*time.Second, cfg.BanSubnetThreshold)
+	s.tcpProxies = map[drivers.Driver]muxconn.Proxy{catchAll: proxy}
+	s.rules.Store(s.buildRules(s.config))
+	live := s.storeChan
+
+	m := &memStorer{files: make(map[string][]byte)}
+	if !assert.NoError(t, s.replay(data, 0, m)) {
+		return
+	}
+
+	// what was sent is stored raw and in the driver's session, only in the replay storer
+	var raw, session bool
+	for name, data := range m.files {
+		switch {
+		case strings.HasPrefix(name, "raw/"):
+			raw = assert.Equal(t, request, string(data))
+		case strings.HasPrefix(name, "sessions/"):
+			session = assert.Equal(t, request, string(data))
+		}
+	}
+	assert.True(t, raw, "raw capture stored")
+	assert.True(t, session, "session stored")
+	assert.Equal(t, live, s.storeChan)
+}
@@ -0,0 +1,212 @@
+package conman
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/antihax/gambit/internal/conman/config"
+	"github.com/antihax/gambit/internal/drivers"
+	"github.com/antihax/gambit/internal/muxconn"
+	"github.com/antihax/gambit/pkg/searchtree"
+)
+
+// ruleSet routes first bytes to drivers and holds the banners to coax them out.
+// It is never modified once published so it can be swapped while in use.
+type ruleSet struct {
+	// config the rules were built from, banner settings are read from here so
+	// they change together with the rules on reload
+	config      *config.Config
+	tcp         searchtree.Tree
+	udp         searchtree.Tree
+	banners     map[uint16]banner
+	ports       map[uint16]*route
+	fallback    map[uint16]*route
+	alpn        map[string]*route
+	catchAll    *route
+	tcpPatterns int
+	udpPatterns int
+}
+
+// banner is sent on a port and where it came from, a driver or the config
+type banner struct {
+	data   []byte
+	source string
+}
+
+// route is where a match sends the connection, one of proxy or handler is set
+type route struct {
+	name    string
+	proxy   *muxconn.Proxy
+	handler drivers.UDPHandlerDriver
+}
+
+func newRuleSet(cfg *config.Config) *ruleSet {
+	return &ruleSet{
+		config:   cfg,
+		tcp:      searchtree.NewTree(),
+		udp:      searchtree.NewTree(),
+		banners:  make(map[uint16]banner),
+		ports:    make(map[uint16]*route),
+		fallback: make(map[uint16]*route),
+		alpn:     make(map[string]*route),
+	}
+}
+
+// addTCP routes the patterns, already checked by validPatterns, to a TCP driver
+func (r *ruleSet) addTCP(patterns []searchtree.Pattern, driver *route, priority int) {
+	for _, p := range patterns {
+		r.tcp.InsertPattern(p, driver, priority)
+	}
+	r.tcpPatterns += len(patterns)
+}
+
+// addUDP routes the patterns, already checked by validPatterns, to a UDP driver
+func (r *ruleSet) addUDP(patterns []searchtree.Pattern, driver *route, priority int) {
+	for _, p := range patterns {
+		r.udp.InsertPattern(p, driver, priority)
+	}
+	r.udpPatterns += len(patterns)
+}
+
+// validPatterns checks every pattern before any are routed, so a driver is
+// either routed completely or not at all
+func validPatterns(patterns []searchtree.Pattern) error {
+	for _, p := range patterns {
+		if err := p.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// buildRules asks each driver for its current patterns and banners, routing
+// to the proxies already serving them, and adds those configured in cfg
+func (s *ConnectionManager) buildRules(cfg *config.Config) *ruleSet {
+	rules := newRuleSet(cfg)
+	for _, d := range drivers.GetDrivers() {
+		patterns := drivers.GetPatterns(d)
+		priority := drivers.GetPriority(d)
+		if err := validPatterns(patterns); err != nil {
+			s.logger.Error().Err(err).Str("driver", d.Name()).Msg("rejecting driver with an invalid pattern")
+			continue
+		}
+
+		if proxy, ok := s.tcpProxies[d]; ok {
+			rt := &route{name: d.Name(), proxy: &proxy}
+			rules.addTCP(patterns, rt, priority)
+
+			// drivers taking whole ports
+			if handler, ok := d.(drivers.PortDriver); ok {
+				for _, port := range handler.Ports() {
+					rules.ports[port] = rt
+				}
+			}
+
+			// drivers taking silent connections to their ports
+			if handler, ok := d.(drivers.FallbackPortDriver); ok {
+				for _, port := range handler.FallbackPorts() {
+					rules.fallback[port] = rt
+				}
+			}
+
+			// drivers taking TLS connections by the protocol agreed
+			if handler, ok := d.(drivers.ALPNDriver); ok {
+				for _, proto := range handler.ALPN() {
+					rules.alpn[proto] = rt
+				}
+			}
+
+			// the driver taking anything unmatched
+			if d.Name() == cfg.CatchAllDriver {
+				rules.catchAll = rt
+			}
+		}
+		if proxy, ok := s.udpProxies[d]; ok {
+			rules.addUDP(patterns, &route{name: d.Name(), proxy: &proxy}, priority)
+		} else if handler, ok := d.(drivers.UDPHandlerDriver); ok {
+			rules.addUDP(patterns, &route{name: d.Name(), handler: handler}, priority)
+		}
+
+		// copy the banners to a map
+		if handler, ok := d.(drivers.TCPBannerDriver); ok {
+			if ports, data := handler.Banner(); len(ports) > 0 {
+				for _, port := range ports {
+					rules.banners[port] = banner{data: data, source: d.Name()}
+				}
+			}
+		}
+	}
+
+	if cfg.CatchAllDriver != "" && rules.catchAll == nil {
+		s.logger.Warn().Str("driver", cfg.CatchAllDriver).Msg("catch all driver not found")
+	}
+
+	// configured banners win over the drivers'
+	for port, data := range cfg.Banners {
+		rules.banners[port] = banner{data: data, source: "config"}
+	}
+	return rules
+}
+
+// Reload re-reads the configuration from the environment and any config file,
+// then rebuilds the rules and banners from it and the drivers. The rules and
+// the banner settings are swapped in together without disturbing listeners or
+// connections in progress. An invalid configuration is refused, keeping the
+// current one. Other settings such as ports and storage need a restart.
+func (s *ConnectionManager) Reload() error {
+	cfg, err := config.LoadConfig(s.configPath)
+	if err != nil {
+		return err
+	}
+	rules := s.buildRules(cfg)
+	old := s.rules.Swap(rules)
+
+	added, removed, changed := 0, 0, 0
+	for port, banner := range rules.banners {
+		if prev, ok := old.banners[port]; !ok {
+			added++
+		} else if !bytes.Equal(prev.data, banner.data) {
+			changed++
+		}
+	}
+	for port := range old.banners {
+		if _, ok := rules.banners[port]; !ok {
+			removed++
+		}
+	}
+
+	s.logger.Info().
+		Int("tcp_patterns", rules.tcpPatterns).
+		Int("tcp_patterns_delta", rules.tcpPatterns-old.tcpPatterns).
+		Int("udp_patterns", rules.udpPatterns).
+		Int("udp_patterns_delta", rules.udpPatterns-old.udpPatterns).
+		Int("banners", len(rules.banners)).
+		Int("banners_added", added).
+		Int("banners_removed", removed).
+		Int("banners_changed", changed).
+		Int("fallback_ports", len(rules.fallback)).
+		Bool("catch_all", rules.catchAll != nil).
+		Int("banner_delay", cfg.BannerDelay).
+		Msg("reloaded rules")
+	return nil
+}
+
+// watchReload reloads the configuration and rules on SIGHUP until ctx is done
+func (s *ConnectionManager) watchReload(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-hup:
+			if err := s.Reload(); err != nil {
+				s.logger.Error().Err(err).Msg("error reloading, keeping the current configuration")
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
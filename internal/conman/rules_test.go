@@ -0,0 +1,155 @@
+package conman
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/antihax/gambit/internal/conman/config"
+	"github.com/antihax/gambit/internal/drivers"
+	"github.com/antihax/gambit/internal/muxconn"
+	"github.com/antihax/gambit/pkg/searchtree"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "conman.json")
+	write := func(data string) {
+		if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"Banners": {"2222": "SSH-2.0-first\\r\\n"}}`)
+	cfg, err := config.LoadConfig(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	catchAll := muxconn.NewProxy(1)
+	defer catchAll.Close()
+	s := &ConnectionManager{
+		config:     cfg,
+		configPath: path,
+		logger:     zerolog.Nop(),
+		tcpProxies: map[drivers.Driver]muxconn.Proxy{drivers.Get("catchall"): catchAll},
+		udpProxies: make(map[drivers.Driver]muxconn.Proxy),
+	}
+	s.rules.Store(s.buildRules(cfg))
+	assert.Equal(t, "SSH-2.0-first\r\n", string(s.rules.Load().banners[2222].data))
+	assert.Nil(t, s.rules.Load().catchAll)
+
+	// edits to the file are picked up
+	write(`{"Banners": {"2222": "SSH-2.0-second\\r\\n"}, "BannerDelay": 0, "CatchAllDriver": "catchall"}`)
+	if !assert.NoError(t, s.Reload()) {
+		return
+	}
+	rules := s.rules.Load()
+	assert.Equal(t, "SSH-2.0-second\r\n", string(rules.banners[2222].data))
+	if assert.NotNil(t, rules.catchAll) {
+		assert.Equal(t, "catchall", rules.catchAll.name)
+	}
+
+	// and the new banner is sent without the old delay
+	client, server := net.Pipe()
+	defer client.Close()
+	muc, err := muxconn.NewMuxConn(context.Background(), server)
+	if !assert.NoError(t, err) {
+		return
+	}
+	go s.sendBanner(context.Background(), rules, muc, 2222)
+	client.SetDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 64)
+	n, _ := client.Read(buf)
+	assert.Equal(t, "SSH-2.0-second\r\n", string(buf[:n]))
+
+	// an invalid file is refused and the rules kept
+	write(`{"LogFormat": "xml"}`)
+	assert.ErrorContains(t, s.Reload(), "LogFormat")
+	assert.Same(t, rules, s.rules.Load())
+}
+
+func TestStartDriversRoutesConfiguredPorts(t *testing.T) {
+	t.Setenv("CONMAN_DRIVERS", `{"relay": {"backends": {"3306": "10.0.0.5:3306"}}}`)
+	cfg, err := config.LoadConfig("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	relay := muxconn.NewProxy(1)
+	defer relay.Close()
+	s := &ConnectionManager{
+		config:     cfg,
+		logger:     zerolog.Nop(),
+		tcpProxies: map[drivers.Driver]muxconn.Proxy{drivers.Get("relay"): relay},
+		udpProxies: make(map[drivers.Driver]muxconn.Proxy),
+	}
+	s.rules.Store(s.buildRules(cfg))
+	assert.NotContains(t, s.rules.Load().ports, uint16(3306))
+
+	// the relay takes its ports from its settings as it starts
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if !assert.NoError(t, s.startDrivers(ctx)) {
+		return
+	}
+	defer drivers.StopDrivers(drivers.GetDrivers())
+	if rt, ok := s.rules.Load().ports[3306]; assert.True(t, ok) {
+		assert.Equal(t, "relay", rt.name)
+	}
+}
+
+func TestValidPatterns(t *testing.T) {
+	good := searchtree.Pattern{Bytes: []byte{0x03, 0x00}, Mask: []byte{0xff, 0x00}}
+	bad := searchtree.Pattern{Bytes: []byte{0x03, 0x00}, Mask: []byte{0xff}}
+	assert.NoError(t, validPatterns([]searchtree.Pattern{good}))
+	// one bad pattern rejects the whole driver
+	assert.ErrorIs(t, validPatterns([]searchtree.Pattern{good, bad}), searchtree.ErrMaskLength)
+}
+
+func TestRulesCanonicalPackets(t *testing.T) {
+	s := &ConnectionManager{
+		logger:     zerolog.Nop(),
+		tcpProxies: make(map[drivers.Driver]muxconn.Proxy),
+		udpProxies: make(map[drivers.Driver]muxconn.Proxy),
+	}
+	for _, d := range drivers.GetDrivers() {
+		if _, ok := d.(drivers.TCPDriver); ok {
+			s.tcpProxies[d] = muxconn.NewProxy(1)
+		}
+	}
+	rules := s.buildRules(&config.Config{})
+	matched := func(data []byte) string {
+		if rt, ok := rules.tcp.Match(data).(*route); ok {
+			return rt.name
+		}
+		return ""
+	}
+
+	// a client hello as crypto/tls sends it
+	client, server := net.Pipe()
+	defer server.Close()
+	go tls.Client(client, &tls.Config{ServerName: "example.com"}).Handshake()
+	server.SetDeadline(time.Now().Add(time.Second * 5))
+	buf := make([]byte, 4096)
+	n, err := server.Read(buf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	client.Close()
+
+	// X.224 connection request with a cookie which happens to carry another driver's pattern
+	rdp := append([]byte{0x03, 0x00, 0x00, 0x2f, 0x2a, 0xe0, 0, 0, 0, 0, 0}, "Cookie: mstshash=USER admin\r\n\x01\x00\x08\x00\x03\x00\x00\x00"...)
+	assert.Equal(t, "rdp", matched(rdp))
+	assert.Equal(t, "rdp", matched([]byte{0x03, 0x00, 0x00, 0x13, 0x0e, 0xe0, 0, 0, 0, 0, 0, 0x01, 0x00, 0x08, 0x00, 0x03, 0x00, 0x00, 0x00}))
+	// the hello is unwrapped before routing, nothing claims it even when the
+	// random happens to hold a TPKT header
+	hello := buf[:n]
+	assert.Equal(t, "", matched(hello))
+	copy(hello[11:], []byte{0x03, 0x00, 0x00})
+	assert.Equal(t, "", matched(hello))
+	assert.Equal(t, "http", matched([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")))
+}
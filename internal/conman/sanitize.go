@@ -2,6 +2,7 @@ package conman
 
 import (
 	"bytes"
+	"io"
 	"net"
 	"strings"
 )
@@ -30,3 +31,36 @@ func (s *ConnectionManager) Sanitize(data []byte) []byte {
 	}
 	return data
 }
+
+// sanitizeStream copies src to dst through Sanitize, holding back the tail of
+// each read so addresses split between reads are still found
+func (s *ConnectionManager) sanitizeStream(dst io.Writer, src io.Reader) error {
+	if !s.config.Sanitize || len(s.addresses) == 0 {
+		_, err := io.Copy(dst, src)
+		return err
+	}
+	keep := 0
+	for _, ip := range s.addresses {
+		keep = max(keep, len(ip)-1, len(ip.String())-1)
+	}
+
+	buf := make([]byte, 32*1024)
+	var pending []byte
+	for {
+		n, err := src.Read(buf)
+		pending = s.Sanitize(append(pending, buf[:n]...))
+		if err == io.EOF {
+			_, err = dst.Write(pending)
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		if len(pending) > keep {
+			if _, err := dst.Write(pending[:len(pending)-keep]); err != nil {
+				return err
+			}
+			pending = append(pending[:0], pending[len(pending)-keep:]...)
+		}
+	}
+}
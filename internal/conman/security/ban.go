@@ -2,55 +2,302 @@
 package security
 
 import (
+	"context"
+	"net/netip"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 )
 
-// BanManager is a struct that manages a list of banned IP addresses and their ban status.
-// It uses a sync.Map to store the last known addresses and a timeout duration for the ban period.
+// BanManager bans addresses which connect more than the threshold number of
+// times within a window. Hits are counted in a window starting at the first,
+// and a ban lasts for one window from when the threshold was crossed, so an
+// address which goes quiet is forgiven.
+//
+// Addresses and networks may also be banned by hand, these are kept until
+// they are removed or the duration they were given passes. If enabled, a
+// whole /24, or /64 for IPv6, is banned for a window once enough of its
+// addresses are banned within one.
 type BanManager struct {
-	lastAddress sync.Map
-	banCount    int
+	threshold       int
+	window          time.Duration
+	subnetThreshold int
+
+	mu      sync.Mutex
+	entries map[string]*banEntry
+	// banned networks, by hand or from their addresses being banned
+	networks prefixTrie[networkBan]
+	// addresses banned in each subnet, while counting towards a subnet ban
+	subnets map[netip.Prefix]*subnetEntry
+}
+
+// Ban is a banned address or network
+type Ban struct {
+	Address string `json:"address"`
+	// Count is the hits in the current window of an automatic ban
+	Count int `json:"count,omitempty"`
+	// Until is when the ban ends, nil if it is kept until removed
+	Until  *time.Time `json:"until,omitempty"`
+	Manual bool       `json:"manual"`
+}
+
+type banEntry struct {
+	// hits since the window started
+	count int
+	start time.Time
+	// banned until, zero if not banned
+	until time.Time
 }
 
-// NewBanManager creates a new BanManager
-func NewBanManager(banCount int) *BanManager {
+type networkBan struct {
+	// ends at, zero if never
+	until  time.Time
+	manual bool
+}
+
+type subnetEntry struct {
+	start time.Time
+	addrs map[netip.Addr]struct{}
+}
+
+// NewBanManager creates a BanManager allowing threshold hits an address per
+// window, and banning a subnet once subnetThreshold of its addresses are
+// banned in a window, never if 0
+func NewBanManager(threshold int, window time.Duration, subnetThreshold int) *BanManager {
 	return &BanManager{
-		banCount: banCount,
+		threshold:       threshold,
+		window:          window,
+		subnetThreshold: subnetThreshold,
+		entries:         make(map[string]*banEntry),
+		subnets:         make(map[netip.Prefix]*subnetEntry),
 	}
 }
 
-// clearBanlist removes all entries in the banlist
-func (s *BanManager) clearBanlist() {
-	s.lastAddress.Range(func(key interface{}, value interface{}) bool {
-		s.lastAddress.Delete(key)
+// TickBanCounter counts a hit from ipAddress and returns true if it is banned
+func (s *BanManager) TickBanCounter(ipAddress string) bool {
+	return s.tick(ipAddress, time.Now())
+}
+
+func (s *BanManager) tick(ipAddress string, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.networkBanned(ipAddress, now) {
+		return true
+	}
+	e := s.entries[ipAddress]
+	if e == nil {
+		e = &banEntry{start: now}
+		s.entries[ipAddress] = e
+	}
+	if e.banned(now) {
 		return true
+	}
+	s.count(e, now)
+	if e.count > s.threshold {
+		e.until = now.Add(s.window)
+		s.countSubnet(ipAddress, now)
+		return true
+	}
+	return false
+}
+
+// count adds a hit, starting a new window if the last has passed
+func (s *BanManager) count(e *banEntry, now time.Time) {
+	if now.Sub(e.start) >= s.window {
+		e.count, e.start = 0, now
+	}
+	e.count++
+}
+
+// countSubnet records a newly banned address against its subnet, banning the
+// subnet if enough of its addresses have been. The lock must be held.
+func (s *BanManager) countSubnet(ipAddress string, now time.Time) {
+	if s.subnetThreshold < 1 {
+		return
+	}
+	addr, err := netip.ParseAddr(ipAddress)
+	if err != nil {
+		return
+	}
+	addr = addr.Unmap()
+	bits := 64
+	if addr.Is4() {
+		bits = 24
+	}
+	subnet, _ := addr.Prefix(bits)
+
+	e := s.subnets[subnet]
+	if e == nil || now.Sub(e.start) >= s.window {
+		e = &subnetEntry{start: now, addrs: make(map[netip.Addr]struct{})}
+		s.subnets[subnet] = e
+	}
+	e.addrs[addr] = struct{}{}
+	if len(e.addrs) < s.subnetThreshold {
+		return
+	}
+	delete(s.subnets, subnet)
+	// never shorten a manual ban
+	if existing, ok := s.networks.get(subnet); ok && existing.manual {
+		return
+	}
+	s.networks.insert(subnet, networkBan{until: now.Add(s.window)})
+}
+
+func (e *banEntry) banned(now time.Time) bool {
+	return now.Before(e.until)
+}
+
+func (b networkBan) active(now time.Time) bool {
+	return b.until.IsZero() || now.Before(b.until)
+}
+
+// BanCount returns the hits from ipAddress in the current window
+func (s *BanManager) BanCount(ipAddress string) int {
+	return s.banCount(ipAddress, time.Now())
+}
+
+func (s *BanManager) banCount(ipAddress string, now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.entries[ipAddress]
+	if e == nil || now.Sub(e.start) >= s.window {
+		return 0
+	}
+	return e.count
+}
+
+// IsBanned returns true if ipAddress is currently banned
+func (s *BanManager) IsBanned(ipAddress string) bool {
+	return s.isBanned(ipAddress, time.Now())
+}
+
+func (s *BanManager) isBanned(ipAddress string, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.entries[ipAddress]
+	return e != nil && e.banned(now) || s.networkBanned(ipAddress, now)
+}
+
+// networkBanned returns true if ipAddress is within a banned network, the lock must be held
+func (s *BanManager) networkBanned(ipAddress string, now time.Time) bool {
+	if s.networks.len() == 0 {
+		return false
+	}
+	addr, err := netip.ParseAddr(ipAddress)
+	if err != nil {
+		return false
+	}
+	return s.networks.match(addr, func(_ netip.Prefix, b networkBan) bool {
+		return b.active(now)
 	})
 }
 
-// TickBanCounter increases the count on an IP list to prep for a ban
-func (s *BanManager) TickBanCounter(ipAddress string) bool {
-	var c int
-	count, ok := s.lastAddress.Load(ipAddress)
-	if ok {
-		if count.(int) > s.banCount {
-			return true
+// AddBan bans an address or network such as "198.51.100.0/24" for duration,
+// or until it is removed if duration is 0
+func (s *BanManager) AddBan(cidr string, duration time.Duration) error {
+	prefix, err := ParsePrefix(cidr)
+	if err != nil {
+		return err
+	}
+	ban := networkBan{manual: true}
+	if duration > 0 {
+		ban.until = time.Now().Add(duration)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.networks.insert(prefix, ban)
+	return nil
+}
+
+// RemoveBan lifts a ban on the address or network, returning false if there
+// was none
+func (s *BanManager) RemoveBan(cidr string) bool {
+	prefix, err := ParsePrefix(cidr)
+	if err != nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	found := s.networks.delete(prefix)
+	if prefix.IsSingleIP() {
+		if _, ok := s.entries[prefix.Addr().String()]; ok {
+			delete(s.entries, prefix.Addr().String())
+			found = true
+		}
+	}
+	return found
+}
+
+// Bans lists the current bans of networks and addresses, by address
+func (s *BanManager) Bans() []Ban {
+	return s.bans(time.Now())
+}
+
+func (s *BanManager) bans(now time.Time) []Ban {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var bans []Ban
+	s.networks.walk(func(prefix netip.Prefix, b networkBan) {
+		if !b.active(now) {
+			return
+		}
+		ban := Ban{Address: prefix.String(), Manual: b.manual}
+		if !b.until.IsZero() {
+			ban.Until = &b.until
+		}
+		bans = append(bans, ban)
+	})
+	for ip, e := range s.entries {
+		if e.banned(now) {
+			until := e.until
+			bans = append(bans, Ban{Address: ip, Count: e.count, Until: &until})
 		}
-		c = count.(int)
-		c++
 	}
-	s.lastAddress.Store(ipAddress, c)
+	slices.SortFunc(bans, func(a, b Ban) int {
+		return strings.Compare(a.Address, b.Address)
+	})
+	return bans
+}
 
-	return false
+// collect forgets addresses whose window and ban have both passed, subnets
+// whose window has passed, and network bans which have ended
+func (s *BanManager) collect(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ip, e := range s.entries {
+		if !e.banned(now) && now.Sub(e.start) >= s.window {
+			delete(s.entries, ip)
+		}
+	}
+	for subnet, e := range s.subnets {
+		if now.Sub(e.start) >= s.window {
+			delete(s.subnets, subnet)
+		}
+	}
+	var ended []netip.Prefix
+	s.networks.walk(func(prefix netip.Prefix, b networkBan) {
+		if !b.active(now) {
+			ended = append(ended, prefix)
+		}
+	})
+	for _, prefix := range ended {
+		s.networks.delete(prefix)
+	}
 }
 
-// Start ticks the banlist managers
-func (s *BanManager) Start() {
-	ticker := time.NewTicker(60 * time.Second)
+// Start periodically forgets expired addresses so the list does not grow unbounded
+func (s *BanManager) Start(ctx context.Context) {
+	ticker := time.NewTicker(s.window)
 	go func() {
+		defer ticker.Stop()
 		for {
-			<-ticker.C
-			s.clearBanlist()
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.collect(time.Now())
+			}
 		}
 	}()
 }
@@ -0,0 +1,151 @@
+package security
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBanThreshold(t *testing.T) {
+	b := NewBanManager(3, time.Minute, 0)
+	now := time.Now()
+
+	// up to the threshold is allowed, one more is banned
+	for i := 1; i <= 3; i++ {
+		assert.False(t, b.tick("192.0.2.1", now))
+		assert.Equal(t, i, b.banCount("192.0.2.1", now))
+	}
+	assert.False(t, b.isBanned("192.0.2.1", now))
+	assert.True(t, b.tick("192.0.2.1", now))
+	assert.True(t, b.isBanned("192.0.2.1", now))
+
+	// others are counted separately
+	assert.False(t, b.tick("192.0.2.2", now))
+	assert.Equal(t, 1, b.banCount("192.0.2.2", now))
+	assert.Equal(t, 0, b.banCount("192.0.2.3", now))
+}
+
+func TestBanWindow(t *testing.T) {
+	b := NewBanManager(2, time.Minute, 0)
+	now := time.Now()
+
+	// hits spread over windows never reach the threshold
+	for i := 0; i < 5; i++ {
+		at := now.Add(time.Duration(i) * time.Minute)
+		assert.False(t, b.tick("192.0.2.1", at))
+		assert.False(t, b.tick("192.0.2.1", at))
+	}
+
+	// a ban lasts a window from when it started then the address is forgiven
+	assert.False(t, b.tick("192.0.2.2", now))
+	assert.False(t, b.tick("192.0.2.2", now))
+	banned := now.Add(time.Second * 30)
+	assert.True(t, b.tick("192.0.2.2", banned))
+	assert.True(t, b.tick("192.0.2.2", banned.Add(time.Second*59)))
+	assert.False(t, b.isBanned("192.0.2.2", banned.Add(time.Minute)))
+	assert.Equal(t, 0, b.banCount("192.0.2.2", banned.Add(time.Minute)))
+	assert.False(t, b.tick("192.0.2.2", banned.Add(time.Minute)))
+
+}
+
+func TestBanCollect(t *testing.T) {
+	b := NewBanManager(2, time.Minute, 0)
+	now := time.Now()
+
+	// expired addresses are forgotten but bans are kept
+	b.tick("192.0.2.1", now)
+	b.tick("192.0.2.2", now)
+	b.tick("192.0.2.2", now)
+	b.tick("192.0.2.2", now.Add(time.Second*59))
+	b.collect(now.Add(time.Second * 90))
+	assert.NotContains(t, b.entries, "192.0.2.1")
+	assert.Contains(t, b.entries, "192.0.2.2")
+}
+
+func TestManualBans(t *testing.T) {
+	b := NewBanManager(100, time.Minute, 0)
+	now := time.Now()
+
+	assert.NoError(t, b.AddBan("198.51.100.0/24", 0))
+	assert.NoError(t, b.AddBan("192.0.2.7", time.Hour))
+	assert.Error(t, b.AddBan("not an address", 0))
+
+	assert.True(t, b.tick("198.51.100.42", now))
+	assert.True(t, b.isBanned("::ffff:198.51.100.1", now))
+	assert.True(t, b.isBanned("192.0.2.7", now))
+	assert.False(t, b.isBanned("192.0.2.8", now))
+
+	bans := b.bans(now)
+	if assert.Len(t, bans, 2) {
+		assert.Equal(t, "192.0.2.7/32", bans[0].Address)
+		assert.NotNil(t, bans[0].Until)
+		assert.Equal(t, "198.51.100.0/24", bans[1].Address)
+		assert.Nil(t, bans[1].Until)
+		assert.True(t, bans[1].Manual)
+	}
+
+	// the sweep only removes manual bans which were given a duration
+	later := now.Add(time.Hour * 2)
+	b.collect(later)
+	assert.False(t, b.isBanned("192.0.2.7", later))
+	assert.True(t, b.isBanned("198.51.100.42", later))
+
+	assert.True(t, b.RemoveBan("198.51.100.0/24"))
+	assert.False(t, b.RemoveBan("198.51.100.0/24"))
+	assert.False(t, b.isBanned("198.51.100.42", later))
+
+	// automatic bans can be lifted too
+	b = NewBanManager(0, time.Minute, 0)
+	assert.True(t, b.tick("192.0.2.1", now))
+	bans = b.bans(now)
+	if assert.Len(t, bans, 1) {
+		assert.Equal(t, Ban{Address: "192.0.2.1", Count: 1, Until: bans[0].Until}, bans[0])
+		assert.Equal(t, now.Add(time.Minute), *bans[0].Until)
+	}
+	assert.True(t, b.RemoveBan("192.0.2.1"))
+	assert.False(t, b.isBanned("192.0.2.1", now))
+}
+
+func TestSubnetBans(t *testing.T) {
+	b := NewBanManager(0, time.Minute, 3)
+	now := time.Now()
+
+	// two banned addresses in a /24 are not enough, nor is one elsewhere
+	assert.True(t, b.tick("203.0.113.1", now))
+	assert.True(t, b.tick("203.0.113.2", now))
+	assert.True(t, b.tick("203.0.113.2", now))
+	assert.True(t, b.tick("198.51.100.3", now))
+	assert.False(t, b.isBanned("203.0.113.9", now))
+
+	// the third bans the subnet for a window
+	assert.True(t, b.tick("203.0.113.3", now))
+	assert.True(t, b.isBanned("203.0.113.9", now))
+	assert.False(t, b.isBanned("203.0.114.9", now))
+	bans := b.bans(now)
+	if assert.Len(t, bans, 5) {
+		assert.Equal(t, Ban{Address: "203.0.113.0/24", Until: bans[1].Until}, bans[1])
+	}
+	assert.False(t, b.isBanned("203.0.113.9", now.Add(time.Minute)))
+
+	// addresses banned windows apart do not add up
+	b.tick("2001:db8::1", now)
+	b.tick("2001:db8::2", now)
+	b.tick("2001:db8::3", now.Add(time.Minute*2))
+	assert.False(t, b.isBanned("2001:db8::4", now.Add(time.Minute*2)))
+	b.tick("2001:db8::4", now.Add(time.Minute*2))
+	b.tick("2001:db8::5", now.Add(time.Minute*2))
+	assert.True(t, b.isBanned("2001:db8::ffff", now.Add(time.Minute*2)))
+
+	// ended subnet bans are collected, manual bans are not replaced
+	b.collect(now.Add(time.Minute * 10))
+	assert.Equal(t, 0, b.networks.len())
+	assert.NoError(t, b.AddBan("2001:db8::/64", 0))
+	for i := 1; i <= 3; i++ {
+		b.countSubnet(fmt.Sprintf("2001:db8::%d", i), now)
+	}
+	ban, _ := b.networks.get(netip.MustParsePrefix("2001:db8::/64"))
+	assert.True(t, ban.manual)
+}
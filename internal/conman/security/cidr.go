@@ -0,0 +1,72 @@
+package security
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// CIDRSet matches addresses against a list of IPv4 and IPv6 networks.
+// A nil set contains nothing.
+type CIDRSet struct {
+	prefixes []netip.Prefix
+}
+
+// NewCIDRSet parses networks such as "10.0.0.0/8" or "2001:db8::/32", bare addresses match a single host
+func NewCIDRSet(cidrs []string) (*CIDRSet, error) {
+	set := &CIDRSet{}
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		prefix, err := ParsePrefix(cidr)
+		if err != nil {
+			return nil, err
+		}
+		set.prefixes = append(set.prefixes, prefix)
+	}
+	return set, nil
+}
+
+// ParsePrefix parses a network such as "10.0.0.0/8", or a bare address as a single host
+func ParsePrefix(cidr string) (netip.Prefix, error) {
+	if !strings.Contains(cidr, "/") {
+		addr, err := netip.ParseAddr(cidr)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return prefix.Masked(), nil
+}
+
+// Contains returns true if ip is in any of the networks
+func (s *CIDRSet) Contains(ip net.IP) bool {
+	if s == nil || len(s.prefixes) == 0 {
+		return false
+	}
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range s.prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Len returns the number of networks in the set
+func (s *CIDRSet) Len() int {
+	if s == nil {
+		return 0
+	}
+	return len(s.prefixes)
+}
@@ -0,0 +1,28 @@
+package security
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCIDRSet(t *testing.T) {
+	set, err := NewCIDRSet([]string{"10.0.0.0/8", "192.0.2.7", "2001:db8::/32"})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.True(t, set.Contains(net.ParseIP("10.1.2.3")))
+	assert.True(t, set.Contains(net.ParseIP("::ffff:10.1.2.3")))
+	assert.True(t, set.Contains(net.ParseIP("192.0.2.7")))
+	assert.False(t, set.Contains(net.ParseIP("192.0.2.8")))
+	assert.True(t, set.Contains(net.ParseIP("2001:db8::1")))
+	assert.False(t, set.Contains(net.ParseIP("2001:db9::1")))
+
+	var empty *CIDRSet
+	assert.False(t, empty.Contains(net.ParseIP("10.1.2.3")))
+
+	_, err = NewCIDRSet([]string{"10.0.0.0/33"})
+	assert.Error(t, err)
+}
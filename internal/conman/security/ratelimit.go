@@ -0,0 +1,80 @@
+package security
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// limiterIdle is how long an address may be quiet before its bucket is forgotten
+const limiterIdle = 5 * time.Minute
+
+// RateLimiter caps how quickly each address may open connections using a token bucket per address.
+type RateLimiter struct {
+	limit rate.Limit
+	burst int
+
+	mu       sync.Mutex
+	limiters map[string]*limiterEntry
+}
+
+type limiterEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// NewRateLimiter creates a RateLimiter allowing perSecond connections with bursts of up to burst
+func NewRateLimiter(perSecond float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		limit:    rate.Limit(perSecond),
+		burst:    burst,
+		limiters: make(map[string]*limiterEntry),
+	}
+}
+
+// Allow takes a token for the address, returning false if it is over the limit
+func (s *RateLimiter) Allow(ipAddress string) bool {
+	return s.allow(ipAddress, time.Now())
+}
+
+func (s *RateLimiter) allow(ipAddress string, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.limiters[ipAddress]
+	if !ok {
+		e = &limiterEntry{limiter: rate.NewLimiter(s.limit, s.burst)}
+		s.limiters[ipAddress] = e
+	}
+	e.lastSeen = now
+	return e.limiter.AllowN(now, 1)
+}
+
+// collect removes addresses which have been idle
+func (s *RateLimiter) collect(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ip, e := range s.limiters {
+		if now.Sub(e.lastSeen) > limiterIdle {
+			delete(s.limiters, ip)
+		}
+	}
+}
+
+// Start periodically forgets idle addresses so the map does not grow unbounded
+func (s *RateLimiter) Start(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.collect(time.Now())
+			}
+		}
+	}()
+}
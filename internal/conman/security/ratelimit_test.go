@@ -0,0 +1,39 @@
+package security
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiterBurst(t *testing.T) {
+	r := NewRateLimiter(1, 3)
+	now := time.Now()
+
+	// the burst is allowed at once, one more is not
+	for i := 0; i < 3; i++ {
+		assert.True(t, r.allow("192.0.2.1", now))
+	}
+	assert.False(t, r.allow("192.0.2.1", now))
+
+	// others have their own bucket
+	assert.True(t, r.allow("192.0.2.2", now))
+
+	// a token is back after a second
+	assert.True(t, r.allow("192.0.2.1", now.Add(time.Second)))
+	assert.False(t, r.allow("192.0.2.1", now.Add(time.Second)))
+}
+
+func TestRateLimiterCollect(t *testing.T) {
+	r := NewRateLimiter(1, 1)
+	now := time.Now()
+	assert.True(t, r.allow("192.0.2.1", now))
+	assert.True(t, r.allow("192.0.2.2", now.Add(limiterIdle)))
+
+	// only the idle address is forgotten, and starts with a full bucket
+	r.collect(now.Add(limiterIdle + time.Second))
+	assert.Len(t, r.limiters, 1)
+	assert.Contains(t, r.limiters, "192.0.2.2")
+	assert.True(t, r.allow("192.0.2.1", now.Add(limiterIdle+time.Second)))
+}
@@ -0,0 +1,117 @@
+package security
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reputation matches addresses against a threat intelligence feed of networks,
+// each listed with a confidence from 1 to 100 that it is malicious. The feed is
+// a file of one network per line optionally followed by the confidence, those
+// without one are taken as 100. Comments start with # or ; as in most feeds.
+type Reputation struct {
+	path string
+	feed atomic.Pointer[prefixTrie[int]]
+
+	// the file last loaded, to reload only when it changes
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+}
+
+// NewReputation loads the feed at path
+func NewReputation(path string) (*Reputation, error) {
+	r := &Reputation{path: path}
+	if _, err := r.Refresh(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Refresh reloads the feed if the file changed since it was last loaded,
+// reporting if it did. The feed in use is kept if the file cannot be read.
+func (r *Reputation) Refresh() (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return false, err
+	}
+	if r.feed.Load() != nil && info.ModTime().Equal(r.modTime) && info.Size() == r.size {
+		return false, nil
+	}
+	f, err := os.Open(r.path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	feed, err := parseReputation(f)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", r.path, err)
+	}
+	r.feed.Store(feed)
+	r.modTime, r.size = info.ModTime(), info.Size()
+	return true, nil
+}
+
+// parseReputation reads a feed, failing on the first line which is not understood
+func parseReputation(rd io.Reader) (*prefixTrie[int], error) {
+	feed := &prefixTrie[int]{}
+	scanner := bufio.NewScanner(rd)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		text, _, _ = strings.Cut(text, ";")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		prefix, err := ParsePrefix(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		confidence := 100
+		if len(fields) > 1 {
+			confidence, err = strconv.Atoi(fields[1])
+			if err != nil || confidence < 1 || confidence > 100 {
+				return nil, fmt.Errorf("line %d: confidence must be from 1 to 100", line)
+			}
+		}
+		feed.insert(prefix, confidence)
+	}
+	return feed, scanner.Err()
+}
+
+// Lookup returns the confidence of the most specific network listing ip, 0 if
+// it is not listed
+func (r *Reputation) Lookup(ip net.IP) int {
+	if r == nil {
+		return 0
+	}
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return 0
+	}
+	confidence := 0
+	r.feed.Load().match(addr, func(_ netip.Prefix, c int) bool {
+		confidence = c
+		return false
+	})
+	return confidence
+}
+
+// Len returns the number of networks in the feed
+func (r *Reputation) Len() int {
+	if r == nil {
+		return 0
+	}
+	return r.feed.Load().len()
+}
@@ -0,0 +1,52 @@
+package security
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReputation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "feed.txt")
+	feed := "# known bad\n192.0.2.0/24 40\n192.0.2.7 ; SBL123\n2001:db8::/32 90\n\n"
+	assert.NoError(t, os.WriteFile(path, []byte(feed), 0600))
+
+	r, err := NewReputation(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 3, r.Len())
+	assert.Equal(t, 40, r.Lookup(net.ParseIP("192.0.2.1")))
+	// the most specific listing wins
+	assert.Equal(t, 100, r.Lookup(net.ParseIP("192.0.2.7")))
+	assert.Equal(t, 100, r.Lookup(net.ParseIP("::ffff:192.0.2.7")))
+	assert.Equal(t, 90, r.Lookup(net.ParseIP("2001:db8::1")))
+	assert.Equal(t, 0, r.Lookup(net.ParseIP("198.51.100.1")))
+
+	// unchanged files are not read again
+	changed, err := r.Refresh()
+	assert.NoError(t, err)
+	assert.False(t, changed)
+
+	// a bad feed keeps the one in use
+	assert.NoError(t, os.WriteFile(path, []byte("192.0.2.0/24 101\n"), 0600))
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Minute))
+	_, err = r.Refresh()
+	assert.Error(t, err)
+	assert.Equal(t, 40, r.Lookup(net.ParseIP("192.0.2.1")))
+
+	assert.NoError(t, os.WriteFile(path, []byte("198.51.100.0/24\n"), 0600))
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Minute*2))
+	changed, err = r.Refresh()
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, 0, r.Lookup(net.ParseIP("192.0.2.1")))
+	assert.Equal(t, 100, r.Lookup(net.ParseIP("198.51.100.1")))
+
+	var none *Reputation
+	assert.Equal(t, 0, none.Lookup(net.ParseIP("192.0.2.1")))
+}
@@ -0,0 +1,150 @@
+package security
+
+import (
+	"net/netip"
+)
+
+// prefixTrie maps networks to values in a binary trie, so matching an address
+// walks at most one node per bit instead of checking every network
+type prefixTrie[V any] struct {
+	v4, v6 *trieNode[V]
+	size   int
+}
+
+type trieNode[V any] struct {
+	child  [2]*trieNode[V]
+	prefix netip.Prefix
+	value  V
+	set    bool
+}
+
+// addrBits holds the bytes of an address so bits are read without allocating
+type addrBits struct {
+	b   [16]byte
+	off int
+}
+
+func newAddrBits(addr netip.Addr) addrBits {
+	a := addrBits{b: addr.As16()}
+	if addr.Is4() {
+		a.off = 12
+	}
+	return a
+}
+
+// bit returns bit i counting from the most significant
+func (a addrBits) bit(i int) int {
+	return int(a.b[a.off+i/8]>>(7-i%8)) & 1
+}
+
+func (t *prefixTrie[V]) root(addr netip.Addr, create bool) **trieNode[V] {
+	root := &t.v6
+	if addr.Is4() {
+		root = &t.v4
+	}
+	if *root == nil && create {
+		*root = &trieNode[V]{}
+	}
+	return root
+}
+
+// insert adds or replaces the value for a masked prefix
+func (t *prefixTrie[V]) insert(p netip.Prefix, v V) {
+	n := *t.root(p.Addr(), true)
+	bits := newAddrBits(p.Addr())
+	for i := 0; i < p.Bits(); i++ {
+		b := bits.bit(i)
+		if n.child[b] == nil {
+			n.child[b] = &trieNode[V]{}
+		}
+		n = n.child[b]
+	}
+	if !n.set {
+		t.size++
+	}
+	n.prefix, n.value, n.set = p, v, true
+}
+
+// get returns the value of exactly the prefix
+func (t *prefixTrie[V]) get(p netip.Prefix) (V, bool) {
+	n := *t.root(p.Addr(), false)
+	bits := newAddrBits(p.Addr())
+	for i := 0; n != nil && i < p.Bits(); i++ {
+		n = n.child[bits.bit(i)]
+	}
+	if n == nil || !n.set {
+		var zero V
+		return zero, false
+	}
+	return n.value, true
+}
+
+// delete removes the prefix, pruning branches left empty, and returns false
+// if it was not present
+func (t *prefixTrie[V]) delete(p netip.Prefix) bool {
+	root := t.root(p.Addr(), false)
+	var deleted bool
+	*root = t.remove(*root, p, newAddrBits(p.Addr()), 0, &deleted)
+	return deleted
+}
+
+func (t *prefixTrie[V]) remove(n *trieNode[V], p netip.Prefix, bits addrBits, depth int, deleted *bool) *trieNode[V] {
+	if n == nil {
+		return nil
+	}
+	if depth == p.Bits() {
+		if n.set {
+			var zero V
+			n.value, n.set = zero, false
+			t.size--
+			*deleted = true
+		}
+	} else {
+		b := bits.bit(depth)
+		n.child[b] = t.remove(n.child[b], p, bits, depth+1, deleted)
+	}
+	if !n.set && n.child[0] == nil && n.child[1] == nil {
+		return nil
+	}
+	return n
+}
+
+// match calls fn for each network containing addr, from the widest, until
+// fn returns true
+func (t *prefixTrie[V]) match(addr netip.Addr, fn func(netip.Prefix, V) bool) bool {
+	addr = addr.Unmap()
+	n := *t.root(addr, false)
+	bits := newAddrBits(addr)
+	for i := 0; n != nil; i++ {
+		if n.set && fn(n.prefix, n.value) {
+			return true
+		}
+		if i == addr.BitLen() {
+			break
+		}
+		n = n.child[bits.bit(i)]
+	}
+	return false
+}
+
+// walk calls fn for every network
+func (t *prefixTrie[V]) walk(fn func(netip.Prefix, V)) {
+	var visit func(n *trieNode[V])
+	visit = func(n *trieNode[V]) {
+		if n == nil {
+			return
+		}
+		if n.set {
+			fn(n.prefix, n.value)
+		}
+		visit(n.child[0])
+		visit(n.child[1])
+	}
+	visit(t.v4)
+	visit(t.v6)
+}
+
+// len returns the number of networks
+func (t *prefixTrie[V]) len() int {
+	return t.size
+}
@@ -0,0 +1,59 @@
+package security
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrefixTrie(t *testing.T) {
+	var trie prefixTrie[string]
+	for _, cidr := range []string{"10.0.0.0/8", "10.1.0.0/16", "192.0.2.7/32", "2001:db8::/32", "0.0.0.0/0"} {
+		trie.insert(netip.MustParsePrefix(cidr), cidr)
+	}
+	assert.Equal(t, 5, trie.len())
+
+	matches := func(ip string) []string {
+		var out []string
+		trie.match(netip.MustParseAddr(ip), func(p netip.Prefix, v string) bool {
+			out = append(out, v)
+			return false
+		})
+		return out
+	}
+	assert.Equal(t, []string{"0.0.0.0/0", "10.0.0.0/8", "10.1.0.0/16"}, matches("10.1.2.3"))
+	assert.Equal(t, []string{"0.0.0.0/0", "192.0.2.7/32"}, matches("192.0.2.7"))
+	assert.Equal(t, []string{"0.0.0.0/0", "192.0.2.7/32"}, matches("::ffff:192.0.2.7"))
+	assert.Equal(t, []string{"2001:db8::/32"}, matches("2001:db8::1"))
+	assert.Empty(t, matches("2001:db9::1"))
+
+	v, ok := trie.get(netip.MustParsePrefix("10.1.0.0/16"))
+	assert.True(t, ok)
+	assert.Equal(t, "10.1.0.0/16", v)
+	_, ok = trie.get(netip.MustParsePrefix("10.1.0.0/24"))
+	assert.False(t, ok)
+
+	assert.True(t, trie.delete(netip.MustParsePrefix("10.1.0.0/16")))
+	assert.False(t, trie.delete(netip.MustParsePrefix("10.1.0.0/16")))
+	assert.True(t, trie.delete(netip.MustParsePrefix("0.0.0.0/0")))
+	assert.Equal(t, []string{"10.0.0.0/8"}, matches("10.1.2.3"))
+	assert.Equal(t, 3, trie.len())
+
+	var all []string
+	trie.walk(func(p netip.Prefix, v string) { all = append(all, p.String()) })
+	assert.ElementsMatch(t, []string{"10.0.0.0/8", "192.0.2.7/32", "2001:db8::/32"}, all)
+}
+
+func BenchmarkPrefixTrieMatch(b *testing.B) {
+	var trie prefixTrie[struct{}]
+	for i := 0; i < 10000; i++ {
+		trie.insert(netip.MustParsePrefix(fmt.Sprintf("%d.%d.%d.0/24", 10+i>>16, (i>>8)&255, i&255)), struct{}{})
+	}
+	addr := netip.MustParseAddr("203.0.113.1")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		trie.match(addr, func(netip.Prefix, struct{}) bool { return true })
+	}
+}
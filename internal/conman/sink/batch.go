@@ -0,0 +1,66 @@
+package sink
+
+import (
+	"time"
+
+	"github.com/antihax/gambit/internal/metrics"
+)
+
+// batcher queues events without blocking and hands them to flush in batches,
+// when a batch is full or the interval passes
+type batcher struct {
+	queue    chan Event
+	size     int
+	interval time.Duration
+	flush    func(batch []Event)
+}
+
+// newBatcher queues up to queueSize events, flushing every size events or interval.
+// flush must not keep the batch, it is reused.
+func newBatcher(queueSize, size int, interval time.Duration, flush func(batch []Event)) *batcher {
+	return &batcher{
+		queue:    make(chan Event, queueSize),
+		size:     max(size, 1),
+		interval: interval,
+		flush:    flush,
+	}
+}
+
+// offer queues the event without blocking, returning false if it was dropped
+func (b *batcher) offer(e Event) bool {
+	select {
+	case b.queue <- e:
+		return true
+	default:
+		metrics.DroppedSinkEvents.Add(1)
+		return false
+	}
+}
+
+// run batches events until the queue is closed, flushing what remains
+func (b *batcher) run() {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+	batch := make([]Event, 0, b.size)
+	flush := func() {
+		if len(batch) > 0 {
+			b.flush(batch)
+			batch = batch[:0]
+		}
+	}
+	for {
+		select {
+		case e, ok := <-b.queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, e)
+			if len(batch) >= b.size {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
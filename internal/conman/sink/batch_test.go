@@ -0,0 +1,47 @@
+package sink
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatcher(t *testing.T) {
+	flushed := make(chan []string, 10)
+	b := newBatcher(10, 2, time.Hour, func(batch []Event) {
+		var attackers []string
+		for _, e := range batch {
+			attackers = append(attackers, e.Attacker)
+		}
+		flushed <- attackers
+	})
+	done := make(chan struct{})
+	go func() {
+		b.run()
+		close(done)
+	}()
+
+	// a full batch is flushed straight away
+	assert.True(t, b.offer(Event{Attacker: "192.0.2.1"}))
+	assert.True(t, b.offer(Event{Attacker: "192.0.2.2"}))
+	select {
+	case batch := <-flushed:
+		assert.Equal(t, []string{"192.0.2.1", "192.0.2.2"}, batch)
+	case <-time.After(time.Second * 5):
+		t.Fatal("full batch was not flushed")
+	}
+
+	// what remains is flushed when the queue closes
+	assert.True(t, b.offer(Event{Attacker: "192.0.2.3"}))
+	close(b.queue)
+	<-done
+	assert.Equal(t, []string{"192.0.2.3"}, <-flushed)
+	assert.Empty(t, flushed)
+}
+
+func TestBatcherDrops(t *testing.T) {
+	b := newBatcher(1, 1, time.Hour, func([]Event) {})
+	assert.True(t, b.offer(Event{}))
+	assert.False(t, b.offer(Event{}))
+}
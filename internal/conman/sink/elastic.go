@@ -0,0 +1,187 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/antihax/gambit/internal/metrics"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// elasticQueueSize bounds events waiting to be indexed before new ones are dropped
+	elasticQueueSize = 10000
+
+	// elasticRetries is how many times a failed bulk request is retried
+	elasticRetries = 2
+)
+
+// elasticMapping types the fields so they can be searched and aggregated as is
+const elasticMapping = `{
+	"mappings": {
+		"properties": {
+			"@timestamp": {"type": "date"},
+			"time": {"type": "date"},
+			"network": {"type": "keyword"},
+			"attacker": {"type": "keyword"},
+			"dstport": {"type": "keyword"},
+			"uuid": {"type": "keyword"},
+			"hash": {"type": "keyword"},
+			"driver": {"type": "keyword"},
+			"tlsunwrap": {"type": "boolean"},
+			"country": {"type": "keyword"},
+			"city": {"type": "keyword"},
+			"asn": {"type": "long"},
+			"as_org": {"type": "keyword"}
+		}
+	}
+}`
+
+// elasticDocument adds the timestamp Kibana looks for by default
+type elasticDocument struct {
+	Timestamp time.Time `json:"@timestamp"`
+	Event
+}
+
+// Elastic bulk indexes events into Elasticsearch or OpenSearch in the background
+type Elastic struct {
+	url     string
+	index   string
+	user    string
+	pass    string
+	client  *http.Client
+	batch   *batcher
+	retries int
+	backoff time.Duration
+	logger  zerolog.Logger
+}
+
+// NewElastic creates a sink indexing into index at the server addr, flushing
+// every batchSize events or interval, whichever comes first
+func NewElastic(addr, index, user, pass string, batchSize int, interval time.Duration, logger zerolog.Logger) *Elastic {
+	s := &Elastic{
+		url:     strings.TrimRight(addr, "/"),
+		index:   index,
+		user:    user,
+		pass:    pass,
+		client:  &http.Client{Timeout: time.Second * 30},
+		retries: elasticRetries,
+		backoff: time.Second,
+		logger:  logger,
+	}
+	s.batch = newBatcher(elasticQueueSize, batchSize, interval, s.flush)
+	return s
+}
+
+// Start creating the index if needed and indexing events
+func (s *Elastic) Start() {
+	go func() {
+		if err := s.createIndex(); err != nil {
+			s.logger.Warn().Err(err).Str("index", s.index).Msg("failed creating elasticsearch index")
+		}
+		s.batch.run()
+	}()
+}
+
+// Send queues an event without blocking, returning false if it was dropped
+func (s *Elastic) Send(e Event) bool {
+	return s.batch.offer(e)
+}
+
+// flush sends the batch to the _bulk API, retrying before dropping it
+func (s *Elastic) flush(batch []Event) {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, e := range batch {
+		body.WriteString(`{"index":{}}` + "\n")
+		enc.Encode(elasticDocument{Timestamp: e.Time, Event: e})
+	}
+
+	failed, err := s.bulk(body.Bytes())
+	for attempt := 0; err != nil && attempt < s.retries; attempt++ {
+		time.Sleep(s.backoff << attempt)
+		failed, err = s.bulk(body.Bytes())
+	}
+	if err != nil {
+		failed = len(batch)
+	}
+	if failed > 0 {
+		metrics.DroppedSinkEvents.Add(int64(failed))
+		s.logger.Warn().Err(err).Int("dropped", failed).Str("index", s.index).Msg("dropped elasticsearch events")
+	}
+}
+
+// bulk posts the request, returning how many documents were refused
+func (s *Elastic) bulk(body []byte) (int, error) {
+	resp, err := s.do(http.MethodPost, "/"+s.index+"/_bulk", "application/x-ndjson", body)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return 0, fmt.Errorf("elasticsearch returned %s", resp.Status)
+	}
+
+	var result struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			Status int `json:"status"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, err
+	}
+	failed := 0
+	if result.Errors {
+		for _, item := range result.Items {
+			for _, r := range item {
+				if r.Status >= 300 {
+					failed++
+				}
+			}
+		}
+	}
+	return failed, nil
+}
+
+// createIndex creates the index with our mapping unless it already exists
+func (s *Elastic) createIndex() error {
+	resp, err := s.do(http.MethodHead, "/"+s.index, "", nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	resp, err = s.do(http.MethodPut, "/"+s.index, "application/json", []byte(elasticMapping))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("elasticsearch returned %s: %s", resp.Status, msg)
+	}
+	return nil
+}
+
+func (s *Elastic) do(method, path, contentType string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.url+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if s.user != "" {
+		req.SetBasicAuth(s.user, s.pass)
+	}
+	return s.client.Do(req)
+}
@@ -0,0 +1,78 @@
+package sink
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestElastic(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		created bool
+		docs    []map[string]any
+		bulked  = make(chan struct{}, 10)
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.Method == http.MethodHead:
+			w.WriteHeader(http.StatusNotFound)
+		case r.Method == http.MethodPut && r.URL.Path == "/events":
+			created = true
+		case r.Method == http.MethodPost && r.URL.Path == "/events/_bulk":
+			assert.Equal(t, "application/x-ndjson", r.Header.Get("Content-Type"))
+			scanner := bufio.NewScanner(r.Body)
+			for scanner.Scan() {
+				assert.JSONEq(t, `{"index":{}}`, scanner.Text())
+				scanner.Scan()
+				var doc map[string]any
+				assert.NoError(t, json.Unmarshal(scanner.Bytes(), &doc))
+				docs = append(docs, doc)
+			}
+			w.Write([]byte(`{"errors":false,"items":[]}`))
+			bulked <- struct{}{}
+		}
+	}))
+	defer srv.Close()
+
+	s := NewElastic(srv.URL, "events", "", "", 2, time.Hour, zerolog.Nop())
+	s.Start()
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	s.Send(Event{Time: now, Attacker: "192.0.2.1", DstPort: "22", Hash: "abc"})
+	s.Send(Event{Time: now, Attacker: "192.0.2.2", DstPort: "80"})
+
+	select {
+	case <-bulked:
+	case <-time.After(time.Second * 5):
+		t.Fatal("batch was not flushed")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	assert.True(t, created)
+	if assert.Len(t, docs, 2) {
+		assert.Equal(t, "2024-01-02T03:04:05Z", docs[0]["@timestamp"])
+		assert.Equal(t, "192.0.2.1", docs[0]["attacker"])
+		assert.Equal(t, "abc", docs[0]["hash"])
+	}
+}
+
+func TestElasticBulkItemErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"errors":true,"items":[{"index":{"status":201}},{"index":{"status":400}}]}`))
+	}))
+	defer srv.Close()
+
+	s := NewElastic(srv.URL, "events", "", "", 10, time.Hour, zerolog.Nop())
+	failed, err := s.bulk([]byte("{}\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, failed)
+}
@@ -0,0 +1,186 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// flowExportTimeout bounds each POST of a rollup
+const flowExportTimeout = time.Second * 30
+
+// Flow summarises the connections from one attacker to one port over an interval
+type Flow struct {
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	Network     string    `json:"network"`
+	Attacker    string    `json:"attacker"`
+	DstPort     string    `json:"dstport"`
+	Connections int64     `json:"connections"`
+	BytesIn     int64     `json:"bytes_in"`
+	BytesOut    int64     `json:"bytes_out"`
+	FirstSeen   time.Time `json:"first_seen"`
+	LastSeen    time.Time `json:"last_seen"`
+}
+
+// FlowExporter ships each rollup of flows
+type FlowExporter interface {
+	Export(flows []Flow) error
+}
+
+// flowKey is the tuple flows are aggregated by
+type flowKey struct {
+	network, attacker, port string
+}
+
+// Flows rolls connection events up into per attacker and port flows in
+// memory, exporting them every interval. Bytes are counted as connections
+// close, so a connection spanning intervals adds its bytes to the later one.
+type Flows struct {
+	mu       sync.Mutex
+	flows    map[flowKey]*Flow
+	start    time.Time
+	interval time.Duration
+	exporter FlowExporter
+	logger   zerolog.Logger
+}
+
+// NewFlows creates a sink exporting rollups of interval to exporter
+func NewFlows(interval time.Duration, exporter FlowExporter, logger zerolog.Logger) *Flows {
+	return &Flows{
+		flows:    make(map[flowKey]*Flow),
+		start:    time.Now().UTC(),
+		interval: interval,
+		exporter: exporter,
+		logger:   logger,
+	}
+}
+
+// Run exports every interval until ctx is done, then exports the partial
+// interval so it is not lost on shutdown
+func (f *Flows) Run(ctx context.Context) {
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			f.flush(now)
+		case <-ctx.Done():
+			f.flush(time.Now())
+			return
+		}
+	}
+}
+
+// Send counts a new connection, it never blocks for long
+func (f *Flows) Send(e Event) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	flow := f.flow(e)
+	flow.Connections++
+	return true
+}
+
+// Closed adds the bytes of a finished connection
+func (f *Flows) Closed(e Event) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	flow := f.flow(e)
+	flow.BytesIn += e.BytesIn
+	flow.BytesOut += e.BytesOut
+	return true
+}
+
+// flow returns the flow for the event, marking it seen. The lock must be held.
+func (f *Flows) flow(e Event) *Flow {
+	key := flowKey{e.Network, e.Attacker, e.DstPort}
+	flow, ok := f.flows[key]
+	if !ok {
+		flow = &Flow{Network: e.Network, Attacker: e.Attacker, DstPort: e.DstPort, FirstSeen: e.Time}
+		f.flows[key] = flow
+	}
+	flow.LastSeen = e.Time
+	return flow
+}
+
+// flush exports the flows seen since the last flush and starts a new interval
+func (f *Flows) flush(now time.Time) {
+	now = now.UTC()
+	f.mu.Lock()
+	flows := make([]Flow, 0, len(f.flows))
+	for _, flow := range f.flows {
+		flow.Start, flow.End = f.start, now
+		flows = append(flows, *flow)
+	}
+	f.flows = make(map[flowKey]*Flow)
+	f.start = now
+	f.mu.Unlock()
+
+	if len(flows) == 0 {
+		return
+	}
+	// busiest first, so collectors which truncate keep what matters
+	sort.Slice(flows, func(i, j int) bool {
+		return flows[i].Connections > flows[j].Connections
+	})
+	if err := f.exporter.Export(flows); err != nil {
+		f.logger.Warn().Err(err).Int("flows", len(flows)).Msg("failed exporting flows")
+	}
+}
+
+// FlowFile appends each flow as a line of JSON
+type FlowFile struct {
+	Path string
+}
+
+// Export appends the flows to the file, creating it if needed
+func (e FlowFile) Export(flows []Flow) error {
+	file, err := os.OpenFile(e.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(file)
+	for _, flow := range flows {
+		if err := enc.Encode(flow); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	return file.Close()
+}
+
+// FlowHTTP POSTs each rollup as a JSON array
+type FlowHTTP struct {
+	URL    string
+	Client *http.Client
+}
+
+// NewFlowHTTP creates an exporter posting to url
+func NewFlowHTTP(url string) *FlowHTTP {
+	return &FlowHTTP{URL: url, Client: &http.Client{Timeout: flowExportTimeout}}
+}
+
+// Export POSTs the flows
+func (e *FlowHTTP) Export(flows []Flow) error {
+	body, err := json.Marshal(flows)
+	if err != nil {
+		return err
+	}
+	resp, err := e.Client.Post(e.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("flow export returned %s", resp.Status)
+	}
+	return nil
+}
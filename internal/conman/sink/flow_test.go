@@ -0,0 +1,93 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+// flowRecorder keeps what was exported
+type flowRecorder struct {
+	flows [][]Flow
+}
+
+func (r *flowRecorder) Export(flows []Flow) error {
+	r.flows = append(r.flows, flows)
+	return nil
+}
+
+func TestFlows(t *testing.T) {
+	r := &flowRecorder{}
+	f := NewFlows(time.Minute, r, zerolog.Nop())
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	a := Event{Time: t0, Network: "tcp", Attacker: "192.0.2.1", DstPort: "22"}
+	f.Send(a)
+	a.Time = t0.Add(time.Second)
+	f.Send(a)
+	a.BytesIn, a.BytesOut = 100, 20
+	f.Closed(a)
+	f.Send(Event{Time: t0, Network: "tcp", Attacker: "192.0.2.2", DstPort: "22"})
+
+	f.flush(t0.Add(time.Minute))
+	if assert.Len(t, r.flows, 1) && assert.Len(t, r.flows[0], 2) {
+		flow := r.flows[0][0]
+		assert.Equal(t, "192.0.2.1", flow.Attacker)
+		assert.Equal(t, int64(2), flow.Connections)
+		assert.Equal(t, int64(100), flow.BytesIn)
+		assert.Equal(t, int64(20), flow.BytesOut)
+		assert.Equal(t, t0, flow.FirstSeen)
+		assert.Equal(t, t0.Add(time.Second), flow.LastSeen)
+		assert.Equal(t, t0.Add(time.Minute), flow.End)
+	}
+
+	// nothing new, nothing exported
+	f.flush(t0.Add(time.Minute * 2))
+	assert.Len(t, r.flows, 1)
+}
+
+func TestFlowsFlushOnStop(t *testing.T) {
+	r := &flowRecorder{}
+	f := NewFlows(time.Hour, r, zerolog.Nop())
+	f.Send(Event{Time: time.Now(), Network: "tcp", Attacker: "192.0.2.1", DstPort: "22"})
+
+	// the partial interval is exported as it stops
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	f.Run(ctx)
+	if assert.Len(t, r.flows, 1) && assert.Len(t, r.flows[0], 1) {
+		assert.Equal(t, int64(1), r.flows[0][0].Connections)
+	}
+}
+
+func TestFlowExporters(t *testing.T) {
+	flows := []Flow{{Attacker: "192.0.2.1", DstPort: "22", Connections: 3}}
+
+	path := filepath.Join(t.TempDir(), "flows.json")
+	assert.NoError(t, FlowFile{Path: path}.Export(flows))
+	assert.NoError(t, FlowFile{Path: path}.Export(flows))
+	b, err := os.ReadFile(path)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 2, strings.Count(string(b), "\n"))
+	}
+
+	var got []Flow
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer srv.Close()
+	assert.NoError(t, NewFlowHTTP(srv.URL).Export(flows))
+	assert.Equal(t, flows, got)
+
+	srv.Config.Handler = http.NotFoundHandler()
+	assert.Error(t, NewFlowHTTP(srv.URL).Export(flows))
+}
@@ -0,0 +1,92 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/antihax/gambit/internal/metrics"
+	"github.com/rs/zerolog"
+	"github.com/segmentio/kafka-go"
+)
+
+// kafkaQueueSize bounds events waiting to be produced before new ones are dropped
+const kafkaQueueSize = 10000
+
+// kafkaWriter is the part of kafka.Writer we produce with
+type kafkaWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+}
+
+// Kafka produces events as JSON messages keyed by the attacker, so each
+// attacker's events land on the same partition in order
+type Kafka struct {
+	writer kafkaWriter
+	topic  string
+	queue  chan Event
+	logger zerolog.Logger
+}
+
+// NewKafka creates a sink producing to topic on the brokers
+func NewKafka(brokers []string, topic string, logger zerolog.Logger) *Kafka {
+	k := &Kafka{
+		topic:  topic,
+		queue:  make(chan Event, kafkaQueueSize),
+		logger: logger,
+	}
+	k.writer = &kafka.Writer{
+		Addr:         kafka.TCP(brokers...),
+		Topic:        topic,
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireOne,
+		BatchTimeout: time.Second,
+		Async:        true,
+		Completion:   k.completed,
+	}
+	return k
+}
+
+// Start producing queued events
+func (k *Kafka) Start() {
+	go k.run()
+}
+
+// Send queues an event without blocking, returning false if it was dropped
+func (k *Kafka) Send(e Event) bool {
+	select {
+	case k.queue <- e:
+		return true
+	default:
+		metrics.DroppedSinkEvents.Add(1)
+		return false
+	}
+}
+
+func (k *Kafka) run() {
+	for e := range k.queue {
+		value, err := json.Marshal(e)
+		if err != nil {
+			k.logger.Warn().Err(err).Str("uuid", e.UUID).Msg("failed encoding kafka event")
+			continue
+		}
+		// asynchronous, failures are reported to completed unless the message
+		// could not be queued at all, such as when no broker is reachable
+		msg := kafka.Message{
+			Key:   []byte(e.Attacker),
+			Value: value,
+			Time:  e.Time,
+		}
+		if err := k.writer.WriteMessages(context.Background(), msg); err != nil {
+			k.completed([]kafka.Message{msg}, err)
+		}
+	}
+}
+
+// completed counts batches the brokers did not accept
+func (k *Kafka) completed(messages []kafka.Message, err error) {
+	if err == nil {
+		return
+	}
+	metrics.DroppedSinkEvents.Add(int64(len(messages)))
+	k.logger.Warn().Err(err).Int("dropped", len(messages)).Str("topic", k.topic).Msg("dropped kafka events")
+}
@@ -0,0 +1,105 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/antihax/gambit/internal/metrics"
+	"github.com/rs/zerolog"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+)
+
+// kafkaRecorder keeps what was produced
+type kafkaRecorder struct {
+	mu       sync.Mutex
+	messages []kafka.Message
+}
+
+func (r *kafkaRecorder) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.messages = append(r.messages, msgs...)
+	return nil
+}
+
+func (r *kafkaRecorder) produced() []kafka.Message {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]kafka.Message(nil), r.messages...)
+}
+
+func TestKafkaSend(t *testing.T) {
+	r := &kafkaRecorder{}
+	k := NewKafka([]string{"127.0.0.1:1"}, "events", zerolog.Nop())
+	k.writer = r
+	k.Start()
+	defer close(k.queue)
+
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	events := []Event{
+		// a new connection matched to a driver
+		{Time: now, Network: "tcp", Attacker: "192.0.2.1", DstPort: "22", UUID: "a", Hash: "abc", Driver: "sshd", Country: "NZ", ASN: 64500},
+		// the same connection as it closes
+		{Time: now, Network: "tcp", Attacker: "192.0.2.1", DstPort: "22", UUID: "a", BytesIn: 100, BytesOut: 20, DurationMS: 5},
+		// an unwrapped TLS connection
+		{Time: now, Network: "tcp", Attacker: "192.0.2.2", DstPort: "443", UUID: "b", TLSUnwrap: true},
+		// a UDP reflection attempt
+		{Time: now, Network: "udp", Attacker: "192.0.2.3", DstPort: "123", UUID: "c", AmplificationVector: "ntp monlist"},
+	}
+	for _, e := range events {
+		assert.True(t, k.Send(e))
+	}
+
+	assert.Eventually(t, func() bool { return len(r.produced()) == len(events) }, time.Second*5, time.Millisecond*10)
+	for i, m := range r.produced() {
+		assert.Equal(t, events[i].Attacker, string(m.Key))
+		assert.Equal(t, now, m.Time)
+		var got Event
+		if assert.NoError(t, json.Unmarshal(m.Value, &got)) {
+			assert.Equal(t, events[i], got)
+		}
+	}
+}
+
+func TestKafkaQueueFull(t *testing.T) {
+	k := NewKafka([]string{"127.0.0.1:1"}, "events", zerolog.Nop())
+	k.queue = make(chan Event, 1)
+	before := metrics.DroppedSinkEvents.Value()
+
+	assert.True(t, k.Send(Event{UUID: "a"}))
+	assert.False(t, k.Send(Event{UUID: "b"}))
+	assert.Equal(t, before+1, metrics.DroppedSinkEvents.Value())
+}
+
+func TestKafkaUnreachable(t *testing.T) {
+	k := NewKafka([]string{"127.0.0.1:1"}, "events", zerolog.Nop())
+	w := k.writer.(*kafka.Writer)
+	w.MaxAttempts = 1
+	w.BatchTimeout = time.Millisecond * 10
+	defer w.Close()
+	k.Start()
+	defer close(k.queue)
+
+	// nothing listens, so the batch is reported failed and counted
+	before := metrics.DroppedSinkEvents.Value()
+	assert.True(t, k.Send(Event{Attacker: "192.0.2.1", UUID: "a"}))
+	assert.Eventually(t, func() bool {
+		return metrics.DroppedSinkEvents.Value() >= before+1
+	}, time.Second*10, time.Millisecond*10)
+}
+
+func TestKafkaCompleted(t *testing.T) {
+	k := NewKafka([]string{"127.0.0.1:1"}, "events", zerolog.Nop())
+	before := metrics.DroppedSinkEvents.Value()
+
+	k.completed([]kafka.Message{{}, {}}, nil)
+	assert.Equal(t, before, metrics.DroppedSinkEvents.Value())
+
+	k.completed([]kafka.Message{{}, {}}, errors.New("no brokers"))
+	assert.Equal(t, before+2, metrics.DroppedSinkEvents.Value())
+}
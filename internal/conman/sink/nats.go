@@ -0,0 +1,108 @@
+package sink
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/antihax/gambit/internal/metrics"
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog"
+)
+
+// natsQueueSize bounds events waiting to be published before new ones are dropped
+const natsQueueSize = 10000
+
+// natsReconnectBuffer bounds what the client holds while reconnecting, publishes
+// beyond it fail and are dropped
+const natsReconnectBuffer = 4 * 1024 * 1024
+
+// NATS publishes events as JSON. The subject may name the port, network or
+// driver, e.g. "gambit.events.{port}", to let subscribers pick what they want.
+type NATS struct {
+	conn    *nats.Conn
+	subject string
+	queue   chan Event
+	logger  zerolog.Logger
+}
+
+// NewNATS connects to the NATS server at url, publishing to subject. The
+// connection is retried in the background if the server cannot be reached.
+func NewNATS(url, subject string, logger zerolog.Logger) (*NATS, error) {
+	n := &NATS{
+		subject: subject,
+		queue:   make(chan Event, natsQueueSize),
+		logger:  logger,
+	}
+	conn, err := nats.Connect(url,
+		nats.Name("gambit"),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+		nats.ReconnectBufSize(natsReconnectBuffer),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			logger.Warn().Err(err).Msg("nats disconnected")
+		}),
+		nats.ReconnectHandler(func(c *nats.Conn) {
+			logger.Info().Str("server", c.ConnectedUrlRedacted()).Msg("nats reconnected")
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	n.conn = conn
+	return n, nil
+}
+
+// Start publishing queued events
+func (n *NATS) Start() {
+	go n.run()
+}
+
+// Close disconnects from the server, dropping anything not yet published
+func (n *NATS) Close() error {
+	n.conn.Close()
+	return nil
+}
+
+// Send queues an event without blocking, returning false if it was dropped
+func (n *NATS) Send(e Event) bool {
+	select {
+	case n.queue <- e:
+		return true
+	default:
+		metrics.DroppedSinkEvents.Add(1)
+		return false
+	}
+}
+
+func (n *NATS) run() {
+	for e := range n.queue {
+		n.publish(e)
+	}
+}
+
+// publish hands an event to the client, which sends it in the background
+func (n *NATS) publish(e Event) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		n.logger.Warn().Err(err).Str("uuid", e.UUID).Msg("failed encoding nats event")
+		return
+	}
+	subject := natsSubject(n.subject, e)
+	if err := n.conn.Publish(subject, data); err != nil {
+		metrics.DroppedSinkEvents.Add(1)
+		n.logger.Debug().Err(err).Str("subject", subject).Msg("dropped nats event")
+	}
+}
+
+// natsSubject fills in the placeholders of the subject for an event
+func natsSubject(subject string, e Event) string {
+	driver := e.Driver
+	if driver == "" {
+		driver = "none"
+	}
+	return strings.NewReplacer(
+		"{port}", e.DstPort,
+		"{network}", e.Network,
+		"{driver}", driver,
+	).Replace(subject)
+}
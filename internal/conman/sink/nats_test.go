@@ -0,0 +1,31 @@
+package sink
+
+import (
+	"testing"
+
+	"github.com/antihax/gambit/internal/metrics"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNATSSubject(t *testing.T) {
+	e := Event{Network: "tcp", DstPort: "445", Driver: "smb"}
+	assert.Equal(t, "gambit.events", natsSubject("gambit.events", e))
+	assert.Equal(t, "gambit.events.445", natsSubject("gambit.events.{port}", e))
+	assert.Equal(t, "gambit.tcp.smb.445", natsSubject("gambit.{network}.{driver}.{port}", e))
+	assert.Equal(t, "gambit.none", natsSubject("gambit.{driver}", Event{}))
+}
+
+func TestNATSDropped(t *testing.T) {
+	// nothing is listening, the client keeps trying in the background
+	n, err := NewNATS("nats://127.0.0.1:1", "events", zerolog.Nop())
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// publishes fail once the connection is closed, and are counted
+	n.conn.Close()
+	before := metrics.DroppedSinkEvents.Value()
+	n.publish(Event{DstPort: "22"})
+	assert.Equal(t, before+1, metrics.DroppedSinkEvents.Value())
+}
@@ -0,0 +1,43 @@
+// Package sink ships connection events to external systems for analysis
+package sink
+
+import "time"
+
+// Event describes a connection as it is routed
+type Event struct {
+	Time      time.Time `json:"time"`
+	Network   string    `json:"network"`
+	Attacker  string    `json:"attacker"`
+	DstPort   string    `json:"dstport"`
+	UUID      string    `json:"uuid"`
+	Hash      string    `json:"hash,omitempty"`
+	Driver    string    `json:"driver,omitempty"`
+	TLSUnwrap bool      `json:"tlsunwrap"`
+	Country   string    `json:"country,omitempty"`
+	City      string    `json:"city,omitempty"`
+	ASN       uint      `json:"asn,omitempty"`
+	ASOrg     string    `json:"as_org,omitempty"`
+	// Reputation is the confidence the attacker is malicious from the reputation feed
+	Reputation int `json:"reputation,omitempty"`
+
+	// AmplificationVector names the reflection abuse a UDP query looks like
+	AmplificationVector string `json:"amplification_vector,omitempty"`
+
+	// set once the connection has closed
+	BytesIn    int64 `json:"bytes_in,omitempty"`
+	BytesOut   int64 `json:"bytes_out,omitempty"`
+	DurationMS int64 `json:"duration_ms,omitempty"`
+}
+
+// Sink receives every connection event
+type Sink interface {
+	// Send queues the event without blocking, returning false if it was dropped
+	Send(e Event) bool
+}
+
+// CloseSink optionally receives the event again when the connection closes,
+// with the bytes and duration filled in
+type CloseSink interface {
+	// Closed queues the event without blocking, returning false if it was dropped
+	Closed(e Event) bool
+}
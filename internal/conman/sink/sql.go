@@ -0,0 +1,168 @@
+package sink
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/antihax/gambit/internal/metrics"
+	_ "github.com/lib/pq" // postgres driver
+	"github.com/rs/zerolog"
+	_ "modernc.org/sqlite" // sqlite driver
+)
+
+const (
+	// sqlQueueSize bounds rows waiting to be written before new ones are dropped
+	sqlQueueSize = 10000
+
+	// sqlBatchSize is the most rows written in one transaction
+	sqlBatchSize = 500
+
+	// sqlFlushInterval is the longest a row waits to be written
+	sqlFlushInterval = time.Second * 5
+)
+
+// sqlColumns are written for each connection, in the order of sqlRow
+var sqlColumns = []string{
+	"time", "network", "attacker", "dstport", "uuid", "hash", "driver", "tlsunwrap",
+	"bytes_in", "bytes_out", "duration_ms", "country", "city", "asn", "as_org",
+}
+
+// sqlSchema creates the table and the indexes common queries need, the column
+// types are understood by both SQLite and Postgres
+const sqlSchema = `
+CREATE TABLE IF NOT EXISTS connections (
+	time TIMESTAMP NOT NULL,
+	network TEXT NOT NULL,
+	attacker TEXT NOT NULL,
+	dstport INTEGER NOT NULL,
+	uuid TEXT NOT NULL,
+	hash TEXT,
+	driver TEXT,
+	tlsunwrap BOOLEAN NOT NULL,
+	bytes_in BIGINT NOT NULL,
+	bytes_out BIGINT NOT NULL,
+	duration_ms BIGINT NOT NULL,
+	country TEXT,
+	city TEXT,
+	asn BIGINT,
+	as_org TEXT
+);
+CREATE INDEX IF NOT EXISTS connections_time ON connections (time);
+CREATE INDEX IF NOT EXISTS connections_attacker ON connections (attacker);
+CREATE INDEX IF NOT EXISTS connections_dstport ON connections (dstport);
+CREATE INDEX IF NOT EXISTS connections_hash ON connections (hash);
+CREATE INDEX IF NOT EXISTS connections_asn ON connections (asn);
+`
+
+// SQL indexes the metadata of every finished connection in SQLite or Postgres,
+// the payloads themselves stay in storage referenced by hash
+type SQL struct {
+	db     *sql.DB
+	insert string
+	batch  *batcher
+	logger zerolog.Logger
+}
+
+// NewSQLite opens or creates the SQLite database at path
+func NewSQLite(path string, logger zerolog.Logger) (*SQL, error) {
+	// a single writer avoids SQLITE_BUSY, WAL keeps readers out of its way
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	return newSQL(db, "?", logger)
+}
+
+// NewPostgres connects to the Postgres database at dsn
+func NewPostgres(dsn string, logger zerolog.Logger) (*SQL, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	return newSQL(db, "$", logger)
+}
+
+// newSQL creates the schema, placeholders are numbered if placeholder is "$"
+func newSQL(db *sql.DB, placeholder string, logger zerolog.Logger) (*SQL, error) {
+	for _, stmt := range strings.Split(sqlSchema, ";") {
+		if strings.TrimSpace(stmt) == "" {
+			continue
+		}
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	params := make([]string, len(sqlColumns))
+	for i := range params {
+		params[i] = placeholder
+		if placeholder == "$" {
+			params[i] = fmt.Sprintf("$%d", i+1)
+		}
+	}
+	s := &SQL{
+		db: db,
+		insert: fmt.Sprintf("INSERT INTO connections (%s) VALUES (%s)",
+			strings.Join(sqlColumns, ", "), strings.Join(params, ", ")),
+		logger: logger,
+	}
+	s.batch = newBatcher(sqlQueueSize, sqlBatchSize, sqlFlushInterval, s.flush)
+	return s, nil
+}
+
+// Start writing queued rows
+func (s *SQL) Start() {
+	go s.batch.run()
+}
+
+// Closed queues the finished connection without blocking, returning false if it was dropped
+func (s *SQL) Closed(e Event) bool {
+	return s.batch.offer(e)
+}
+
+// flush writes the batch in one transaction, dropping it on failure
+func (s *SQL) flush(batch []Event) {
+	if err := s.write(batch); err != nil {
+		metrics.DroppedSinkEvents.Add(int64(len(batch)))
+		s.logger.Warn().Err(err).Int("dropped", len(batch)).Msg("dropped sql rows")
+	}
+}
+
+func (s *SQL) write(batch []Event) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(s.insert)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, e := range batch {
+		if _, err := stmt.Exec(sqlRow(e)...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// sqlRow returns the values of sqlColumns
+func sqlRow(e Event) []any {
+	// the column is an integer, a port which does not parse is stored as 0
+	port, _ := strconv.Atoi(e.DstPort)
+	return []any{
+		e.Time.UTC(), e.Network, e.Attacker, port, e.UUID, e.Hash, e.Driver, e.TLSUnwrap,
+		e.BytesIn, e.BytesOut, e.DurationMS, e.Country, e.City, int64(e.ASN), e.ASOrg,
+	}
+}
+
+// Close writes nothing further and closes the database
+func (s *SQL) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,47 @@
+package sink
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSQLite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.db")
+	s, err := NewSQLite(path, zerolog.Nop())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer s.Close()
+
+	now := time.Now()
+	assert.NoError(t, s.write([]Event{
+		{Time: now, Network: "tcp", Attacker: "192.0.2.1", DstPort: "445", UUID: "a", Hash: "abc", Driver: "smb", ASN: 64500, BytesIn: 10, DurationMS: 5},
+		{Time: now, Network: "tcp", Attacker: "192.0.2.2", DstPort: "22", UUID: "b"},
+	}))
+
+	var count int
+	var bytesIn int64
+	err = s.db.QueryRow("SELECT COUNT(*), SUM(bytes_in) FROM connections WHERE asn = ? AND dstport = ?", 64500, 445).Scan(&count, &bytesIn)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1, count)
+		assert.Equal(t, int64(10), bytesIn)
+	}
+
+	// ports are stored as integers, not text
+	var kind string
+	if assert.NoError(t, s.db.QueryRow("SELECT DISTINCT typeof(dstport) FROM connections").Scan(&kind)) {
+		assert.Equal(t, "integer", kind)
+	}
+
+	// reopening keeps the schema and rows
+	again, err := NewSQLite(path, zerolog.Nop())
+	if assert.NoError(t, err) {
+		defer again.Close()
+		assert.NoError(t, again.db.QueryRow("SELECT COUNT(*) FROM connections").Scan(&count))
+		assert.Equal(t, 2, count)
+	}
+}
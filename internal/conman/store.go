@@ -2,9 +2,24 @@ package conman
 
 import (
 	"bytes"
-	"io/ioutil"
+	"compress/gzip"
+	"context"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
+	"time"
 
+	"github.com/antihax/gambit/internal/drivers"
+	"github.com/antihax/gambit/internal/muxconn"
 	"github.com/antihax/gambit/internal/store"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
@@ -12,64 +27,414 @@ import (
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
-// Store data if needed
-func (s *ConnectionManager) store(filename, location string, data []byte) error {
-	// write out
+var errStoreSetup = errors.New("store is already set up")
 
-	if s.config.OutputFolder != "" {
-		if err := ioutil.WriteFile(s.config.OutputFolder+"/"+location+"/"+filename, s.Sanitize(data), 0644); err != nil {
-			s.logger.Debug().Err(err).Msg("error saving raw data")
-			return err
+// store sanitizes the data and fans it out to each registered storer
+func (s *ConnectionManager) store(file store.File) {
+	defer file.Release()
+	file.Truncate(s.config.MaxCaptureBytes)
+
+	// raw captures are named by their hash, skip those another honeypot
+	// sharing the dedup backend has stored
+	rawClaim := ""
+	if file.Location == "raw" && s.dedup != nil {
+		if s.sharedHashSeen("raw:" + file.Filename) {
+			s.rememberHash(file.Filename)
+			return
 		}
+		rawClaim = "raw:" + file.Filename
 	}
-	// upload to s3
-	if s.uploader != nil {
-		if _, err := s.uploader.Upload(&s3manager.UploadInput{
-			Bucket: aws.String(s.config.S3Bucket),
-			Key:    aws.String(location + "/" + filename),
-			Body:   ioutil.NopCloser(bytes.NewReader(s.Sanitize(data))),
-		}); err != nil {
-			s.logger.Debug().Err(err).Msg("error saving raw data")
-			return err
+
+	content, filename, contentHash, err := s.prepare(file)
+	if err != nil {
+		s.logger.Debug().Err(err).Str("filename", file.Filename).Msg("error preparing data")
+		s.forgetShared(rawClaim)
+		return
+	}
+	defer content.Release()
+
+	// skip remote backends if this content was already uploaded, claiming it
+	// otherwise so other pumps, and honeypots sharing the backend, skip it
+	uploaded, claimed, uploadClaim := false, false, ""
+	if s.config.DedupUploads && s.hasRemoteStorer() {
+		_, uploaded = s.uploadedHashes.LoadOrAdd(contentHash, struct{}{})
+		claimed = !uploaded
+		if !uploaded && s.dedup != nil {
+			if uploaded = s.sharedHashSeen("upload:" + contentHash); !uploaded {
+				uploadClaim = "upload:" + contentHash
+			}
 		}
 	}
-	s.knownHashes.Store(filename, true)
-	return nil
+
+	failed, uploadFailed := false, false
+	for _, storer := range s.storers {
+		remote, ok := storer.(store.RemoteStorer)
+		isRemote := ok && remote.Remote()
+		if isRemote && uploaded {
+			continue
+		}
+
+		if content.Streamed() {
+			err = store.StoreStream(storer, filename, file.Location, content.Reader)
+		} else {
+			err = storer.Store(filename, file.Location, content.Data)
+		}
+		if err != nil && storer == s.archive {
+			s.logger.Warn().Err(err).
+				Str("location", file.Location).
+				Str("filename", filename).
+				Msg("error archiving data")
+			continue
+		}
+		if err != nil {
+			s.logger.Debug().Err(err).
+				Str("storer", storer.Name()).
+				Str("location", file.Location).
+				Str("filename", filename).
+				Bool("truncated", file.Truncated).
+				Msg("error saving data")
+			failed = true
+			uploadFailed = uploadFailed || isRemote
+		}
+	}
+
+	// a failed upload is released so it is tried again
+	if uploadFailed {
+		if claimed {
+			s.uploadedHashes.Remove(contentHash)
+		}
+		s.forgetShared(uploadClaim)
+	}
+
+	// only remember the file once every backend has it
+	if !failed {
+		s.rememberHash(file.Filename)
+	} else {
+		s.forgetShared(rawClaim)
+	}
+}
+
+// hasRemoteStorer reports if any backend uploads, otherwise there is nothing to dedup uploads against
+func (s *ConnectionManager) hasRemoteStorer() bool {
+	for _, storer := range s.storers {
+		if remote, ok := storer.(store.RemoteStorer); ok && remote.Remote() {
+			return true
+		}
+	}
+	return false
+}
+
+// prepare sanitizes and optionally compresses the content of file, returning
+// it with the name to store it as and the hash of the uncompressed content.
+// Streamed files are processed into a new spool and never held in memory.
+func (s *ConnectionManager) prepare(file store.File) (content store.File, filename, contentHash string, err error) {
+	// small captures are compressed in memory, anything larger goes through
+	// the spool so the compressed copy is not held alongside the original
+	if !file.Streamed() && !s.spooled(len(file.Data)) {
+		data := s.Sanitize(file.Data)
+		contentHash = drivers.GetHash(data)
+		if s.config.CompressOutput {
+			if data, err = store.Gzip(data); err != nil {
+				return content, "", "", err
+			}
+		}
+		content.Data = data
+	} else {
+		r, err := file.Reader()
+		if err != nil {
+			return content, "", "", err
+		}
+		defer r.Close()
+
+		// compress once for every backend, hashes are of the original content
+		spool := store.NewSpool(int64(s.config.StreamCaptureBytes))
+		h := sha1.New()
+		var (
+			w  io.Writer = spool
+			gz *gzip.Writer
+		)
+		if s.config.CompressOutput {
+			gz = gzip.NewWriter(spool)
+			w = gz
+		}
+		if err := s.sanitizeStream(io.MultiWriter(w, h), r); err != nil {
+			spool.Close()
+			return content, "", "", err
+		}
+		if gz != nil {
+			if err := gz.Close(); err != nil {
+				spool.Close()
+				return content, "", "", err
+			}
+		}
+		if err := spool.Fill(&content); err != nil {
+			return content, "", "", err
+		}
+		contentHash = hex.EncodeToString(h.Sum(nil))
+	}
+
+	filename = store.ExpandName(s.config.FileNameTemplate, file, contentHash, time.Now())
+	if s.config.CompressOutput {
+		filename += store.GzipExtension
+	}
+	return content, filename, contentHash, nil
+}
+
+// spooled reports if a capture of size bytes is too large to keep in memory
+func (s *ConnectionManager) spooled(size int) bool {
+	return s.config.StreamCaptureBytes > 0 && size > s.config.StreamCaptureBytes
+}
+
+// capturePcap starts recording the connection if pcaps are enabled
+func (s *ConnectionManager) capturePcap(raw *muxconn.MuxConn, allowed bool) {
+	if s.config.CapturePcap && !allowed {
+		raw.CapturePcap(int64(s.config.MaxCaptureBytes))
+	}
+}
+
+// storePcap saves the recording of a connection matched to a driver once it closes
+func (s *ConnectionManager) storePcap(ch chan store.File, raw *muxconn.MuxConn, ip, port string) {
+	if !s.config.CapturePcap {
+		return
+	}
+	raw.OnClose(func() {
+		data, truncated := raw.Pcap()
+		if data == nil {
+			return
+		}
+		store.Offer(ch, store.File{
+			Filename:  raw.GetUUID() + ".pcap",
+			Location:  "pcap",
+			Data:      data,
+			Attacker:  ip,
+			DstPort:   port,
+			UUID:      raw.GetUUID(),
+			Truncated: truncated,
+		})
+	})
+}
+
+// newSamplers creates a capture sampler for each driver with limits
+func newSamplers(every map[string]int, perSecond map[string]float64) map[string]*store.Sampler {
+	samplers := make(map[string]*store.Sampler)
+	for driver := range every {
+		samplers[driver] = store.NewSampler(every[driver], perSecond[driver])
+	}
+	for driver := range perSecond {
+		if _, ok := samplers[driver]; !ok {
+			samplers[driver] = store.NewSampler(0, perSecond[driver])
+		}
+	}
+	return samplers
+}
+
+// rawHashKnown reports if raw data with this hash was stored already. Only
+// hashes known here are checked, so connections never wait on the network,
+// the store pump checks with any shared dedup backend before storing.
+func (s *ConnectionManager) rawHashKnown(hash string) bool {
+	_, ok := s.knownHashes.Load(hash)
+	return ok
+}
+
+// sharedHashSeen records the key with the dedup backend, failing open so
+// captures are stored when the backend cannot be reached
+func (s *ConnectionManager) sharedHashSeen(key string) bool {
+	seen, err := s.dedup.HashSeen(key)
+	if err != nil {
+		s.logger.Debug().Err(err).Str("key", key).Msg("error checking shared dedup")
+		return false
+	}
+	return seen
+}
+
+// forgetShared releases a key claimed for a capture which failed to store
+func (s *ConnectionManager) forgetShared(key string) {
+	if key == "" {
+		return
+	}
+	if err := s.dedup.Forget(key); err != nil {
+		s.logger.Debug().Err(err).Str("key", key).Msg("error releasing shared dedup")
+	}
 }
 
 // read files to store
 func (s *ConnectionManager) storePump() {
+	defer s.storePumps.Done()
 	for {
-		file := <-s.storeChan
-		if err := s.store(file.Filename, file.Location, file.Data); err != nil {
-			s.storeChan <- file
+		select {
+		case file := <-s.storeChan:
+			s.safeStore(file)
+		case <-s.storeDone:
+			// save what was queued before closing, then stop
+			for {
+				select {
+				case file := <-s.storeChan:
+					s.safeStore(file)
+				default:
+					return
+				}
+			}
 		}
 	}
 }
 
-func (s *ConnectionManager) setupStore() error {
-	s.storeChan = make(chan store.File, 1000)
+// safeStore stores the file, recovering so one bad backend cannot kill the pump
+func (s *ConnectionManager) safeStore(file store.File) {
+	defer func() {
+		if r := recover(); r != nil {
+			s.logger.Error().
+				Interface("panic", r).
+				Str("location", file.Location).
+				Str("filename", file.Filename).
+				Msg("recovered while saving data")
+		}
+	}()
+	s.store(file)
+}
 
-	// setup local storage
-	if s.config.OutputFolder == "." {
-		pwd, err := os.Getwd()
+// closeStore stops the pumps and waits up to timeout for them to save what is
+// already queued, returning false if they did not finish. Captures offered
+// later are left in the channel and never stored.
+func (s *ConnectionManager) closeStore(timeout time.Duration) bool {
+	if s.storeChan == nil {
+		return true
+	}
+	s.storeOnce.Do(func() { close(s.storeDone) })
+	done := make(chan struct{})
+	go func() {
+		s.storePumps.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		s.logger.Warn().Int("queued", len(s.storeChan)).Msg("gave up waiting for the store")
+		return false
+	}
+}
+
+// offerRaw queues the start of a connection to be stored under its hash. The
+// data is copied as buf is the connection's read buffer, which is reused
+// long before the store gets to it.
+func (s *ConnectionManager) offerRaw(ch chan store.File, buf []byte, hash, ip, port, uuid string) {
+	f := store.File{
+		Filename: hash, Location: "raw", Data: bytes.Clone(buf),
+		Attacker: ip, DstPort: port, UUID: uuid,
+	}
+	f.Truncate(s.config.MaxCaptureBytes)
+	store.Offer(ch, f)
+}
+
+// storeBanner records the banner sent before any driver took the connection,
+// named like the outbound side of a driver's transcript so the pair can be read together
+func (s *ConnectionManager) storeBanner(muc *muxconn.MuxConn, port uint16, b banner) {
+	ip, _, _ := net.SplitHostPort(muc.RemoteAddr().String())
+	s.logger.Debug().
+		Str("attacker", ip).
+		Uint16("dstport", port).
+		Str("uuid", muc.GetUUID()).
+		Str("banner", b.source).
+		Int("size", len(b.data)).
+		Msg("sent banner")
+	// banners are never modified so need no copy
+	store.Offer(s.storeChan, store.File{
+		Filename: fmt.Sprintf("%s.banner.%s", muc.GetUUID(), drivers.DirectionOutbound),
+		Location: "sessions",
+		Data:     b.data,
+		Attacker: ip,
+		DstPort:  strconv.Itoa(int(port)),
+		UUID:     muc.GetUUID(),
+	})
+}
+
+// AddStorer registers an additional storage backend
+func (s *ConnectionManager) AddStorer(storer store.Storer) {
+	if s.config.StoragePrefix != "" {
+		hostname, _ := os.Hostname()
+		storer = store.NewPrefix(storer, s.config.StoragePrefix, hostname)
+	}
+	s.storers = append(s.storers, storer)
+}
+
+// addRemoteStorer registers a storage backend which retries failures
+func (s *ConnectionManager) addRemoteStorer(storer store.Storer) {
+	s.AddStorer(store.NewRetry(storer,
+		s.config.UploadMaxRetries,
+		time.Millisecond*time.Duration(s.config.UploadRetryBackoff),
+	))
+}
+
+// normalizeFolder makes the output folder absolute without a trailing separator,
+// so every path is built the same way with filepath.Join. Empty disables local storage.
+func normalizeFolder(folder string) (string, error) {
+	if folder == "" {
+		return "", nil
+	}
+	return filepath.Abs(folder)
+}
+
+// s3HTTPClient trusts the system roots plus those in caFile, or nothing at all if insecure
+func s3HTTPClient(caFile string, insecure bool) (*http.Client, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecure}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		s.config.OutputFolder = pwd + string(os.PathSeparator)
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport}, nil
+}
+
+// setupStore creates the storage backends and starts the pumps feeding them,
+// it may only be called once as the pumps hold the channel it creates
+func (s *ConnectionManager) setupStore() error {
+	if s.storeChan != nil {
+		return errStoreSetup
 	}
+	s.storeChan = make(chan store.File, s.config.StoreChanSize)
+	s.storeDone = make(chan struct{})
 
-	if _, err := os.Stat(s.config.OutputFolder); os.IsNotExist(err) {
+	// setup local storage
+	folder, err := normalizeFolder(s.config.OutputFolder)
+	if err != nil {
 		return err
 	}
+	s.config.OutputFolder = folder
 
 	if s.config.OutputFolder != "" {
-		if err := os.Mkdir(s.config.OutputFolder+"raw", 0755); err != nil {
-			s.logger.Debug().Err(err).Msg("error with raw data")
+		// other locations are created as they are first written to
+		for _, location := range []string{"raw", "sessions"} {
+			if err := os.MkdirAll(filepath.Join(s.config.OutputFolder, location), s.config.DirMode.Mode()); err != nil {
+				return err
+			}
 		}
-		if err := os.Mkdir(s.config.OutputFolder+"sessions", 0755); err != nil {
-			s.logger.Debug().Err(err).Msg("error with sessions data")
+		s.AddStorer(store.NewLocal(s.config.OutputFolder, s.config.FileMode.Mode(), s.config.DirMode.Mode()))
+	}
+
+	// setup the archive copy, partitioned on its own rather than by StoragePrefix
+	if s.config.ArchiveFolder != "" {
+		folder, err := normalizeFolder(s.config.ArchiveFolder)
+		if err != nil {
+			return err
+		}
+		s.config.ArchiveFolder = folder
+		s.archive = store.NewArchive(folder, s.config.ArchiveFileMode.Mode(), s.config.ArchiveDirMode.Mode())
+		if s.config.ArchivePrefix != "" {
+			hostname, _ := os.Hostname()
+			s.archive = store.NewPrefix(s.archive, s.config.ArchivePrefix, hostname)
 		}
+		s.storers = append(s.storers, s.archive)
 	}
 
 	// setup s3 storage
@@ -79,19 +444,62 @@ func (s *ConnectionManager) setupStore() error {
 			Endpoint:         aws.String(s.config.S3Endpoint),
 			Region:           aws.String(s.config.S3Region),
 			S3ForcePathStyle: aws.Bool(true),
-			MaxRetries:       aws.Int(10),
+			// failures are retried by the Retry storer, retrying in the sdk too multiplies the attempts
+			MaxRetries: aws.Int(0),
+		}
+		if s.config.S3CACertFile != "" || s.config.S3Insecure {
+			client, err := s3HTTPClient(s.config.S3CACertFile, s.config.S3Insecure)
+			if err != nil {
+				return err
+			}
+			s3Config.HTTPClient = client
 		}
 		sess, err := session.NewSession(s3Config)
 		if err != nil {
 			return err
 		}
-		s.uploader = s3manager.NewUploader(sess, func(u *s3manager.Uploader) {
+		uploader := s3manager.NewUploader(sess, func(u *s3manager.Uploader) {
 			u.LeavePartsOnError = false
 			u.Concurrency = 1
 		})
+		s.addRemoteStorer(store.NewS3(uploader, s.config.S3Bucket, store.S3Options{
+			SSE: s.config.S3SSE,
+			ACL: s.config.S3ACL,
+		}))
 	}
 
-	go s.storePump()
+	// setup google cloud storage
+	if s.config.GCSBucket != "" {
+		gcs, err := store.NewGCS(context.Background(), s.config.GCSBucket, s.config.GCSCredentialsFile)
+		if err != nil {
+			return err
+		}
+		s.addRemoteStorer(gcs)
+	}
+
+	// setup azure blob storage
+	if s.config.AzureContainer != "" {
+		azure, err := store.NewAzure(store.AzureOptions{
+			Account:   s.config.AzureAccount,
+			Container: s.config.AzureContainer,
+			Key:       s.config.AzureKey,
+			SAS:       s.config.AzureSAS,
+			Endpoint:  s.config.AzureEndpoint,
+		})
+		if err != nil {
+			return err
+		}
+		s.addRemoteStorer(azure)
+	}
+
+	workers := s.config.StoreWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	s.storePumps.Add(workers)
+	for i := 0; i < workers; i++ {
+		go s.storePump()
+	}
 
 	return nil
 }
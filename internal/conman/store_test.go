@@ -0,0 +1,396 @@
+package conman
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/antihax/gambit/internal/conman/config"
+	"github.com/antihax/gambit/internal/drivers"
+	"github.com/antihax/gambit/internal/store"
+	"github.com/antihax/gambit/pkg/lru"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeFolder(t *testing.T) {
+	dir := t.TempDir()
+	for _, folder := range []string{dir, dir + "/", dir + "//", dir + "/./"} {
+		got, err := normalizeFolder(folder)
+		assert.NoError(t, err)
+		assert.Equal(t, dir, got, folder)
+	}
+
+	got, err := normalizeFolder("")
+	assert.NoError(t, err)
+	assert.Empty(t, got)
+
+	pwd, _ := os.Getwd()
+	got, err = normalizeFolder(".")
+	assert.NoError(t, err)
+	assert.Equal(t, pwd, got)
+}
+
+func TestSetupStoreFolder(t *testing.T) {
+	for _, suffix := range []string{"", "/"} {
+		dir := filepath.Join(t.TempDir(), "gambit")
+		s := &ConnectionManager{
+			config: &config.Config{OutputFolder: dir + suffix, FileNameTemplate: store.DefaultNameTemplate},
+			logger: zerolog.Nop(),
+		}
+		if !assert.NoError(t, s.setupStore()) {
+			continue
+		}
+
+		// the folders made are the ones written to
+		assert.DirExists(t, filepath.Join(dir, "raw"))
+		assert.NoDirExists(t, dir+"raw")
+		s.store(store.File{Filename: "abc", Location: "raw", Data: []byte("payload")})
+		assert.FileExists(t, filepath.Join(dir, "raw", "abc"))
+	}
+}
+
+func TestSetupStoreNoFolder(t *testing.T) {
+	s := &ConnectionManager{config: &config.Config{}, logger: zerolog.Nop()}
+	assert.NoError(t, s.setupStore())
+	assert.Empty(t, s.storers)
+}
+
+// fakeDedup shares seen hashes in memory, failing when err is set
+type fakeDedup struct {
+	seen map[string]bool
+	err  error
+}
+
+func (f *fakeDedup) HashSeen(hash string) (bool, error) {
+	if f.err != nil {
+		return false, f.err
+	}
+	seen := f.seen[hash]
+	f.seen[hash] = true
+	return seen, nil
+}
+
+func (f *fakeDedup) Forget(hash string) error {
+	delete(f.seen, hash)
+	return f.err
+}
+
+// memStorer keeps what it is given, failing when err is set
+type memStorer struct {
+	files map[string][]byte
+	err   error
+}
+
+func (m *memStorer) Name() string { return "memory" }
+
+func (m *memStorer) Store(filename, location string, data []byte) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.files[location+"/"+filename] = data
+	return nil
+}
+
+func TestSharedDedup(t *testing.T) {
+	shared := &fakeDedup{seen: make(map[string]bool)}
+	newManager := func() (*ConnectionManager, *memStorer) {
+		m := &memStorer{files: make(map[string][]byte)}
+		return &ConnectionManager{
+			config:  &config.Config{FileNameTemplate: store.DefaultNameTemplate, DedupUploads: true},
+			dedup:   shared,
+			storers: []store.Storer{m},
+			logger:  zerolog.Nop(),
+		}, m
+	}
+	a, aFiles := newManager()
+	b, bFiles := newManager()
+	raw := func(hash string) store.File {
+		return store.File{Filename: hash, Location: "raw", Data: []byte(hash)}
+	}
+
+	// the first node to store a hash keeps it, others skip it
+	a.store(raw("abc"))
+	b.store(raw("abc"))
+	assert.Contains(t, aFiles.files, "raw/abc")
+	assert.NotContains(t, bFiles.files, "raw/abc")
+	assert.True(t, b.rawHashKnown("abc"), "remembered locally")
+
+	// connections only check locally
+	c, _ := newManager()
+	assert.False(t, c.rawHashKnown("abc"))
+
+	// a node failing to store releases the hash for the next
+	aFiles.err = errors.New("full")
+	a.store(raw("def"))
+	b.store(raw("def"))
+	assert.Contains(t, bFiles.files, "raw/def")
+
+	// without a remote backend there are no uploads to dedup
+	assert.NotContains(t, shared.seen, "upload:"+drivers.GetHash([]byte("abc")))
+
+	// and stores anyway if the backend is down
+	shared.err = errors.New("down")
+	b.store(raw("ghi"))
+	assert.Contains(t, bFiles.files, "raw/ghi")
+}
+
+func TestOfferRawCopies(t *testing.T) {
+	s := &ConnectionManager{config: &config.Config{}, storeChan: make(chan store.File, 1)}
+
+	// the read buffer goes back to the pool and is reused before the store runs
+	buf := []byte("first payload")
+	s.offerRaw(s.storeChan, buf, "abc", "192.0.2.1", "80", "uuid")
+	copy(buf, "reused buffer")
+	f := <-s.storeChan
+	assert.Equal(t, "first payload", string(f.Data))
+	assert.Equal(t, "192.0.2.1", f.Attacker)
+
+	drivers.StoreHash(buf, s.storeChan)
+	copy(buf, "overwritten!!")
+	f = <-s.storeChan
+	assert.Equal(t, "reused buffer", string(f.Data))
+}
+
+func TestStoreStreamed(t *testing.T) {
+	dir := t.TempDir()
+	s := &ConnectionManager{
+		config: &config.Config{
+			OutputFolder:       dir,
+			FileNameTemplate:   store.DefaultNameTemplate,
+			Sanitize:           true,
+			StreamCaptureBytes: 64,
+		},
+		addresses: []net.IP{net.ParseIP("192.0.2.10")},
+		logger:    zerolog.Nop(),
+	}
+	if !assert.NoError(t, s.setupStore()) {
+		return
+	}
+
+	// spread the address across reads of the spool
+	spool := store.NewSpool(64)
+	want := strings.Repeat("-", 32*1024-4)
+	spool.Write([]byte(want + "192.0.2.10" + want))
+	f := store.File{Filename: "abc", Location: "sessions"}
+	if !assert.NoError(t, spool.Fill(&f)) || !assert.True(t, f.Streamed()) {
+		return
+	}
+	s.store(f)
+
+	data, err := os.ReadFile(filepath.Join(dir, "sessions", "abc"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, want+"xxx.xxx.xxx.xxx"+want, string(data))
+	}
+}
+
+func TestPrepareSpoolsLargeCapture(t *testing.T) {
+	s := &ConnectionManager{
+		config: &config.Config{
+			FileNameTemplate:   store.DefaultNameTemplate,
+			Sanitize:           true,
+			CompressOutput:     true,
+			StreamCaptureBytes: 64,
+		},
+		addresses: []net.IP{net.ParseIP("192.0.2.10")},
+	}
+
+	// a large in memory capture is compressed into the spool, not a second buffer
+	want := strings.Repeat("-", 32*1024)
+	content, filename, _, err := s.prepare(store.File{Filename: "abc", Data: []byte(want + "192.0.2.10")})
+	if !assert.NoError(t, err) || !assert.True(t, content.Streamed()) {
+		return
+	}
+	defer content.Release()
+	assert.True(t, strings.HasSuffix(filename, store.GzipExtension))
+
+	r, err := content.Reader()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer r.Close()
+	gz, err := gzip.NewReader(r)
+	if !assert.NoError(t, err) {
+		return
+	}
+	data, err := io.ReadAll(gz)
+	if assert.NoError(t, err) {
+		assert.Equal(t, want+"xxx.xxx.xxx.xxx", string(data))
+	}
+
+	// small ones stay in memory
+	content, _, _, err = s.prepare(store.File{Filename: "abc", Data: []byte("small")})
+	if assert.NoError(t, err) {
+		assert.False(t, content.Streamed())
+	}
+}
+
+func TestStoreArchive(t *testing.T) {
+	newManager := func(dir, archive string) *ConnectionManager {
+		s := &ConnectionManager{
+			config: &config.Config{
+				OutputFolder:     dir,
+				ArchiveFolder:    archive,
+				ArchivePrefix:    "{date}",
+				FileNameTemplate: store.DefaultNameTemplate,
+			},
+			logger: zerolog.Nop(),
+		}
+		if !assert.NoError(t, s.setupStore()) {
+			t.FailNow()
+		}
+		t.Cleanup(func() { s.closeStore(time.Second) })
+		return s
+	}
+
+	dir, archive := t.TempDir(), t.TempDir()
+	s := newManager(dir, archive)
+	s.store(store.File{Filename: "abc", Location: "raw", Data: []byte("payload")})
+	assert.FileExists(t, filepath.Join(dir, "raw", "abc"))
+	assert.FileExists(t, filepath.Join(archive, time.Now().UTC().Format(store.DateFormat), "raw", "abc"))
+
+	// the pumps own the channel, so the store cannot be set up again
+	assert.ErrorIs(t, s.setupStore(), errStoreSetup)
+
+	// an archive which cannot be written does not hold back the capture
+	blocked := filepath.Join(t.TempDir(), "file")
+	assert.NoError(t, os.WriteFile(blocked, nil, 0600))
+	s = newManager(dir, blocked)
+	s.store(store.File{Filename: "def", Location: "raw", Data: []byte("payload")})
+	assert.FileExists(t, filepath.Join(dir, "raw", "def"))
+	assert.True(t, s.rawHashKnown("def"))
+}
+
+func TestCloseStore(t *testing.T) {
+	dir := t.TempDir()
+	s := &ConnectionManager{
+		config: &config.Config{
+			OutputFolder:     dir,
+			FileNameTemplate: store.DefaultNameTemplate,
+			StoreChanSize:    10,
+			StoreWorkers:     2,
+		},
+		logger: zerolog.Nop(),
+	}
+	if !assert.NoError(t, s.setupStore()) {
+		return
+	}
+
+	// whatever is queued is saved before closing returns
+	for _, name := range []string{"a", "b", "c"} {
+		assert.True(t, store.Offer(s.storeChan, store.File{Filename: name, Location: "raw", Data: []byte(name)}))
+	}
+	assert.True(t, s.closeStore(time.Second*5))
+	for _, name := range []string{"a", "b", "c"} {
+		assert.FileExists(t, filepath.Join(dir, "raw", name))
+	}
+
+	// late captures are never stored rather than panicking, and closing again is harmless
+	store.Offer(s.storeChan, store.File{Filename: "d", Location: "raw", Data: []byte("d")})
+	assert.True(t, s.closeStore(time.Second))
+	assert.NoFileExists(t, filepath.Join(dir, "raw", "d"))
+}
+
+func TestStoreFanOut(t *testing.T) {
+	first := &memStorer{files: make(map[string][]byte)}
+	second := &memStorer{files: make(map[string][]byte)}
+	s := &ConnectionManager{
+		config:  &config.Config{FileNameTemplate: store.DefaultNameTemplate},
+		logger:  zerolog.Nop(),
+		storers: []store.Storer{first, second},
+	}
+
+	// every backend is given the file
+	s.store(store.File{Filename: "abc", Location: "raw", Data: []byte("payload")})
+	assert.Equal(t, []byte("payload"), first.files["raw/abc"])
+	assert.Equal(t, []byte("payload"), second.files["raw/abc"])
+	assert.True(t, s.rawHashKnown("abc"))
+
+	// one failing still leaves the other with a copy, but the hash is not remembered
+	second.err = errors.New("unavailable")
+	s.store(store.File{Filename: "def", Location: "raw", Data: []byte("payload")})
+	assert.Equal(t, []byte("payload"), first.files["raw/def"])
+	assert.NotContains(t, second.files, "raw/def")
+	assert.False(t, s.rawHashKnown("def"))
+}
+
+// panicStorer panics on one filename and keeps the rest
+type panicStorer struct {
+	memStorer
+	panicOn string
+}
+
+func (m *panicStorer) Store(filename, location string, data []byte) error {
+	if filename == m.panicOn {
+		panic("storer failed")
+	}
+	return m.memStorer.Store(filename, location, data)
+}
+
+func TestStorePumpRecovers(t *testing.T) {
+	storer := &panicStorer{memStorer: memStorer{files: make(map[string][]byte)}, panicOn: "bad"}
+	s := &ConnectionManager{
+		config:    &config.Config{FileNameTemplate: store.DefaultNameTemplate},
+		logger:    zerolog.Nop(),
+		storers:   []store.Storer{storer},
+		storeChan: make(chan store.File, 10),
+		storeDone: make(chan struct{}),
+	}
+	s.storePumps.Add(1)
+	go s.storePump()
+
+	// the panic is recovered and the pump carries on with the next file
+	store.Offer(s.storeChan, store.File{Filename: "bad", Location: "raw", Data: []byte("bad")})
+	store.Offer(s.storeChan, store.File{Filename: "good", Location: "raw", Data: []byte("good")})
+	assert.True(t, s.closeStore(time.Second*5))
+	assert.Equal(t, map[string][]byte{"raw/good": []byte("good")}, storer.files)
+}
+
+// remoteMemStorer is a memStorer counted as remote storage
+type remoteMemStorer struct {
+	memStorer
+	uploads int
+}
+
+func (m *remoteMemStorer) Remote() bool { return true }
+
+func (m *remoteMemStorer) Store(filename, location string, data []byte) error {
+	m.uploads++
+	return m.memStorer.Store(filename, location, data)
+}
+
+func TestUploadDedup(t *testing.T) {
+	remote := &remoteMemStorer{memStorer: memStorer{files: make(map[string][]byte)}}
+	s := &ConnectionManager{
+		config:         &config.Config{FileNameTemplate: store.DefaultNameTemplate, DedupUploads: true},
+		storers:        []store.Storer{remote},
+		uploadedHashes: lru.New[string, struct{}](2),
+		logger:         zerolog.Nop(),
+	}
+	session := func(name, data string) store.File {
+		return store.File{Filename: name, Location: "sessions", Data: []byte(data)}
+	}
+
+	// a failed upload is tried again
+	remote.err = errors.New("down")
+	s.store(session("a", "payload"))
+	remote.err = nil
+	s.store(session("b", "payload"))
+	assert.Equal(t, 2, remote.uploads)
+
+	// then the same content is uploaded once
+	s.store(session("c", "payload"))
+	assert.Equal(t, 2, remote.uploads)
+
+	// and forgotten once pushed out of the set
+	s.store(session("d", "other"))
+	s.store(session("e", "another"))
+	s.store(session("f", "payload"))
+	assert.Equal(t, 5, remote.uploads)
+}
@@ -0,0 +1,93 @@
+package conman
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/antihax/gambit/internal/metrics"
+)
+
+// subscriberBuffer is how many events a stream client may fall behind before missing some
+const subscriberBuffer = 64
+
+// eventHub fans events out to live subscribers without ever blocking the publisher
+type eventHub struct {
+	sync.Mutex
+	subscribers map[chan RecentEvent]struct{}
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subscribers: make(map[chan RecentEvent]struct{})}
+}
+
+// Subscribe returns a channel of new events, call cancel to stop receiving them
+func (h *eventHub) Subscribe() (events <-chan RecentEvent, cancel func()) {
+	ch := make(chan RecentEvent, subscriberBuffer)
+	h.Lock()
+	h.subscribers[ch] = struct{}{}
+	h.Unlock()
+	return ch, func() {
+		h.Lock()
+		delete(h.subscribers, ch)
+		h.Unlock()
+	}
+}
+
+// Publish sends e to every subscriber, dropping it for those which are full
+func (h *eventHub) Publish(e RecentEvent) {
+	if h == nil {
+		return
+	}
+	h.Lock()
+	defer h.Unlock()
+	for ch := range h.subscribers {
+		select {
+		case ch <- e:
+		default:
+			metrics.DroppedStreamEvents.Add(1)
+		}
+	}
+}
+
+// Len returns the number of subscribers
+func (h *eventHub) Len() int {
+	h.Lock()
+	defer h.Unlock()
+	return len(h.subscribers)
+}
+
+// handleStream pushes new events to the client as server-sent events until it disconnects
+func (s *ConnectionManager) handleStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	events, cancel := s.eventHub.Subscribe()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-events:
+			data, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package conman
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventHub(t *testing.T) {
+	h := newEventHub()
+	events, cancel := h.Subscribe()
+	assert.Equal(t, 1, h.Len())
+
+	// slow subscribers miss events rather than blocking
+	for i := 0; i < subscriberBuffer+10; i++ {
+		h.Publish(RecentEvent{UUID: "a"})
+	}
+	assert.Len(t, events, subscriberBuffer)
+
+	cancel()
+	assert.Equal(t, 0, h.Len())
+}
+
+func TestHandleStream(t *testing.T) {
+	s := &ConnectionManager{recentEvents: newEventRing(10), eventHub: newEventHub(), logger: zerolog.Nop()}
+	srv := httptest.NewServer(http.HandlerFunc(s.handleStream))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	// wait for the handler to subscribe
+	assert.Eventually(t, func() bool { return s.eventHub.Len() == 1 }, time.Second, time.Millisecond*10)
+	s.recordEvent(RecentEvent{Network: "tcp", Attacker: "192.0.2.1", DstPort: "22", Driver: "sshd"}, nil)
+
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(line, "data: "))
+	assert.Contains(t, line, `"driver":"sshd"`)
+
+	// disconnecting removes the subscriber
+	resp.Body.Close()
+	assert.Eventually(t, func() bool { return s.eventHub.Len() == 0 }, time.Second, time.Millisecond*10)
+}
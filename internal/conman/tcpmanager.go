@@ -2,34 +2,47 @@ package conman
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"slices"
 	"strconv"
 	"sync"
 	"time"
 
 	"github.com/antihax/gambit/internal/conman/gctx"
+	"github.com/antihax/gambit/internal/conman/notify"
 	"github.com/antihax/gambit/internal/drivers"
+	"github.com/antihax/gambit/internal/metrics"
 	"github.com/antihax/gambit/internal/muxconn"
-	"github.com/antihax/gambit/internal/store"
+	"github.com/antihax/gambit/pkg/ja3"
 	"github.com/antihax/gambit/pkg/probe"
+	"github.com/antihax/gambit/pkg/proxyproto"
 )
 
 // tcpManager listens for unknown packets and fires up listeners to handle
-// in the future
-func (s *ConnectionManager) tcpManager() {
-	conn, err := net.ListenIP("ip:tcp", nil)
+// in the future, until ctx is done
+func (s *ConnectionManager) tcpManager(ctx context.Context) error {
+	conn, err := listenRaw("ip:tcp", nil)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("opening raw tcp socket, this needs root or CAP_NET_RAW: %w", err)
 	}
+	s.ready.tcpManager.Store(true)
+	context.AfterFunc(ctx, func() {
+		conn.Close()
+		s.ready.tcpManager.Store(false)
+	})
 
 	go func() {
+		// read max MTU if available, packets are done with before the next is read
+		buf := make([]byte, readBufferSize)
 		for {
-			// read max MTU if available
-			buf := make([]byte, 1500)
 			n, addr, err := conn.ReadFrom(buf)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			if err != nil { // get out if we error
 				s.logger.Trace().Err(err).
 					Str("network", "tcp").
@@ -52,6 +65,7 @@ func (s *ConnectionManager) tcpManager() {
 			}
 		}
 	}()
+	return nil
 }
 
 // CreateTCPListener will create a new listener if one does not already exist and return if it was created or not.
@@ -59,17 +73,37 @@ func (s *ConnectionManager) CreateTCPListener(port uint16) (bool, error) {
 	if port > s.config.MaxPort {
 		return false, errors.New("above config.Maxport")
 	}
+	if !s.config.PortAllowed(port) {
+		s.logger.Trace().Str("network", "tcp").Uint16("port", port).Msg("port not allowed")
+		return true, nil
+	}
 
 	// create a new listener if one does not already exist
 	s.tcpmu.Lock()
 	defer s.tcpmu.Unlock()
 	if _, ok := s.tcpListeners[port]; !ok {
-		addr := fmt.Sprintf("%s:%d", gctx.IPAddress, port)
-		ln, err := net.Listen("tcp", addr)
+		// ports held by other services are only retried after a backoff
+		if s.tcpBindFailures.blocked(port, time.Now()) {
+			return true, nil
+		}
+		ip, err := s.bindAddress()
 		if err != nil {
 			return true, err
 		}
+		ln, err := net.Listen("tcp", net.JoinHostPort(ip, strconv.Itoa(int(port))))
+		if err != nil {
+			metrics.ListenerBindFailures.Add(1)
+			backoff := s.tcpBindFailures.failed(port, time.Now())
+			s.logger.Debug().Err(err).
+				Str("network", "tcp").
+				Uint16("port", port).
+				Dur("retry_in", backoff).
+				Msg("failed to bind")
+			return true, err
+		}
+		s.tcpBindFailures.succeeded(port)
 		s.tcpListeners[port] = ln
+		metrics.TCPListeners.Set(int64(len(s.tcpListeners)))
 
 		// handle the connections
 		go func() {
@@ -77,11 +111,13 @@ func (s *ConnectionManager) CreateTCPListener(port uint16) (bool, error) {
 			for {
 				conn, err := ln.Accept()
 				if err != nil {
+					if errors.Is(err, net.ErrClosed) {
+						break
+					}
 					s.logger.Trace().Err(err).Msg("error accepting connection")
 					continue
 				}
-				wg.Add(1)
-				go s.handleConnection(conn, ln, &wg)
+				s.dispatch(conn, ln, &wg, s.handleConnection, "tcp")
 			}
 			wg.Wait()
 		}()
@@ -92,39 +128,139 @@ func (s *ConnectionManager) CreateTCPListener(port uint16) (bool, error) {
 	return true, nil
 }
 
+// ActiveListeners returns the TCP ports currently listening, in order
+func (s *ConnectionManager) ActiveListeners() []uint16 {
+	s.tcpmu.Lock()
+	defer s.tcpmu.Unlock()
+	ports := make([]uint16, 0, len(s.tcpListeners))
+	for port := range s.tcpListeners {
+		ports = append(ports, port)
+	}
+	slices.Sort(ports)
+	return ports
+}
+
+// ActiveListenerCount returns how many TCP ports are currently listening
+func (s *ConnectionManager) ActiveListenerCount() int {
+	s.tcpmu.Lock()
+	defer s.tcpmu.Unlock()
+	return len(s.tcpListeners)
+}
+
+// tuneTCP sets the keep-alive and linger of an accepted connection
+func (s *ConnectionManager) tuneTCP(conn net.Conn) {
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if s.config.KeepAlivePeriod > 0 {
+		tcp.SetKeepAlive(true)
+		tcp.SetKeepAlivePeriod(time.Second * time.Duration(s.config.KeepAlivePeriod))
+	} else {
+		tcp.SetKeepAlive(false)
+	}
+	if s.config.Linger >= 0 {
+		tcp.SetLinger(s.config.Linger)
+	}
+}
+
 func (s *ConnectionManager) handleConnection(conn net.Conn, root net.Listener, wg *sync.WaitGroup) {
 	defer wg.Done()
+	defer s.releaseConnection()
+	s.tuneTCP(conn)
+	// find the real client behind a load balancer before anything else
+	if s.config.ExpectProxyProtocol {
+		proxied, err := proxyproto.ReadHeader(conn, s.config.ProxyProtocolStrict, time.Second*5)
+		if err != nil {
+			s.logger.Trace().Err(err).
+				Str("network", "tcp").
+				Str("address", conn.RemoteAddr().String()).
+				Msg("error reading proxy protocol")
+			conn.Close()
+			return
+		}
+		conn = proxied
+	}
+
+	// our own scanners and monitoring are left alone
+	allowed := s.allowListed(conn.RemoteAddr())
+	if allowed && s.config.AllowListDrop {
+		conn.Close()
+		return
+	}
+
 	// ban hammers
-	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && !allowed {
+		if s.config.PerIPConnRate > 0 && !s.rateLimiter.Allow(addr.IP.String()) {
+			metrics.RateLimitedConnections.Add(1)
+			conn.Close()
+			return
+		}
 		if s.banList.TickBanCounter(addr.IP.String()) {
 			conn.Close()
 			return
 		}
+		if s.blockedByReputation(conn, addr.IP, "tcp") {
+			return
+		}
 	}
 
 	// create our sniffer
-	ctx, globalutils := s.getGlobalContext()
+	ctx, globalutils := s.getGlobalContext(conn)
+	if allowed {
+		quietGlobals(globalutils)
+	}
 	muc, err := muxconn.NewMuxConn(ctx, conn)
 	if err != nil {
 		s.logger.Debug().Str("network", "tcp").Err(err).Msg("error building NewMuxConn")
 		return
 	}
 
-	r := muc.StartSniffing()
+	s.reapConnection(muc)
+	if s.config.ObserveOnly {
+		muc.DiscardWrites()
+	}
+	raw := muc // the connection on the wire, before any unwrapping
+	s.capturePcap(raw, allowed)
+
 	port := strconv.Itoa(root.Addr().(*net.TCPAddr).Port)
 	ip := conn.RemoteAddr().(*net.TCPAddr).IP.String()
 
+	// some drivers take every connection to their ports without sniffing
+	rules := s.rules.Load()
+	if rt, ok := rules.ports[uint16(root.Addr().(*net.TCPAddr).Port)]; ok {
+		s.injectPortRoute(muc, raw, globalutils, rt, ip, port, allowed)
+		return
+	}
+
+	r := muc.StartSniffing()
+
+	// servers speaking first take over if the attacker stays quiet, otherwise
 	// fire a request to send a banner if the attacker does not send first
 	bannerCtx, bannerCancel := context.WithCancel(context.Background())
-	go s.sendBanner(bannerCtx, muc, uint16(root.Addr().(*net.TCPAddr).Port))
+	fallback, hasFallback := rules.fallback[uint16(root.Addr().(*net.TCPAddr).Port)]
+	if hasFallback {
+		muc.SetReadDeadline(time.Now().Add(time.Second * time.Duration(rules.config.BannerDelay)))
+	} else {
+		go s.sendBanner(bannerCtx, rules, muc, uint16(root.Addr().(*net.TCPAddr).Port))
+	}
 
 	timeoutCtx, timeoutCancel := context.WithCancel(context.Background())
 	go s.timeoutConnection(timeoutCtx, muc)
 
 	// How are those first bytes tasting?
-	n := 1500
-	buf := make([]byte, n)
-	n, err = r.Read(buf)
+	pooled := getReadBuffer()
+	defer putReadBuffer(pooled)
+	buf := *pooled
+	n, err := r.Read(buf)
+	if hasFallback && n == 0 && isTimeout(err) {
+		bannerCancel()
+		timeoutCancel()
+		muc.SetReadDeadline(time.Time{})
+		muc.Reset()
+		s.injectPortRoute(muc, raw, globalutils, fallback, ip, port, allowed)
+		return
+	}
 	if err != nil {
 		if err != io.EOF {
 			s.logger.Trace().Err(err).
@@ -137,15 +273,32 @@ func (s *ConnectionManager) handleConnection(conn net.Conn, root net.Listener, w
 	timeoutCancel() // Cancel the timeout
 
 	tlsUnwrap := false
+	ja3Hash, sni, negotiated := "", "", ""
+	var alpn []string
 	// try unwrapping TLS/SSL
-	if buf[0] == 0x16 {
-		muc.DoneSniffing()
-		newMuxConn, newBuf, newN, err := s.decryptConn(ctx, muc, "tcp")
-		if err == nil {
-			muc = newMuxConn
-			buf = newBuf
-			n = newN
-			tlsUnwrap = true
+	if n > 0 && buf[0] == 0x16 {
+		// fingerprint the client, leaving anything else starting 0x16 alone
+		hello, helloErr := ja3.Parse(buf[:n])
+		if errors.Is(helloErr, ja3.ErrIncomplete) {
+			hello, helloErr = readClientHello(r, muc, buf[:n])
+		}
+		if helloErr == nil {
+			ja3Hash, alpn = hello.Hash(), hello.ALPN
+		}
+		if !errors.Is(helloErr, ja3.ErrNotClientHello) {
+			if plain, plainBuf, plainN, ok := s.unwrapTLS(ctx, muc, "tcp"); ok {
+				muc, buf, n = plain, plainBuf, plainN
+				tlsUnwrap = true
+				if tlsConn, ok := muc.Conn.(*tls.Conn); ok {
+					state := tlsConn.ConnectionState()
+					sni, negotiated = state.ServerName, state.NegotiatedProtocol
+				}
+				// the hello is kept on its own, otherwise it is the raw capture.
+				// Raw may alias the pooled buffer, StoreHash copies it.
+				if helloErr == nil {
+					drivers.StoreHash(hello.Raw, globalutils.Store)
+				}
+			}
 		}
 	}
 	muc.Reset()
@@ -163,33 +316,91 @@ func (s *ConnectionManager) handleConnection(conn net.Conn, root net.Listener, w
 		Str("dstport", port).
 		Str("hash", hash).
 		Logger()
+	globalutils.Logger = s.enrichLogger(globalutils.Logger, ip, port)
+	if ja3Hash != "" {
+		globalutils.Logger = globalutils.Logger.With().Str("ja3", ja3Hash).Logger()
+	}
+	if sni != "" {
+		globalutils.Logger = globalutils.Logger.With().Str("sni", sni).Logger()
+	}
+	if len(alpn) > 0 {
+		globalutils.Logger = globalutils.Logger.With().Strs("alpn", alpn).Logger()
+	}
+	s.logClose(raw, globalutils.Logger)
 
 	// log the connection
 	globalutils.Logger.Trace().Msgf("tcp knock")
 
 	// save the raw data
 	if n > 0 {
-		if _, ok := s.knownHashes.Load(hash); !ok {
-			s.storeChan <- store.File{Filename: hash, Location: "raw", Data: buf[:n]}
+		if !allowed && !s.rawHashKnown(hash) {
+			s.offerRaw(globalutils.Store, buf[:n], hash, ip, port, muc.GetUUID())
+			s.notifyNewHash(notify.NewEvent(hash, "tcp", ip, port, muc.GetUUID(), tlsUnwrap, buf[:n]))
 		}
 	}
 
 	// see if we match a rule and transfer the connection to the driver
-	entry := s.tcpRules.Match(buf)
+	rules = s.rules.Load()
+	entry := rules.tcp.Match(buf[:n])
 
 	// stop sniffing and pass to the driver listener
 	muc.Reset()
-	ln, ok := entry.(muxconn.Proxy)
-	if ok {
-		// pipe the connection into Accept()
-		ln.InjectConn(muc)
-	} else {
+	rt, ok := entry.(*route)
+	// the protocol agreed in the handshake says more than the first bytes
+	if alpnRoute, found := rules.alpn[negotiated]; found && negotiated != "" {
+		rt, ok = alpnRoute, true
+	}
+	if !ok && n > 0 {
 		// no driver
-		if n > 0 {
-			globalutils.Logger.Debug().Err(err).Msg("no driver")
+		globalutils.Logger.Debug().Err(err).Msg("no driver")
+
+		// keep the attacker talking if something will listen
+		if rules.catchAll != nil && err == nil {
+			rt, ok = rules.catchAll, true
 		}
+	}
+	if !allowed {
+		e := RecentEvent{Network: "tcp", Attacker: ip, DstPort: port, UUID: muc.GetUUID(), Hash: hash, TLSUnwrap: tlsUnwrap}
+		if ok {
+			e.Driver = rt.name
+		}
+		s.recordEvent(e, raw)
+	}
+	if ok {
+		markDriver(globalutils, rt.name)
+		globalutils.Logger.Info().Msg("driver matched")
+		s.storePcap(globalutils.Store, raw, ip, port)
 
+		// pipe the connection into Accept()
+		rt.proxy.InjectConn(muc)
+	} else {
 		// close the connection
 		muc.Close()
 	}
 }
+
+// injectPortRoute hands a connection to the driver routed by its port rather than its data
+func (s *ConnectionManager) injectPortRoute(muc, raw *muxconn.MuxConn, globalutils *gctx.GlobalUtils, rt *route, ip, port string, allowed bool) {
+	globalutils.MuxConn = muc
+	globalutils.Logger = globalutils.Logger.With().
+		Str("network", "tcp").
+		Str("attacker", ip).
+		Str("uuid", muc.GetUUID()).
+		Str("dstport", port).
+		Logger()
+	globalutils.Logger = s.enrichLogger(globalutils.Logger, ip, port)
+	markDriver(globalutils, rt.name)
+	s.logClose(raw, globalutils.Logger)
+	globalutils.Logger.Info().Msg("driver matched")
+	s.storePcap(globalutils.Store, raw, ip, port)
+	if !allowed {
+		s.recordEvent(RecentEvent{Network: "tcp", Attacker: ip, DstPort: port, UUID: muc.GetUUID(), Driver: rt.name}, raw)
+	}
+	rt.proxy.InjectConn(muc)
+}
+
+// isTimeout reports if err is a read deadline passing
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,64 @@
+package conman
+
+import (
+	"net"
+	"testing"
+
+	"github.com/antihax/gambit/internal/conman/config"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestTuneTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer ln.Close()
+
+	// dial a single client and accept its connection
+	accept := func() (client, server net.Conn, err error) {
+		if client, err = net.Dial("tcp", ln.Addr().String()); err != nil {
+			return nil, nil, err
+		}
+		if server, err = ln.Accept(); err != nil {
+			client.Close()
+			return nil, nil, err
+		}
+		return client, server, nil
+	}
+
+	sockopts := func(conn net.Conn) (keepAlive, idle int, linger *unix.Linger) {
+		raw, _ := conn.(*net.TCPConn).SyscallConn()
+		raw.Control(func(fd uintptr) {
+			keepAlive, _ = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_KEEPALIVE)
+			idle, _ = unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_KEEPIDLE)
+			linger, _ = unix.GetsockoptLinger(int(fd), unix.SOL_SOCKET, unix.SO_LINGER)
+		})
+		return
+	}
+
+	s := &ConnectionManager{config: &config.Config{KeepAlivePeriod: 45, Linger: 0}}
+	client, conn, err := accept()
+	if assert.NoError(t, err) {
+		s.tuneTCP(conn)
+		keepAlive, idle, linger := sockopts(conn)
+		assert.Equal(t, 1, keepAlive)
+		assert.Equal(t, 45, idle)
+		assert.Equal(t, int32(1), linger.Onoff)
+		assert.Equal(t, int32(0), linger.Linger)
+		conn.Close()
+		client.Close()
+	}
+
+	s.config = &config.Config{Linger: -1}
+	client, conn, err = accept()
+	if assert.NoError(t, err) {
+		s.tuneTCP(conn)
+		keepAlive, _, linger := sockopts(conn)
+		assert.Equal(t, 0, keepAlive)
+		assert.Equal(t, int32(0), linger.Onoff)
+		conn.Close()
+		client.Close()
+	}
+}
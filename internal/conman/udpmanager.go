@@ -4,16 +4,17 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"strconv"
 	"sync"
 	"time"
 
-	"github.com/antihax/gambit/internal/conman/gctx"
+	"github.com/antihax/gambit/internal/conman/notify"
 	"github.com/antihax/gambit/internal/drivers"
+	"github.com/antihax/gambit/internal/metrics"
 	"github.com/antihax/gambit/internal/muxconn"
-	"github.com/antihax/gambit/internal/store"
 	"github.com/lunixbochs/struc"
 	"github.com/pion/udp"
 )
@@ -27,17 +28,25 @@ type UDPHeader struct {
 }
 
 // udpManager listens for unknown packets and fires up listeners to handle
-// in the future
-func (s *ConnectionManager) udpManager() {
-	conn, err := net.ListenIP("ip4:udp", nil)
+// in the future, until ctx is done
+func (s *ConnectionManager) udpManager(ctx context.Context) error {
+	conn, err := listenRaw("ip4:udp", nil)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("opening raw udp socket, this needs root or CAP_NET_RAW: %w", err)
 	}
+	s.ready.udpManager.Store(true)
+	context.AfterFunc(ctx, func() {
+		conn.Close()
+		s.ready.udpManager.Store(false)
+	})
 	go func() {
 		for {
 			// read max MTU if available
 			buf := make([]byte, 1500)
 			_, addr, err := conn.ReadFrom(buf)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			if err != nil {
 				s.logger.Trace().Err(err).
 					Str("network", "udp").
@@ -49,7 +58,7 @@ func (s *ConnectionManager) udpManager() {
 			header := UDPHeader{}
 
 			struc.Unpack(reader, &header)
-			if s.config.PortIgnored(header.Destination) {
+			if !s.config.PortAllowed(header.Destination) {
 				continue
 			}
 			// see if we match a rule and transfer the connection to the driver
@@ -65,6 +74,7 @@ func (s *ConnectionManager) udpManager() {
 
 		}
 	}()
+	return nil
 }
 
 // CreateUDPListener will create a new listener if one does not already exist and return if it was created or not.
@@ -72,12 +82,20 @@ func (s *ConnectionManager) CreateUDPListener(port uint16) (bool, error) {
 	if port > s.config.MaxPort {
 		return false, errors.New("above config.Maxport")
 	}
+	if !s.config.PortAllowed(port) {
+		s.logger.Trace().Str("network", "udp").Uint16("port", port).Msg("port not allowed")
+		return true, nil
+	}
 
 	// create a new listener if one does not already exist
 	s.udpmu.Lock()
 	defer s.udpmu.Unlock()
 	if _, ok := s.udpListeners[port]; !ok {
-		addr := &net.UDPAddr{IP: net.ParseIP(gctx.IPAddress), Port: int(port)}
+		ip, err := s.bindAddress()
+		if err != nil {
+			return true, err
+		}
+		addr := &net.UDPAddr{IP: net.ParseIP(ip), Port: int(port)}
 		ln, err := udp.Listen("udp", addr)
 		if err != nil {
 			return true, err
@@ -89,10 +107,13 @@ func (s *ConnectionManager) CreateUDPListener(port uint16) (bool, error) {
 			var wg sync.WaitGroup
 			for {
 				conn, err := ln.Accept()
-				if err == nil {
-					wg.Add(1)
-					go s.handleDatagram(conn, ln, &wg)
+				if err != nil {
+					if errors.Is(err, net.ErrClosed) {
+						break
+					}
+					continue
 				}
+				s.dispatch(conn, ln, &wg, s.handleDatagram, "udp")
 			}
 			wg.Wait()
 		}()
@@ -105,22 +126,48 @@ func (s *ConnectionManager) CreateUDPListener(port uint16) (bool, error) {
 
 func (s *ConnectionManager) handleDatagram(conn net.Conn, root net.Listener, wg *sync.WaitGroup) {
 	defer wg.Done()
+	defer s.releaseConnection()
+	// our own scanners and monitoring are left alone
+	allowed := s.allowListed(conn.RemoteAddr())
+	if allowed && s.config.AllowListDrop {
+		conn.Close()
+		return
+	}
+
 	// ban hammers
-	if addr, ok := conn.RemoteAddr().(*net.UDPAddr); ok {
+	if addr, ok := conn.RemoteAddr().(*net.UDPAddr); ok && !allowed {
+		if s.config.PerIPConnRate > 0 && !s.rateLimiter.Allow(addr.IP.String()) {
+			metrics.RateLimitedConnections.Add(1)
+			conn.Close()
+			return
+		}
 		if s.banList.TickBanCounter(addr.IP.String()) {
 			conn.Close()
 			return
 		}
+		if s.blockedByReputation(conn, addr.IP, "udp") {
+			return
+		}
 	}
 
 	// create our sniffer
-	ctx, globalutils := s.getGlobalContext()
+	ctx, globalutils := s.getGlobalContext(conn)
+	if allowed {
+		quietGlobals(globalutils)
+	}
 	muc, err := muxconn.NewMuxConn(ctx, conn)
 	if err != nil {
 		s.logger.Debug().Str("network", "udp").Err(err).Msg("error building NewMuxConn")
 		return
 	}
 
+	s.reapConnection(muc)
+	if s.config.ObserveOnly {
+		muc.DiscardWrites()
+	}
+	raw := muc // the connection on the wire, before any unwrapping
+	s.capturePcap(raw, allowed)
+
 	r := muc.StartSniffing()
 	port := strconv.Itoa(root.Addr().(*net.UDPAddr).Port)
 	ip := conn.RemoteAddr().(*net.UDPAddr).IP.String()
@@ -129,9 +176,10 @@ func (s *ConnectionManager) handleDatagram(conn net.Conn, root net.Listener, wg
 	go s.timeoutConnection(timeoutCtx, muc)
 
 	// How are those first bytes tasting?
-	n := 1500
-	buf := make([]byte, n)
-	n, err = r.Read(buf)
+	pooled := getReadBuffer()
+	defer putReadBuffer(pooled)
+	buf := *pooled
+	n, err := r.Read(buf)
 	if err != nil {
 		if err != io.EOF {
 			s.logger.Trace().Err(err).
@@ -144,13 +192,9 @@ func (s *ConnectionManager) handleDatagram(conn net.Conn, root net.Listener, wg
 
 	tlsUnwrap := false
 	// try unwrapping DTLS
-	if buf[0] == 0x16 {
-		muc.DoneSniffing()
-		newMuxConn, newBuf, newN, err := s.decryptConn(ctx, muc, "udp")
-		if err == nil {
-			muc = newMuxConn
-			buf = newBuf
-			n = newN
+	if n > 0 && buf[0] == 0x16 {
+		if plain, plainBuf, plainN, ok := s.unwrapTLS(ctx, muc, "udp"); ok {
+			muc, buf, n = plain, plainBuf, plainN
 			tlsUnwrap = true
 		}
 	}
@@ -169,27 +213,54 @@ func (s *ConnectionManager) handleDatagram(conn net.Conn, root net.Listener, wg
 		Str("dstport", port).
 		Str("hash", hash).
 		Logger()
+	globalutils.Logger = s.enrichLogger(globalutils.Logger, ip, port)
+
+	// flag queries used to reflect floods at a spoofed source
+	vector := classifyAmplification(uint16(root.Addr().(*net.UDPAddr).Port), buf[:n])
+	if vector != "" {
+		metrics.AmplificationQueries.Add(vector, 1)
+		globalutils.Logger = globalutils.Logger.With().Str("amplification_vector", vector).Logger()
+	}
+	s.logClose(raw, globalutils.Logger)
 
 	// log the connection
 	globalutils.Logger.Trace().Msgf("udp knock")
 
 	// save the raw data
 	if n > 0 {
-		if _, ok := s.knownHashes.Load(hash); !ok {
-			s.storeChan <- store.File{Filename: hash, Location: "raw", Data: buf[:n]}
+		if !allowed && !s.rawHashKnown(hash) {
+			s.offerRaw(globalutils.Store, buf[:n], hash, ip, port, muc.GetUUID())
+			s.notifyNewHash(notify.NewEvent(hash, "udp", ip, port, muc.GetUUID(), tlsUnwrap, buf[:n]))
 		}
 	}
 
 	// see if we match a rule and transfer the connection to the driver
-	entry := s.udpRules.Match(buf)
+	entry := s.rules.Load().udp.Match(buf[:n])
 
 	// stop sniffing and pass to the driver listener
 	muc.Reset()
-	ln, ok := entry.(muxconn.Proxy)
+	rt, ok := entry.(*route)
+	e := RecentEvent{Network: "udp", Attacker: ip, DstPort: port, UUID: muc.GetUUID(), Hash: hash, TLSUnwrap: tlsUnwrap,
+		AmplificationVector: vector}
 	if ok {
+		e.Driver = rt.name
+		markDriver(globalutils, rt.name)
+		globalutils.Logger.Info().Msg("driver matched")
+		s.storePcap(globalutils.Store, raw, ip, port)
+	}
+	if !allowed {
+		s.recordEvent(e, raw)
+	}
+	switch {
+	case ok && rt.proxy != nil:
 		// pipe the connection into Accept()
-		ln.InjectConn(muc)
-	} else {
+		rt.proxy.InjectConn(muc)
+	case ok && rt.handler != nil:
+		// hand each datagram to the driver
+		muc.DoneSniffing()
+		// the handler may keep the datagram, which outlives the pooled buffer
+		s.serveDatagrams(muc, rt.handler, bytes.Clone(buf[:n]))
+	default:
 		// no driver
 		if n > 0 {
 			globalutils.Logger.Debug().Err(err).Msg("no driver")
@@ -199,3 +270,29 @@ func (s *ConnectionManager) handleDatagram(conn net.Conn, root net.Listener, wg
 		muc.Close()
 	}
 }
+
+// serveDatagrams feeds the first and any following datagrams from the peer to
+// a per datagram driver until the peer goes quiet.
+func (s *ConnectionManager) serveDatagrams(muc *muxconn.MuxConn, driver drivers.UDPHandlerDriver, first []byte) {
+	defer muc.Close()
+
+	// skip the sniffed datagram being replayed
+	buf := make([]byte, readBufferSize)
+	muc.Read(buf)
+
+	payload := first
+	for {
+		if reply := driver.HandleUDP(muc.Context, muc.RemoteAddr(), payload); len(reply) > 0 {
+			if _, err := muc.Write(reply); err != nil {
+				return
+			}
+		}
+
+		muc.SetReadDeadline(time.Now().Add(time.Second * 5))
+		n, err := muc.Read(buf)
+		if err != nil || n == 0 {
+			return
+		}
+		payload = buf[:n]
+	}
+}
@@ -0,0 +1,128 @@
+package conman
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/antihax/gambit/internal/conman/config"
+	"github.com/antihax/gambit/internal/conman/security"
+	"github.com/antihax/gambit/internal/metrics"
+	"github.com/antihax/gambit/internal/store"
+	"github.com/antihax/gambit/pkg/searchtree"
+	"github.com/pion/udp"
+	"github.com/stretchr/testify/assert"
+)
+
+// echoDatagrams answers each datagram and remembers what it was handed
+type echoDatagrams struct {
+	sync.Mutex
+	payloads []string
+}
+
+func (d *echoDatagrams) HandleUDP(_ context.Context, _ net.Addr, payload []byte) []byte {
+	d.Lock()
+	defer d.Unlock()
+	d.payloads = append(d.payloads, string(payload))
+	return append([]byte("re:"), payload...)
+}
+
+func (d *echoDatagrams) received() []string {
+	d.Lock()
+	defer d.Unlock()
+	return append([]string(nil), d.payloads...)
+}
+
+// newDatagramTestManager routes datagrams starting with ping to an echoDatagrams
+// and serves them on a local port
+func newDatagramTestManager(t *testing.T, cfg *config.Config) (*ConnectionManager, *echoDatagrams, string) {
+	cfg.KillDelay = 5
+	s := newRunTestManager(cfg)
+	s.banList = security.NewBanManager(100, time.Minute, 0)
+	s.rateLimiter = security.NewRateLimiter(cfg.PerIPConnRate, cfg.PerIPConnBurst)
+	s.connCtx = context.Background()
+	s.storeChan = make(chan store.File, 10)
+	driver := &echoDatagrams{}
+	rules := newRuleSet(s.config)
+	rules.addUDP(searchtree.FromBytes([][]byte{[]byte("ping")}), &route{name: "echo", handler: driver}, 0)
+	s.rules.Store(rules)
+
+	ln, err := udp.Listen("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		var wg sync.WaitGroup
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				break
+			}
+			wg.Add(1)
+			go s.handleDatagram(conn, ln, &wg)
+		}
+		wg.Wait()
+	}()
+	return s, driver, ln.Addr().String()
+}
+
+// dialDatagrams opens a new flow to addr
+func dialDatagrams(t *testing.T, addr string) net.Conn {
+	client, err := net.Dial("udp", addr)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { client.Close() })
+	client.SetDeadline(time.Now().Add(time.Second * 5))
+	return client
+}
+
+func TestHandleDatagramHandler(t *testing.T) {
+	s, driver, addr := newDatagramTestManager(t, &config.Config{})
+	client := dialDatagrams(t, addr)
+
+	// every datagram is answered, the sniffed first one only once
+	buf := make([]byte, 64)
+	for _, payload := range []string{"ping 1", "ping 2", "other"} {
+		if _, err := client.Write([]byte(payload)); !assert.NoError(t, err) {
+			return
+		}
+		n, err := client.Read(buf)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, "re:"+payload, string(buf[:n]))
+	}
+	assert.Equal(t, []string{"ping 1", "ping 2", "other"}, driver.received())
+
+	// the first datagram was captured
+	f := <-s.storeChan
+	assert.Equal(t, "raw", f.Location)
+	assert.Equal(t, "ping 1", string(f.Data))
+}
+
+func TestHandleDatagramRateLimited(t *testing.T) {
+	_, driver, addr := newDatagramTestManager(t, &config.Config{PerIPConnRate: 0.001, PerIPConnBurst: 1})
+	before := metrics.RateLimitedConnections.Value()
+
+	// the first flow uses the burst
+	buf := make([]byte, 64)
+	client := dialDatagrams(t, addr)
+	client.Write([]byte("ping 1"))
+	n, err := client.Read(buf)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "re:ping 1", string(buf[:n]))
+	}
+
+	// a new flow from the same address is dropped
+	client = dialDatagrams(t, addr)
+	client.SetReadDeadline(time.Now().Add(time.Millisecond * 200))
+	client.Write([]byte("ping 2"))
+	_, err = client.Read(buf)
+	assert.Error(t, err)
+	assert.Equal(t, before+1, metrics.RateLimitedConnections.Value())
+	assert.Equal(t, []string{"ping 1"}, driver.received())
+}
@@ -0,0 +1,80 @@
+package conman
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// workerQueueWait is how long an accept loop waits for room in the queue
+// before giving up on a connection
+const workerQueueWait = time.Millisecond * 100
+
+// connHandler handles an accepted connection, calling Done on wg when finished
+type connHandler func(conn net.Conn, root net.Listener, wg *sync.WaitGroup)
+
+// connJob is an accepted connection waiting for a worker
+type connJob struct {
+	conn   net.Conn
+	root   net.Listener
+	wg     *sync.WaitGroup
+	handle connHandler
+}
+
+// workerPool handles connections on a fixed number of goroutines, fed by a
+// bounded queue, so a flood cannot grow the goroutine count without limit
+type workerPool struct {
+	jobs chan connJob
+}
+
+// newWorkerPool starts workers taking connections from a queue of size, they
+// run for the life of the process
+func newWorkerPool(workers, size int) *workerPool {
+	p := &workerPool{jobs: make(chan connJob, size)}
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *workerPool) work() {
+	for job := range p.jobs {
+		job.handle(job.conn, job.root, job.wg)
+	}
+}
+
+// enqueue waits up to wait for room in the queue, returning false if there was none
+func (p *workerPool) enqueue(job connJob, wait time.Duration) bool {
+	select {
+	case p.jobs <- job:
+		return true
+	default:
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case p.jobs <- job:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// dispatch hands an accepted connection to the worker pool, or a goroutine of
+// its own without one, closing it if we are at capacity
+func (s *ConnectionManager) dispatch(conn net.Conn, root net.Listener, wg *sync.WaitGroup, handle connHandler, network string) {
+	if !s.acquireConnection() {
+		s.rejectOverloaded(conn, network)
+		return
+	}
+	wg.Add(1)
+	if s.workers == nil {
+		go handle(conn, root, wg)
+		return
+	}
+	if !s.workers.enqueue(connJob{conn: conn, root: root, wg: wg, handle: handle}, workerQueueWait) {
+		wg.Done()
+		s.releaseConnection()
+		s.rejectOverloaded(conn, network)
+	}
+}
@@ -0,0 +1,107 @@
+package conman
+
+import (
+	"crypto/sha1"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/antihax/gambit/internal/conman/config"
+	"github.com/antihax/gambit/internal/metrics"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+// floodConn is an accepted connection which only needs closing
+type floodConn struct {
+	net.Conn
+	closed bool
+}
+
+func (c *floodConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func (c *floodConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}
+}
+
+func TestDispatchQueueFull(t *testing.T) {
+	s := &ConnectionManager{config: &config.Config{}, logger: zerolog.Nop()}
+	// no workers take from the queue
+	s.workers = &workerPool{jobs: make(chan connJob, 1)}
+
+	var wg sync.WaitGroup
+	handle := func(net.Conn, net.Listener, *sync.WaitGroup) {}
+	first, second := &floodConn{}, &floodConn{}
+	before := metrics.OverloadedConnections.Value()
+	s.dispatch(first, nil, &wg, handle, "tcp")
+	s.dispatch(second, nil, &wg, handle, "tcp")
+
+	assert.False(t, first.closed)
+	assert.True(t, second.closed)
+	assert.Equal(t, before+1, metrics.OverloadedConnections.Value())
+
+	// only the queued connection is waited for
+	job := <-s.workers.jobs
+	assert.Same(t, first, job.conn)
+	wg.Done()
+	wg.Wait()
+}
+
+func TestDispatchConcurrencyCap(t *testing.T) {
+	s := &ConnectionManager{config: &config.Config{}, logger: zerolog.Nop()}
+	s.inFlight = make(chan struct{}, 1)
+
+	// handlers hold their slot until told to finish
+	finish := make(chan struct{})
+	var wg sync.WaitGroup
+	handle := func(_ net.Conn, _ net.Listener, wg *sync.WaitGroup) {
+		defer wg.Done()
+		defer s.releaseConnection()
+		<-finish
+	}
+	first, second, third := &floodConn{}, &floodConn{}, &floodConn{}
+	before := metrics.OverloadedConnections.Value()
+	s.dispatch(first, nil, &wg, handle, "tcp")
+	s.dispatch(second, nil, &wg, handle, "tcp")
+	assert.False(t, first.closed)
+	assert.True(t, second.closed)
+	assert.Equal(t, before+1, metrics.OverloadedConnections.Value())
+
+	// the slot is free again once the first is done
+	close(finish)
+	wg.Wait()
+	s.dispatch(third, nil, &wg, handle, "tcp")
+	wg.Wait()
+	assert.False(t, third.closed)
+	assert.Equal(t, before+1, metrics.OverloadedConnections.Value())
+}
+
+// benchmarkDispatch floods the manager with connections doing a little work each
+func benchmarkDispatch(b *testing.B, s *ConnectionManager) {
+	payload := make([]byte, 1500)
+	handle := func(conn net.Conn, _ net.Listener, wg *sync.WaitGroup) {
+		defer wg.Done()
+		sha1.Sum(payload)
+		conn.Close()
+	}
+	var wg sync.WaitGroup
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.dispatch(&floodConn{}, nil, &wg, handle, "tcp")
+	}
+	wg.Wait()
+}
+
+func BenchmarkDispatchGoroutines(b *testing.B) {
+	benchmarkDispatch(b, &ConnectionManager{config: &config.Config{}, logger: zerolog.Nop()})
+}
+
+func BenchmarkDispatchWorkers(b *testing.B) {
+	s := &ConnectionManager{config: &config.Config{}, logger: zerolog.Nop()}
+	s.workers = newWorkerPool(8, 1024)
+	benchmarkDispatch(b, s)
+}
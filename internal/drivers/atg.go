@@ -3,7 +3,6 @@ package drivers
 import (
 	"bufio"
 	"fmt"
-	"log"
 	"net"
 	"net/textproto"
 	"time"
@@ -20,6 +19,11 @@ func init() {
 type atg struct {
 }
 
+// Name of the driver
+func (s *atg) Name() string {
+	return "atg"
+}
+
 func (s *atg) Patterns() [][]byte {
 	return [][]byte{
 		[]byte("I20100"),
@@ -30,7 +34,7 @@ func (s *atg) ServeTCP(ln net.Listener) {
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			log.Printf("failed to accept %s\n", err)
+			acceptFailed(s.Name(), err)
 			return
 		}
 
@@ -1,7 +1,6 @@
 package drivers
 
 import (
-	"log"
 	"net"
 	"time"
 
@@ -21,6 +20,11 @@ func init() {
 	AddDriver(s)
 }
 
+// Name of the driver
+func (s *cassandra) Name() string {
+	return "cassandra"
+}
+
 func (s *cassandra) Patterns() [][]byte {
 	return [][]byte{
 		{0x04, 0x00, 0x12, 0x34, 0x01},
@@ -34,7 +38,7 @@ func (s *cassandra) ServeTCP(ln net.Listener) {
 	for {
 		c, err := ln.Accept()
 		if err != nil {
-			log.Println("failed accept")
+			acceptFailed(s.Name(), err)
 			return
 		}
 		if mux, ok := c.(*muxconn.MuxConn); ok {
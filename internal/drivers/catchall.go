@@ -0,0 +1,119 @@
+package drivers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/antihax/gambit/internal/conman/gctx"
+	"github.com/antihax/gambit/internal/muxconn"
+	"github.com/antihax/gambit/internal/store"
+)
+
+// catchAllConfig controls how long unknown protocols are kept talking, it is
+// read from the catchall entry in Drivers, e.g. {"catchall": {"banner": "220 ready\r\n"}}
+type catchAllConfig struct {
+	// MaxBytes stops reading after this many bytes, default is 65536
+	MaxBytes int64 `json:"maxBytes"`
+
+	// IdleTimeout closes connections with no activity for this many seconds, default is 10
+	IdleTimeout int `json:"idleTimeout"`
+
+	// Banner is sent once the connection is taken, nothing is sent if empty
+	Banner string `json:"banner"`
+}
+
+func init() {
+	AddDriver(&catchAll{})
+}
+
+// OnStart reads how long to keep connections
+func (s *catchAll) OnStart(ctx context.Context, cfg DriverConfig) error {
+	s.config = catchAllConfig{MaxBytes: 65536, IdleTimeout: 10}
+	if err := cfg.Decode(&s.config); err != nil {
+		return err
+	}
+	if s.config.MaxBytes < 1 || s.config.IdleTimeout < 1 {
+		return errors.New("maxBytes and idleTimeout must be at least 1")
+	}
+	return nil
+}
+
+// catchAll keeps connections no other driver matched, capturing what they send.
+// It has no patterns and is only used when named by CONMAN_CATCHALL_DRIVER.
+type catchAll struct {
+	config catchAllConfig
+}
+
+// Name of the driver
+func (s *catchAll) Name() string {
+	return "catchall"
+}
+
+func (s *catchAll) Patterns() [][]byte {
+	return nil
+}
+
+func (s *catchAll) ServeTCP(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			acceptFailed(s.Name(), err)
+			return
+		}
+		if mux, ok := conn.(*muxconn.MuxConn); ok {
+			go s.handle(mux)
+		}
+	}
+}
+
+func (s *catchAll) handle(mux *muxconn.MuxConn) {
+	defer mux.Close()
+	glob := gctx.GetGlobalFromContext(mux.Context, "catchall")
+
+	mux.SetDeadline(time.Time{})
+	mux.SetIdleTimeout(time.Second * time.Duration(s.config.IdleTimeout))
+	if len(s.config.Banner) > 0 {
+		if _, err := io.WriteString(mux, s.config.Banner); err != nil {
+			return
+		}
+	}
+
+	// the sniffed first bytes are replayed so the capture starts from the beginning
+	var inbound bytes.Buffer
+	limit := captureLimit(glob, s.config.MaxBytes)
+	io.Copy(&inbound, io.LimitReader(mux, limit))
+	if inbound.Len() == 0 {
+		return
+	}
+
+	hash := GetHash(inbound.Bytes())
+	l := glob.NewSession(mux.Sequence(), hash)
+	f := store.File{
+		Filename: fmt.Sprintf("%s.%s", mux.GetUUID(), DirectionInbound),
+		Location: "sessions",
+		Data:     inbound.Bytes(),
+		UUID:     mux.GetUUID(),
+		Sequence: mux.Sequence(),
+		// a full buffer means the attacker had more to say
+		Truncated: int64(inbound.Len()) >= limit,
+	}
+	if host, _, err := net.SplitHostPort(mux.RemoteAddr().String()); err == nil {
+		f.Attacker = host
+	}
+	if _, port, err := net.SplitHostPort(mux.LocalAddr().String()); err == nil {
+		f.DstPort = port
+	}
+	if sampled(glob, "catchall", hash) {
+		store.Offer(glob.Store, f)
+	}
+
+	l.Logger.Info().
+		Int("bytes_in", inbound.Len()).
+		Bool("truncated", f.Truncated).
+		Msg("caught unknown protocol")
+}
@@ -0,0 +1,25 @@
+package drivers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCatchAll(t *testing.T) {
+	s := &catchAll{}
+	if !assert.NoError(t, s.OnStart(context.Background(), DriverConfig{Raw: []byte(`{"banner": "220 ready\r\n"}`)})) {
+		return
+	}
+	assert.Equal(t, 10, s.config.IdleTimeout, "defaults kept")
+
+	// the banner goes out and everything sent is kept, sniffed bytes included
+	h := newDriverHarness(t, s, []byte("HELO?"))
+	h.expect("220 ready\r\n")
+	h.send("more")
+	h.client.Close()
+	assert.Equal(t, "HELO?more", string(h.stored("sessions").Data))
+
+	assert.Error(t, s.OnStart(context.Background(), DriverConfig{Raw: []byte(`{"maxBytes": 0}`)}))
+}
@@ -1,8 +1,9 @@
 package drivers
 
 import (
+	"context"
 	"encoding/binary"
-	"log"
+	"fmt"
 	"net"
 	"time"
 
@@ -11,11 +12,47 @@ import (
 	"github.com/miekg/dns"
 )
 
+const (
+	// dnsModeAnswer replies to queries with an A record
+	dnsModeAnswer = "answer"
+	// dnsModeNXDomain replies to every query with NXDOMAIN
+	dnsModeNXDomain = "nxdomain"
+	// dnsModeSink never replies, only capturing the queries
+	dnsModeSink = "sink"
+)
+
+// dnsConfig controls how the DNS driver responds, it is read from the dns
+// entry in Drivers, e.g. {"dns": {"mode": "nxdomain"}}
+type dnsConfig struct {
+	// Mode selects the response, one of answer, nxdomain or sink, default is answer
+	Mode string `json:"mode"`
+
+	// Answer is the address returned for A queries, defaults to the bind address
+	Answer string `json:"answer"`
+}
+
 type decoratedWriter struct {
 	dns.Writer
 	EvilDNS *evildns
 }
 
+// OnStart reads how queries are answered
+func (s *evildns) OnStart(ctx context.Context, cfg DriverConfig) error {
+	s.config = dnsConfig{Mode: dnsModeAnswer}
+	if err := cfg.Decode(&s.config); err != nil {
+		return err
+	}
+	switch s.config.Mode {
+	case dnsModeAnswer, dnsModeNXDomain, dnsModeSink:
+	default:
+		return fmt.Errorf("unknown mode %q", s.config.Mode)
+	}
+	if s.config.Answer != "" && net.ParseIP(s.config.Answer) == nil {
+		return fmt.Errorf("answer %q is not an IP address", s.config.Answer)
+	}
+	return nil
+}
+
 func (dr *decoratedWriter) Write(p []byte) (int, error) {
 	n, e := dr.Writer.Write(p)
 	return n, e
@@ -30,11 +67,11 @@ func (dr *decoratedReader) ReadTCP(conn net.Conn, timeout time.Duration) ([]byte
 	b, e := dr.Reader.ReadTCP(conn, timeout)
 	if len(b) > 0 {
 		if mux, ok := conn.(*muxconn.ModConn).GetConn().(*muxconn.MuxConn); ok {
-			dr.EvilDNS.Glob = gctx.GetGlobalFromContext(mux.Context, "dns")
+			glob := gctx.GetGlobalFromContext(mux.Context, "dns")
 
 			// save session data
-			dr.EvilDNS.Glob.NewSession(mux.Sequence(), StoreHash(mux.Snapshot(), dr.EvilDNS.Glob.Store)).
-				Logger.Info().Msg("dns")
+			l := glob.NewSession(mux.Sequence(), StoreHash(mux.Snapshot(), glob.Store))
+			dr.EvilDNS.logQuery(l, b)
 		}
 	}
 	return b, e
@@ -71,9 +108,12 @@ func init() {
 type evildns struct {
 	Server *dns.Server
 	Proxy  muxconn.Proxy
-	Hash   string
-	PHash  string
-	Glob   *gctx.GlobalUtils
+	config dnsConfig
+}
+
+// Name of the driver
+func (s *evildns) Name() string {
+	return "dns"
 }
 
 func (s *evildns) Patterns() [][]byte {
@@ -107,8 +147,8 @@ func (s *evildns) ServeUDP(ln net.Listener) {
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			log.Println(err)
-			continue
+			acceptFailed(s.Name(), err)
+			return
 		}
 
 		modcon := muxconn.NewModConn(
@@ -126,8 +166,8 @@ func (s *evildns) ServeTCP(ln net.Listener) {
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			log.Println(err)
-			continue
+			acceptFailed(s.Name(), err)
+			return
 		}
 		modcon := muxconn.NewModConn(
 			conn,
@@ -139,20 +179,57 @@ func (s *evildns) ServeTCP(ln net.Listener) {
 	}
 }
 
+// logQuery records each question asked in the raw query
+func (s *evildns) logQuery(l *gctx.Session, b []byte) {
+	r := new(dns.Msg)
+	if err := r.Unpack(b); err != nil {
+		l.LogError(err)
+		return
+	}
+
+	for _, q := range r.Question {
+		values := []gctx.Value{
+			{Key: "qname", Value: q.Name},
+			{Key: "qtype", Value: dns.TypeToString[q.Qtype]},
+			{Key: "qclass", Value: dns.ClassToString[q.Qclass]},
+		}
+		// ANY queries are the staple of amplification abuse
+		if q.Qtype == dns.TypeANY {
+			l.ATTACKEntReflectionAmplification(values...)
+			continue
+		}
+		l.ATTACKEntActiveScanning(values...)
+	}
+}
+
+// Handler replies to the query based on the configured mode
 // [TODO] expand to serve other types
 func (s *evildns) Handler(w dns.ResponseWriter, r *dns.Msg) {
-	m := new(dns.Msg)
-	m.SetReply(r)
-	rr := &dns.A{
-		Hdr: dns.RR_Header{Name: "*.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 0},
-		A:   net.ParseIP(gctx.IPAddress),
+	if s.config.Mode == dnsModeSink || len(r.Question) == 0 {
+		return
 	}
 
-	m.Answer = append(m.Answer, rr)
+	m := new(dns.Msg)
+	if s.config.Mode == dnsModeNXDomain {
+		m.SetRcode(r, dns.RcodeNameError)
+		w.WriteMsg(m)
+		return
+	}
 
-	s.Glob.Logger.Debug().Str("dig", r.String()).Msg("dns dig")
+	m.SetReply(r)
+	answer := s.config.Answer
+	if answer == "" {
+		answer = gctx.IPAddress
+	}
+	q := m.Question[0]
+	if q.Qtype == dns.TypeA || q.Qtype == dns.TypeANY {
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 0},
+			A:   net.ParseIP(answer),
+		})
+	}
 
-	if m.Question[0].Name == "." {
+	if q.Name == "." {
 		m.Truncated = true
 		buf, _ := m.Pack()
 		w.Write(buf[:len(buf)/2])
@@ -0,0 +1,21 @@
+package drivers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDNSOnStart(t *testing.T) {
+	s := &evildns{}
+	if assert.NoError(t, s.OnStart(context.Background(), DriverConfig{})) {
+		assert.Equal(t, dnsModeAnswer, s.config.Mode)
+	}
+	if assert.NoError(t, s.OnStart(context.Background(), DriverConfig{Raw: []byte(`{"mode": "sink", "answer": "10.0.0.1"}`)})) {
+		assert.Equal(t, dnsModeSink, s.config.Mode)
+		assert.Equal(t, "10.0.0.1", s.config.Answer)
+	}
+	assert.Error(t, s.OnStart(context.Background(), DriverConfig{Raw: []byte(`{"mode": "refuse"}`)}))
+	assert.Error(t, s.OnStart(context.Background(), DriverConfig{Raw: []byte(`{"answer": "nowhere"}`)}))
+}
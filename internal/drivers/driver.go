@@ -1,21 +1,102 @@
 package drivers
 
-import "net"
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
 
-var drivers []Driver
+	"github.com/antihax/gambit/pkg/searchtree"
+	"github.com/rs/zerolog"
+)
+
+var (
+	drivers     []Driver
+	driversLock sync.RWMutex
+
+	// logger is the base of the driver scoped loggers, nothing is logged until it is set
+	logger atomic.Pointer[zerolog.Logger]
+)
+
+const (
+	// DirectionInbound is data sent by the attacker
+	DirectionInbound = "inbound"
+	// DirectionOutbound is data sent to the attacker
+	DirectionOutbound = "outbound"
+)
 
 // AddDriver adds a driver to the internal list
 func AddDriver(handler Driver) {
+	driversLock.Lock()
+	defer driversLock.Unlock()
 	drivers = append(drivers, handler)
 }
 
-// GetDrivers returns the available driver list
+// GetDrivers returns a copy of the available driver list
 func GetDrivers() []Driver {
-	return drivers
+	driversLock.RLock()
+	defer driversLock.RUnlock()
+	return append([]Driver(nil), drivers...)
+}
+
+// List returns the names of registered drivers in the order they were added
+func List() []string {
+	driversLock.RLock()
+	defer driversLock.RUnlock()
+	names := make([]string, 0, len(drivers))
+	for _, d := range drivers {
+		names = append(names, d.Name())
+	}
+	return names
+}
+
+// Get returns the registered driver with name, or nil if there is none
+func Get(name string) Driver {
+	driversLock.RLock()
+	defer driversLock.RUnlock()
+	for _, d := range drivers {
+		if d.Name() == name {
+			return d
+		}
+	}
+	return nil
+}
+
+// SetLogger sets where drivers log anything not tied to a connection, such as
+// their listener failing
+func SetLogger(l zerolog.Logger) {
+	logger.Store(&l)
+}
+
+// Logger returns a logger scoped to the named driver. Output about a
+// connection should use the logger of its context instead, so it carries the
+// attacker and session.
+func Logger(name string) zerolog.Logger {
+	l := zerolog.Nop()
+	if base := logger.Load(); base != nil {
+		l = *base
+	}
+	return l.With().Str("driver", name).Logger()
+}
+
+// acceptFailed logs why a serve loop stopped, unless its listener was closed
+// as we shut down
+func acceptFailed(name string, err error) {
+	if err == nil || errors.Is(err, net.ErrClosed) {
+		return
+	}
+	l := Logger(name)
+	l.Error().Err(err).Msg("failed to accept")
 }
 
 // Driver implements a protocol handler
 type Driver interface {
+	// Name identifies the driver in logs and configuration
+	Name() string
 	Patterns() [][]byte
 }
 
@@ -34,6 +115,14 @@ type UDPDriver interface {
 	ServeUDP(ln net.Listener)
 }
 
+// UDPHandlerDriver handles UDP datagrams individually after matching a sniff test.
+// Drivers only implementing TCP are unaffected.
+type UDPHandlerDriver interface {
+	// HandleUDP receives each datagram payload from addr, the context carries
+	// the enriched logger and store. Returned bytes are sent back to addr.
+	HandleUDP(ctx context.Context, addr net.Addr, payload []byte) []byte
+}
+
 // TCPBannerDriver provide optional information to send if an aggressor does not
 // do anything after connecting.
 type TCPBannerDriver interface {
@@ -41,3 +130,124 @@ type TCPBannerDriver interface {
 	// of inactivity in order to to coax a response.
 	Banner() ([]uint16, []byte)
 }
+
+// OffsetPatternDriver optionally provides patterns at a fixed offset or with a
+// wildcard mask, for fields which are not at the start of the data.
+type OffsetPatternDriver interface {
+	OffsetPatterns() []searchtree.Pattern
+}
+
+// GetPatterns returns every pattern for a driver, adapting the simple form
+func GetPatterns(d Driver) []searchtree.Pattern {
+	patterns := searchtree.FromBytes(d.Patterns())
+	if p, ok := d.(OffsetPatternDriver); ok {
+		patterns = append(patterns, p.OffsetPatterns()...)
+	}
+	return patterns
+}
+
+// PortDriver optionally claims every TCP connection to its ports as soon as it is
+// accepted, before anything is sniffed. Useful when the server must speak first.
+type PortDriver interface {
+	Ports() []uint16
+}
+
+// FallbackPortDriver optionally claims TCP connections to its ports where the attacker
+// sends nothing before the banner delay, for protocols where the server speaks first.
+// Connections which do send first are still matched on their patterns.
+type FallbackPortDriver interface {
+	FallbackPorts() []uint16
+}
+
+// ALPNDriver optionally claims TLS connections which negotiate one of its
+// application protocols, such as h2, whatever the plaintext looks like.
+// Protocols are only agreed when the client offers them.
+type ALPNDriver interface {
+	ALPN() []string
+}
+
+// PriorityDriver optionally ranks a driver's patterns against others which also match.
+// Matches at the start of the data come first, then higher priorities win over
+// longer patterns, drivers without a priority are 0.
+type PriorityDriver interface {
+	Priority() int
+}
+
+// GetPriority returns the priority of a driver
+func GetPriority(d Driver) int {
+	if p, ok := d.(PriorityDriver); ok {
+		return p.Priority()
+	}
+	return 0
+}
+
+// DriverConfig is handed to a driver as it starts
+type DriverConfig struct {
+	// Logger is tagged with the driver name
+	Logger zerolog.Logger
+	// Raw is the driver's entry in the Drivers setting, nil if there is none
+	Raw json.RawMessage
+}
+
+// Decode reads the driver's settings into v, leaving v untouched if there are
+// none. Unknown fields are an error so typos are not silently ignored.
+//
+// A driver declares its settings as a struct with JSON tags and reads them in
+// OnStart, keeping its own defaults for anything not set:
+//
+//	type sshdConfig struct {
+//		HostKeyFile string `json:"hostKeyFile"`
+//	}
+//
+//	func (s *sshd) OnStart(ctx context.Context, cfg DriverConfig) error {
+//		s.config = sshdConfig{HostKeyFile: "/keys/rsa"}
+//		return cfg.Decode(&s.config)
+//	}
+//
+// It is then configured by driver name, e.g. {"Drivers": {"sshd": {"hostKeyFile": "/keys/ed25519"}}}.
+func (c DriverConfig) Decode(v any) error {
+	if len(c.Raw) == 0 {
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(c.Raw))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// StartDriver optionally prepares a driver once the configuration is loaded and
+// before any connections reach it, such as generating keys. The context is
+// cancelled when conman shuts down.
+type StartDriver interface {
+	OnStart(ctx context.Context, cfg DriverConfig) error
+}
+
+// StopDriver optionally cleans up a driver when conman shuts down
+type StopDriver interface {
+	OnStop()
+}
+
+// StartDrivers calls OnStart on each driver which has it. If one fails, those
+// already started are stopped and the error is returned.
+func StartDrivers(ctx context.Context, ds []Driver, config func(Driver) DriverConfig) error {
+	for i, d := range ds {
+		starter, ok := d.(StartDriver)
+		if !ok {
+			continue
+		}
+		if err := starter.OnStart(ctx, config(d)); err != nil {
+			StopDrivers(ds[:i])
+			return fmt.Errorf("starting driver %s: %w", d.Name(), err)
+		}
+	}
+	return nil
+}
+
+// StopDrivers calls OnStop on each driver which has it, in the reverse order
+// they were started
+func StopDrivers(ds []Driver) {
+	for i := len(ds) - 1; i >= 0; i-- {
+		if stopper, ok := ds[i].(StopDriver); ok {
+			stopper.OnStop()
+		}
+	}
+}
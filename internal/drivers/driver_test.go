@@ -1,9 +1,14 @@
 package drivers
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"net"
 	"testing"
 
+	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -20,6 +25,10 @@ func (s *Both) Banner() ([]uint16, []byte) {
 	return nil, nil
 }
 
+func (s *Both) Name() string {
+	return "both"
+}
+
 func (s *Both) Patterns() [][]byte {
 	return nil
 }
@@ -27,6 +36,10 @@ func (s *Both) Patterns() [][]byte {
 // UDP Struct
 type UDP struct{}
 
+func (s *UDP) Name() string {
+	return "udp"
+}
+
 func (s *UDP) Patterns() [][]byte {
 	return nil
 }
@@ -34,12 +47,31 @@ func (s *UDP) Patterns() [][]byte {
 func (s *UDP) ServeUDP(ln net.Listener) {
 }
 
+// Datagram Struct
+type Datagram struct{}
+
+func (s *Datagram) Name() string {
+	return "datagram"
+}
+
+func (s *Datagram) Patterns() [][]byte {
+	return nil
+}
+
+func (s *Datagram) HandleUDP(ctx context.Context, addr net.Addr, payload []byte) []byte {
+	return payload
+}
+
 // TCP Struct
 type TCP struct{}
 
 func (s *TCP) ServeTCP(ln net.Listener) {
 }
 
+func (s *TCP) Name() string {
+	return "tcp"
+}
+
 func (s *TCP) Patterns() [][]byte {
 	return nil
 }
@@ -83,8 +115,107 @@ func doTCPInterface(t *testing.T, handle Driver) {
 	}
 }
 
+// Test an interface handling single datagrams is correct
+func doDatagramInterface(t *testing.T, handle Driver) {
+	_, ok := handle.(UDPDriver)
+	assert.False(t, ok)
+	_, ok = handle.(TCPDriver)
+	assert.False(t, ok)
+
+	udp, ok := handle.(UDPHandlerDriver)
+	if assert.True(t, ok) {
+		assert.Equal(t, []byte("ping"), udp.HandleUDP(context.Background(), nil, []byte("ping")))
+	}
+}
+
 func TestInterface(t *testing.T) {
+	doDatagramInterface(t, &Datagram{})
 	doBothInterface(t, &Both{})
 	doTCPInterface(t, &TCP{})
 	doUDPInterface(t, &UDP{})
 }
+
+func TestRegistry(t *testing.T) {
+	names := List()
+	assert.Contains(t, names, "rdp")
+	assert.Len(t, names, len(GetDrivers()))
+
+	d := Get("rdp")
+	if assert.NotNil(t, d) {
+		assert.Equal(t, "rdp", d.Name())
+	}
+	assert.Nil(t, Get("nonexistent"))
+}
+
+// Lifecycle Struct recording its hooks
+type Lifecycle struct {
+	name  string
+	fail  bool
+	calls *[]string
+}
+
+func (s *Lifecycle) Name() string {
+	return s.name
+}
+
+func (s *Lifecycle) Patterns() [][]byte {
+	return nil
+}
+
+func (s *Lifecycle) OnStart(ctx context.Context, cfg DriverConfig) error {
+	*s.calls = append(*s.calls, "start "+s.name)
+	if s.fail {
+		return errors.New("failed")
+	}
+	return nil
+}
+
+func (s *Lifecycle) OnStop() {
+	*s.calls = append(*s.calls, "stop "+s.name)
+}
+
+func TestLifecycle(t *testing.T) {
+	var calls []string
+	config := func(Driver) DriverConfig { return DriverConfig{} }
+	ds := []Driver{&Lifecycle{name: "a", calls: &calls}, &TCP{}, &Lifecycle{name: "b", calls: &calls}}
+
+	assert.NoError(t, StartDrivers(context.Background(), ds, config))
+	StopDrivers(ds)
+	assert.Equal(t, []string{"start a", "start b", "stop b", "stop a"}, calls)
+
+	// a failure stops only those already started
+	calls = nil
+	ds = append(ds, &Lifecycle{name: "c", fail: true, calls: &calls}, &Lifecycle{name: "d", calls: &calls})
+	assert.ErrorContains(t, StartDrivers(context.Background(), ds, config), "starting driver c")
+	assert.Equal(t, []string{"start a", "start b", "start c", "stop b", "stop a"}, calls)
+}
+
+func TestDriverConfigDecode(t *testing.T) {
+	type settings struct {
+		Key   string `json:"key"`
+		Count int    `json:"count"`
+	}
+	v := settings{Key: "default", Count: 1}
+	assert.NoError(t, DriverConfig{}.Decode(&v))
+	assert.Equal(t, settings{Key: "default", Count: 1}, v)
+
+	assert.NoError(t, DriverConfig{Raw: []byte(`{"count": 5}`)}.Decode(&v))
+	assert.Equal(t, settings{Key: "default", Count: 5}, v)
+
+	assert.Error(t, DriverConfig{Raw: []byte(`{"cuont": 5}`)}.Decode(&v))
+}
+
+func TestAcceptFailed(t *testing.T) {
+	var buf bytes.Buffer
+	SetLogger(zerolog.New(&buf))
+	defer SetLogger(zerolog.Nop())
+
+	// closing the listener is how serve loops are told to stop
+	acceptFailed("test", fmt.Errorf("proxy: %w", net.ErrClosed))
+	acceptFailed("test", nil)
+	assert.Empty(t, buf.String())
+
+	acceptFailed("test", errors.New("too many open files"))
+	assert.Contains(t, buf.String(), `"driver":"test"`)
+	assert.Contains(t, buf.String(), "too many open files")
+}
@@ -0,0 +1,193 @@
+package drivers
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/antihax/gambit/internal/conman/gctx"
+	"github.com/antihax/gambit/internal/muxconn"
+)
+
+// ftpMaxLine bounds a single command line
+const ftpMaxLine = 4096
+
+type ftp struct{}
+
+func init() {
+	AddDriver(&ftp{})
+}
+
+// Name of the driver
+func (s *ftp) Name() string {
+	return "ftp"
+}
+
+func (s *ftp) Patterns() [][]byte {
+	return [][]byte{
+		[]byte("USER "),
+		[]byte("user "),
+	}
+}
+
+// Ports takes the FTP ports straight away, clients wait for our greeting
+func (s *ftp) Ports() []uint16 {
+	return []uint16{21, 2121}
+}
+
+func (s *ftp) ServeTCP(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			acceptFailed(s.Name(), err)
+			return
+		}
+		if mux, ok := conn.(*muxconn.MuxConn); ok {
+			go s.handle(mux)
+		}
+	}
+}
+
+// ftpSession is the state of one control connection
+type ftpSession struct {
+	conn *muxconn.MuxConn
+	glob *gctx.GlobalUtils
+	r    *bufio.Reader
+	w    *bufio.Writer
+	user string
+	cwd  string
+}
+
+func (s *ftp) handle(conn *muxconn.MuxConn) {
+	defer conn.Close()
+	c := &ftpSession{
+		conn: conn,
+		glob: gctx.GetGlobalFromContext(conn.Context, "ftp"),
+		r:    bufio.NewReaderSize(conn, ftpMaxLine),
+		w:    bufio.NewWriter(conn),
+		cwd:  "/",
+	}
+
+	c.reply("220 (vsFTPd 3.0.3)")
+	for {
+		conn.SetDeadline(time.Now().Add(time.Second * 30))
+		line, isPrefix, err := c.r.ReadLine()
+		if err != nil {
+			if err != io.EOF {
+				c.glob.LogError(err)
+			}
+			return
+		}
+		if isPrefix {
+			c.glob.LogError(fmt.Errorf("ftp line too long"))
+			return
+		}
+
+		verb, arg, _ := strings.Cut(string(line), " ")
+		verb = strings.ToUpper(verb)
+		l := c.glob.NewSession(conn.Sequence(), StoreHash(line, c.glob.Store))
+		l.AppendLogger(
+			gctx.Value{Key: "opCode", Value: verb},
+			gctx.Value{Key: "args", Value: arg},
+		)
+		l.Logger.Info().Msg("ftp command")
+
+		if !c.command(l, verb, arg) {
+			return
+		}
+	}
+}
+
+// command answers a single command, returning false once the client quits
+func (c *ftpSession) command(l *gctx.Session, verb, arg string) bool {
+	switch verb {
+	case "USER":
+		c.user = arg
+		c.reply("331 Please specify the password.")
+	case "PASS":
+		l.ATTACKEntPasswordGuessing(
+			gctx.Value{Key: "user", Value: c.user},
+			gctx.Value{Key: "pass", Value: arg},
+		)
+		c.reply("230 Login successful.")
+	case "SYST":
+		c.reply("215 UNIX Type: L8")
+	case "FEAT":
+		c.reply("211-Features:\r\n EPSV\r\n PASV\r\n SIZE\r\n UTF8\r\n211 End")
+	case "PWD", "XPWD":
+		c.reply("257 \"%s\" is the current directory", c.cwd)
+	case "CWD":
+		c.cwd = c.path(arg)
+		l.ATTACKEntFileandDirectoryDiscovery(gctx.Value{Key: "path", Value: c.cwd})
+		c.reply("250 Directory successfully changed.")
+	case "CDUP":
+		c.cwd = c.path("..")
+		c.reply("250 Directory successfully changed.")
+	case "TYPE":
+		if strings.HasPrefix(strings.ToUpper(arg), "I") {
+			c.reply("200 Switching to Binary mode.")
+		} else {
+			c.reply("200 Switching to ASCII mode.")
+		}
+	case "MODE", "STRU", "OPTS":
+		c.reply("200 OK.")
+	case "PASV":
+		ip := net.IPv4(127, 0, 0, 1).To4()
+		if addr, ok := c.conn.LocalAddr().(*net.TCPAddr); ok && addr.IP.To4() != nil {
+			ip = addr.IP.To4()
+		}
+		port := 30000 + rand.Intn(20000)
+		c.reply("227 Entering Passive Mode (%d,%d,%d,%d,%d,%d).", ip[0], ip[1], ip[2], ip[3], port>>8, port&0xff)
+	case "EPSV":
+		c.reply("229 Entering Extended Passive Mode (|||%d|)", 30000+rand.Intn(20000))
+	case "PORT", "EPRT":
+		// where the attacker wanted the data sent, never connected to
+		l.AppendLogger(gctx.Value{Key: "dataAddress", Value: arg})
+		c.reply("200 PORT command successful. Consider using PASV.")
+	case "LIST", "NLST", "MLSD":
+		l.ATTACKEntFileandDirectoryDiscovery(gctx.Value{Key: "path", Value: c.path(arg)})
+		c.reply("150 Here comes the directory listing.")
+		c.reply("226 Directory send OK.")
+	case "SIZE", "MDTM":
+		c.reply("550 Could not get file size.")
+	case "RETR":
+		l.ATTACKEntDatafromLocalSystem(gctx.Value{Key: "path", Value: c.path(arg)})
+		c.reply("550 Failed to open file.")
+	case "STOR", "STOU", "APPE":
+		l.ATTACKEntIngressToolTransfer(gctx.Value{Key: "path", Value: c.path(arg)})
+		c.reply("150 Ok to send data.")
+		c.reply("226 Transfer complete.")
+	case "DELE", "RMD", "MKD", "RNFR", "RNTO", "SITE":
+		c.reply("550 Permission denied.")
+	case "NOOP":
+		c.reply("200 NOOP ok.")
+	case "QUIT":
+		c.reply("221 Goodbye.")
+		c.w.Flush()
+		return false
+	default:
+		c.reply("500 Unknown command.")
+	}
+	return true
+}
+
+// reply sends a response, flushing once pipelined commands are answered
+func (c *ftpSession) reply(format string, args ...interface{}) {
+	fmt.Fprintf(c.w, format+"\r\n", args...)
+	if c.r.Buffered() == 0 {
+		c.w.Flush()
+	}
+}
+
+// path resolves arg against the working directory, purely for logging
+func (c *ftpSession) path(arg string) string {
+	if strings.HasPrefix(arg, "/") {
+		return path.Clean(arg)
+	}
+	return path.Join(c.cwd, arg)
+}
@@ -0,0 +1,42 @@
+package drivers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFTPLogin(t *testing.T) {
+	h := newDriverHarness(t, &ftp{}, nil)
+	h.expect("220 (vsFTPd 3.0.3)\r\n")
+	h.send("USER admin\r\n")
+	h.expect("331 Please specify the password.\r\n")
+	h.send("PASS hunter2\r\n")
+	h.expect("230 Login successful.\r\n")
+	h.send("QUIT\r\n")
+	assert.Equal(t, "221 Goodbye.\r\n", h.closed())
+
+	// each command is stored and the credentials logged together
+	assert.Equal(t, "USER admin", string(h.stored("raw").Data))
+	assert.Equal(t, "PASS hunter2", string(h.stored("raw").Data))
+	assert.Regexp(t, `"user":"admin".*"pass":"hunter2"`, h.logs.String())
+}
+
+func TestFTPStor(t *testing.T) {
+	h := newDriverHarness(t, &ftp{}, []byte("USER anonymous\r\n"))
+	h.expect("220 (vsFTPd 3.0.3)\r\n")
+	h.expect("331 Please specify the password.\r\n")
+
+	// pipelined commands are answered in order, uploads resolved against the working directory
+	h.send("PASS x\r\nCWD /tmp\r\nTYPE I\r\nPASV\r\nSTOR ../bin/bot\r\n")
+	h.expect("230 Login successful.\r\n")
+	h.expect("250 Directory successfully changed.\r\n")
+	h.expect("200 Switching to Binary mode.\r\n")
+	h.expect("227 Entering Passive Mode (")
+	h.expect(").\r\n")
+	assert.Equal(t, "150 Ok to send data.\r\n226 Transfer complete.\r\n", h.expect("226 Transfer complete.\r\n"))
+	h.send("QUIT\r\n")
+	h.expect("221 Goodbye.\r\n")
+
+	assert.Contains(t, h.logs.String(), `"path":"/bin/bot"`)
+}
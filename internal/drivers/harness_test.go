@@ -0,0 +1,161 @@
+package drivers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/antihax/gambit/internal/conman/gctx"
+	"github.com/antihax/gambit/internal/muxconn"
+	"github.com/antihax/gambit/internal/store"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+// harnessTimeout bounds each step so a stuck driver fails the test rather than hanging it
+const harnessTimeout = time.Second * 5
+
+// driverHarness serves one connection to a driver as conman would, over an
+// in-memory pipe. The test plays the attacker on the other end.
+type driverHarness struct {
+	t *testing.T
+	// attacker end of the pipe, and its buffered reader for the driver's responses
+	client net.Conn
+	r      *bufio.Reader
+	// conn is what the driver was given
+	conn  *muxconn.MuxConn
+	store chan store.File
+	proxy muxconn.Proxy
+	// logs is everything the driver logged
+	logs *logBuffer
+}
+
+// logBuffer collects log lines written by the driver while the test reads them
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// newDriverHarness connects an attacker to d. When first is set the attacker
+// sends it and it is sniffed and replayed as if matched by a pattern, without
+// it the connection is handed over at once as for drivers taking whole ports.
+func newDriverHarness(t *testing.T, d TCPDriver, first []byte) *driverHarness {
+	t.Helper()
+	return newDriverHarnessGlobals(t, d, first, &gctx.GlobalUtils{})
+}
+
+// newDriverHarnessGlobals is newDriverHarness with the connection settings in
+// globals, its logger and store are replaced by the harness's own
+func newDriverHarnessGlobals(t *testing.T, d TCPDriver, first []byte, globals *gctx.GlobalUtils) *driverHarness {
+	t.Helper()
+	client, server := net.Pipe()
+	h := &driverHarness{
+		t:      t,
+		client: client,
+		r:      bufio.NewReader(client),
+		store:  make(chan store.File, 64),
+		proxy:  muxconn.NewProxy(1),
+		logs:   &logBuffer{},
+	}
+	globals.Logger, globals.Store = zerolog.New(h.logs), h.store
+	conn, err := muxconn.NewMuxConn(gctx.GlobalUtilsContext(context.Background(), globals), server)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	globals.MuxConn = conn
+	h.conn = conn
+	client.SetDeadline(time.Now().Add(harnessTimeout))
+	t.Cleanup(func() {
+		client.Close()
+		h.proxy.Close()
+	})
+
+	if first != nil {
+		// sniff the first bytes, then rewind so the driver reads them again
+		go client.Write(first)
+		sniffed := make([]byte, len(first))
+		conn.SetReadDeadline(time.Now().Add(harnessTimeout))
+		if _, err := io.ReadFull(conn.StartSniffing(), sniffed); !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		conn.Reset()
+		conn.SetReadDeadline(time.Time{})
+		globals.BaseHash = GetHash(sniffed)
+	}
+
+	go d.ServeTCP(h.proxy)
+	h.proxy.InjectConn(conn)
+	return h
+}
+
+// send writes attacker bytes to the driver
+func (h *driverHarness) send(p string) {
+	h.t.Helper()
+	_, err := h.client.Write([]byte(p))
+	assert.NoError(h.t, err)
+}
+
+// read returns exactly n bytes of the driver's response
+func (h *driverHarness) read(n int) []byte {
+	h.t.Helper()
+	b := make([]byte, n)
+	_, err := io.ReadFull(h.r, b)
+	assert.NoError(h.t, err)
+	return b
+}
+
+// expect reads the response up to and including want, failing if it never comes
+func (h *driverHarness) expect(want string) string {
+	h.t.Helper()
+	var got strings.Builder
+	for !strings.HasSuffix(got.String(), want) {
+		b, err := h.r.ReadByte()
+		if !assert.NoError(h.t, err, "waiting for %q after %q", want, got.String()) {
+			return got.String()
+		}
+		got.WriteByte(b)
+	}
+	return got.String()
+}
+
+// closed waits for the driver to hang up, returning anything it sent first
+func (h *driverHarness) closed() string {
+	h.t.Helper()
+	rest, err := io.ReadAll(h.r)
+	assert.NoError(h.t, err)
+	return string(rest)
+}
+
+// stored waits for the driver to store a file in location
+func (h *driverHarness) stored(location string) store.File {
+	h.t.Helper()
+	timeout := time.After(harnessTimeout)
+	for {
+		select {
+		case f := <-h.store:
+			if f.Location == location {
+				return f
+			}
+		case <-timeout:
+			h.t.Fatalf("nothing stored in %s", location)
+		}
+	}
+}
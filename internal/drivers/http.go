@@ -1,17 +1,25 @@
 package drivers
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/http/httputil"
 
 	"github.com/antihax/gambit/internal/conman/gctx"
 	"github.com/antihax/gambit/internal/muxconn"
+	"golang.org/x/net/http2"
 )
 
-var server http.Server
+var (
+	server http.Server
+	// h2server serves connections which agreed HTTP/2 as TLS was unwrapped
+	h2server http2.Server
+)
 
 type httpd struct{}
 
@@ -25,8 +33,58 @@ var (
 )
 
 func (s *httpd) ServeTCP(ln net.Listener) {
-	server.Serve(ln)
+	acceptFailed(s.Name(), server.Serve(h2Listener{Listener: ln, serve: s.serveHTTP2}))
+}
+
+// ALPN takes TLS connections agreeing HTTP/2, which share nothing with the
+// HTTP/1 patterns
+func (s *httpd) ALPN() []string {
+	return []string{http2.NextProtoTLS}
+}
+
+// h2Listener passes HTTP/1 connections to the server and serves those which
+// agreed HTTP/2 itself, http.Server only does so for TLS it terminates
+type h2Listener struct {
+	net.Listener
+	serve func(*muxconn.MuxConn)
+}
+
+func (l h2Listener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if mux, ok := conn.(*muxconn.MuxConn); ok && negotiatedHTTP2(mux) {
+			go l.serve(mux)
+			continue
+		}
+		return conn, nil
+	}
 }
+
+// negotiatedHTTP2 reports if h2 was agreed when TLS was unwrapped
+func negotiatedHTTP2(mux *muxconn.MuxConn) bool {
+	tlsConn, ok := mux.Conn.(*tls.Conn)
+	return ok && tlsConn.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS
+}
+
+// serveHTTP2 serves the streams of an HTTP/2 connection through the same
+// handlers as HTTP/1, each request carrying the connection's globals
+func (s *httpd) serveHTTP2(mux *muxconn.MuxConn) {
+	defer mux.Close()
+	h2server.ServeConn(mux, &http2.ServeConnOpts{
+		Context:    s.SaveMuxInContext(context.Background(), mux),
+		BaseConfig: &server,
+		Handler:    server.Handler,
+	})
+}
+
+// Name of the driver
+func (s *httpd) Name() string {
+	return "http"
+}
+
 func (s *httpd) Patterns() [][]byte {
 	return [][]byte{
 		[]byte("GET "),
@@ -68,7 +126,7 @@ func init() {
 // copy context values to the http context
 func (s *httpd) SaveMuxInContext(ctx context.Context, c net.Conn) context.Context {
 	if mux, ok := c.(*muxconn.MuxConn); ok {
-		return context.WithValue(ctx, gctx.GlobalContextKey, gctx.GetGlobalFromContext(mux.Context, ""))
+		return gctx.GlobalUtilsContext(ctx, gctx.GetGlobalFromContext(mux.Context, ""))
 	}
 	return ctx
 }
@@ -84,13 +142,41 @@ func loggerFromContext(ctx context.Context) *gctx.Session {
 func (s *httpd) logger(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		glob := gctx.GetGlobalFromContext(r.Context(), "http")
-		b, err := httputil.DumpRequest(r, true)
+		// only as much of the body as we would store is read, handlers are given
+		// it back followed by whatever was left unread
+		spool := newSpool(glob)
+		b, err := httputil.DumpRequest(r, false)
 		if err != nil {
 			glob.LogError(err)
 		}
+		spool.Write(b)
+		body := io.Reader(r.Body)
+		if limit := captureLimit(glob, 0); limit > 0 {
+			body = io.LimitReader(body, limit)
+		}
+		var read bytes.Buffer
+		io.Copy(io.MultiWriter(spool, &read), body)
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(&read, r.Body), r.Body}
+
+		hash := spool.Sum()
+		if sampled(glob, "http", hash) {
+			StoreSpool(spool, glob.Store)
+		} else {
+			spool.Close()
+		}
 
-		l := glob.NewSession(glob.MuxConn.Sequence(), StoreHash(b, glob.Store))
-		l.AppendLogger(gctx.Value{Key: "url", Value: r.URL.Path})
+		// the same fields whichever version of HTTP was spoken
+		l := glob.NewSession(glob.MuxConn.Sequence(), hash)
+		l.AppendLogger(
+			gctx.Value{Key: "url", Value: r.URL.Path},
+			gctx.Value{Key: "method", Value: r.Method},
+			gctx.Value{Key: "host", Value: r.Host},
+			gctx.Value{Key: "ua", Value: r.UserAgent()},
+			gctx.Value{Key: "proto", Value: r.Proto},
+		)
 		l.Logger.Info().Msg("url")
 		r = r.WithContext(newContextWithLogger(r.Context(), r, l))
 
@@ -114,6 +200,7 @@ func (s *httpd) handleAll(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *httpd) handleTrap(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
 	loggerFromContext(r.Context()).
 		ATTACKEntPasswordGuessing(
 			gctx.Value{Key: "user", Value: r.Form.Get("user")},
@@ -0,0 +1,110 @@
+package drivers
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/antihax/gambit/internal/conman/gctx"
+	"github.com/antihax/gambit/internal/muxconn"
+	"github.com/antihax/gambit/internal/store"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
+)
+
+// testCertificate is a throwaway self signed certificate
+func testCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	tml := &x509.Certificate{SerialNumber: big.NewInt(1), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, tml, tml, &key.PublicKey, key)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestHTTP2(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(harnessTimeout))
+
+	// unwrap TLS agreeing h2, as conman does before routing by ALPN
+	tlsServer := tls.Server(server, &tls.Config{
+		Certificates: []tls.Certificate{testCertificate(t)},
+		NextProtos:   []string{http2.NextProtoTLS},
+	})
+	tlsClient := tls.Client(client, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{http2.NextProtoTLS}})
+	go tlsClient.Handshake()
+	if !assert.NoError(t, tlsServer.Handshake()) {
+		return
+	}
+
+	storeChan := make(chan store.File, 8)
+	globals := &gctx.GlobalUtils{Logger: zerolog.Nop(), Store: storeChan}
+	mux, err := muxconn.NewMuxConn(gctx.GlobalUtilsContext(context.Background(), globals), tlsServer)
+	if !assert.NoError(t, err) {
+		return
+	}
+	globals.MuxConn = mux
+
+	proxy := muxconn.NewProxy(1)
+	defer proxy.Close()
+	go (&httpd{}).ServeTCP(proxy)
+	proxy.InjectConn(mux)
+
+	cc, err := (&http2.Transport{}).NewClientConn(tlsClient)
+	if !assert.NoError(t, err) {
+		return
+	}
+	req, _ := http.NewRequest(http.MethodPost, "https://example.com/_ping", strings.NewReader("user=admin"))
+	req.Header.Set("User-Agent", "scanner")
+	resp, err := cc.RoundTrip(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 2, resp.ProtoMajor)
+
+	select {
+	case f := <-storeChan:
+		assert.Contains(t, string(f.Data), "POST /_ping HTTP/2.0")
+		assert.True(t, strings.HasSuffix(string(f.Data), "user=admin"))
+	case <-time.After(harnessTimeout):
+		t.Fatal("request was not stored")
+	}
+}
+
+func TestHTTPFormBody(t *testing.T) {
+	h := newDriverHarness(t, &httpd{}, nil)
+	body := "user=admin&pass=hunter2"
+	h.send("POST /loginto.cgi HTTP/1.1\r\nHost: example.com\r\nContent-Type: application/x-www-form-urlencoded\r\n" +
+		"Content-Length: " + strconv.Itoa(len(body)) + "\r\nConnection: close\r\n\r\n" + body)
+
+	// the handler still sees the body the capture read
+	resp, err := http.ReadResponse(h.r, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	resp.Body.Close()
+	assert.Eventually(t, func() bool {
+		logs := h.logs.String()
+		return strings.Contains(logs, `"user":"admin"`) && strings.Contains(logs, `"pass":"hunter2"`)
+	}, harnessTimeout, time.Millisecond*10)
+
+	assert.True(t, strings.HasSuffix(string(h.stored("raw").Data), body))
+}
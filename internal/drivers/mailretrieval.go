@@ -0,0 +1,398 @@
+package drivers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/antihax/gambit/internal/conman/gctx"
+	"github.com/antihax/gambit/internal/muxconn"
+	"github.com/antihax/gambit/internal/store"
+)
+
+const (
+	// mailMaxLine bounds a single command line
+	mailMaxLine = 4096
+	// mailMaxCommands bounds the commands taken in one session
+	mailMaxCommands = 100
+	// imapMaxLiteral bounds a literal string sent within a command
+	imapMaxLiteral = 4096
+)
+
+var errMailLine = errors.New("mail command too long")
+
+type pop3 struct{}
+
+type imap struct{}
+
+func init() {
+	AddDriver(&pop3{})
+	AddDriver(&imap{})
+}
+
+// Name of the driver
+func (s *pop3) Name() string {
+	return "pop3"
+}
+
+func (s *pop3) Patterns() [][]byte {
+	return nil
+}
+
+// Ports takes the POP3 port straight away, clients wait for our greeting
+func (s *pop3) Ports() []uint16 {
+	return []uint16{110}
+}
+
+func (s *pop3) ServeTCP(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			acceptFailed(s.Name(), err)
+			return
+		}
+		if mux, ok := conn.(*muxconn.MuxConn); ok {
+			go s.handle(mux)
+		}
+	}
+}
+
+// Name of the driver
+func (s *imap) Name() string {
+	return "imap"
+}
+
+func (s *imap) Patterns() [][]byte {
+	return nil
+}
+
+// Ports takes the IMAP port straight away, clients wait for our greeting
+func (s *imap) Ports() []uint16 {
+	return []uint16{143}
+}
+
+func (s *imap) ServeTCP(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			acceptFailed(s.Name(), err)
+			return
+		}
+		if mux, ok := conn.(*muxconn.MuxConn); ok {
+			go s.handle(mux)
+		}
+	}
+}
+
+// mailSession is the state of one POP3 or IMAP conversation
+type mailSession struct {
+	conn       *muxconn.MuxConn
+	glob       *gctx.GlobalUtils
+	r          *bufio.Reader
+	w          io.Writer
+	transcript bytes.Buffer
+}
+
+func newMailSession(conn *muxconn.MuxConn, driver string) *mailSession {
+	return &mailSession{
+		conn: conn,
+		glob: gctx.GetGlobalFromContext(conn.Context, driver),
+		r:    bufio.NewReader(conn),
+		w:    conn,
+	}
+}
+
+func (s *pop3) handle(conn *muxconn.MuxConn) {
+	defer conn.Close()
+	c := newMailSession(conn, "pop3")
+	defer c.store()
+
+	c.reply("+OK Dovecot ready.")
+	user := ""
+	for i := 0; i < mailMaxCommands; i++ {
+		line, err := c.readLine()
+		if err != nil {
+			c.done(err)
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		verb = strings.ToUpper(verb)
+		c.command("", verb, line)
+
+		switch verb {
+		case "CAPA":
+			c.reply("+OK\r\nCAPA\r\nTOP\r\nUIDL\r\nRESP-CODES\r\nAUTH-RESP-CODE\r\nUSER\r\nSASL PLAIN LOGIN\r\n.")
+		case "USER":
+			user = arg
+			c.reply("+OK")
+		case "PASS":
+			c.credentials("USER", user, arg)
+			c.reply("-ERR [AUTH] Authentication failed.")
+		case "APOP":
+			name, digest, _ := strings.Cut(arg, " ")
+			c.credentials("APOP", name, digest)
+			c.reply("-ERR [AUTH] Authentication failed.")
+		case "AUTH":
+			if arg == "" {
+				c.reply("+OK\r\nPLAIN\r\nLOGIN\r\n.")
+				continue
+			}
+			if !c.sasl(arg, "+ ") {
+				c.reply("-ERR Unsupported authentication mechanism.")
+				continue
+			}
+			c.reply("-ERR [AUTH] Authentication failed.")
+		case "STLS":
+			c.reply("-ERR TLS support isn't enabled.")
+		case "NOOP":
+			c.reply("+OK")
+		case "QUIT":
+			c.reply("+OK Logging out.")
+			return
+		default:
+			// mailbox commands need a login which never succeeds
+			c.reply("-ERR Unknown command.")
+		}
+	}
+}
+
+func (s *imap) handle(conn *muxconn.MuxConn) {
+	defer conn.Close()
+	c := newMailSession(conn, "imap")
+	defer c.store()
+
+	const capabilities = "IMAP4rev1 SASL-IR LOGIN-REFERRALS ID ENABLE IDLE LITERAL+ AUTH=PLAIN AUTH=LOGIN"
+	c.reply("* OK [CAPABILITY %s] Dovecot ready.", capabilities)
+	for i := 0; i < mailMaxCommands; i++ {
+		line, err := c.readIMAPCommand()
+		if err != nil {
+			c.done(err)
+			return
+		}
+		tag, rest, _ := strings.Cut(line, " ")
+		verb, arg, _ := strings.Cut(rest, " ")
+		verb = strings.ToUpper(verb)
+		c.command(tag, verb, line)
+
+		switch verb {
+		case "CAPABILITY":
+			c.reply("* CAPABILITY %s\r\n%s OK Pre-login capabilities listed, post-login capabilities have more.", capabilities, tag)
+		case "LOGIN":
+			args := imapArgs(arg)
+			for len(args) < 2 {
+				args = append(args, "")
+			}
+			c.credentials("LOGIN", args[0], args[1])
+			c.reply("%s NO [AUTHENTICATIONFAILED] Authentication failed.", tag)
+		case "AUTHENTICATE":
+			if !c.sasl(arg, "+ ") {
+				c.reply("%s NO Unsupported authentication mechanism.", tag)
+				continue
+			}
+			c.reply("%s NO [AUTHENTICATIONFAILED] Authentication failed.", tag)
+		case "ID":
+			c.reply("* ID (\"name\" \"Dovecot\")\r\n%s OK ID completed.", tag)
+		case "STARTTLS":
+			c.reply("%s BAD TLS support isn't enabled.", tag)
+		case "NOOP":
+			c.reply("%s OK NOOP completed.", tag)
+		case "LOGOUT":
+			c.reply("* BYE Logging out\r\n%s OK Logout completed.", tag)
+			return
+		case "SELECT", "EXAMINE", "LIST", "LSUB", "STATUS", "FETCH", "SEARCH", "UID":
+			c.reply("%s BAD Error in IMAP command %s: Please login first.", tag, verb)
+		default:
+			c.reply("%s BAD Error in IMAP command received by server.", tag)
+		}
+	}
+}
+
+// reply sends a response, adding the line ending
+func (c *mailSession) reply(format string, args ...interface{}) {
+	fmt.Fprintf(c.w, format+"\r\n", args...)
+}
+
+// readLine reads a command without the line ending, keeping it in the transcript
+func (c *mailSession) readLine() (string, error) {
+	c.conn.SetDeadline(time.Now().Add(time.Second * 30))
+	var line []byte
+	for {
+		chunk, isPrefix, err := c.r.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		line = append(line, chunk...)
+		if len(line) > mailMaxLine {
+			return "", errMailLine
+		}
+		if !isPrefix {
+			c.transcript.Write(line)
+			c.transcript.WriteByte('\n')
+			return string(line), nil
+		}
+	}
+}
+
+// readIMAPCommand reads a command line, folding in any literals it carries.
+// A line ending {n} is followed by n bytes then the rest of the command, the
+// client waits for us to continue unless it sent {n+}.
+func (c *mailSession) readIMAPCommand() (string, error) {
+	var cmd strings.Builder
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return "", err
+		}
+		n, sync, ok := imapLiteral(line)
+		if !ok {
+			cmd.WriteString(line)
+			return cmd.String(), nil
+		}
+		if n > imapMaxLiteral || cmd.Len()+len(line)+n > mailMaxLine {
+			return "", errMailLine
+		}
+		if sync {
+			c.reply("+ OK")
+		}
+		literal := make([]byte, n)
+		if _, err := io.ReadFull(c.r, literal); err != nil {
+			return "", err
+		}
+		c.transcript.Write(literal)
+		// carry the literal on as a quoted string so the arguments parse alike
+		cmd.WriteString(line[:strings.LastIndexByte(line, '{')])
+		cmd.WriteString(strconv.Quote(string(literal)))
+	}
+}
+
+// imapLiteral reports if line ends with a literal marker, its size and if
+// the client waits for a continuation before sending it
+func imapLiteral(line string) (int, bool, bool) {
+	if !strings.HasSuffix(line, "}") {
+		return 0, false, false
+	}
+	i := strings.LastIndexByte(line, '{')
+	if i < 0 {
+		return 0, false, false
+	}
+	size, sync := line[i+1:len(line)-1], true
+	if strings.HasSuffix(size, "+") {
+		size, sync = size[:len(size)-1], false
+	}
+	n, err := strconv.Atoi(size)
+	if err != nil || n < 0 {
+		return 0, false, false
+	}
+	return n, sync, true
+}
+
+// imapArgs splits arguments into atoms and quoted strings
+func imapArgs(s string) []string {
+	var args []string
+	for s = strings.TrimLeft(s, " "); s != ""; s = strings.TrimLeft(s, " ") {
+		if s[0] != '"' {
+			arg, rest, _ := strings.Cut(s, " ")
+			args = append(args, arg)
+			s = rest
+			continue
+		}
+		var arg strings.Builder
+		i := 1
+		for ; i < len(s) && s[i] != '"'; i++ {
+			if s[i] == '\\' && i+1 < len(s) {
+				i++
+			}
+			arg.WriteByte(s[i])
+		}
+		args = append(args, arg.String())
+		s = s[min(i+1, len(s)):]
+	}
+	return args
+}
+
+// sasl runs a PLAIN or LOGIN exchange, prompting with prefix, and records the
+// credentials. False is returned for other mechanisms.
+func (c *mailSession) sasl(arg, prefix string) bool {
+	mechanism, initial, _ := strings.Cut(arg, " ")
+	mechanism = strings.ToUpper(mechanism)
+	var user, pass string
+	switch mechanism {
+	case "PLAIN":
+		if initial == "" {
+			c.reply(prefix)
+			initial, _ = c.readLine()
+		}
+		decoded, _ := base64.StdEncoding.DecodeString(initial)
+		// authzid \0 authcid \0 password
+		if parts := strings.SplitN(string(decoded), "\x00", 3); len(parts) == 3 {
+			user, pass = parts[1], parts[2]
+		}
+	case "LOGIN":
+		if initial == "" {
+			c.reply(prefix + "VXNlcm5hbWU6")
+			initial, _ = c.readLine()
+		}
+		u, _ := base64.StdEncoding.DecodeString(initial)
+		c.reply(prefix + "UGFzc3dvcmQ6")
+		line, _ := c.readLine()
+		p, _ := base64.StdEncoding.DecodeString(line)
+		user, pass = string(u), string(p)
+	default:
+		return false
+	}
+	c.credentials(mechanism, user, pass)
+	return true
+}
+
+// command logs each command as it arrives, with the tag for IMAP
+func (c *mailSession) command(tag, verb, line string) {
+	e := c.glob.Logger.Debug().Str("verb", verb).Str("command", line)
+	if tag != "" {
+		e = e.Str("tag", tag)
+	}
+	e.Msg("mail command")
+}
+
+// credentials records a login attempt
+func (c *mailSession) credentials(mechanism, user, pass string) {
+	c.glob.NewSession(c.conn.Sequence(), StoreHash([]byte(user+":"+pass), c.glob.Store)).
+		ATTACKEntPasswordGuessing(
+			gctx.Value{Key: "user", Value: user},
+			gctx.Value{Key: "pass", Value: pass},
+			gctx.Value{Key: "mechanism", Value: mechanism},
+		)
+}
+
+func (c *mailSession) done(err error) {
+	if err != io.EOF {
+		c.glob.LogError(err)
+	}
+}
+
+// store saves the commands of the whole session
+func (c *mailSession) store() {
+	if c.transcript.Len() == 0 {
+		return
+	}
+	f := store.File{
+		Filename: fmt.Sprintf("%s.%s", c.conn.GetUUID(), DirectionInbound),
+		Location: "sessions",
+		Data:     c.transcript.Bytes(),
+		UUID:     c.conn.GetUUID(),
+		Sequence: c.conn.Sequence(),
+	}
+	if host, _, err := net.SplitHostPort(c.conn.RemoteAddr().String()); err == nil {
+		f.Attacker = host
+	}
+	if _, port, err := net.SplitHostPort(c.conn.LocalAddr().String()); err == nil {
+		f.DstPort = port
+	}
+	store.Offer(c.glob.Store, f)
+}
@@ -0,0 +1,71 @@
+package drivers
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/antihax/gambit/internal/muxconn"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIMAPArgs(t *testing.T) {
+	assert.Equal(t, []string{"admin", "pa ss\"word"}, imapArgs(`admin "pa ss\"word"`))
+	assert.Equal(t, []string{"", "x"}, imapArgs(`"" x`))
+	assert.Equal(t, []string{"unterminated"}, imapArgs(`"unterminated`))
+	assert.Empty(t, imapArgs("  "))
+}
+
+func TestIMAPLiteral(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	mux, err := muxconn.NewMuxConn(context.Background(), server)
+	if !assert.NoError(t, err) {
+		return
+	}
+	client.SetDeadline(time.Now().Add(time.Second * 5))
+	go func() {
+		client.Write([]byte("a1 LOGIN {5}\r\n"))
+		// wait for the continuation before sending a synchronising literal
+		line, _ := bufio.NewReader(client).ReadString('\n')
+		assert.Equal(t, "+ OK\r\n", line)
+		client.Write([]byte("admin {4+}\r\npass\r\n"))
+	}()
+
+	c := &mailSession{conn: mux, r: bufio.NewReader(mux), w: mux}
+	line, err := c.readIMAPCommand()
+	assert.NoError(t, err)
+	assert.Equal(t, `a1 LOGIN "admin" "pass"`, line)
+	assert.Equal(t, []string{"admin", "pass"}, imapArgs(line[len("a1 LOGIN "):]))
+}
+
+func TestPOP3Session(t *testing.T) {
+	h := newDriverHarness(t, &pop3{}, nil)
+	h.expect("+OK Dovecot ready.\r\n")
+	h.send("USER admin\r\n")
+	h.expect("+OK\r\n")
+	h.send("PASS hunter2\r\n")
+	h.expect("-ERR [AUTH] Authentication failed.\r\n")
+	h.send("QUIT\r\n")
+	assert.Equal(t, "+OK Logging out.\r\n", h.closed())
+
+	f := h.stored("sessions")
+	assert.Equal(t, h.conn.GetUUID()+".inbound", f.Filename)
+	assert.Equal(t, "USER admin\nPASS hunter2\nQUIT\n", string(f.Data))
+}
+
+func TestIMAPSession(t *testing.T) {
+	h := newDriverHarness(t, &imap{}, nil)
+	h.expect("Dovecot ready.\r\n")
+	h.send("a1 LOGIN admin \"hunter 2\"\r\n")
+	h.expect("a1 NO [AUTHENTICATIONFAILED] Authentication failed.\r\n")
+	// AUTHENTICATE PLAIN with the credentials on the next line
+	h.send("a2 AUTHENTICATE PLAIN\r\n")
+	h.expect("+ \r\n")
+	h.send("AGFkbWluAGh1bnRlcjI=\r\n")
+	h.expect("a2 NO [AUTHENTICATIONFAILED] Authentication failed.\r\n")
+	h.send("a3 LOGOUT\r\n")
+	assert.Equal(t, "* BYE Logging out\r\na3 OK Logout completed.\r\n", h.closed())
+}
@@ -1,7 +1,6 @@
 package drivers
 
 import (
-	"log"
 	"net"
 	"time"
 
@@ -17,6 +16,11 @@ func init() {
 	AddDriver(&mikrotikRouterOS{})
 }
 
+// Name of the driver
+func (s *mikrotikRouterOS) Name() string {
+	return "mikrotik"
+}
+
 // [TODO] Find good pattern
 func (s *mikrotikRouterOS) Patterns() [][]byte {
 	return [][]byte{
@@ -29,7 +33,7 @@ func (s *mikrotikRouterOS) ServeTCP(ln net.Listener) {
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			log.Printf("failed to accept %s\n", err)
+			acceptFailed(s.Name(), err)
 			return
 		}
 		if mux, ok := conn.(*muxconn.MuxConn); ok {
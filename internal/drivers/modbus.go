@@ -1,7 +1,6 @@
 package drivers
 
 import (
-	"log"
 	"net"
 	"time"
 
@@ -18,6 +17,11 @@ func init() {
 	AddDriver(&modbus{})
 }
 
+// Name of the driver
+func (s *modbus) Name() string {
+	return "modbus"
+}
+
 // [TODO] Find good pattern
 func (s *modbus) Patterns() [][]byte {
 	return [][]byte{}
@@ -27,7 +31,7 @@ func (s *modbus) ServeTCP(ln net.Listener) {
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			log.Printf("failed to accept %s\n", err)
+			acceptFailed(s.Name(), err)
 			return
 		}
 		if mux, ok := conn.(*muxconn.MuxConn); ok {
@@ -0,0 +1,393 @@
+package drivers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/antihax/gambit/internal/conman/gctx"
+	"github.com/antihax/gambit/internal/muxconn"
+	"github.com/antihax/gambit/pkg/searchtree"
+)
+
+// MQTT control packet types, the high nibble of the fixed header
+const (
+	mqttCONNECT     = 1
+	mqttCONNACK     = 2
+	mqttPUBLISH     = 3
+	mqttPUBACK      = 4
+	mqttPUBREC      = 5
+	mqttPUBREL      = 6
+	mqttPUBCOMP     = 7
+	mqttSUBSCRIBE   = 8
+	mqttSUBACK      = 9
+	mqttUNSUBSCRIBE = 10
+	mqttUNSUBACK    = 11
+	mqttPINGREQ     = 12
+	mqttPINGRESP    = 13
+	mqttDISCONNECT  = 14
+)
+
+// mqttMaxPacket bounds the remaining length we will read, the protocol allows 256MB
+const mqttMaxPacket = 1024 * 1024
+
+var (
+	errMQTTLength    = errors.New("malformed mqtt remaining length")
+	errMQTTTooLarge  = errors.New("mqtt packet too large")
+	errMQTTMalformed = errors.New("malformed mqtt packet")
+)
+
+type mqtt struct{}
+
+func init() {
+	AddDriver(&mqtt{})
+}
+
+// Name of the driver
+func (s *mqtt) Name() string {
+	return "mqtt"
+}
+
+func (s *mqtt) Patterns() [][]byte {
+	return nil
+}
+
+// OffsetPatterns match a CONNECT by the protocol name following the remaining
+// length, which is one byte for most clients but may be two
+func (s *mqtt) OffsetPatterns() []searchtree.Pattern {
+	var patterns []searchtree.Pattern
+	for _, name := range []string{"\x00\x04MQTT", "\x00\x06MQIsdp"} {
+		patterns = append(patterns,
+			searchtree.Pattern{
+				Bytes: append([]byte{0x10, 0x00}, name...),
+				Mask:  append([]byte{0xff, 0x80}, bytes.Repeat([]byte{0xff}, len(name))...),
+			},
+			searchtree.Pattern{
+				Bytes: append([]byte{0x10, 0x80, 0x00}, name...),
+				Mask:  append([]byte{0xff, 0x80, 0x80}, bytes.Repeat([]byte{0xff}, len(name))...),
+			},
+		)
+	}
+	return patterns
+}
+
+// Ports takes the MQTT port straight away
+func (s *mqtt) Ports() []uint16 {
+	return []uint16{1883}
+}
+
+func (s *mqtt) ServeTCP(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			acceptFailed(s.Name(), err)
+			return
+		}
+		if mux, ok := conn.(*muxconn.MuxConn); ok {
+			go s.handle(mux)
+		}
+	}
+}
+
+// mqttConnect is what we keep of a CONNECT packet
+type mqttConnect struct {
+	protocol string
+	level    byte
+	clientID string
+	username string
+	password string
+	hasUser  bool
+	hasPass  bool
+	willTo   string
+}
+
+func (s *mqtt) handle(conn *muxconn.MuxConn) {
+	defer conn.Close()
+	glob := gctx.GetGlobalFromContext(conn.Context, "mqtt")
+	r := bufio.NewReader(conn)
+
+	conn.SetDeadline(time.Now().Add(time.Second * 30))
+	header, body, err := mqttReadPacket(r)
+	if err != nil || header>>4 != mqttCONNECT {
+		glob.LogError(err)
+		return
+	}
+	c, err := mqttParseConnect(body)
+	if err != nil {
+		glob.LogError(err)
+		return
+	}
+
+	l := glob.NewSession(conn.Sequence(), StoreHash(body, glob.Store))
+	l.AppendLogger(
+		gctx.Value{Key: "protocol", Value: c.protocol},
+		gctx.Value{Key: "level", Value: c.level},
+		gctx.Value{Key: "clientID", Value: c.clientID},
+	)
+	if c.willTo != "" {
+		l.AppendLogger(gctx.Value{Key: "willTopic", Value: c.willTo})
+	}
+	if c.hasUser || c.hasPass {
+		l.ATTACKEntPasswordGuessing(
+			gctx.Value{Key: "user", Value: c.username},
+			gctx.Value{Key: "pass", Value: c.password},
+		)
+	} else {
+		l.ATTACKEntActiveScanning()
+	}
+
+	// accept whatever was offered
+	if c.level == 5 {
+		conn.Write([]byte{mqttCONNACK << 4, 3, 0, 0, 0})
+	} else {
+		conn.Write([]byte{mqttCONNACK << 4, 2, 0, 0})
+	}
+
+	for {
+		conn.SetDeadline(time.Now().Add(time.Second * 30))
+		header, body, err := mqttReadPacket(r)
+		if err != nil {
+			if err != io.EOF {
+				glob.LogError(err)
+			}
+			return
+		}
+		if !s.packet(conn, glob, c.level, header, body) {
+			return
+		}
+	}
+}
+
+// packet handles one packet after the CONNECT, returning false to hang up
+func (s *mqtt) packet(conn *muxconn.MuxConn, glob *gctx.GlobalUtils, level, header byte, body []byte) bool {
+	p := &mqttReader{b: body}
+	switch header >> 4 {
+	case mqttPUBLISH:
+		qos := (header >> 1) & 3
+		topic := p.str()
+		var id uint16
+		if qos > 0 {
+			id = p.u16()
+		}
+		if level == 5 {
+			p.properties()
+		}
+		if p.err != nil {
+			glob.LogError(p.err)
+			return false
+		}
+		l := glob.NewSession(conn.Sequence(), StoreHash(p.rest(), glob.Store))
+		l.ATTACKEntTransmittedDataManipulation(
+			gctx.Value{Key: "topic", Value: topic},
+			gctx.Value{Key: "qos", Value: qos},
+		)
+		switch qos {
+		case 1:
+			conn.Write(mqttAck(mqttPUBACK<<4, id))
+		case 2:
+			conn.Write(mqttAck(mqttPUBREC<<4, id))
+		}
+
+	case mqttPUBREL:
+		conn.Write(mqttAck(mqttPUBCOMP<<4, p.u16()))
+
+	case mqttSUBSCRIBE:
+		id := p.u16()
+		if level == 5 {
+			p.properties()
+		}
+		var topics []string
+		var granted []byte
+		for p.err == nil && p.remaining() > 0 {
+			topics = append(topics, p.str())
+			granted = append(granted, p.u8()&3)
+		}
+		if p.err != nil {
+			glob.LogError(p.err)
+			return false
+		}
+		l := glob.NewSession(conn.Sequence(), StoreHash(body, glob.Store))
+		l.ATTACKEntAutomatedCollection(gctx.Value{Key: "topics", Value: topics})
+
+		ack := binary.BigEndian.AppendUint16(nil, id)
+		if level == 5 {
+			ack = append(ack, 0)
+		}
+		conn.Write(append(mqttFixedHeader(mqttSUBACK<<4, len(ack)+len(granted)), append(ack, granted...)...))
+
+	case mqttUNSUBSCRIBE:
+		conn.Write(mqttAck(mqttUNSUBACK<<4, p.u16()))
+
+	case mqttPINGREQ:
+		conn.Write([]byte{mqttPINGRESP << 4, 0})
+
+	case mqttDISCONNECT:
+		return false
+	}
+	return true
+}
+
+// mqttParseConnect reads the variable header and payload of a CONNECT
+func mqttParseConnect(body []byte) (*mqttConnect, error) {
+	p := &mqttReader{b: body}
+	c := &mqttConnect{}
+	c.protocol = p.str()
+	c.level = p.u8()
+	flags := p.u8()
+	p.u16() // keep alive
+	if c.level == 5 {
+		p.properties()
+	}
+	c.clientID = p.str()
+	if flags&0x04 != 0 {
+		if c.level == 5 {
+			p.properties()
+		}
+		c.willTo = p.str()
+		p.bin()
+	}
+	if flags&0x80 != 0 {
+		c.username, c.hasUser = p.str(), true
+	}
+	if flags&0x40 != 0 {
+		c.password, c.hasPass = string(p.bin()), true
+	}
+	return c, p.err
+}
+
+// mqttReadPacket reads a fixed header and the body it describes
+func mqttReadPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, err := mqttReadLength(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if length > mqttMaxPacket {
+		return 0, nil, errMQTTTooLarge
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
+
+// mqttReadLength decodes the variable byte integer of up to four bytes, seven
+// bits at a time with the high bit marking that another byte follows
+func mqttReadLength(r io.ByteReader) (int, error) {
+	length, shift := 0, 0
+	for i := 0; i < 4; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		length |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return length, nil
+		}
+		shift += 7
+	}
+	return 0, errMQTTLength
+}
+
+// mqttFixedHeader encodes a fixed header for a body of length bytes
+func mqttFixedHeader(header byte, length int) []byte {
+	out := []byte{header}
+	for {
+		b := byte(length & 0x7f)
+		length >>= 7
+		if length > 0 {
+			b |= 0x80
+		}
+		out = append(out, b)
+		if length == 0 {
+			return out
+		}
+	}
+}
+
+// mqttAck is a packet carrying only a packet identifier
+func mqttAck(header byte, id uint16) []byte {
+	return binary.BigEndian.AppendUint16([]byte{header, 2}, id)
+}
+
+// mqttReader walks a packet body, keeping the first error so fields can be
+// read without checking each one
+type mqttReader struct {
+	b   []byte
+	err error
+}
+
+func (p *mqttReader) remaining() int {
+	return len(p.b)
+}
+
+func (p *mqttReader) take(n int) []byte {
+	if p.err != nil || n < 0 || n > len(p.b) {
+		p.err = errMQTTMalformed
+		p.b = nil
+		return nil
+	}
+	out := p.b[:n]
+	p.b = p.b[n:]
+	return out
+}
+
+func (p *mqttReader) u8() byte {
+	if b := p.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (p *mqttReader) u16() uint16 {
+	if b := p.take(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (p *mqttReader) bin() []byte {
+	return p.take(int(p.u16()))
+}
+
+func (p *mqttReader) str() string {
+	return string(p.bin())
+}
+
+// properties skips MQTT 5 properties, which are prefixed with their length
+func (p *mqttReader) properties() {
+	if p.err != nil {
+		return
+	}
+	r := &mqttReader{b: p.b}
+	length, err := mqttReadLength(r)
+	if err != nil {
+		p.err = errMQTTMalformed
+		return
+	}
+	p.b = r.b
+	p.take(length)
+}
+
+func (p *mqttReader) rest() []byte {
+	out := p.b
+	p.b = nil
+	return out
+}
+
+// ReadByte lets the length decoder read from the body
+func (p *mqttReader) ReadByte() (byte, error) {
+	b := p.take(1)
+	if b == nil {
+		return 0, p.err
+	}
+	return b[0], nil
+}
@@ -0,0 +1,57 @@
+package drivers
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMQTTRemainingLength(t *testing.T) {
+	for _, length := range []int{0, 127, 128, 16383, 16384, 2097151, 2097152, 268435455} {
+		header := mqttFixedHeader(0x30, length)
+		got, err := mqttReadLength(bytes.NewReader(header[1:]))
+		if assert.NoError(t, err, length) {
+			assert.Equal(t, length, got)
+		}
+	}
+	assert.Equal(t, []byte{0x30, 0x80, 0x01}, mqttFixedHeader(0x30, 128))
+
+	// a fifth byte is never valid
+	_, err := mqttReadLength(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff, 0x01}))
+	assert.ErrorIs(t, err, errMQTTLength)
+
+	// lengths beyond what we accept are refused before reading the body
+	_, _, err = mqttReadPacket(bufio.NewReader(bytes.NewReader(mqttFixedHeader(0x30, mqttMaxPacket+1))))
+	assert.ErrorIs(t, err, errMQTTTooLarge)
+}
+
+func TestMQTTParseConnect(t *testing.T) {
+	// MQTT 3.1.1 with a will, username and password
+	body := []byte("\x00\x04MQTT\x04\xc4\x00\x3c" +
+		"\x00\x04bot1" +
+		"\x00\x05dying\x00\x03bye" +
+		"\x00\x05admin" +
+		"\x00\x06public")
+	c, err := mqttParseConnect(body)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "MQTT", c.protocol)
+		assert.Equal(t, byte(4), c.level)
+		assert.Equal(t, "bot1", c.clientID)
+		assert.Equal(t, "dying", c.willTo)
+		assert.Equal(t, "admin", c.username)
+		assert.Equal(t, "public", c.password)
+	}
+
+	// MQTT 5 with properties and no credentials
+	c, err = mqttParseConnect([]byte("\x00\x04MQTT\x05\x02\x00\x3c\x05\x11\x00\x00\x00\x0a\x00\x00"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, byte(5), c.level)
+		assert.False(t, c.hasUser || c.hasPass)
+	}
+
+	// a password longer than the packet
+	_, err = mqttParseConnect([]byte("\x00\x04MQTT\x04\x40\x00\x3c\x00\x00\x00\x10pw"))
+	assert.ErrorIs(t, err, errMQTTMalformed)
+}
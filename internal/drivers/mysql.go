@@ -0,0 +1,352 @@
+package drivers
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/antihax/gambit/internal/conman/gctx"
+	"github.com/antihax/gambit/internal/muxconn"
+)
+
+const (
+	mysqlVersion       = "5.7.44-log"
+	mysqlNativePlugin  = "mysql_native_password"
+	mysqlMaxPacket     = 64 * 1024
+	mysqlCharsetUTF8   = 0x21
+	mysqlStatusAutoCmt = 0x0002
+	mysqlErrAccess     = 1045
+)
+
+// capability flags we care about
+const (
+	mysqlClientConnectWithDB    = 0x00000008
+	mysqlClientProtocol41       = 0x00000200
+	mysqlClientSSL              = 0x00000800
+	mysqlClientSecureConn       = 0x00008000
+	mysqlClientPluginAuth       = 0x00080000
+	mysqlClientConnectAttrs     = 0x00100000
+	mysqlClientPluginAuthLenEnc = 0x00200000
+
+	// what a stock 5.7 server offers, less SSL so clients stay in the clear
+	mysqlServerCapabilities = 0xc1fff7ff &^ mysqlClientSSL
+)
+
+var errMySQLShort = errors.New("mysql packet too short")
+
+type mysql struct{}
+
+func init() {
+	AddDriver(&mysql{})
+}
+
+// Name of the driver
+func (s *mysql) Name() string {
+	return "mysql"
+}
+
+// Patterns are empty, the client waits for our handshake
+func (s *mysql) Patterns() [][]byte {
+	return nil
+}
+
+// Ports takes the MySQL port straight away
+func (s *mysql) Ports() []uint16 {
+	return []uint16{3306}
+}
+
+func (s *mysql) ServeTCP(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			acceptFailed(s.Name(), err)
+			return
+		}
+		if mux, ok := conn.(*muxconn.MuxConn); ok {
+			go s.handle(mux)
+		}
+	}
+}
+
+// mysqlLogin is what the client sent in its handshake response
+type mysqlLogin struct {
+	capabilities uint32
+	charset      byte
+	user         string
+	authResponse []byte
+	database     string
+	plugin       string
+	attributes   map[string]string
+}
+
+func (s *mysql) handle(conn *muxconn.MuxConn) {
+	defer conn.Close()
+	glob := gctx.GetGlobalFromContext(conn.Context, "mysql")
+	conn.SetDeadline(time.Now().Add(time.Second * 10))
+
+	salt := mysqlSalt()
+	var connID [4]byte
+	rand.Read(connID[:])
+	if err := mysqlWritePacket(conn, 0, mysqlHandshake(binary.LittleEndian.Uint32(connID[:]), salt)); err != nil {
+		glob.LogError(err)
+		return
+	}
+
+	seq, payload, err := mysqlReadPacket(conn)
+	if err != nil {
+		if err != io.EOF {
+			glob.LogError(err)
+		}
+		return
+	}
+
+	login, err := mysqlParseLogin(payload)
+	if err != nil {
+		glob.NewSession(conn.Sequence(), StoreHash(payload, glob.Store)).
+			Logger.Info().Err(err).Msg("mysql bad handshake")
+		return
+	}
+
+	// in the hashcat format for mysql_native_password, so it can be cracked offline
+	crackable := fmt.Sprintf("%s:$mysqlna$%x*%x", login.user, salt, login.authResponse)
+	l := glob.NewSession(conn.Sequence(), StoreHash([]byte(crackable), glob.Store))
+	l.ATTACKEntPasswordGuessing(
+		gctx.Value{Key: "user", Value: login.user},
+		gctx.Value{Key: "pass", Value: hex.EncodeToString(login.authResponse)},
+		gctx.Value{Key: "salt", Value: hex.EncodeToString(salt)},
+		gctx.Value{Key: "database", Value: login.database},
+		gctx.Value{Key: "plugin", Value: login.plugin},
+		gctx.Value{Key: "capabilities", Value: fmt.Sprintf("0x%08x", login.capabilities)},
+		gctx.Value{Key: "attributes", Value: login.attributes},
+	)
+
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	using := "NO"
+	if len(login.authResponse) > 0 {
+		using = "YES"
+	}
+	msg := fmt.Sprintf("Access denied for user '%s'@'%s' (using password: %s)", login.user, host, using)
+	if err := mysqlWritePacket(conn, seq+1, mysqlError(mysqlErrAccess, "28000", msg)); err != nil {
+		glob.LogError(err)
+	}
+}
+
+// mysqlSalt returns 20 printable bytes, as the server's scramble never contains NUL
+func mysqlSalt() []byte {
+	salt := make([]byte, 20)
+	rand.Read(salt)
+	for i := range salt {
+		salt[i] = 0x21 + salt[i]%0x5e
+	}
+	return salt
+}
+
+// mysqlHandshake builds the protocol 10 initial handshake payload
+func mysqlHandshake(connID uint32, salt []byte) []byte {
+	var b bytes.Buffer
+	b.WriteByte(10)
+	b.WriteString(mysqlVersion)
+	b.WriteByte(0)
+	binary.Write(&b, binary.LittleEndian, connID)
+	b.Write(salt[:8])
+	b.WriteByte(0)
+	binary.Write(&b, binary.LittleEndian, uint16(mysqlServerCapabilities&0xffff))
+	b.WriteByte(mysqlCharsetUTF8)
+	binary.Write(&b, binary.LittleEndian, uint16(mysqlStatusAutoCmt))
+	binary.Write(&b, binary.LittleEndian, uint16(mysqlServerCapabilities>>16))
+	b.WriteByte(byte(len(salt) + 1))
+	b.Write(make([]byte, 10))
+	b.Write(salt[8:])
+	b.WriteByte(0)
+	b.WriteString(mysqlNativePlugin)
+	b.WriteByte(0)
+	return b.Bytes()
+}
+
+// mysqlError builds an ERR packet payload
+func mysqlError(code uint16, state, msg string) []byte {
+	var b bytes.Buffer
+	b.WriteByte(0xff)
+	binary.Write(&b, binary.LittleEndian, code)
+	b.WriteByte('#')
+	b.WriteString(state)
+	b.WriteString(msg)
+	return b.Bytes()
+}
+
+// mysqlWritePacket frames the payload with its 3 byte length and sequence id
+func mysqlWritePacket(w io.Writer, seq byte, payload []byte) error {
+	header := []byte{byte(len(payload)), byte(len(payload) >> 8), byte(len(payload) >> 16), seq}
+	_, err := w.Write(append(header, payload...))
+	return err
+}
+
+// mysqlReadPacket reads one framed packet, refusing anything large
+func mysqlReadPacket(r io.Reader) (byte, []byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	length := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+	if length > mysqlMaxPacket {
+		return 0, nil, fmt.Errorf("mysql packet of %d bytes too large", length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[3], payload, nil
+}
+
+// mysqlParseLogin decodes a HandshakeResponse41, or the older 320 form
+func mysqlParseLogin(p []byte) (*mysqlLogin, error) {
+	if len(p) < 2 {
+		return nil, errMySQLShort
+	}
+	login := &mysqlLogin{}
+
+	// pre 4.1 clients, 2 byte capabilities and 3 byte max packet, then user and the rest is the password
+	if binary.LittleEndian.Uint16(p)&mysqlClientProtocol41 == 0 {
+		if len(p) < 5 {
+			return nil, errMySQLShort
+		}
+		login.capabilities = uint32(binary.LittleEndian.Uint16(p))
+		user, rest, err := mysqlNullString(p[5:])
+		if err != nil {
+			return nil, err
+		}
+		login.user = user
+		login.authResponse, _ = bytes.CutSuffix(rest, []byte{0})
+		return login, nil
+	}
+
+	if len(p) < 32 {
+		return nil, errMySQLShort
+	}
+	login.capabilities = binary.LittleEndian.Uint32(p)
+	login.charset = p[8]
+	if login.capabilities&mysqlClientSSL != 0 && len(p) == 32 {
+		return nil, errors.New("mysql client requested SSL")
+	}
+	p = p[32:]
+
+	var err error
+	if login.user, p, err = mysqlNullString(p); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case login.capabilities&mysqlClientPluginAuthLenEnc != 0:
+		var n uint64
+		if n, p, err = mysqlLenEncInt(p); err != nil {
+			return nil, err
+		}
+		if uint64(len(p)) < n {
+			return nil, errMySQLShort
+		}
+		login.authResponse, p = p[:n], p[n:]
+	case login.capabilities&mysqlClientSecureConn != 0:
+		if len(p) < 1 || len(p) < 1+int(p[0]) {
+			return nil, errMySQLShort
+		}
+		login.authResponse, p = p[1:1+int(p[0])], p[1+int(p[0]):]
+	default:
+		var pass string
+		if pass, p, err = mysqlNullString(p); err != nil {
+			return nil, err
+		}
+		login.authResponse = []byte(pass)
+	}
+
+	// the rest is optional, keep what we have if the client cut it short
+	if login.capabilities&mysqlClientConnectWithDB != 0 && len(p) > 0 {
+		if login.database, p, err = mysqlNullString(p); err != nil {
+			return login, nil
+		}
+	}
+	if login.capabilities&mysqlClientPluginAuth != 0 && len(p) > 0 {
+		if login.plugin, p, err = mysqlNullString(p); err != nil {
+			return login, nil
+		}
+	}
+	if login.capabilities&mysqlClientConnectAttrs != 0 && len(p) > 0 {
+		login.attributes = mysqlAttributes(p)
+	}
+	return login, nil
+}
+
+// mysqlAttributes decodes the length prefixed key value pairs of connection attributes
+func mysqlAttributes(p []byte) map[string]string {
+	attrs := make(map[string]string)
+	total, p, err := mysqlLenEncInt(p)
+	if err != nil {
+		return attrs
+	}
+	if uint64(len(p)) > total {
+		p = p[:total]
+	}
+	for len(p) > 0 {
+		var key, value []byte
+		if key, p, err = mysqlLenEncString(p); err != nil {
+			break
+		}
+		if value, p, err = mysqlLenEncString(p); err != nil {
+			break
+		}
+		attrs[string(key)] = string(value)
+	}
+	return attrs
+}
+
+// mysqlNullString splits a NUL terminated string off the front of p
+func mysqlNullString(p []byte) (string, []byte, error) {
+	i := bytes.IndexByte(p, 0)
+	if i < 0 {
+		return "", nil, errMySQLShort
+	}
+	return string(p[:i]), p[i+1:], nil
+}
+
+// mysqlLenEncInt splits a length encoded integer off the front of p
+func mysqlLenEncInt(p []byte) (uint64, []byte, error) {
+	if len(p) < 1 {
+		return 0, nil, errMySQLShort
+	}
+	size := 0
+	switch p[0] {
+	case 0xfc:
+		size = 2
+	case 0xfd:
+		size = 3
+	case 0xfe:
+		size = 8
+	default:
+		return uint64(p[0]), p[1:], nil
+	}
+	if len(p) < 1+size {
+		return 0, nil, errMySQLShort
+	}
+	var n uint64
+	for i := size; i > 0; i-- {
+		n = n<<8 | uint64(p[i])
+	}
+	return n, p[1+size:], nil
+}
+
+// mysqlLenEncString splits a length encoded string off the front of p
+func mysqlLenEncString(p []byte) ([]byte, []byte, error) {
+	n, p, err := mysqlLenEncInt(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	if uint64(len(p)) < n {
+		return nil, nil, errMySQLShort
+	}
+	return p[:n], p[n:], nil
+}
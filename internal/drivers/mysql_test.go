@@ -0,0 +1,83 @@
+package drivers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMySQLPacketFraming(t *testing.T) {
+	var buf bytes.Buffer
+	payload := bytes.Repeat([]byte{'a'}, 300)
+	assert.NoError(t, mysqlWritePacket(&buf, 7, payload))
+	assert.Equal(t, []byte{0x2c, 0x01, 0x00, 0x07}, buf.Bytes()[:4])
+
+	seq, got, err := mysqlReadPacket(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, byte(7), seq)
+	assert.Equal(t, payload, got)
+
+	// refuse anything claiming to be huge
+	_, _, err = mysqlReadPacket(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0x00}))
+	assert.Error(t, err)
+}
+
+func TestMySQLHandshake(t *testing.T) {
+	salt := mysqlSalt()
+	assert.NotContains(t, salt, byte(0))
+
+	p := mysqlHandshake(42, salt)
+	assert.Equal(t, byte(10), p[0])
+	version, rest, err := mysqlNullString(p[1:])
+	assert.NoError(t, err)
+	assert.Equal(t, mysqlVersion, version)
+	assert.Equal(t, uint32(42), binary.LittleEndian.Uint32(rest))
+	assert.Equal(t, salt[:8], rest[4:12])
+	assert.Equal(t, salt[8:], rest[31:43])
+	assert.True(t, bytes.HasSuffix(p, []byte(mysqlNativePlugin+"\x00")))
+}
+
+func TestMySQLParseLogin(t *testing.T) {
+	caps := uint32(mysqlClientProtocol41 | mysqlClientSecureConn | mysqlClientConnectWithDB |
+		mysqlClientPluginAuth | mysqlClientConnectAttrs | mysqlClientPluginAuthLenEnc)
+	scramble := bytes.Repeat([]byte{0xab}, 20)
+
+	var p bytes.Buffer
+	binary.Write(&p, binary.LittleEndian, caps)
+	binary.Write(&p, binary.LittleEndian, uint32(16777216))
+	p.WriteByte(mysqlCharsetUTF8)
+	p.Write(make([]byte, 23))
+	p.WriteString("root\x00")
+	p.WriteByte(byte(len(scramble)))
+	p.Write(scramble)
+	p.WriteString("mysql\x00")
+	p.WriteString(mysqlNativePlugin + "\x00")
+	attrs := []byte("\x0c_client_name\x08libmysql")
+	p.WriteByte(byte(len(attrs)))
+	p.Write(attrs)
+
+	login, err := mysqlParseLogin(p.Bytes())
+	if assert.NoError(t, err) {
+		assert.Equal(t, "root", login.user)
+		assert.Equal(t, scramble, login.authResponse)
+		assert.Equal(t, "mysql", login.database)
+		assert.Equal(t, mysqlNativePlugin, login.plugin)
+		assert.Equal(t, map[string]string{"_client_name": "libmysql"}, login.attributes)
+	}
+
+	// truncated packets are refused rather than panicking
+	for i := 0; i < 37; i++ {
+		_, err := mysqlParseLogin(p.Bytes()[:i])
+		assert.Error(t, err, i)
+	}
+}
+
+func TestMySQLParseOldLogin(t *testing.T) {
+	login, err := mysqlParseLogin([]byte("\x85\x00\x00\x00\x00admin\x00secret\x00"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "admin", login.user)
+		assert.Equal(t, []byte("secret"), login.authResponse)
+	}
+}
@@ -0,0 +1,186 @@
+package drivers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// NTLMSSP message types
+const (
+	ntlmNegotiate    = 1
+	ntlmChallenge    = 2
+	ntlmAuthenticate = 3
+)
+
+// NTLMSSP negotiate flags we answer with
+const (
+	ntlmFlagUnicode          = 0x00000001
+	ntlmFlagRequestTarget    = 0x00000004
+	ntlmFlagNTLM             = 0x00000200
+	ntlmFlagAlwaysSign       = 0x00008000
+	ntlmFlagTargetTypeServer = 0x00020000
+	ntlmFlagExtendedSecurity = 0x00080000
+	ntlmFlagTargetInfo       = 0x00800000
+	ntlmFlagVersion          = 0x02000000
+	ntlmFlag128              = 0x20000000
+	ntlmFlagKeyExchange      = 0x40000000
+	ntlmFlag56               = 0x80000000
+
+	ntlmServerFlags = ntlmFlagUnicode | ntlmFlagRequestTarget | ntlmFlagNTLM | ntlmFlagAlwaysSign |
+		ntlmFlagExtendedSecurity | ntlmFlag128 | ntlmFlagKeyExchange | ntlmFlag56
+)
+
+var (
+	ntlmSignature = []byte("NTLMSSP\x00")
+	errNTLMShort  = errors.New("ntlm message too short")
+)
+
+// ntlmMessage is what we could decode from a client's NEGOTIATE or AUTHENTICATE
+type ntlmMessage struct {
+	Type        uint32
+	Flags       uint32
+	Domain      string
+	User        string
+	Workstation string
+	LMResponse  []byte
+	NTResponse  []byte
+}
+
+// findNTLM returns the NTLMSSP message inside a security blob, skipping any SPNEGO wrapping
+func findNTLM(blob []byte) []byte {
+	if i := bytes.Index(blob, ntlmSignature); i >= 0 {
+		return blob[i:]
+	}
+	return nil
+}
+
+// parseNTLM decodes a NEGOTIATE or AUTHENTICATE message
+func parseNTLM(msg []byte) (*ntlmMessage, error) {
+	if len(msg) < 16 || !bytes.HasPrefix(msg, ntlmSignature) {
+		return nil, errNTLMShort
+	}
+	m := &ntlmMessage{Type: binary.LittleEndian.Uint32(msg[8:])}
+
+	switch m.Type {
+	case ntlmNegotiate:
+		m.Flags = binary.LittleEndian.Uint32(msg[12:])
+		if len(msg) >= 32 {
+			m.Domain = string(ntlmField(msg, 16))
+			m.Workstation = string(ntlmField(msg, 24))
+		}
+	case ntlmAuthenticate:
+		if len(msg) < 64 {
+			return nil, errNTLMShort
+		}
+		m.Flags = binary.LittleEndian.Uint32(msg[60:])
+		m.LMResponse = ntlmField(msg, 12)
+		m.NTResponse = ntlmField(msg, 20)
+		m.Domain = ntlmString(ntlmField(msg, 28), m.Flags)
+		m.User = ntlmString(ntlmField(msg, 36), m.Flags)
+		m.Workstation = ntlmString(ntlmField(msg, 44), m.Flags)
+	default:
+		return nil, fmt.Errorf("unexpected ntlm message type %d", m.Type)
+	}
+	return m, nil
+}
+
+// ntlmField reads the length and offset at pos and returns the payload they
+// point to, or nothing if they point outside the message
+func ntlmField(msg []byte, pos int) []byte {
+	if len(msg) < pos+8 {
+		return nil
+	}
+	length := int(binary.LittleEndian.Uint16(msg[pos:]))
+	offset := int(binary.LittleEndian.Uint32(msg[pos+4:]))
+	if length == 0 || offset < 0 || offset+length > len(msg) {
+		return nil
+	}
+	return msg[offset : offset+length]
+}
+
+// ntlmString decodes UTF-16LE when the unicode flag is set
+func ntlmString(b []byte, flags uint32) string {
+	if flags&ntlmFlagUnicode == 0 {
+		return string(b)
+	}
+	return decodeUTF16(b)
+}
+
+// decodeUTF16 decodes little endian UTF-16, ignoring a trailing odd byte
+func decodeUTF16(b []byte) string {
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = binary.LittleEndian.Uint16(b[i*2:])
+	}
+	return string(utf16.Decode(u))
+}
+
+// encodeUTF16 encodes s as little endian UTF-16
+func encodeUTF16(s string) []byte {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, len(u)*2)
+	for i, c := range u {
+		binary.LittleEndian.PutUint16(b[i*2:], c)
+	}
+	return b
+}
+
+// ntlmChallengeMessage builds a CHALLENGE for the client's flags, advertising
+// ourselves as a standalone server named computer
+func ntlmChallengeMessage(clientFlags uint32, challenge []byte, computer string, now time.Time) []byte {
+	flags := clientFlags&ntlmServerFlags | ntlmFlagTargetTypeServer | ntlmFlagTargetInfo | ntlmFlagVersion
+	target := encodeUTF16(computer)
+
+	// attribute value pairs describing the server
+	var info bytes.Buffer
+	av := func(id uint16, value []byte) {
+		binary.Write(&info, binary.LittleEndian, id)
+		binary.Write(&info, binary.LittleEndian, uint16(len(value)))
+		info.Write(value)
+	}
+	av(2, target) // MsvAvNbDomainName
+	av(1, target) // MsvAvNbComputerName
+	av(4, encodeUTF16(strings.ToLower(computer)))
+	av(3, encodeUTF16(strings.ToLower(computer)))
+	filetime := make([]byte, 8)
+	binary.LittleEndian.PutUint64(filetime, toFiletime(now))
+	av(7, filetime) // MsvAvTimestamp
+	av(0, nil)      // MsvAvEOL
+
+	const headerSize = 56
+	var b bytes.Buffer
+	b.Write(ntlmSignature)
+	binary.Write(&b, binary.LittleEndian, uint32(ntlmChallenge))
+	binary.Write(&b, binary.LittleEndian, uint16(len(target)))
+	binary.Write(&b, binary.LittleEndian, uint16(len(target)))
+	binary.Write(&b, binary.LittleEndian, uint32(headerSize))
+	binary.Write(&b, binary.LittleEndian, flags)
+	b.Write(challenge)
+	b.Write(make([]byte, 8))
+	binary.Write(&b, binary.LittleEndian, uint16(info.Len()))
+	binary.Write(&b, binary.LittleEndian, uint16(info.Len()))
+	binary.Write(&b, binary.LittleEndian, uint32(headerSize+len(target)))
+	b.Write([]byte{10, 0, 0x63, 0x45, 0, 0, 0, 15}) // Windows 10 build 17763, NTLM revision 15
+	b.Write(target)
+	b.Write(info.Bytes())
+	return b.Bytes()
+}
+
+// Crackable returns the response in the hashcat NetNTLMv1/v2 format for the challenge we sent
+func (m *ntlmMessage) Crackable(challenge []byte) string {
+	if len(m.NTResponse) > 24 {
+		// NTLMv2, the proof is the first 16 bytes and the blob follows
+		return fmt.Sprintf("%s::%s:%x:%x:%x", m.User, m.Domain, challenge, m.NTResponse[:16], m.NTResponse[16:])
+	}
+	return fmt.Sprintf("%s::%s:%x:%x:%x", m.User, m.Domain, m.LMResponse, m.NTResponse, challenge)
+}
+
+// toFiletime converts to Windows FILETIME, 100ns intervals since 1601
+func toFiletime(t time.Time) uint64 {
+	return uint64(t.UnixNano()/100) + 116444736000000000
+}
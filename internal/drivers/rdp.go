@@ -2,29 +2,78 @@ package drivers
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/asn1"
 	"errors"
-	"log"
+	"fmt"
+	"io"
 	"net"
+	"strings"
 	"time"
 
 	"github.com/antihax/gambit/internal/conman/gctx"
 	"github.com/antihax/gambit/internal/muxconn"
+	"github.com/antihax/gambit/internal/store"
+	"github.com/antihax/gambit/pkg/searchtree"
+	fake "github.com/brianvoe/gofakeit/v6"
 	"github.com/lunixbochs/struc"
 )
 
+// rdpConfig controls how the RDP driver negotiates security, it is read from
+// the rdp entry in Drivers, e.g. {"rdp": {"protocol": "tls"}}
+type rdpConfig struct {
+	// Protocol is the security protocol offered, one of rdp, tls or credssp, default is credssp
+	Protocol string `json:"protocol"`
+}
+
 func init() {
+	AddDriver(&rdp{
+		computer: strings.ToUpper(fake.Word()) + "-RDS",
+	})
+}
+
+// OnStart reads the security protocol to offer
+func (s *rdp) OnStart(ctx context.Context, cfg DriverConfig) error {
+	s.config = rdpConfig{Protocol: "credssp"}
+	if err := cfg.Decode(&s.config); err != nil {
+		return err
+	}
+	protocol, ok := rdpProtocols[s.config.Protocol]
+	if !ok {
+		return fmt.Errorf("protocol must be one of rdp, tls or credssp, not %q", s.config.Protocol)
+	}
+	s.protocol = protocol
+	cfg.Logger.Debug().Str("protocol", s.config.Protocol).Msg("offering security protocol")
+	return nil
+}
 
-	AddDriver(&rdp{})
+// Name of the driver
+func (s *rdp) Name() string {
+	return "rdp"
 }
 
-// [TODO] this may be too aggressive
 func (s *rdp) Patterns() [][]byte {
-	return [][]byte{
-		{3, 0, 0},
+	return nil
+}
+
+// OffsetPatterns anchor the TPKT header to the start, it is too short to find anywhere
+func (s *rdp) OffsetPatterns() []searchtree.Pattern {
+	return []searchtree.Pattern{
+		{Bytes: []byte{3, 0, 0}},
 	}
 }
 
+// Priority yields to any other driver matching at the start, the TPKT header is too broad to win
+func (s *rdp) Priority() int {
+	return -1
+}
+
 type rdp struct {
+	config   rdpConfig
+	protocol uint32
+	computer string
 }
 
 // [TODO] Refactor this cluster or find an actual library to do it
@@ -39,8 +88,8 @@ type rdp_CONNECTIONCONFIRM struct {
 	Class     uint8
 	Type      uint8
 	Flags     uint8
-	Length2   uint16 `struct:"little"`
-	Protocols uint32 `struct:"little"`
+	Length2   uint16 `struc:"little"`
+	Protocols uint32 `struc:"little"`
 }
 
 type rdp_TPKTHeader struct {
@@ -68,25 +117,40 @@ type rdp_X224CRQ struct {
 type rdp_NEGREQ struct {
 	Type      uint8
 	Flags     uint8
-	Length    uint16 `struct:"little"`
-	Protocols uint32 `struct:"little"`
+	Length    uint16 `struc:"little"`
+	Protocols uint32 `struc:"little"`
 }
 
-// UnwrapTPKT reads the TPKT header and payload
-func (s *rdp) UnwrapTPKT(conn net.Conn) (*rdp_TPKTHeader, []byte, error) {
+// TPKT sizes include the four byte header
+const (
+	// rdpMinTPKT is the header and the shortest TPDU header, a length and code
+	rdpMinTPKT = 4 + 2
+	// rdpMaxTPKT bounds what we allocate, the requests we answer are far smaller
+	rdpMaxTPKT = 500
+)
+
+var (
+	errRDPSize    = errors.New("wrong tpkt size")
+	errRDPVersion = errors.New("unknown tpkt version")
+)
+
+// UnwrapTPKT reads the TPKT header and payload, refusing sizes which are too
+// short to hold a TPDU or larger than we are willing to allocate
+func (s *rdp) UnwrapTPKT(r io.Reader) (*rdp_TPKTHeader, []byte, error) {
 	hdr := &rdp_TPKTHeader{}
-	if err := struc.Unpack(conn, hdr); err != nil {
+	if err := struc.Unpack(r, hdr); err != nil {
 		return nil, nil, err
 	}
-	if hdr.Size < 4 || hdr.Size > 500 {
-		return nil, nil, errors.New("wrong payload size")
-	}
 	if hdr.Version != 3 {
-		return nil, nil, errors.New("unknown version")
+		return nil, nil, errRDPVersion
+	}
+	if hdr.Size < rdpMinTPKT || hdr.Size > rdpMaxTPKT {
+		return nil, nil, errRDPSize
 	}
 	b := make([]byte, hdr.Size-4)
 
-	if _, err := conn.Read(b); err != nil {
+	// a short read would leave the rest of the packet to be taken as the next header
+	if _, err := io.ReadFull(r, b); err != nil {
 		return nil, nil, err
 	}
 
@@ -140,68 +204,326 @@ const (
 	TPDU_DT = 0b1111 // Data
 )
 
+// security protocols requested in the negotiation request and selected in the response
+const (
+	rdpProtocolRDP     = 0x0
+	rdpProtocolSSL     = 0x1
+	rdpProtocolHybrid  = 0x2
+	rdpProtocolHybridX = 0x8
+)
+
+// rdpProtocols maps the "protocol" of the rdp entry in Drivers to the protocol offered
+var rdpProtocols = map[string]uint32{
+	"rdp":     rdpProtocolRDP,
+	"tls":     rdpProtocolSSL,
+	"credssp": rdpProtocolHybrid,
+}
+
+// negotiation response types and the failures sent when the client cannot
+// speak the protocol we offer
+const (
+	rdpNegResponse = 0x02
+	rdpNegFailure  = 0x03
+
+	rdpSSLRequired    = 0x1
+	rdpHybridRequired = 0x5
+)
+
+const (
+	// rdpMaxCapture bounds how much decrypted data is kept after the negotiation
+	rdpMaxCapture = 64 * 1024
+	// rdpMaxTSRequest bounds a single CredSSP message
+	rdpMaxTSRequest = 16 * 1024
+	// rdpMaxTSRequests bounds the CredSSP messages taken in one session
+	rdpMaxTSRequests = 4
+	// rdpCredSSPVersion is the highest CredSSP version we claim
+	rdpCredSSPVersion = 6
+	// rdpLogonFailure is STATUS_LOGON_FAILURE, returned to the failed authentication
+	rdpLogonFailure = -0x3fffff93
+)
+
+var errRDPTSRequest = errors.New("bad credssp message")
+
+// rdpTSRequest is the CredSSP message carrying the NTLM exchange
+type rdpTSRequest struct {
+	Version     int           `asn1:"explicit,tag:0"`
+	NegoTokens  []rdpNegoData `asn1:"explicit,optional,tag:1"`
+	AuthInfo    []byte        `asn1:"explicit,optional,tag:2"`
+	PubKeyAuth  []byte        `asn1:"explicit,optional,tag:3"`
+	ErrorCode   int           `asn1:"explicit,optional,tag:4"`
+	ClientNonce []byte        `asn1:"explicit,optional,tag:5"`
+}
+
+type rdpNegoData struct {
+	Token []byte `asn1:"explicit,tag:0"`
+}
+
 func (s *rdp) ServeTCP(ln net.Listener) {
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			log.Printf("failed to accept %s\n", err)
+			acceptFailed(s.Name(), err)
 			return
 		}
 		if mux, ok := conn.(*muxconn.MuxConn); ok {
+			go s.handle(mux)
+		}
+	}
+}
+
+func (s *rdp) handle(conn *muxconn.MuxConn) {
+	defer conn.Close()
+	// hang up when the manager shuts down, the read below unblocks on close
+	defer context.AfterFunc(conn.Context, func() { conn.Close() })()
+	glob := gctx.GetGlobalFromContext(conn.Context, "rdp")
+	for {
+		conn.SetDeadline(time.Now().Add(time.Second * 5))
+		hdr, b, err := s.UnwrapTPKT(conn)
+		if err != nil {
+			glob.LogError(err)
+			return
+		}
+
+		// save session data
+		l := glob.NewSession(conn.Sequence(), StoreHash(conn.Snapshot(), glob.Store))
+
+		reader := bytes.NewReader(b)
+		pdu, err := s.UnwrapTPDUHeader(reader)
+		if err != nil {
+			l.LogError(err)
+			return
+		}
+		switch pdu.Code >> 4 {
+		case TPDU_CR:
+			neg, req, err := s.ReadNegotiationRequest(reader, pdu.Length)
+			if err != nil {
+				l.LogError(err)
+				return
+			}
+			response := s.negotiate(req.Protocols)
+			l.AppendLogger(
+				gctx.Value{Key: "cookie", Value: string(neg.Cookie)},
+				gctx.Value{Key: "requestedProtocols", Value: fmt.Sprintf("0x%08x", req.Protocols)},
+				gctx.Value{Key: "rdpflags", Value: fmt.Sprintf("0x%02x", req.Flags)},
+			)
+			if response.Type == rdpNegFailure {
+				l.Logger.Info().Uint32("failure", response.Protocols).Msg("rdp negotiation refused")
+			} else {
+				l.Logger.Info().Uint32("selectedProtocol", response.Protocols).Msg("rdp negotiation")
+			}
+
+			response.Version = hdr.Version
+			response.Class = neg.Class
+			var buf bytes.Buffer
+			if err := struc.Pack(&buf, response); err != nil {
+				l.LogError(err)
+				return
+			}
+			conn.Write(buf.Bytes())
 
-			glob := gctx.GetGlobalFromContext(mux.Context, "rdp")
-
-			go func(conn *muxconn.MuxConn) {
-				defer conn.Close()
-				for {
-					conn.SetDeadline(time.Now().Add(time.Second * 5))
-					hdr, b, err := s.UnwrapTPKT(conn)
-					if err != nil {
-						glob.LogError(err)
-						return
-					}
-
-					// save session data
-					l := glob.NewSession(conn.Sequence(), StoreHash(conn.Snapshot(), glob.Store))
-
-					reader := bytes.NewReader(b)
-					pdu, err := s.UnwrapTPDUHeader(reader)
-					if err != nil {
-						l.LogError(err)
-						return
-					}
-					switch pdu.Code >> 4 {
-					case TPDU_CR:
-						neg, req, err := s.ReadNegotiationRequest(reader, pdu.Length)
-						if err != nil {
-							l.LogError(err)
-							return
-						}
-
-						var buf bytes.Buffer
-						if err := struc.Pack(&buf, &rdp_CONNECTIONCONFIRM{
-							Version:   hdr.Version,
-							Size:      0x13,
-							Code:      0xd0,
-							Length:    0x0e,
-							SrcRef:    0x1234,
-							Class:     neg.Class,
-							Flags:     req.Flags,
-							Type:      0x02,
-							Length2:   0x08,
-							Protocols: 0x00000000,
-						}); err != nil {
-							l.LogError(err)
-							return
-						}
-						conn.Write(buf.Bytes())
-					default:
-						//fmt.Printf("\n%+v\n%+v\n\n", hdr, b)
-					}
-
-					l.Logger.Trace().Msg("rdp knock")
-				}
-			}(mux)
+			if response.Type == rdpNegFailure {
+				return
+			}
+			if response.Protocols != rdpProtocolRDP {
+				s.secure(conn, glob, response.Protocols)
+				return
+			}
+		default:
+			//fmt.Printf("\n%+v\n%+v\n\n", hdr, b)
 		}
+
+		l.Logger.Trace().Msg("rdp knock")
+	}
+}
+
+// negotiate builds the response to the protocols requested, selecting the
+// configured protocol or refusing clients which did not ask for it as a server
+// requiring it would
+func (s *rdp) negotiate(requested uint32) *rdp_CONNECTIONCONFIRM {
+	response := &rdp_CONNECTIONCONFIRM{
+		Size:      0x13,
+		Code:      0xd0,
+		Length:    0x0e,
+		SrcRef:    0x1234,
+		Type:      rdpNegResponse,
+		Length2:   0x08,
+		Protocols: s.protocol,
+	}
+	switch {
+	case s.protocol == rdpProtocolSSL && requested&rdpProtocolSSL == 0:
+		response.Type, response.Protocols = rdpNegFailure, rdpSSLRequired
+	case s.protocol == rdpProtocolHybrid && requested&(rdpProtocolHybrid|rdpProtocolHybridX) == 0:
+		response.Type, response.Protocols = rdpNegFailure, rdpHybridRequired
+	}
+	return response
+}
+
+// secure completes the TLS handshake the negotiation selected, then runs any
+// CredSSP exchange and keeps what the client sends after it
+func (s *rdp) secure(conn *muxconn.MuxConn, glob *gctx.GlobalUtils, protocol uint32) {
+	// without a certificate, or when we may not answer, the raw capture is all there is
+	if glob.TLSCertificate == nil || glob.ObserveOnly {
+		return
+	}
+	conn.SetDeadline(time.Now().Add(time.Second * 10))
+	tc := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{*glob.TLSCertificate}})
+	if err := tc.Handshake(); err != nil {
+		glob.LogError(err)
+		return
+	}
+
+	var transcript bytes.Buffer
+	r := io.TeeReader(io.LimitReader(tc, rdpMaxCapture), &transcript)
+	defer s.store(conn, glob, &transcript)
+
+	if protocol == rdpProtocolHybrid {
+		if !s.credssp(conn, glob, tc, r) {
+			return
+		}
+	}
+	conn.SetDeadline(time.Now().Add(time.Second * 10))
+	io.Copy(io.Discard, r)
+}
+
+// credssp answers an NTLM NEGOTIATE with a challenge, and logs the AUTHENTICATE
+// before refusing it. True is returned if the client moved on without one.
+func (s *rdp) credssp(conn *muxconn.MuxConn, glob *gctx.GlobalUtils, w io.Writer, r io.Reader) bool {
+	challenge := make([]byte, 8)
+	rand.Read(challenge)
+	for i := 0; i < rdpMaxTSRequests; i++ {
+		conn.SetDeadline(time.Now().Add(time.Second * 10))
+		msg, err := readDER(r, rdpMaxTSRequest)
+		if err != nil {
+			glob.LogError(err)
+			return false
+		}
+		l := glob.NewSession(conn.Sequence(), StoreHash(msg, glob.Store))
+
+		var req rdpTSRequest
+		if _, err := asn1.Unmarshal(msg, &req); err != nil {
+			l.LogError(err)
+			return false
+		}
+		l.AppendLogger(gctx.Value{Key: "credssp", Value: req.Version})
+
+		var token, raw []byte
+		for _, t := range req.NegoTokens {
+			if raw = findNTLM(t.Token); raw != nil {
+				token = t.Token
+				break
+			}
+		}
+		if raw == nil {
+			l.Logger.Info().Msg("credssp without ntlm")
+			return true
+		}
+		m, err := parseNTLM(raw)
+		if err != nil {
+			l.Logger.Info().Err(err).Msg("rdp bad ntlm")
+			return false
+		}
+
+		version := min(req.Version, rdpCredSSPVersion)
+		switch m.Type {
+		case ntlmNegotiate:
+			l.AppendLogger(
+				gctx.Value{Key: "domain", Value: m.Domain},
+				gctx.Value{Key: "workstation", Value: m.Workstation},
+				gctx.Value{Key: "ntlmflags", Value: fmt.Sprintf("0x%08x", m.Flags)},
+			)
+			l.Logger.Info().Msg("ntlm negotiate")
+
+			reply := ntlmChallengeMessage(m.Flags, challenge, s.computer, time.Now())
+			if !bytes.HasPrefix(token, ntlmSignature) {
+				reply = spnegoResponse(reply)
+			}
+			if err := writeTSRequest(w, rdpTSRequest{Version: version, NegoTokens: []rdpNegoData{{Token: reply}}}); err != nil {
+				l.LogError(err)
+				return false
+			}
+
+		default:
+			// keep the response in a crackable form with the challenge it answered
+			StoreHash([]byte(m.Crackable(challenge)), glob.Store)
+			l.ATTACKEntPasswordGuessing(
+				gctx.Value{Key: "user", Value: m.User},
+				gctx.Value{Key: "domain", Value: m.Domain},
+				gctx.Value{Key: "workstation", Value: m.Workstation},
+				gctx.Value{Key: "ntlmflags", Value: fmt.Sprintf("0x%08x", m.Flags)},
+				gctx.Value{Key: "anonymous", Value: m.User == "" && len(m.NTResponse) == 0},
+			)
+			// clients before version 3 only learn of the failure as we hang up
+			if version >= 3 {
+				writeTSRequest(w, rdpTSRequest{Version: version, ErrorCode: rdpLogonFailure})
+			}
+			return false
+		}
+	}
+	return false
+}
+
+// writeTSRequest sends a CredSSP message
+func writeTSRequest(w io.Writer, req rdpTSRequest) error {
+	b, err := asn1.Marshal(req)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// readDER reads one DER encoded SEQUENCE, refusing any larger than max
+func readDER(r io.Reader, max int) ([]byte, error) {
+	hdr := make([]byte, 2, 6)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	if hdr[0] != 0x30 {
+		return nil, errRDPTSRequest
+	}
+	size := int(hdr[1])
+	if size&0x80 != 0 {
+		n := size & 0x7f
+		if n == 0 || n > 3 {
+			return nil, errRDPTSRequest
+		}
+		hdr = hdr[:2+n]
+		if _, err := io.ReadFull(r, hdr[2:]); err != nil {
+			return nil, err
+		}
+		size = 0
+		for _, b := range hdr[2:] {
+			size = size<<8 | int(b)
+		}
+	}
+	if size > max {
+		return nil, errRDPTSRequest
+	}
+	msg := make([]byte, len(hdr)+size)
+	copy(msg, hdr)
+	if _, err := io.ReadFull(r, msg[len(hdr):]); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// store saves what the client sent once TLS was established
+func (s *rdp) store(conn *muxconn.MuxConn, glob *gctx.GlobalUtils, transcript *bytes.Buffer) {
+	if transcript.Len() == 0 {
+		return
+	}
+	f := store.File{
+		Filename: fmt.Sprintf("%s.%s", conn.GetUUID(), DirectionInbound),
+		Location: "sessions",
+		Data:     transcript.Bytes(),
+		UUID:     conn.GetUUID(),
+		Sequence: conn.Sequence(),
+	}
+	if host, _, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil {
+		f.Attacker = host
+	}
+	if _, port, err := net.SplitHostPort(conn.LocalAddr().String()); err == nil {
+		f.DstPort = port
 	}
+	store.Offer(glob.Store, f)
 }
@@ -0,0 +1,135 @@
+package drivers
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/asn1"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/antihax/gambit/internal/conman/gctx"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnwrapTPKT(t *testing.T) {
+	s := &rdp{}
+
+	// a connection request, split across reads
+	packet := "\x03\x00\x00\x0b\x06\xe0\x00\x00\x00\x00\x00"
+	hdr, b, err := s.UnwrapTPKT(io.MultiReader(strings.NewReader(packet[:6]), strings.NewReader(packet[6:])))
+	if assert.NoError(t, err) {
+		assert.Equal(t, uint16(11), hdr.Size)
+		assert.Equal(t, []byte(packet[4:]), b)
+	}
+
+	for name, packet := range map[string]string{
+		"empty":     "\x03\x00\x00\x00",
+		"no tpdu":   "\x03\x00\x00\x04",
+		"too large": "\x03\x00\xff\xff",
+	} {
+		_, _, err := s.UnwrapTPKT(strings.NewReader(packet + strings.Repeat("\x00", 16)))
+		assert.ErrorIs(t, err, errRDPSize, name)
+	}
+	_, _, err = s.UnwrapTPKT(strings.NewReader("\x04\x00\x00\x0b"))
+	assert.ErrorIs(t, err, errRDPVersion)
+	_, _, err = s.UnwrapTPKT(strings.NewReader("\x03\x00\x00\x0b\x06"))
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	_, _, err = s.UnwrapTPKT(strings.NewReader("\x03\x00"))
+	assert.Error(t, err)
+}
+
+// rdpRequest builds a connection request with a cookie asking for protocols
+func rdpRequest(protocols uint32) []byte {
+	negReq := []byte{0x01, 0x00, 0x08, 0x00, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(negReq[4:], protocols)
+	x224 := append([]byte("\xe0\x00\x00\x00\x00\x00Cookie: mstshash=admin\r\n"), negReq...)
+	return append([]byte{0x03, 0x00, 0x00, byte(4 + 1 + len(x224)), byte(len(x224))}, x224...)
+}
+
+func TestRDPNegotiation(t *testing.T) {
+	request := rdpRequest(rdpProtocolSSL | rdpProtocolHybrid)
+
+	h := newDriverHarness(t, &rdp{protocol: rdpProtocolRDP}, request)
+	confirm := h.read(19)
+	assert.Equal(t, []byte{0x03, 0x00, 0x00, 0x13, 0x0e, 0xd0}, confirm[:6])
+	assert.Equal(t, []byte{rdpNegResponse, 0x00, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00}, confirm[11:])
+
+	// the request the driver read is stored, sniffed bytes included
+	assert.Equal(t, request, h.stored("raw").Data)
+}
+
+func TestRDPNegotiate(t *testing.T) {
+	for _, tc := range []struct {
+		offered, requested uint32
+		typ                uint8
+		protocol           uint32
+	}{
+		{rdpProtocolRDP, rdpProtocolHybrid, rdpNegResponse, rdpProtocolRDP},
+		{rdpProtocolSSL, rdpProtocolSSL | rdpProtocolHybrid, rdpNegResponse, rdpProtocolSSL},
+		{rdpProtocolSSL, rdpProtocolRDP, rdpNegFailure, rdpSSLRequired},
+		{rdpProtocolHybrid, rdpProtocolSSL | rdpProtocolHybrid, rdpNegResponse, rdpProtocolHybrid},
+		{rdpProtocolHybrid, rdpProtocolSSL | rdpProtocolHybridX, rdpNegResponse, rdpProtocolHybrid},
+		{rdpProtocolHybrid, rdpProtocolSSL, rdpNegFailure, rdpHybridRequired},
+	} {
+		response := (&rdp{protocol: tc.offered}).negotiate(tc.requested)
+		assert.Equal(t, tc.typ, response.Type, tc)
+		assert.Equal(t, tc.protocol, response.Protocols, tc)
+	}
+}
+
+func TestRDPOnStart(t *testing.T) {
+	s := &rdp{}
+	if assert.NoError(t, s.OnStart(context.Background(), DriverConfig{})) {
+		assert.Equal(t, uint32(rdpProtocolHybrid), s.protocol)
+	}
+	if assert.NoError(t, s.OnStart(context.Background(), DriverConfig{Raw: []byte(`{"protocol": "tls"}`)})) {
+		assert.Equal(t, uint32(rdpProtocolSSL), s.protocol)
+	}
+	assert.ErrorContains(t, s.OnStart(context.Background(), DriverConfig{Raw: []byte(`{"protocol": "nla"}`)}), "nla")
+}
+
+func TestRDPCredSSP(t *testing.T) {
+	cert := testCertificate(t)
+	h := newDriverHarnessGlobals(t, &rdp{protocol: rdpProtocolHybrid, computer: "TEST"}, rdpRequest(rdpProtocolSSL|rdpProtocolHybrid),
+		&gctx.GlobalUtils{TLSCertificate: &cert})
+	confirm := h.read(19)
+	assert.Equal(t, []byte{rdpNegResponse, 0x00, 0x08, 0x00, rdpProtocolHybrid, 0x00, 0x00, 0x00}, confirm[11:])
+
+	// nothing follows the confirm until the handshake, so the buffered reader holds nothing more
+	tc := tls.Client(h.client, &tls.Config{InsecureSkipVerify: true})
+	if !assert.NoError(t, tc.Handshake()) {
+		return
+	}
+	exchange := func(req rdpTSRequest) rdpTSRequest {
+		b, err := asn1.Marshal(req)
+		assert.NoError(t, err)
+		tc.Write(b)
+		msg, err := readDER(tc, rdpMaxTSRequest)
+		assert.NoError(t, err)
+		var resp rdpTSRequest
+		_, err = asn1.Unmarshal(msg, &resp)
+		assert.NoError(t, err)
+		return resp
+	}
+
+	// NTLM negotiate gets a challenge
+	resp := exchange(rdpTSRequest{Version: 6, NegoTokens: []rdpNegoData{{Token: []byte("NTLMSSP\x00\x01\x00\x00\x00\x07\x82\x08\xa2")}}})
+	assert.Equal(t, 6, resp.Version)
+	if assert.Len(t, resp.NegoTokens, 1) {
+		assert.True(t, bytes.HasPrefix(resp.NegoTokens[0].Token, []byte("NTLMSSP\x00\x02\x00\x00\x00")))
+	}
+	assert.Zero(t, resp.ErrorCode)
+
+	// and the authenticate is refused
+	auth := ntlmAuthenticateMessage("CORP", "admin", "KALI", bytes.Repeat([]byte{1}, 24))
+	resp = exchange(rdpTSRequest{Version: 6, NegoTokens: []rdpNegoData{{Token: auth}}})
+	assert.Equal(t, rdpLogonFailure, resp.ErrorCode)
+	assert.Empty(t, resp.NegoTokens)
+
+	// with the decrypted messages kept
+	session := h.stored("sessions")
+	assert.True(t, bytes.HasSuffix(session.Data, auth))
+}
@@ -2,7 +2,6 @@ package drivers
 
 import (
 	"bufio"
-	"log"
 	"net"
 	"strings"
 	"time"
@@ -21,10 +20,24 @@ func init() {
 	AddDriver(s)
 }
 
+// Name of the driver
+func (s *redis) Name() string {
+	return "redis"
+}
+
 func (s *redis) Patterns() [][]byte {
 	return [][]byte{
+		// RESP arrays of bulk strings
 		{0x2A, 0x31, 0x0D, 0x0A, 0x24},
 		{0x2A, 0x32, 0x0D, 0x0A, 0x24},
+		{0x2A, 0x33, 0x0D, 0x0A, 0x24},
+		{0x2A, 0x34, 0x0D, 0x0A, 0x24},
+		{0x2A, 0x35, 0x0D, 0x0A, 0x24},
+		// inline commands, the parser does not support pipelining these
+		[]byte("PING\r\n"),
+		[]byte("INFO\r\n"),
+		[]byte("ping\r\n"),
+		[]byte("info\r\n"),
 	}
 }
 
@@ -40,12 +53,18 @@ func (s *redis) flattenCommand(c *redisproto.Command) (r string) {
 	return r
 }
 
-// [TODO] add fake command responses
+// redisState tracks what a persistence attack has configured
+type redisState struct {
+	dir        string
+	dbfilename string
+}
+
 func (s *redis) ServeTCP(ln net.Listener) {
 	for {
 		c, err := ln.Accept()
 		if err != nil {
-			log.Println("failed accept")
+			acceptFailed(s.Name(), err)
+			return
 		}
 		if mux, ok := c.(*muxconn.MuxConn); ok {
 			glob := gctx.GetGlobalFromContext(mux.Context, "redis")
@@ -53,75 +72,36 @@ func (s *redis) ServeTCP(ln net.Listener) {
 			go func(conn *muxconn.MuxConn) {
 				defer conn.Close()
 
+				state := &redisState{dir: "/data", dbfilename: "dump.rdb"}
 				parser := redisproto.NewParser(conn)
 				writer := redisproto.NewWriter(bufio.NewWriter(conn))
 				for {
 					conn.SetDeadline(time.Now().Add(time.Second * 5))
 					command, err := parser.ReadCommand()
 					if err != nil {
-						writer.WriteError(err.Error())
+						if _, ok := err.(*redisproto.ProtocolError); ok {
+							writer.WriteError(err.Error())
+							writer.Flush()
+						}
 						glob.LogError(err)
 						return
 					}
 
+					// keep the attacker's bytes as sent, binary payloads included,
+					// pipelined commands arrive together with the first of them
+					flat := s.flattenCommand(command)
 					cmd := strings.ToUpper(string(command.Get(0)))
-					l := glob.NewSession(conn.Sequence(), StoreHash(conn.Snapshot(), glob.Store))
+					hash := ""
+					if raw := conn.Snapshot(); len(raw) > 0 {
+						hash = StoreHash(raw, glob.Store)
+					}
+					l := glob.NewSession(conn.Sequence(), hash)
 					l.AppendLogger(
 						gctx.Value{Key: "opCode", Value: cmd},
-						gctx.Value{Key: "args", Value: s.flattenCommand(command)},
+						gctx.Value{Key: "args", Value: flat},
 					)
 					l.Logger.Info().Msg("redis knock")
-					if err != nil {
-						_, ok := err.(*redisproto.ProtocolError)
-						if ok {
-							writer.WriteError(err.Error())
-							glob.LogError(err)
-							return
-						}
-						glob.LogError(err)
-						return
-					}
-					l.ATTACKEntActiveScanning()
-					switch cmd {
-					case "AUTH":
-						l.ATTACKEntPasswordGuessing(
-							gctx.Value{Key: "user", Value: "redis"},
-							gctx.Value{Key: "pass", Value: string(command.Get(1))},
-						)
-						writer.WriteBulkString("OK")
-					case "CLIENT":
-						switch strings.ToUpper(string(command.Get(1))) {
-						case "LIST":
-							writer.WriteBulkString(s.out(REDIS_CLIENT_LIST))
-						default:
-							writer.WriteBulkString("OK")
-						}
-
-					case "CONFIG":
-						switch strings.ToUpper(string(command.Get(1))) {
-						case "SET":
-							if string(command.Get(3)) == "crontab" || string(command.Get(3)) == "/etc/cron.d/" {
-								l.ATTACKEntCron()
-							} else {
-								l.ATTACKEntDataManipulation()
-							}
-							writer.WriteBulkString("OK")
-						default:
-							writer.WriteBulkString("OK")
-						}
-					case "FLUSHALL":
-						l.ATTACKEntDataDestruction()
-					case "PING":
-						writer.WriteBulkString("PONG")
-					case "INFO":
-						writer.WriteBulkString(s.out(REDIS_INFO))
-					case "COMMAND":
-						writer.WriteBulkString(REDIS_COMMAND)
-					case "NONEXISTENT":
-						writer.WriteError("ERR unknown command `NONEXISTENT`, with args beginning with:")
-					default:
-						writer.WriteBulkString("OK")
-					}
+					s.handleCommand(l, writer, state, cmd, command)
 
 					if command.IsLast() {
 						writer.Flush()
@@ -131,3 +111,88 @@ func (s *redis) ServeTCP(ln net.Listener) {
 		}
 	}
 }
+
+func (s *redis) handleCommand(l *gctx.Session, writer *redisproto.Writer, state *redisState, cmd string, command *redisproto.Command) {
+	switch cmd {
+	case "AUTH":
+		l.ATTACKEntPasswordGuessing(
+			gctx.Value{Key: "user", Value: "redis"},
+			gctx.Value{Key: "pass", Value: string(command.Get(1))},
+		)
+		writer.WriteSimpleString("OK")
+	case "CLIENT":
+		switch strings.ToUpper(string(command.Get(1))) {
+		case "LIST":
+			writer.WriteBulkString(s.out(REDIS_CLIENT_LIST))
+		default:
+			writer.WriteSimpleString("OK")
+		}
+	case "CONFIG":
+		switch strings.ToUpper(string(command.Get(1))) {
+		case "SET":
+			key, value := strings.ToLower(string(command.Get(2))), string(command.Get(3))
+			switch key {
+			case "dir":
+				state.dir = value
+			case "dbfilename":
+				state.dbfilename = value
+			}
+			if value == "crontab" || strings.Contains(value, "/cron") {
+				l.ATTACKEntCron()
+			} else if strings.Contains(value, ".ssh") || value == "authorized_keys" {
+				l.ATTACKEntSSHAuthorizedKeys()
+			} else {
+				l.ATTACKEntDataManipulation()
+			}
+			writer.WriteSimpleString("OK")
+		case "GET":
+			writer.WriteBulks(command.Get(2), []byte(""))
+		default:
+			writer.WriteSimpleString("OK")
+		}
+	case "SLAVEOF", "REPLICAOF":
+		// rogue master attacks sync a malicious module from the attacker
+		l.ATTACKEntIngressToolTransfer(
+			gctx.Value{Key: "master", Value: string(command.Get(1)) + ":" + string(command.Get(2))},
+		)
+		writer.WriteSimpleString("OK")
+	case "MODULE":
+		if strings.ToUpper(string(command.Get(1))) == "LOAD" {
+			l.ATTACKEntSharedModules(gctx.Value{Key: "module", Value: string(command.Get(2))})
+		}
+		writer.WriteSimpleString("OK")
+	case "SET":
+		l.ATTACKEntStoredDataManipulation(gctx.Value{Key: "key", Value: string(command.Get(1))})
+		writer.WriteSimpleString("OK")
+	case "SAVE", "BGSAVE":
+		// the payloads set above land wherever CONFIG SET pointed
+		path := state.dir + "/" + state.dbfilename
+		if strings.Contains(path, "cron") {
+			l.ATTACKEntCron(gctx.Value{Key: "path", Value: path})
+		} else if strings.Contains(path, ".ssh") {
+			l.ATTACKEntSSHAuthorizedKeys(gctx.Value{Key: "path", Value: path})
+		} else {
+			l.ATTACKEntActiveScanning(gctx.Value{Key: "path", Value: path})
+		}
+		if cmd == "BGSAVE" {
+			writer.WriteSimpleString("Background saving started")
+		} else {
+			writer.WriteSimpleString("OK")
+		}
+	case "FLUSHALL", "FLUSHDB":
+		l.ATTACKEntDataDestruction()
+		writer.WriteSimpleString("OK")
+	case "PING":
+		writer.WriteSimpleString("PONG")
+	case "INFO":
+		l.ATTACKEntActiveScanning()
+		writer.WriteBulkString(s.out(REDIS_INFO))
+	case "COMMAND":
+		writer.WriteBulkString(REDIS_COMMAND)
+	case "NONEXISTENT":
+		writer.WriteError("ERR unknown command `NONEXISTENT`, with args beginning with:")
+	default:
+		l.ATTACKEntActiveScanning()
+		writer.WriteSimpleString("OK")
+	}
+}
@@ -0,0 +1,56 @@
+package drivers
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// resp encodes a command as a RESP array of bulk strings
+func resp(args ...string) string {
+	var b strings.Builder
+	b.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, a := range args {
+		b.WriteString("$" + strconv.Itoa(len(a)) + "\r\n" + a + "\r\n")
+	}
+	return b.String()
+}
+
+func TestRedisCommands(t *testing.T) {
+	first := resp("PING")
+	h := newDriverHarness(t, &redis{}, []byte(first))
+	assert.Equal(t, "+PONG\r\n", h.expect("\r\n"))
+	assert.Equal(t, first, string(h.stored("raw").Data))
+
+	h.send(resp("AUTH", "hunter2"))
+	assert.Equal(t, "+OK\r\n", h.expect("\r\n"))
+
+	// a persistence attack points the dump somewhere useful then saves
+	h.send(resp("CONFIG", "SET", "dir", "/var/spool/cron"))
+	assert.Equal(t, "+OK\r\n", h.expect("\r\n"))
+	h.send(resp("CONFIG", "GET", "dir"))
+	assert.Equal(t, "*2\r\n$3\r\ndir\r\n$0\r\n\r\n", h.expect("$0\r\n\r\n"))
+
+	// binary payloads are stored exactly as sent
+	payload := resp("SET", "x", "\n\n*/1 * * * * curl\x00\xff\n\n")
+	h.send(payload)
+	assert.Equal(t, "+OK\r\n", h.expect("\r\n"))
+	// each command is stored as it arrives, AUTH and CONFIG come first
+	var stored []string
+	for i := 0; i < 4; i++ {
+		stored = append(stored, string(h.stored("raw").Data))
+	}
+	assert.Equal(t, payload, stored[3])
+
+	h.send(resp("BGSAVE"))
+	assert.Equal(t, "+Background saving started\r\n", h.expect("\r\n"))
+	h.send(resp("NONEXISTENT"))
+	assert.True(t, strings.HasPrefix(h.expect("\r\n"), "-ERR unknown command"))
+
+	logs := h.logs.String()
+	assert.Contains(t, logs, `"pass":"hunter2"`)
+	assert.Contains(t, logs, `"path":"/var/spool/cron/dump.rdb"`)
+	assert.Contains(t, logs, `"args":"CONFIG SET dir /var/spool/cron"`)
+}
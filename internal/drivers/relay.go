@@ -0,0 +1,192 @@
+package drivers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/antihax/gambit/internal/conman/gctx"
+	"github.com/antihax/gambit/internal/muxconn"
+	"github.com/antihax/gambit/internal/store"
+)
+
+// relayConfig controls where the relay forwards connections, it is read from
+// the relay's entry in Drivers, e.g. {"relay": {"backends": {"22": "10.0.0.5:22"}}}
+type relayConfig struct {
+	// Backends maps ports to real services
+	Backends map[uint16]string `json:"backends"`
+
+	// IdleTimeout closes relayed connections with no activity for this many seconds, default is 60
+	IdleTimeout int `json:"idleTimeout"`
+
+	// MaxBytes closes relayed connections after this many bytes in either direction, default is 10485760
+	MaxBytes int64 `json:"maxBytes"`
+}
+
+func init() {
+	AddDriver(&relay{})
+}
+
+// relay transparently proxies connections to a real backend, capturing both directions
+type relay struct {
+	config relayConfig
+}
+
+// Name of the driver
+func (s *relay) Name() string {
+	return "relay"
+}
+
+func (s *relay) Patterns() [][]byte {
+	return nil
+}
+
+// OnStart reads the backends to relay to
+func (s *relay) OnStart(ctx context.Context, cfg DriverConfig) error {
+	s.config = relayConfig{IdleTimeout: 60, MaxBytes: 10485760}
+	if err := cfg.Decode(&s.config); err != nil {
+		return err
+	}
+	if s.config.IdleTimeout < 1 || s.config.MaxBytes < 1 {
+		return errors.New("idleTimeout and maxBytes must be at least 1")
+	}
+	return nil
+}
+
+// Ports claims every configured port
+func (s *relay) Ports() []uint16 {
+	ports := make([]uint16, 0, len(s.config.Backends))
+	for port := range s.config.Backends {
+		ports = append(ports, port)
+	}
+	return ports
+}
+
+func (s *relay) ServeTCP(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			acceptFailed(s.Name(), err)
+			return
+		}
+		if mux, ok := conn.(*muxconn.MuxConn); ok {
+			go s.relay(mux)
+		} else {
+			conn.Close()
+		}
+	}
+}
+
+func (s *relay) relay(mux *muxconn.MuxConn) {
+	defer mux.Close()
+	glob := gctx.GetGlobalFromContext(mux.Context, "relay")
+
+	addr, ok := mux.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return
+	}
+	backend, ok := s.config.Backends[uint16(addr.Port)]
+	if !ok {
+		return
+	}
+	mux.SetIdleTimeout(time.Second * time.Duration(s.config.IdleTimeout))
+
+	// connecting the attacker to a real backend would engage them, keep what
+	// they send until they go quiet instead
+	if glob.ObserveOnly {
+		inbound := newSpool(glob)
+		s.pipe(glob, io.Discard, mux, inbound)
+		l := glob.NewSession(mux.Sequence(), inbound.Sum())
+		s.storeSession(glob, mux, DirectionInbound, inbound)
+		l.Logger.Info().
+			Str("backend", backend).
+			Int64("bytes_in", inbound.Len()).
+			Msg("observed without relaying")
+		return
+	}
+
+	upstream, err := net.DialTimeout("tcp", backend, time.Second*5)
+	if err != nil {
+		glob.LogError(err)
+		return
+	}
+	defer upstream.Close()
+
+	// tear down the backend when the reaper closes the attacker
+	mux.OnClose(func() { upstream.Close() })
+
+	// transcripts move to disk as they grow so long relays are not held in memory
+	inbound, outbound := newSpool(glob), newSpool(glob)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		s.pipe(glob, upstream, mux, inbound)
+		upstream.Close()
+	}()
+	go func() {
+		defer wg.Done()
+		s.pipe(glob, mux, upstream, outbound)
+		mux.Close()
+	}()
+	wg.Wait()
+
+	l := glob.NewSession(mux.Sequence(), inbound.Sum())
+	s.storeSession(glob, mux, DirectionInbound, inbound)
+	s.storeSession(glob, mux, DirectionOutbound, outbound)
+	l.Logger.Info().
+		Str("backend", backend).
+		Int64("bytes_in", inbound.Len()).
+		Int64("bytes_out", outbound.Len()).
+		Msg("relayed")
+}
+
+// pipe copies src to dst up to the byte cap, keeping a transcript up to the capture cap
+func (s *relay) pipe(glob *gctx.GlobalUtils, dst io.Writer, src io.Reader, transcript io.Writer) {
+	keep := &cappedWriter{w: transcript, max: captureLimit(glob, s.config.MaxBytes)}
+	io.Copy(dst, io.TeeReader(io.LimitReader(src, s.config.MaxBytes), keep))
+}
+
+// cappedWriter keeps the first max bytes written and silently drops the rest
+type cappedWriter struct {
+	w   io.Writer
+	n   int64
+	max int64
+}
+
+func (w *cappedWriter) Write(p []byte) (int, error) {
+	if room := w.max - w.n; room > 0 {
+		n, _ := w.w.Write(p[:min(int64(len(p)), room)])
+		w.n += int64(n)
+	}
+	return len(p), nil
+}
+
+// storeSession saves one direction of the transcript
+func (s *relay) storeSession(glob *gctx.GlobalUtils, mux *muxconn.MuxConn, direction string, transcript *store.Spool) {
+	if transcript.Len() == 0 {
+		transcript.Close()
+		return
+	}
+	f := store.File{
+		Filename: fmt.Sprintf("%s.%s", mux.GetUUID(), direction),
+		Location: "sessions",
+		UUID:     mux.GetUUID(),
+		Sequence: mux.Sequence(),
+	}
+	if err := transcript.Fill(&f); err != nil {
+		glob.LogError(err)
+		return
+	}
+	if host, _, err := net.SplitHostPort(mux.RemoteAddr().String()); err == nil {
+		f.Attacker = host
+	}
+	if _, port, err := net.SplitHostPort(mux.LocalAddr().String()); err == nil {
+		f.DstPort = port
+	}
+	store.Offer(glob.Store, f)
+}
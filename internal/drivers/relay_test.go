@@ -0,0 +1,84 @@
+package drivers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/antihax/gambit/internal/conman/gctx"
+	"github.com/antihax/gambit/internal/muxconn"
+	"github.com/antihax/gambit/internal/store"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRelayBackends(t *testing.T) {
+	// a backend echoing what it is sent
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer backend.Close()
+	go func() {
+		conn, err := backend.Accept()
+		if err == nil {
+			io.Copy(conn, conn)
+			conn.Close()
+		}
+	}()
+
+	front, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer front.Close()
+	port := front.Addr().(*net.TCPAddr).Port
+
+	s := &relay{}
+	raw := fmt.Sprintf(`{"backends": {"%d": %q}, "idleTimeout": 5}`, port, backend.Addr().String())
+	if !assert.NoError(t, s.OnStart(context.Background(), DriverConfig{Raw: []byte(raw)})) {
+		return
+	}
+	assert.Equal(t, []uint16{uint16(port)}, s.Ports())
+	assert.Equal(t, int64(10485760), s.config.MaxBytes, "defaults kept")
+
+	client, err := net.Dial("tcp", front.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer client.Close()
+	server, err := front.Accept()
+	if !assert.NoError(t, err) {
+		return
+	}
+	stored := make(chan store.File, 4)
+	globals := &gctx.GlobalUtils{Logger: zerolog.Nop(), Store: stored}
+	mux, err := muxconn.NewMuxConn(gctx.GlobalUtilsContext(context.Background(), globals), server)
+	if !assert.NoError(t, err) {
+		return
+	}
+	go s.relay(mux)
+
+	// the attacker reaches the decoded backend
+	client.SetDeadline(time.Now().Add(harnessTimeout))
+	client.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(client, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+	client.Close()
+
+	select {
+	case f := <-stored:
+		assert.Equal(t, "sessions", f.Location)
+	case <-time.After(harnessTimeout):
+		t.Fatal("relay was not stored")
+	}
+
+	// settings which could never relay are refused
+	assert.Error(t, s.OnStart(context.Background(), DriverConfig{Raw: []byte(`{"idleTimeout": 0}`)}))
+	assert.Error(t, s.OnStart(context.Background(), DriverConfig{Raw: []byte(`{"backend": {}}`)}))
+}
@@ -2,146 +2,393 @@ package drivers
 
 import (
 	"bytes"
-	"log"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"net"
+	"strings"
 	"time"
-	"unsafe"
 
 	"github.com/antihax/gambit/internal/conman/gctx"
 	"github.com/antihax/gambit/internal/muxconn"
-	"github.com/lunixbochs/struc"
+	fake "github.com/brianvoe/gofakeit/v6"
+)
+
+const (
+	// smbMaxMessage bounds a single NetBIOS message, far above any negotiate or session setup
+	smbMaxMessage  = 128 * 1024
+	smb2HeaderSize = 64
+
+	smb1CommandNegotiate = 0x72
+
+	smb2CommandNegotiate    = 0x0000
+	smb2CommandSessionSetup = 0x0001
+	smb2CommandLogoff       = 0x0002
+	smb2CommandTreeConnect  = 0x0003
+
+	smb2FlagResponse = 0x00000001
+
+	smbStatusSuccess         = 0x00000000
+	smbStatusMoreProcessing  = 0xc0000016
+	smbStatusLogonFailure    = 0xc000006d
+	smbStatusAccessDenied    = 0xc0000022
+	smbStatusNotSupported    = 0xc00000bb
+	smb2DialectWildcard      = 0x02ff
+	smb2HighestDialectServed = 0x0302
+)
+
+var (
+	smb1Magic = []byte{0xff, 'S', 'M', 'B'}
+	smb2Magic = []byte{0xfe, 'S', 'M', 'B'}
+
+	// SPNEGO and NTLMSSP object identifiers, DER encoded
+	spnegoOID = []byte{0x06, 0x06, 0x2b, 0x06, 0x01, 0x05, 0x05, 0x02}
+	ntlmOID   = []byte{0x06, 0x0a, 0x2b, 0x06, 0x01, 0x04, 0x01, 0x82, 0x37, 0x02, 0x02, 0x0a}
+
+	errSMBFraming = errors.New("smb message is not a NetBIOS session message")
 )
 
 type smb struct {
+	computer string
+	guid     [16]byte
+	started  time.Time
 }
 
 func init() {
-	//xFF SMB
-	AddDriver(&smb{})
+	s := &smb{
+		computer: strings.ToUpper(fake.Word()) + "-SRV",
+		started:  time.Now().Add(-time.Duration(fake.Number(1, 90*24)) * time.Hour),
+	}
+	rand.Read(s.guid[:])
+	AddDriver(s)
 }
 
+// Name of the driver
+func (s *smb) Name() string {
+	return "smb"
+}
+
+// Patterns match SMB1 and SMB2 headers after the 4 byte NetBIOS header
 func (s *smb) Patterns() [][]byte {
-	return [][]byte{
-		{255, 83, 77, 66},
-	}
+	return [][]byte{smb1Magic, smb2Magic}
 }
 
 func (s *smb) ServeTCP(ln net.Listener) {
-	const (
-		CommandNegotiate uint8 = iota + 114
-		CommandSessionSetup
-		CommandLogoff
-		CommandTreeConnect
-		CommandTreeDisconnect
-		CommandCreate
-		CommandClose
-		CommandFlush
-		CommandRead
-		CommandWrite
-		CommandLock
-		CommandIOCtl
-		CommandCancel
-		CommandEcho
-		CommandQueryDirectory
-		CommandChangeNotify
-		CommandQueryInfo
-		CommandSetInfo
-		CommandOplockBreak
-	)
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			log.Printf("failed to accept %s\n", err)
+			acceptFailed(s.Name(), err)
 			return
 		}
 		if mux, ok := conn.(*muxconn.MuxConn); ok {
-			glob := gctx.GetGlobalFromContext(mux.Context, "smb")
-
-			go func(conn *muxconn.MuxConn) {
-				defer conn.Close()
-				for {
-					conn.SetDeadline(time.Now().Add(time.Second * 5))
-					var size uint32
-					hdr := &smb_HeaderV1{}
-
-					// Get the whole message
-					struc.Unpack(conn, &size)
-					b := make([]byte, size)
-					struc.Unpack(conn, &b)
-
-					buf := bytes.NewReader(b)
-
-					// Get the header
-					struc.Unpack(buf, hdr)
-
-					switch hdr.Command {
-					case CommandNegotiate:
-						r := &smb_NegotiateRespV1{
-							SecurityMode:    0x2,
-							DialectRevision: 0x0202,
-						}
-						r.Command = CommandNegotiate
-
-						struc.Pack(conn, uint32(unsafe.Sizeof(r)))
-						struc.Pack(conn, r)
-
-					case CommandSessionSetup:
-						r := &smb_NegotiateRespV1{}
-						r.Command = CommandSessionSetup
-						struc.Pack(conn, uint32(unsafe.Sizeof(r)))
-						struc.Pack(conn, r)
-
-					case CommandTreeConnect:
-						r := &smb_NegotiateRespV1{}
-						r.Command = CommandTreeConnect
-						struc.Pack(conn, uint32(unsafe.Sizeof(r)))
-						struc.Pack(conn, r)
-					default: // Byeeeeeeeeeeeee
-						return
-					}
-
-					glob.NewSession(conn.Sequence(), StoreHash(conn.Snapshot(), glob.Store)).
-						Logger.Trace().Msg("smb knock")
-				}
-			}(mux)
+			go s.handle(mux)
+		}
+	}
+}
+
+// smbSession is the state of one connection
+type smbSession struct {
+	conn      *muxconn.MuxConn
+	glob      *gctx.GlobalUtils
+	sessionID uint64
+	challenge []byte
+	spnego    bool
+}
+
+func (s *smb) handle(conn *muxconn.MuxConn) {
+	defer conn.Close()
+	c := &smbSession{
+		conn:      conn,
+		glob:      gctx.GetGlobalFromContext(conn.Context, "smb"),
+		challenge: make([]byte, 8),
+	}
+	rand.Read(c.challenge)
+	var sid [8]byte
+	rand.Read(sid[:])
+	c.sessionID = binary.LittleEndian.Uint64(sid[:])
+
+	for {
+		conn.SetDeadline(time.Now().Add(time.Second * 10))
+		msg, err := readNetBIOS(conn)
+		if err != nil {
+			if err != io.EOF {
+				c.glob.LogError(err)
+			}
+			return
+		}
+		l := c.glob.NewSession(conn.Sequence(), StoreHash(msg, c.glob.Store))
+
+		var resp []byte
+		switch {
+		case bytes.HasPrefix(msg, smb1Magic):
+			resp = s.smb1(l, msg)
+		case bytes.HasPrefix(msg, smb2Magic):
+			resp = s.smb2(c, l, msg)
+		default:
+			l.Logger.Info().Msg("smb unknown message")
+		}
+		if resp == nil {
+			return
+		}
+		if err := writeNetBIOS(conn, resp); err != nil {
+			c.glob.LogError(err)
+			return
+		}
+	}
+}
+
+// smb1 answers the SMB1 negotiate, upgrading to SMB2 when the client offers it.
+// Clients only speaking SMB1 are scanning for bugs like EternalBlue and are dropped.
+func (s *smb) smb1(l *gctx.Session, msg []byte) []byte {
+	if len(msg) < 35 || msg[4] != smb1CommandNegotiate {
+		l.AppendLogger(gctx.Value{Key: "smbversion", Value: 1})
+		l.Logger.Info().Msg("smb1 command")
+		return nil
+	}
+
+	// dialects are 0x02 prefixed NUL terminated strings after the word and byte counts
+	var dialects []string
+	for _, d := range bytes.Split(msg[35:], []byte{0}) {
+		if len(d) > 1 && d[0] == 0x02 {
+			dialects = append(dialects, string(d[1:]))
 		}
 	}
+	l.AppendLogger(
+		gctx.Value{Key: "smbversion", Value: 1},
+		gctx.Value{Key: "dialects", Value: dialects},
+	)
+
+	for _, d := range dialects {
+		switch d {
+		case "SMB 2.???":
+			l.Logger.Info().Msg("smb negotiate")
+			return s.negotiateResponse(0, smb2DialectWildcard)
+		case "SMB 2.002":
+			l.Logger.Info().Msg("smb negotiate")
+			return s.negotiateResponse(0, 0x0202)
+		}
+	}
+	l.ATTACKEntVulnerabilityScanning()
+	return nil
 }
 
-/*func bread(b io.Reader, v interface{}) error {
-	return binary.Read(b, binary.BigEndian, v)
-}*/
-
-type smb_HeaderV1 struct {
-	ProtocolID       [4]uint8
-	Command          uint8
-	Status           uint32
-	Flags            uint8
-	Flags2           uint16
-	PIDHigh          uint16
-	SecurityFeatures uint64
-	Reserved         uint16
-	TID              uint16
-	PIDLow           uint16
-	UID              uint16
-	MID              uint16
-}
-
-type smb_NegotiateRespV1 struct {
-	smb_HeaderV1
-	StructureSize        uint16
-	SecurityMode         uint16
-	DialectRevision      uint16
-	Reserved             uint16
-	ServerGuid           [16]byte
-	Capabilities         uint32
-	MaxTransactSize      uint32
-	MaxReadSize          uint32
-	MaxWriteSize         uint32
-	SystemTime           uint64
-	ServerStartTime      uint64
-	SecurityBufferOffset uint16 `struc:"offset:SecurityBlob"`
-	SecurityBufferLength uint16 `struc:"len:SecurityBlob"`
-	Reserved2            uint32
-	SecurityBlob         []byte
+// smb2 answers the commands leading up to authentication, refusing everything after
+func (s *smb) smb2(c *smbSession, l *gctx.Session, msg []byte) []byte {
+	if len(msg) < smb2HeaderSize {
+		l.Logger.Info().Msg("smb2 short header")
+		return nil
+	}
+	command := binary.LittleEndian.Uint16(msg[12:])
+	messageID := binary.LittleEndian.Uint64(msg[24:])
+	body := msg[smb2HeaderSize:]
+	l.AppendLogger(
+		gctx.Value{Key: "smbversion", Value: 2},
+		gctx.Value{Key: "opCode", Value: command},
+	)
+
+	switch command {
+	case smb2CommandNegotiate:
+		// StructureSize, DialectCount, SecurityMode, Reserved, Capabilities, ClientGuid, contexts, then dialects
+		if len(body) < 36 {
+			return nil
+		}
+		count := int(binary.LittleEndian.Uint16(body[2:]))
+		dialect := uint16(0)
+		offered := []string{}
+		for i := 0; i < count && 36+i*2+2 <= len(body); i++ {
+			d := binary.LittleEndian.Uint16(body[36+i*2:])
+			offered = append(offered, fmt.Sprintf("0x%04x", d))
+			if d > dialect && d <= smb2HighestDialectServed {
+				dialect = d
+			}
+		}
+		l.AppendLogger(gctx.Value{Key: "dialects", Value: offered})
+		l.Logger.Info().Msg("smb negotiate")
+		if dialect == 0 {
+			return nil
+		}
+		return s.negotiateResponse(messageID, dialect)
+
+	case smb2CommandSessionSetup:
+		// StructureSize, Flags, SecurityMode, Capabilities, Channel, then the buffer offset and length
+		if len(body) < 24 {
+			return nil
+		}
+		offset := int(binary.LittleEndian.Uint16(body[12:]))
+		length := int(binary.LittleEndian.Uint16(body[14:]))
+		if offset < smb2HeaderSize || offset+length > len(msg) {
+			l.Logger.Info().Msg("smb session setup out of bounds")
+			return nil
+		}
+		return s.sessionSetup(c, l, messageID, msg[offset:offset+length])
+
+	case smb2CommandTreeConnect, smb2CommandLogoff:
+		return smb2Response(command, smbStatusAccessDenied, messageID, c.sessionID, smb2Error())
+
+	default:
+		l.Logger.Info().Msg("smb2 command")
+		return smb2Response(command, smbStatusNotSupported, messageID, c.sessionID, smb2Error())
+	}
+}
+
+// sessionSetup answers NTLM NEGOTIATE with a challenge, and logs the AUTHENTICATE before refusing it
+func (s *smb) sessionSetup(c *smbSession, l *gctx.Session, messageID uint64, blob []byte) []byte {
+	raw := findNTLM(blob)
+	if raw == nil {
+		l.Logger.Info().Msg("smb session setup without ntlm")
+		return smb2Response(smb2CommandSessionSetup, smbStatusLogonFailure, messageID, c.sessionID, smb2Error())
+	}
+	c.spnego = !bytes.HasPrefix(blob, ntlmSignature)
+
+	m, err := parseNTLM(raw)
+	if err != nil {
+		l.Logger.Info().Err(err).Msg("smb bad ntlm")
+		return nil
+	}
+
+	switch m.Type {
+	case ntlmNegotiate:
+		l.AppendLogger(
+			gctx.Value{Key: "domain", Value: m.Domain},
+			gctx.Value{Key: "workstation", Value: m.Workstation},
+			gctx.Value{Key: "ntlmflags", Value: fmt.Sprintf("0x%08x", m.Flags)},
+		)
+		l.Logger.Info().Msg("ntlm negotiate")
+
+		token := ntlmChallengeMessage(m.Flags, c.challenge, s.computer, time.Now())
+		if c.spnego {
+			token = spnegoResponse(token)
+		}
+		return smb2Response(smb2CommandSessionSetup, smbStatusMoreProcessing, messageID, c.sessionID, smb2SessionSetupBody(token))
+
+	default:
+		// keep the response in a crackable form with the challenge it answered
+		StoreHash([]byte(m.Crackable(c.challenge)), c.glob.Store)
+		l.ATTACKEntPasswordGuessing(
+			gctx.Value{Key: "user", Value: m.User},
+			gctx.Value{Key: "domain", Value: m.Domain},
+			gctx.Value{Key: "workstation", Value: m.Workstation},
+			gctx.Value{Key: "ntlmflags", Value: fmt.Sprintf("0x%08x", m.Flags)},
+			gctx.Value{Key: "anonymous", Value: m.User == "" && len(m.NTResponse) == 0},
+		)
+		return smb2Response(smb2CommandSessionSetup, smbStatusLogonFailure, messageID, c.sessionID, smb2Error())
+	}
+}
+
+// negotiateResponse builds an SMB2 NEGOTIATE response offering SPNEGO with NTLM
+func (s *smb) negotiateResponse(messageID uint64, dialect uint16) []byte {
+	blob := spnegoInit()
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, uint16(65)) // StructureSize
+	binary.Write(&b, binary.LittleEndian, uint16(1))  // SecurityMode, signing enabled
+	binary.Write(&b, binary.LittleEndian, dialect)
+	binary.Write(&b, binary.LittleEndian, uint16(0)) // NegotiateContextCount
+	b.Write(s.guid[:])
+	binary.Write(&b, binary.LittleEndian, uint32(0x7))     // Capabilities, DFS, leasing and large MTU
+	binary.Write(&b, binary.LittleEndian, uint32(8388608)) // MaxTransactSize
+	binary.Write(&b, binary.LittleEndian, uint32(8388608)) // MaxReadSize
+	binary.Write(&b, binary.LittleEndian, uint32(8388608)) // MaxWriteSize
+	binary.Write(&b, binary.LittleEndian, toFiletime(time.Now()))
+	binary.Write(&b, binary.LittleEndian, toFiletime(s.started))
+	binary.Write(&b, binary.LittleEndian, uint16(smb2HeaderSize+64)) // SecurityBufferOffset
+	binary.Write(&b, binary.LittleEndian, uint16(len(blob)))
+	binary.Write(&b, binary.LittleEndian, uint32(0)) // NegotiateContextOffset
+	b.Write(blob)
+	return smb2Response(smb2CommandNegotiate, smbStatusSuccess, messageID, 0, b.Bytes())
+}
+
+// smb2SessionSetupBody wraps a security token in a SESSION_SETUP response
+func smb2SessionSetupBody(token []byte) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, uint16(9)) // StructureSize
+	binary.Write(&b, binary.LittleEndian, uint16(0)) // SessionFlags
+	binary.Write(&b, binary.LittleEndian, uint16(smb2HeaderSize+8))
+	binary.Write(&b, binary.LittleEndian, uint16(len(token)))
+	b.Write(token)
+	return b.Bytes()
+}
+
+// smb2Error is the body of an ERROR response
+func smb2Error() []byte {
+	return []byte{9, 0, 0, 0, 0, 0, 0, 0, 0}
+}
+
+// smb2Response prefixes the body with a response header
+func smb2Response(command uint16, status uint32, messageID, sessionID uint64, body []byte) []byte {
+	var b bytes.Buffer
+	b.Write(smb2Magic)
+	binary.Write(&b, binary.LittleEndian, uint16(smb2HeaderSize))
+	binary.Write(&b, binary.LittleEndian, uint16(0)) // CreditCharge
+	binary.Write(&b, binary.LittleEndian, status)
+	binary.Write(&b, binary.LittleEndian, command)
+	binary.Write(&b, binary.LittleEndian, uint16(1)) // CreditResponse
+	binary.Write(&b, binary.LittleEndian, uint32(smb2FlagResponse))
+	binary.Write(&b, binary.LittleEndian, uint32(0)) // NextCommand
+	binary.Write(&b, binary.LittleEndian, messageID)
+	binary.Write(&b, binary.LittleEndian, uint32(0)) // Reserved
+	binary.Write(&b, binary.LittleEndian, uint32(0)) // TreeId
+	binary.Write(&b, binary.LittleEndian, sessionID)
+	b.Write(make([]byte, 16)) // Signature
+	b.Write(body)
+	return b.Bytes()
+}
+
+// readNetBIOS reads one session message, a zero byte then a 3 byte big endian length
+func readNetBIOS(r io.Reader) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	if header[0] != 0 {
+		return nil, errSMBFraming
+	}
+	length := int(header[1])<<16 | int(header[2])<<8 | int(header[3])
+	if length > smbMaxMessage {
+		return nil, fmt.Errorf("smb message of %d bytes too large", length)
+	}
+	msg := make([]byte, length)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// writeNetBIOS frames msg as a session message
+func writeNetBIOS(w io.Writer, msg []byte) error {
+	header := []byte{0, byte(len(msg) >> 16), byte(len(msg) >> 8), byte(len(msg))}
+	_, err := w.Write(append(header, msg...))
+	return err
+}
+
+// spnegoInit is the NegTokenInit offering NTLMSSP
+func spnegoInit() []byte {
+	mechTypes := derTLV(0xa0, derTLV(0x30, ntlmOID))
+	return derTLV(0x60, append(append([]byte{}, spnegoOID...), derTLV(0xa0, derTLV(0x30, mechTypes))...))
+}
+
+// spnegoResponse wraps an NTLM token in a NegTokenResp, accept-incomplete
+func spnegoResponse(token []byte) []byte {
+	var b []byte
+	b = append(b, derTLV(0xa0, []byte{0x0a, 0x01, 0x01})...)
+	b = append(b, derTLV(0xa1, ntlmOID)...)
+	b = append(b, derTLV(0xa2, derTLV(0x04, token))...)
+	return derTLV(0xa1, derTLV(0x30, b))
+}
+
+// derTLV encodes a DER tag, length and value
+func derTLV(tag byte, value []byte) []byte {
+	n := len(value)
+	var length []byte
+	switch {
+	case n < 0x80:
+		length = []byte{byte(n)}
+	case n < 0x100:
+		length = []byte{0x81, byte(n)}
+	default:
+		length = []byte{0x82, byte(n >> 8), byte(n)}
+	}
+	out := append([]byte{tag}, length...)
+	return append(out, value...)
 }
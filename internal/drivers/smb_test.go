@@ -0,0 +1,146 @@
+package drivers
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/antihax/gambit/internal/muxconn"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNetBIOSFraming(t *testing.T) {
+	var buf bytes.Buffer
+	msg := bytes.Repeat([]byte{'a'}, 70000)
+	assert.NoError(t, writeNetBIOS(&buf, msg))
+	assert.Equal(t, []byte{0x00, 0x01, 0x11, 0x70}, buf.Bytes()[:4])
+
+	got, err := readNetBIOS(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, msg, got)
+
+	// other session packet types and oversized messages are refused
+	_, err = readNetBIOS(bytes.NewReader([]byte{0x85, 0, 0, 0}))
+	assert.ErrorIs(t, err, errSMBFraming)
+	_, err = readNetBIOS(bytes.NewReader([]byte{0x00, 0xff, 0xff, 0xff}))
+	assert.Error(t, err)
+}
+
+// smb2Request builds a request header and body
+func smb2Request(command uint16, messageID uint64, body []byte) []byte {
+	var b bytes.Buffer
+	b.Write(smb2Magic)
+	binary.Write(&b, binary.LittleEndian, uint16(smb2HeaderSize))
+	b.Write(make([]byte, 6))
+	binary.Write(&b, binary.LittleEndian, command)
+	b.Write(make([]byte, 10))
+	binary.Write(&b, binary.LittleEndian, messageID)
+	b.Write(make([]byte, 32))
+	b.Write(body)
+	return b.Bytes()
+}
+
+// sessionSetupRequest wraps a security blob in a SESSION_SETUP request
+func sessionSetupRequest(messageID uint64, blob []byte) []byte {
+	var body bytes.Buffer
+	binary.Write(&body, binary.LittleEndian, uint16(25))
+	body.Write(make([]byte, 10))
+	binary.Write(&body, binary.LittleEndian, uint16(smb2HeaderSize+24))
+	binary.Write(&body, binary.LittleEndian, uint16(len(blob)))
+	body.Write(make([]byte, 8))
+	body.Write(blob)
+	return smb2Request(smb2CommandSessionSetup, messageID, body.Bytes())
+}
+
+// ntlmAuthenticateMessage builds a unicode AUTHENTICATE with the payload after the 64 byte header
+func ntlmAuthenticateMessage(domain, user, workstation string, nt []byte) []byte {
+	fields := [][]byte{nil, nt, encodeUTF16(domain), encodeUTF16(user), encodeUTF16(workstation), nil}
+	var header, payload bytes.Buffer
+	header.Write(ntlmSignature)
+	binary.Write(&header, binary.LittleEndian, uint32(ntlmAuthenticate))
+	for _, f := range fields {
+		binary.Write(&header, binary.LittleEndian, uint16(len(f)))
+		binary.Write(&header, binary.LittleEndian, uint16(len(f)))
+		binary.Write(&header, binary.LittleEndian, uint32(64+payload.Len()))
+		payload.Write(f)
+	}
+	binary.Write(&header, binary.LittleEndian, uint32(ntlmFlagUnicode))
+	return append(header.Bytes(), payload.Bytes()...)
+}
+
+func TestParseNTLM(t *testing.T) {
+	nt := bytes.Repeat([]byte{0x11}, 40)
+	m, err := parseNTLM(ntlmAuthenticateMessage("CORP", "admin", "KALI", nt))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "CORP", m.Domain)
+		assert.Equal(t, "admin", m.User)
+		assert.Equal(t, "KALI", m.Workstation)
+		assert.Equal(t, nt, m.NTResponse)
+		assert.Contains(t, m.Crackable([]byte("12345678")), "admin::CORP:3132333435363738:")
+	}
+
+	// fields pointing outside the message are ignored
+	msg := ntlmAuthenticateMessage("CORP", "admin", "KALI", nil)
+	binary.LittleEndian.PutUint32(msg[40:], 0xffffff)
+	m, err = parseNTLM(msg)
+	if assert.NoError(t, err) {
+		assert.Empty(t, m.User)
+	}
+
+	for i := 0; i < 64; i++ {
+		_, err := parseNTLM(msg[:i])
+		assert.Error(t, err, i)
+	}
+}
+
+func TestSMBSession(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	mux, err := muxconn.NewMuxConn(context.Background(), server)
+	if !assert.NoError(t, err) {
+		return
+	}
+	go (&smb{computer: "TEST"}).handle(mux)
+	client.SetDeadline(time.Now().Add(time.Second * 5))
+
+	exchange := func(req []byte) []byte {
+		assert.NoError(t, writeNetBIOS(client, req))
+		resp, err := readNetBIOS(client)
+		assert.NoError(t, err)
+		assert.True(t, bytes.HasPrefix(resp, smb2Magic))
+		return resp
+	}
+	status := func(resp []byte) uint32 {
+		return binary.LittleEndian.Uint32(resp[8:])
+	}
+
+	// negotiate picks the highest dialect we serve and offers SPNEGO
+	var body bytes.Buffer
+	binary.Write(&body, binary.LittleEndian, uint16(36))
+	binary.Write(&body, binary.LittleEndian, uint16(3))
+	body.Write(make([]byte, 32))
+	for _, d := range []uint16{0x0202, 0x0302, 0x0311} {
+		binary.Write(&body, binary.LittleEndian, d)
+	}
+	resp := exchange(smb2Request(smb2CommandNegotiate, 0, body.Bytes()))
+	assert.Equal(t, uint32(smbStatusSuccess), status(resp))
+	assert.Equal(t, uint16(0x0302), binary.LittleEndian.Uint16(resp[smb2HeaderSize+4:]))
+	offset := binary.LittleEndian.Uint16(resp[smb2HeaderSize+56:])
+	length := binary.LittleEndian.Uint16(resp[smb2HeaderSize+58:])
+	assert.Equal(t, spnegoInit(), resp[offset:offset+length])
+
+	// NTLM negotiate gets a challenge
+	resp = exchange(sessionSetupRequest(1, []byte("NTLMSSP\x00\x01\x00\x00\x00\x07\x82\x08\xa2")))
+	assert.Equal(t, uint32(smbStatusMoreProcessing), status(resp))
+	offset = binary.LittleEndian.Uint16(resp[smb2HeaderSize+4:])
+	length = binary.LittleEndian.Uint16(resp[smb2HeaderSize+6:])
+	challenge := resp[offset : offset+length]
+	assert.True(t, bytes.HasPrefix(challenge, []byte("NTLMSSP\x00\x02\x00\x00\x00")))
+
+	// and the authenticate is refused
+	resp = exchange(sessionSetupRequest(2, ntlmAuthenticateMessage("CORP", "admin", "KALI", bytes.Repeat([]byte{1}, 24))))
+	assert.Equal(t, uint32(smbStatusLogonFailure), status(resp))
+}
@@ -0,0 +1,267 @@
+package drivers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/antihax/gambit/internal/conman/gctx"
+	"github.com/antihax/gambit/internal/muxconn"
+	fake "github.com/brianvoe/gofakeit/v6"
+)
+
+const (
+	// smtpMaxMessage bounds the DATA section we keep
+	smtpMaxMessage = 10 * 1024 * 1024
+	// smtpMaxLine bounds a single command line
+	smtpMaxLine = 4096
+)
+
+type smtp struct {
+	hostname string
+}
+
+func init() {
+	AddDriver(&smtp{hostname: "mail." + fake.DomainName()})
+}
+
+// Name of the driver
+func (s *smtp) Name() string {
+	return "smtp"
+}
+
+func (s *smtp) Patterns() [][]byte {
+	return [][]byte{
+		[]byte("EHLO "),
+		[]byte("HELO "),
+		[]byte("ehlo "),
+		[]byte("helo "),
+	}
+}
+
+// Ports takes the mail ports straight away, clients wait for our greeting
+func (s *smtp) Ports() []uint16 {
+	return []uint16{25, 587, 2525}
+}
+
+func (s *smtp) ServeTCP(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			acceptFailed(s.Name(), err)
+			return
+		}
+		if mux, ok := conn.(*muxconn.MuxConn); ok {
+			go s.handle(mux)
+		}
+	}
+}
+
+// smtpSession is the state of one conversation
+type smtpSession struct {
+	conn *muxconn.MuxConn
+	glob *gctx.GlobalUtils
+	r    *bufio.Reader
+	w    *bufio.Writer
+	helo string
+	from string
+	rcpt []string
+}
+
+func (s *smtp) handle(conn *muxconn.MuxConn) {
+	defer conn.Close()
+	c := &smtpSession{
+		conn: conn,
+		glob: gctx.GetGlobalFromContext(conn.Context, "smtp"),
+		r:    bufio.NewReader(conn),
+		w:    bufio.NewWriter(conn),
+	}
+
+	c.reply("220 %s ESMTP Postfix", s.hostname)
+	for {
+		conn.SetDeadline(time.Now().Add(time.Second * 30))
+		line, err := c.readLine()
+		if err != nil {
+			if err != io.EOF {
+				c.glob.LogError(err)
+			}
+			return
+		}
+
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "HELO":
+			c.helo = arg
+			c.reply("250 %s", s.hostname)
+		case "EHLO":
+			c.helo = arg
+			c.reply("250-%s\r\n250-PIPELINING\r\n250-SIZE %d\r\n250-AUTH PLAIN LOGIN\r\n250-8BITMIME\r\n250 SMTPUTF8", s.hostname, smtpMaxMessage)
+		case "MAIL":
+			c.from = smtpAddress(arg)
+			c.rcpt = nil
+			c.reply("250 2.1.0 Ok")
+		case "RCPT":
+			c.rcpt = append(c.rcpt, smtpAddress(arg))
+			c.reply("250 2.1.5 Ok")
+		case "DATA":
+			if c.from == "" || len(c.rcpt) == 0 {
+				c.reply("503 5.5.1 Error: need RCPT command")
+				continue
+			}
+			c.reply("354 End data with <CR><LF>.<CR><LF>")
+			if err := c.data(); err != nil {
+				c.glob.LogError(err)
+				return
+			}
+			c.reply("250 2.0.0 Ok: queued as %X", fake.Uint32())
+		case "AUTH":
+			if err := c.auth(arg); err != nil {
+				if err != io.EOF {
+					c.glob.LogError(err)
+				}
+				return
+			}
+		case "STARTTLS":
+			c.reply("454 4.7.0 TLS not available due to local problem")
+		case "RSET":
+			c.from, c.rcpt = "", nil
+			c.reply("250 2.0.0 Ok")
+		case "NOOP":
+			c.reply("250 2.0.0 Ok")
+		case "VRFY":
+			c.reply("252 2.0.0 %s", arg)
+		case "QUIT":
+			c.reply("221 2.0.0 Bye")
+			c.w.Flush()
+			return
+		default:
+			c.reply("502 5.5.2 Error: command not recognized")
+		}
+	}
+}
+
+// reply queues a response, flushing once pipelined commands are answered
+func (c *smtpSession) reply(format string, args ...interface{}) {
+	fmt.Fprintf(c.w, format+"\r\n", args...)
+	if c.r.Buffered() == 0 {
+		c.w.Flush()
+	}
+}
+
+// readLine reads a command without the line ending
+func (c *smtpSession) readLine() (string, error) {
+	var line []byte
+	for {
+		chunk, isPrefix, err := c.r.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		line = append(line, chunk...)
+		if len(line) > smtpMaxLine {
+			return "", fmt.Errorf("smtp line too long")
+		}
+		if !isPrefix {
+			return string(line), nil
+		}
+	}
+}
+
+// data reads the message up to the lone dot, removing dot stuffing, and stores the envelope with it
+func (c *smtpSession) data() error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "HELO: %s\r\nMAIL FROM: %s\r\nRCPT TO: %s\r\n\r\n", c.helo, c.from, strings.Join(c.rcpt, ", "))
+	for {
+		c.conn.SetDeadline(time.Now().Add(time.Second * 30))
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		trimmed := strings.TrimRight(line, "\r\n")
+		if trimmed == "." {
+			break
+		}
+		if strings.HasPrefix(line, ".") {
+			line = line[1:]
+		}
+		if msg.Len()+len(line) <= smtpMaxMessage {
+			msg.WriteString(line)
+		}
+	}
+
+	l := c.glob.NewSession(c.conn.Sequence(), StoreHash(msg.Bytes(), c.glob.Store))
+	l.ATTACKEntPhishing(
+		gctx.Value{Key: "helo", Value: c.helo},
+		gctx.Value{Key: "from", Value: c.from},
+		gctx.Value{Key: "rcpt", Value: c.rcpt},
+		gctx.Value{Key: "size", Value: msg.Len()},
+	)
+	c.from, c.rcpt = "", nil
+	return nil
+}
+
+// auth captures PLAIN and LOGIN credentials, accepting anything. An error is
+// returned if the client goes away part way through.
+func (c *smtpSession) auth(arg string) error {
+	mechanism, initial, _ := strings.Cut(arg, " ")
+	var user, pass string
+	var err error
+	switch strings.ToUpper(mechanism) {
+	case "PLAIN":
+		if initial == "" {
+			c.reply("334 ")
+			if initial, err = c.readLine(); err != nil {
+				return err
+			}
+		}
+		decoded, _ := base64.StdEncoding.DecodeString(initial)
+		// authzid \0 authcid \0 password
+		parts := strings.SplitN(string(decoded), "\x00", 3)
+		if len(parts) == 3 {
+			user, pass = parts[1], parts[2]
+		}
+	case "LOGIN":
+		if initial == "" {
+			c.reply("334 VXNlcm5hbWU6")
+			if initial, err = c.readLine(); err != nil {
+				return err
+			}
+		}
+		u, _ := base64.StdEncoding.DecodeString(initial)
+		c.reply("334 UGFzc3dvcmQ6")
+		line, err := c.readLine()
+		if err != nil {
+			return err
+		}
+		p, _ := base64.StdEncoding.DecodeString(line)
+		user, pass = string(u), string(p)
+	default:
+		c.reply("504 5.5.4 Unrecognized authentication type")
+		return nil
+	}
+
+	c.glob.NewSession(c.conn.Sequence(), StoreHash(c.conn.Snapshot(), c.glob.Store)).
+		ATTACKEntPasswordGuessing(
+			gctx.Value{Key: "user", Value: user},
+			gctx.Value{Key: "pass", Value: pass},
+			gctx.Value{Key: "mechanism", Value: strings.ToUpper(mechanism)},
+		)
+	c.reply("235 2.7.0 Authentication successful")
+	return nil
+}
+
+// smtpAddress pulls the address out of "FROM:<a@b> SIZE=1"
+func smtpAddress(arg string) string {
+	if _, after, ok := strings.Cut(arg, ":"); ok {
+		arg = after
+	}
+	arg = strings.TrimSpace(arg)
+	if i := strings.IndexByte(arg, '>'); i >= 0 {
+		arg = arg[:i]
+	}
+	return strings.TrimPrefix(arg, "<")
+}
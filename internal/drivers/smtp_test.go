@@ -0,0 +1,54 @@
+package drivers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSMTPPipelined(t *testing.T) {
+	h := newDriverHarness(t, &smtp{hostname: "mail.example.com"}, nil)
+	h.expect("220 mail.example.com ESMTP Postfix\r\n")
+	h.send("EHLO attacker\r\n")
+	h.expect("250 SMTPUTF8\r\n")
+
+	// the envelope and message arrive in one go, each is answered in order
+	h.send("MAIL FROM:<a@example.com> SIZE=10\r\nRCPT TO:<b@example.com>\r\nRCPT TO:<c@example.com>\r\nDATA\r\n")
+	assert.Equal(t, "250 2.1.0 Ok\r\n250 2.1.5 Ok\r\n250 2.1.5 Ok\r\n354 End data with <CR><LF>.<CR><LF>\r\n",
+		h.expect("<CR><LF>.<CR><LF>\r\n"))
+	h.send("Subject: hi\r\n\r\n..leading dot\r\n.\r\nQUIT\r\n")
+	h.expect("Ok: queued as ")
+	h.expect("\r\n")
+	assert.Equal(t, "221 2.0.0 Bye\r\n", h.closed())
+
+	// the body is stored unstuffed along with its envelope
+	f := h.stored("raw")
+	assert.Equal(t, "HELO: attacker\r\nMAIL FROM: a@example.com\r\nRCPT TO: b@example.com, c@example.com\r\n\r\nSubject: hi\r\n\r\n.leading dot\r\n", string(f.Data))
+}
+
+func TestSMTPAuth(t *testing.T) {
+	h := newDriverHarness(t, &smtp{hostname: "mail.example.com"}, nil)
+	h.expect("220 mail.example.com ESMTP Postfix\r\n")
+	h.send("AUTH LOGIN\r\n")
+	h.expect("334 VXNlcm5hbWU6\r\n")
+	h.send("YWRtaW4=\r\n")
+	h.expect("334 UGFzc3dvcmQ6\r\n")
+	h.send("aHVudGVyMg==\r\n")
+	h.expect("235 2.7.0 Authentication successful\r\n")
+	h.stored("raw")
+
+	h.send("AUTH PLAIN AGFkbWluAGh1bnRlcjI=\r\n")
+	h.expect("235 2.7.0 Authentication successful\r\n")
+	h.stored("raw")
+
+	// a client leaving part way through is not logged in
+	h.send("AUTH PLAIN\r\n")
+	h.expect("334 \r\n")
+	h.client.Close()
+	select {
+	case f := <-h.store:
+		t.Fatalf("stored %s after the client left", f.Filename)
+	case <-time.After(time.Millisecond * 100):
+	}
+}
@@ -0,0 +1,277 @@
+package drivers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/antihax/gambit/internal/conman/gctx"
+	"github.com/antihax/gambit/internal/muxconn"
+	"github.com/antihax/gambit/pkg/searchtree"
+)
+
+// SOCKS5 authentication methods, address types and replies, RFC 1928 and 1929
+const (
+	socks5NoAuth       = 0x00
+	socks5UserPass     = 0x02
+	socks5NoAcceptable = 0xff
+
+	socksIPv4   = 0x01
+	socksDomain = 0x03
+	socksIPv6   = 0x04
+
+	socks5Refused  = 0x05
+	socks4Rejected = 0x5b
+)
+
+// socksMaxString bounds the NUL terminated fields of SOCKS4
+const socksMaxString = 255
+
+var errSOCKSMalformed = errors.New("malformed socks request")
+
+// socksCommands names the request commands, shared by both versions
+var socksCommands = map[byte]string{1: "connect", 2: "bind", 3: "udp associate"}
+
+type socks struct{}
+
+func init() {
+	AddDriver(&socks{})
+}
+
+// Name of the driver
+func (s *socks) Name() string {
+	return "socks"
+}
+
+func (s *socks) Patterns() [][]byte {
+	return nil
+}
+
+// OffsetPatterns anchor the version byte to the start, it is too short to find anywhere
+func (s *socks) OffsetPatterns() []searchtree.Pattern {
+	return []searchtree.Pattern{
+		// SOCKS5 greeting offering a handful of the low methods
+		{Bytes: []byte{0x05, 0x00, 0x00}, Mask: []byte{0xff, 0xf0, 0xf0}},
+		// SOCKS4 connect and bind
+		{Bytes: []byte{0x04, 0x01}},
+		{Bytes: []byte{0x04, 0x02}},
+	}
+}
+
+func (s *socks) ServeTCP(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			acceptFailed(s.Name(), err)
+			return
+		}
+		if mux, ok := conn.(*muxconn.MuxConn); ok {
+			go s.handle(mux)
+		} else {
+			conn.Close()
+		}
+	}
+}
+
+// socksRequest is where the attacker wanted to go
+type socksRequest struct {
+	version  byte
+	command  byte
+	host     string
+	port     uint16
+	user     string
+	pass     string
+	hasCreds bool
+}
+
+func (s *socks) handle(conn *muxconn.MuxConn) {
+	defer conn.Close()
+	glob := gctx.GetGlobalFromContext(conn.Context, "socks")
+	conn.SetDeadline(time.Now().Add(time.Second * 30))
+
+	// keep everything read for the capture
+	var raw bytes.Buffer
+	r := bufio.NewReader(io.TeeReader(conn, &raw))
+
+	version, err := r.ReadByte()
+	if err != nil {
+		glob.LogError(err)
+		return
+	}
+	var req *socksRequest
+	switch version {
+	case 4:
+		req, err = socks4Request(r)
+		if err == nil {
+			// never proxy, tell them the request was rejected
+			conn.Write([]byte{0x00, socks4Rejected, 0, 0, 0, 0, 0, 0})
+		}
+	case 5:
+		req, err = socks5Request(r, conn)
+		if err == nil {
+			conn.Write([]byte{0x05, socks5Refused, 0x00, socksIPv4, 0, 0, 0, 0, 0, 0})
+		}
+	default:
+		err = errSOCKSMalformed
+	}
+	// malformed probes are kept too
+	hash := StoreHash(raw.Bytes(), glob.Store)
+	if err != nil {
+		glob.LogError(err)
+		return
+	}
+
+	l := glob.NewSession(conn.Sequence(), hash)
+	if req.hasCreds {
+		l.ATTACKEntPasswordGuessing(
+			gctx.Value{Key: "user", Value: req.user},
+			gctx.Value{Key: "pass", Value: req.pass},
+		)
+	}
+	l.ATTACKEntProxy(
+		gctx.Value{Key: "version", Value: req.version},
+		gctx.Value{Key: "command", Value: socksCommands[req.command]},
+		gctx.Value{Key: "destination", Value: net.JoinHostPort(req.host, strconv.Itoa(int(req.port)))},
+		gctx.Value{Key: "user", Value: req.user},
+	)
+}
+
+// socks4Request reads a SOCKS4 or 4a request following the version byte:
+// command, port, address and a NUL terminated userid, then a NUL terminated
+// host name for 4a when the address is 0.0.0.x
+func socks4Request(r *bufio.Reader) (*socksRequest, error) {
+	var hdr [7]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	req := &socksRequest{
+		version: 4,
+		command: hdr[0],
+		port:    binary.BigEndian.Uint16(hdr[1:3]),
+		host:    net.IP(hdr[3:7]).String(),
+	}
+	user, err := socksString(r)
+	if err != nil {
+		return nil, err
+	}
+	req.user = user
+	if hdr[3] == 0 && hdr[4] == 0 && hdr[5] == 0 && hdr[6] != 0 {
+		if req.host, err = socksString(r); err != nil {
+			return nil, err
+		}
+	}
+	return req, nil
+}
+
+// socksString reads up to a NUL
+func socksString(r *bufio.Reader) (string, error) {
+	var b []byte
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if c == 0 {
+			return string(b), nil
+		}
+		if len(b) >= socksMaxString {
+			return "", errSOCKSMalformed
+		}
+		b = append(b, c)
+	}
+}
+
+// socks5Request negotiates authentication, asking for a username and password
+// if the attacker offers them, then reads the request
+func socks5Request(r *bufio.Reader, w io.Writer) (*socksRequest, error) {
+	n, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	methods := make([]byte, n)
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return nil, err
+	}
+	req := &socksRequest{version: 5}
+	switch {
+	case bytes.IndexByte(methods, socks5UserPass) >= 0:
+		w.Write([]byte{0x05, socks5UserPass})
+		if req.user, req.pass, err = socks5Credentials(r, w); err != nil {
+			return nil, err
+		}
+		req.hasCreds = true
+	case bytes.IndexByte(methods, socks5NoAuth) >= 0:
+		w.Write([]byte{0x05, socks5NoAuth})
+	default:
+		w.Write([]byte{0x05, socks5NoAcceptable})
+		return nil, errSOCKSMalformed
+	}
+
+	// version, command, reserved and address type
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[0] != 5 {
+		return nil, errSOCKSMalformed
+	}
+	req.command = hdr[1]
+	switch hdr[3] {
+	case socksIPv4, socksIPv6:
+		ip := make(net.IP, 4)
+		if hdr[3] == socksIPv6 {
+			ip = make(net.IP, 16)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return nil, err
+		}
+		req.host = ip.String()
+	case socksDomain:
+		if req.host, err = socksLengthString(r); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errSOCKSMalformed
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return nil, err
+	}
+	req.port = binary.BigEndian.Uint16(port[:])
+	return req, nil
+}
+
+// socks5Credentials reads a RFC 1929 username and password, accepting any
+func socks5Credentials(r *bufio.Reader, w io.Writer) (string, string, error) {
+	if v, err := r.ReadByte(); err != nil || v != 1 {
+		return "", "", errSOCKSMalformed
+	}
+	user, err := socksLengthString(r)
+	if err != nil {
+		return "", "", err
+	}
+	pass, err := socksLengthString(r)
+	if err != nil {
+		return "", "", err
+	}
+	w.Write([]byte{0x01, 0x00})
+	return user, pass, nil
+}
+
+// socksLengthString reads a string prefixed with a one byte length
+func socksLengthString(r *bufio.Reader) (string, error) {
+	n, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
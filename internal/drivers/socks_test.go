@@ -0,0 +1,54 @@
+package drivers
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSOCKS4Request(t *testing.T) {
+	// plain SOCKS4 then 4a carrying a host name
+	req, err := socks4Request(bufio.NewReader(strings.NewReader("\x01\x00\x50\xc0\x00\x02\x01bot\x00")))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "192.0.2.1", req.host)
+		assert.Equal(t, uint16(80), req.port)
+		assert.Equal(t, "bot", req.user)
+	}
+	req, err = socks4Request(bufio.NewReader(strings.NewReader("\x01\x01\xbb\x00\x00\x00\x01\x00evil.test\x00")))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "evil.test", req.host)
+		assert.Equal(t, uint16(443), req.port)
+	}
+	_, err = socks4Request(bufio.NewReader(strings.NewReader("\x01\x00\x50\xc0\x00\x02\x01" + strings.Repeat("a", 300))))
+	assert.ErrorIs(t, err, errSOCKSMalformed)
+}
+
+func TestSOCKS5Request(t *testing.T) {
+	// offered user and password, we ask for them
+	var out bytes.Buffer
+	req, err := socks5Request(bufio.NewReader(strings.NewReader(
+		"\x02\x00\x02"+"\x01\x04user\x04pass"+"\x05\x01\x00\x04"+strings.Repeat("\x00", 15)+"\x01\x00\x16")), &out)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "::1", req.host)
+		assert.Equal(t, uint16(22), req.port)
+		assert.True(t, req.hasCreds)
+		assert.Equal(t, "pass", req.pass)
+		assert.Equal(t, []byte{0x05, 0x02, 0x01, 0x00}, out.Bytes())
+	}
+
+	// unsupported methods are refused
+	out.Reset()
+	_, err = socks5Request(bufio.NewReader(strings.NewReader("\x01\x80")), &out)
+	assert.Error(t, err)
+	assert.Equal(t, []byte{0x05, 0xff}, out.Bytes())
+}
+
+func TestSOCKSMalformedStored(t *testing.T) {
+	h := newDriverHarness(t, &socks{}, nil)
+	h.send("\x04\x01\x00\x50\xc0\x00\x02\x01" + strings.Repeat("a", 300))
+	h.closed()
+	assert.Equal(t, "\x04\x01\x00\x50\xc0\x00\x02\x01", string(h.stored("raw").Data[:8]))
+}
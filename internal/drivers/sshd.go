@@ -41,16 +41,27 @@ func init() {
 	AddDriver(s)
 }
 
+// Name of the driver
+func (s *sshd) Name() string {
+	return "sshd"
+}
+
 func (s *sshd) Patterns() [][]byte {
 	return [][]byte{
 		[]byte("SSH-2.0"),
 	}
 }
 
+// FallbackPorts takes silent clients on the SSH ports, the server sends its version first
+func (s *sshd) FallbackPorts() []uint16 {
+	return []uint16{22, 2222}
+}
+
 func (s *sshd) ServeTCP(ln net.Listener) {
 	for {
 		c, err := ln.Accept()
 		if err != nil {
+			acceptFailed(s.Name(), err)
 			return
 		}
 		if mux, ok := c.(*muxconn.MuxConn); ok {
@@ -0,0 +1,139 @@
+package drivers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/antihax/gambit/internal/conman/gctx"
+	"github.com/antihax/gambit/internal/muxconn"
+)
+
+// tarpitMaxCapture bounds how much of what the attacker sends is kept
+const tarpitMaxCapture = 64 * 1024
+
+// tarpitConfig controls which ports are tarpitted and how slowly, it is read
+// from the tarpit entry in Drivers, e.g. {"tarpit": {"ports": [23, 2323], "delay": 10}}
+type tarpitConfig struct {
+	// Ports lists ports where every connection is tarpitted
+	Ports []uint16 `json:"ports"`
+
+	// Delay sets the seconds between each byte sent, default is 5
+	Delay int `json:"delay"`
+
+	// MaxLifetime closes tarpitted connections after this many seconds, default is 600
+	MaxLifetime int `json:"maxLifetime"`
+}
+
+func init() {
+	AddDriver(&tarpit{})
+}
+
+// OnStart reads the ports to tarpit and how slowly
+func (s *tarpit) OnStart(ctx context.Context, cfg DriverConfig) error {
+	s.config = tarpitConfig{Delay: 5, MaxLifetime: 600}
+	if err := cfg.Decode(&s.config); err != nil {
+		return err
+	}
+	if s.config.Delay < 1 || s.config.MaxLifetime < 1 {
+		return errors.New("delay and maxLifetime must be at least 1")
+	}
+	return nil
+}
+
+// tarpit holds connections open as long as possible, trickling out junk
+type tarpit struct {
+	config tarpitConfig
+}
+
+// Name of the driver
+func (s *tarpit) Name() string {
+	return "tarpit"
+}
+
+func (s *tarpit) Patterns() [][]byte {
+	return nil
+}
+
+// Ports claims every configured port
+func (s *tarpit) Ports() []uint16 {
+	return s.config.Ports
+}
+
+func (s *tarpit) ServeTCP(ln net.Listener) {
+	// stop trickling when the listener shuts down
+	done := make(chan struct{})
+	defer close(done)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			acceptFailed(s.Name(), err)
+			return
+		}
+		if mux, ok := conn.(*muxconn.MuxConn); ok {
+			go s.trickle(mux, done)
+		} else {
+			conn.Close()
+		}
+	}
+}
+
+func (s *tarpit) trickle(mux *muxconn.MuxConn, done chan struct{}) {
+	defer mux.Close()
+	glob := gctx.GetGlobalFromContext(mux.Context, "tarpit")
+
+	// the reaper enforces our own lifetime and the trickle keeps it from idling out
+	delay := time.Second * time.Duration(s.config.Delay)
+	mux.SetLifetime(time.Second * time.Duration(s.config.MaxLifetime))
+	mux.SetIdleTimeout(delay * 3)
+
+	// a tiny receive window slows senders, and each byte goes out alone
+	if tcp, ok := mux.Conn.(*net.TCPConn); ok {
+		tcp.SetReadBuffer(1)
+		tcp.SetNoDelay(true)
+	}
+
+	// keep whatever the attacker sends while we stall
+	var captured bytes.Buffer
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		io.Copy(&captured, io.LimitReader(mux, captureLimit(glob, tarpitMaxCapture)))
+		io.Copy(io.Discard, mux)
+	}()
+
+	ticker := time.NewTicker(delay)
+	defer ticker.Stop()
+	b := []byte{0}
+loop:
+	for {
+		select {
+		case <-done:
+			break loop
+		case <-closed:
+			break loop
+		case <-ticker.C:
+			b[0] = byte('a' + rand.Intn(26))
+			if _, err := mux.Write(b); err != nil {
+				break loop
+			}
+		}
+	}
+	mux.Close()
+	<-closed
+
+	phash := ""
+	if captured.Len() > 0 {
+		phash = StoreHash(captured.Bytes(), glob.Store)
+	}
+	l := glob.NewSession(mux.Sequence(), phash)
+	l.Logger.Info().
+		Int64("duration_ms", mux.Duration().Milliseconds()).
+		Int("captured", captured.Len()).
+		Msg("tarpit")
+}
@@ -0,0 +1,24 @@
+package drivers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTarpitOnStart(t *testing.T) {
+	s := &tarpit{}
+	if assert.NoError(t, s.OnStart(context.Background(), DriverConfig{Raw: []byte(`{"ports": [23, 2323], "delay": 10}`)})) {
+		assert.Equal(t, []uint16{23, 2323}, s.Ports())
+		assert.Equal(t, 10, s.config.Delay)
+		assert.Equal(t, 600, s.config.MaxLifetime)
+	}
+
+	// without settings nothing is tarpitted
+	if assert.NoError(t, s.OnStart(context.Background(), DriverConfig{})) {
+		assert.Empty(t, s.Ports())
+		assert.Equal(t, 5, s.config.Delay)
+	}
+	assert.Error(t, s.OnStart(context.Background(), DriverConfig{Raw: []byte(`{"delay": 0}`)}))
+}
@@ -1,30 +1,398 @@
 package drivers
 
 import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
 	"net"
+	"regexp"
+	"strings"
+	"time"
 
-	"github.com/aprice/telnet"
+	"github.com/antihax/gambit/internal/conman/gctx"
+	"github.com/antihax/gambit/internal/muxconn"
+	"github.com/antihax/gambit/internal/store"
 )
 
+// telnet commands and options, RFC 854 onwards
+const (
+	telnetSE   = 240
+	telnetSB   = 250
+	telnetWILL = 251
+	telnetWONT = 252
+	telnetDO   = 253
+	telnetDONT = 254
+	telnetIAC  = 255
+
+	telnetOptEcho  = 1
+	telnetOptSGA   = 3
+	telnetOptTType = 24
+	telnetOptNAWS  = 31
+)
+
+const (
+	// telnetMaxLine bounds a single line of input
+	telnetMaxLine = 4096
+	// telnetMaxTranscript bounds what is kept of a session
+	telnetMaxTranscript = 1024 * 1024
+	// telnetMaxSubnegotiation bounds option subnegotiation data
+	telnetMaxSubnegotiation = 256
+)
+
+// telnetDownload finds URLs handed to the usual download tools
+var telnetDownload = regexp.MustCompile(`(?:wget|curl|tftp|ftpget)\s[^;|&]*?((?:https?|ftp|tftp)://[^\s;|&]+|\d+\.\d+\.\d+\.\d+)`)
+
+type telnet struct {
+	hostname string
+}
+
 func init() {
-	serv := telnet.NewServer(":9999", telnet.HandleFunc(func(c *telnet.Connection) {
-		c.Write([]byte("Hello world!\r\n"))
-		c.Close()
-	}))
-	s := &telnetServer{Server: serv}
-	AddDriver(s)
+	AddDriver(&telnet{hostname: "localhost"})
 }
 
-type telnetServer struct {
-	Server *telnet.Server
+// Name of the driver
+func (s *telnet) Name() string {
+	return "telnet"
 }
 
-func (s *telnetServer) Patterns() [][]byte {
+// Patterns match clients which start by negotiating options
+func (s *telnet) Patterns() [][]byte {
 	return [][]byte{
-		{0x0D, 0x0A},
+		{telnetIAC, telnetDO},
+		{telnetIAC, telnetDONT},
+		{telnetIAC, telnetWILL},
+		{telnetIAC, telnetWONT},
+	}
+}
+
+// Ports takes the telnet ports straight away, bots wait for the login prompt
+func (s *telnet) Ports() []uint16 {
+	return []uint16{23, 2323}
+}
+
+func (s *telnet) ServeTCP(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			acceptFailed(s.Name(), err)
+			return
+		}
+		if mux, ok := conn.(*muxconn.MuxConn); ok {
+			go s.handle(mux)
+		}
+	}
+}
+
+// telnetSession is the state of one connection
+type telnetSession struct {
+	conn       *muxconn.MuxConn
+	glob       *gctx.GlobalUtils
+	r          *bufio.Reader
+	transcript bytes.Buffer
+	terminal   string
+}
+
+func (s *telnet) handle(conn *muxconn.MuxConn) {
+	defer conn.Close()
+	c := &telnetSession{
+		conn: conn,
+		glob: gctx.GetGlobalFromContext(conn.Context, "telnet"),
+		r:    bufio.NewReader(conn),
+	}
+	defer c.store()
+
+	// we echo and suppress go ahead, like busybox telnetd
+	conn.Write([]byte{
+		telnetIAC, telnetWILL, telnetOptEcho,
+		telnetIAC, telnetWILL, telnetOptSGA,
+		telnetIAC, telnetDO, telnetOptNAWS,
+	})
+
+	user := ""
+	for user == "" {
+		c.write("%s login: ", s.hostname)
+		line, err := c.readLine(true)
+		if err != nil {
+			c.done(err)
+			return
+		}
+		user = strings.TrimSpace(line)
+	}
+	c.write("Password: ")
+	pass, err := c.readLine(false)
+	if err != nil {
+		c.done(err)
+		return
+	}
+	c.write("\r\n")
+
+	l := c.glob.NewSession(conn.Sequence(), StoreHash([]byte(user+":"+pass), c.glob.Store))
+	l.ATTACKEntPasswordGuessing(
+		gctx.Value{Key: "user", Value: user},
+		gctx.Value{Key: "pass", Value: pass},
+		gctx.Value{Key: "terminal", Value: c.terminal},
+	)
+
+	prompt := "$ "
+	if user == "root" || user == "admin" {
+		prompt = "# "
+	}
+	c.write("\r\nBusyBox v1.19.4 (2016-08-23 10:08:51 CST) built-in shell (ash)\r\nEnter 'help' for a list of built-in commands.\r\n\r\n")
+	for {
+		c.write(prompt)
+		line, err := c.readLine(true)
+		if err != nil {
+			c.done(err)
+			return
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if !c.command(line) {
+			return
+		}
+	}
+}
+
+// command logs a shell line and answers what bots check for, returning false on exit
+func (c *telnetSession) command(line string) bool {
+	l := c.glob.NewSession(c.conn.Sequence(), StoreHash([]byte(line), c.glob.Store))
+	l.AppendLogger(gctx.Value{Key: "command", Value: line})
+	if m := telnetDownload.FindAllStringSubmatch(line, -1); m != nil {
+		urls := []string{}
+		for _, u := range m {
+			urls = append(urls, u[1])
+		}
+		l.ATTACKEntIngressToolTransfer(gctx.Value{Key: "urls", Value: urls})
+	} else {
+		l.ATTACKEntUnixShell()
+	}
+
+	var out strings.Builder
+	for _, part := range strings.FieldsFunc(line, func(r rune) bool { return r == ';' || r == '&' || r == '|' }) {
+		args := strings.Fields(part)
+		if len(args) == 0 {
+			continue
+		}
+		// busybox applets may be called through busybox itself
+		if strings.HasSuffix(args[0], "busybox") && len(args) > 1 {
+			args = args[1:]
+		}
+		switch args[0] {
+		case "exit", "logout":
+			return false
+		case "echo":
+			out.WriteString(telnetEcho(args[1:]))
+		case "enable", "system", "shell", "sh", "cd", "export", "wget", "curl", "tftp", "chmod", "rm", "cp":
+		case "uname":
+			out.WriteString("Linux\r\n")
+		case "id", "whoami":
+			out.WriteString("uid=0(root) gid=0(root)\r\n")
+		case "cat":
+			out.WriteString("cat: read error: Is a directory\r\n")
+		case "ps":
+			out.WriteString("  PID USER       VSZ STAT COMMAND\r\n    1 root      1516 S    init\r\n")
+		default:
+			// lets bots checking for a real busybox see the string they sent
+			out.WriteString(args[0] + ": applet not found\r\n")
+		}
 	}
+	c.write("%s", out.String())
+	return true
 }
 
-func (s *telnetServer) ServeTCP(ln net.Listener) {
-	go s.Server.Serve(ln)
+// telnetEcho mimics echo, expanding escapes with -e as bots use it to drop binaries
+func telnetEcho(args []string) string {
+	newline, escapes := true, false
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		newline = newline && !strings.Contains(args[0], "n")
+		escapes = escapes || strings.Contains(args[0], "e")
+		args = args[1:]
+	}
+	s := strings.Trim(strings.Join(args, " "), `"'`)
+	if escapes {
+		var b []byte
+		for len(s) > 0 {
+			var h byte
+			if len(s) >= 4 && s[0] == '\\' && s[1] == 'x' {
+				if _, err := fmt.Sscanf(s[2:4], "%02x", &h); err == nil {
+					b = append(b, h)
+					s = s[4:]
+					continue
+				}
+			}
+			b = append(b, s[0])
+			s = s[1:]
+		}
+		s = string(b)
+	}
+	if newline {
+		s += "\r\n"
+	}
+	return s
+}
+
+// readLine reads up to a carriage return or newline, removing telnet commands
+// and applying backspaces. Input is echoed back if echo is set.
+func (c *telnetSession) readLine(echo bool) (string, error) {
+	var line []byte
+	for {
+		c.conn.SetDeadline(time.Now().Add(time.Second * 60))
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if b == telnetIAC {
+			data, err := c.readCommand()
+			if err != nil {
+				return "", err
+			}
+			if data < 0 {
+				continue
+			}
+			b = byte(data)
+		}
+
+		switch b {
+		case '\r', '\n':
+			// swallow the \n or \0 following \r
+			if b == '\r' {
+				if next, err := c.r.Peek(1); err == nil && (next[0] == '\n' || next[0] == 0) {
+					c.r.ReadByte()
+				}
+			}
+			c.record(append(line, '\n'))
+			if echo {
+				c.write("\r\n")
+			}
+			return string(line), nil
+		case 0x08, 0x7f:
+			if len(line) > 0 {
+				line = line[:len(line)-1]
+				if echo {
+					c.write("\b \b")
+				}
+			}
+		case 0:
+		default:
+			if len(line) >= telnetMaxLine {
+				return "", fmt.Errorf("telnet line too long")
+			}
+			line = append(line, b)
+			if echo {
+				c.conn.Write([]byte{b})
+			}
+		}
+	}
+}
+
+// readCommand handles the command following an IAC, negotiating options and
+// reading subnegotiations. It returns an escaped 0xff data byte, or -1.
+func (c *telnetSession) readCommand() (int, error) {
+	cmd, err := c.r.ReadByte()
+	if err != nil {
+		return -1, err
+	}
+	switch cmd {
+	case telnetIAC:
+		return telnetIAC, nil
+	case telnetDO, telnetDONT, telnetWILL, telnetWONT:
+		opt, err := c.r.ReadByte()
+		if err != nil {
+			return -1, err
+		}
+		c.negotiate(cmd, opt)
+	case telnetSB:
+		return -1, c.subnegotiation()
+	}
+	return -1, nil
+}
+
+// negotiate refuses everything except the options we offered ourselves
+func (c *telnetSession) negotiate(cmd, opt byte) {
+	switch cmd {
+	case telnetDO:
+		if opt != telnetOptEcho && opt != telnetOptSGA {
+			c.conn.Write([]byte{telnetIAC, telnetWONT, opt})
+		}
+	case telnetWILL:
+		switch opt {
+		case telnetOptNAWS, telnetOptSGA:
+		case telnetOptTType:
+			// ask for the terminal type, it fingerprints the client
+			c.conn.Write([]byte{telnetIAC, telnetDO, telnetOptTType, telnetIAC, telnetSB, telnetOptTType, 1, telnetIAC, telnetSE})
+		default:
+			c.conn.Write([]byte{telnetIAC, telnetDONT, opt})
+		}
+	}
+}
+
+// subnegotiation reads up to IAC SE, keeping the terminal type if that is what it is
+func (c *telnetSession) subnegotiation() error {
+	var data []byte
+	for {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if b == telnetIAC {
+			next, err := c.r.ReadByte()
+			if err != nil {
+				return err
+			}
+			if next == telnetSE {
+				break
+			}
+			b = next
+		}
+		if len(data) < telnetMaxSubnegotiation {
+			data = append(data, b)
+		}
+	}
+	// TTYPE IS <name>
+	if len(data) > 2 && data[0] == telnetOptTType && data[1] == 0 {
+		c.terminal = string(data[2:])
+	}
+	return nil
+}
+
+// write sends text to the attacker
+func (c *telnetSession) write(format string, args ...interface{}) {
+	fmt.Fprintf(c.conn, format, args...)
+}
+
+// record keeps the plaintext the attacker sent for the session transcript
+func (c *telnetSession) record(b []byte) {
+	if int64(c.transcript.Len()+len(b)) <= captureLimit(c.glob, telnetMaxTranscript) {
+		c.transcript.Write(b)
+	}
+}
+
+// done logs why the session ended if it was not the attacker hanging up
+func (c *telnetSession) done(err error) {
+	if err != io.EOF {
+		c.glob.LogError(err)
+	}
+}
+
+// store saves the plaintext of the whole session
+func (c *telnetSession) store() {
+	if c.transcript.Len() == 0 {
+		return
+	}
+	f := store.File{
+		Filename: fmt.Sprintf("%s.%s", c.conn.GetUUID(), DirectionInbound),
+		Location: "sessions",
+		Data:     c.transcript.Bytes(),
+		UUID:     c.conn.GetUUID(),
+		Sequence: c.conn.Sequence(),
+	}
+	if host, _, err := net.SplitHostPort(c.conn.RemoteAddr().String()); err == nil {
+		f.Attacker = host
+	}
+	if _, port, err := net.SplitHostPort(c.conn.LocalAddr().String()); err == nil {
+		f.DstPort = port
+	}
+	store.Offer(c.glob.Store, f)
 }
@@ -0,0 +1,45 @@
+package drivers
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/antihax/gambit/internal/conman/gctx"
+	"github.com/antihax/gambit/internal/muxconn"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTelnetReadLine(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	mux, err := muxconn.NewMuxConn(context.Background(), server)
+	if !assert.NoError(t, err) {
+		return
+	}
+	client.SetDeadline(time.Now().Add(time.Second * 5))
+	go io.Copy(io.Discard, client)
+	go client.Write([]byte(
+		"\xff\xfb\x18\xff\xfa\x18\x00vt100\xff\xf0" + // terminal type
+			"ro\xff\xfd\x05ox\x7ft\r\x00" + // option mid line and a backspace
+			"a\xff\xffb\r\n" + // escaped 0xff
+			"last\n"))
+
+	c := &telnetSession{conn: mux, glob: &gctx.GlobalUtils{}, r: bufio.NewReader(mux)}
+	for _, want := range []string{"root", "a\xffb", "last"} {
+		line, err := c.readLine(true)
+		assert.NoError(t, err)
+		assert.Equal(t, want, line)
+	}
+	assert.Equal(t, "vt100", c.terminal)
+	assert.Equal(t, "root\na\xffb\nlast\n", c.transcript.String())
+}
+
+func TestTelnetEcho(t *testing.T) {
+	assert.Equal(t, "hello world\r\n", telnetEcho([]string{"hello", "world"}))
+	assert.Equal(t, "AB", telnetEcho([]string{"-ne", `"\x41\x42"`}))
+	assert.Equal(t, `\x41`, telnetEcho([]string{"-n", `\x41`}))
+}
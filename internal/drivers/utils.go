@@ -1,9 +1,11 @@
 package drivers
 
 import (
+	"bytes"
 	"crypto/sha1"
 	"encoding/hex"
 
+	"github.com/antihax/gambit/internal/conman/gctx"
 	"github.com/antihax/gambit/internal/store"
 )
 
@@ -13,12 +15,47 @@ func GetHash(b []byte) string {
 	return hex.EncodeToString(h.Sum(nil))
 }
 
+// captureLimit returns the smaller of n and the connection's maximum capture size, 0 is unlimited
+func captureLimit(glob *gctx.GlobalUtils, n int64) int64 {
+	max := int64(glob.MaxCaptureBytes)
+	if max > 0 && (n <= 0 || n > max) {
+		return max
+	}
+	return n
+}
+
+// StoreHash queues buf to be stored under its hash and returns the hash. The
+// data is copied so drivers may reuse buf straight away.
 func StoreHash(buf []byte, storeChan chan store.File) string {
 	hash := GetHash(buf)
-	storeChan <- store.File{
+	store.Offer(storeChan, store.File{
 		Filename: hash,
 		Location: "raw",
-		Data:     buf,
+		Data:     bytes.Clone(buf),
+	})
+	return hash
+}
+
+// sampled reports if the driver's capture sampler, if it has one, keeps a
+// capture with this hash. Drivers which flood storage opt in by checking it.
+func sampled(glob *gctx.GlobalUtils, driver, hash string) bool {
+	return glob.Samplers[driver].Allow(hash)
+}
+
+// newSpool holds a capture, moving it to disk once it passes the connection's size
+func newSpool(glob *gctx.GlobalUtils) *store.Spool {
+	return store.NewSpool(int64(glob.StreamCaptureBytes))
+}
+
+// StoreSpool offers the spooled capture as raw data, returning its hash
+func StoreSpool(spool *store.Spool, storeChan chan store.File) string {
+	hash := spool.Sum()
+	f := store.File{
+		Filename: hash,
+		Location: "raw",
+	}
+	if err := spool.Fill(&f); err == nil {
+		store.Offer(storeChan, f)
 	}
 	return hash
 }
@@ -0,0 +1,137 @@
+package drivers
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/antihax/gambit/internal/conman/gctx"
+	"github.com/antihax/gambit/internal/muxconn"
+)
+
+const (
+	vncVersion      = "RFB 003.008\n"
+	vncSecurityAuth = 2
+	vncAuthFailed   = 1
+)
+
+type vnc struct {
+}
+
+func init() {
+	AddDriver(&vnc{})
+}
+
+// Name of the driver
+func (s *vnc) Name() string {
+	return "vnc"
+}
+
+func (s *vnc) Patterns() [][]byte {
+	return [][]byte{
+		[]byte("RFB 003."),
+	}
+}
+
+// Banner sends our version, VNC clients wait for the server to speak first
+func (s *vnc) Banner() ([]uint16, []byte) {
+	ports := []uint16{}
+	for port := uint16(5900); port <= 5910; port++ {
+		ports = append(ports, port)
+	}
+	return ports, []byte(vncVersion)
+}
+
+func (s *vnc) ServeTCP(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			acceptFailed(s.Name(), err)
+			return
+		}
+		if mux, ok := conn.(*muxconn.MuxConn); ok {
+			go s.handle(mux)
+		}
+	}
+}
+
+func (s *vnc) handle(conn *muxconn.MuxConn) {
+	defer conn.Close()
+	glob := gctx.GetGlobalFromContext(conn.Context, "vnc")
+	conn.SetDeadline(time.Now().Add(time.Second * 10))
+
+	// the banner already gave our version, read theirs
+	version := make([]byte, len(vncVersion))
+	if _, err := io.ReadFull(conn, version); err != nil {
+		glob.LogError(err)
+		return
+	}
+	clientVersion := strings.TrimSpace(string(version))
+	values := []gctx.Value{{Key: "rfbversion", Value: clientVersion}}
+
+	// 3.3 clients are told the security type, later versions choose from a list
+	securityType := byte(vncSecurityAuth)
+	if clientVersion < "RFB 003.007" {
+		if err := binary.Write(conn, binary.BigEndian, uint32(vncSecurityAuth)); err != nil {
+			glob.LogError(err)
+			return
+		}
+	} else {
+		if _, err := conn.Write([]byte{1, vncSecurityAuth}); err != nil {
+			glob.LogError(err)
+			return
+		}
+		chosen := make([]byte, 1)
+		if _, err := io.ReadFull(conn, chosen); err != nil {
+			glob.LogError(err)
+			return
+		}
+		securityType = chosen[0]
+	}
+	values = append(values, gctx.Value{Key: "securitytype", Value: securityType})
+
+	// only VNC authentication was offered, anything else is refused unchallenged
+	if securityType != vncSecurityAuth {
+		glob.NewSession(conn.Sequence(), StoreHash(conn.Snapshot(), glob.Store)).
+			ATTACKEntActiveScanning(values...)
+		s.fail(conn, clientVersion, "Security type not supported")
+		return
+	}
+
+	// challenge them and keep the response for cracking
+	challenge := make([]byte, 16)
+	rand.Read(challenge)
+	if _, err := conn.Write(challenge); err != nil {
+		glob.LogError(err)
+		return
+	}
+	response := make([]byte, 16)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		glob.NewSession(conn.Sequence(), StoreHash(conn.Snapshot(), glob.Store)).
+			ATTACKEntActiveScanning(values...)
+		return
+	}
+
+	// the challenge is ours and random, only what the client sent is stored
+	l := glob.NewSession(conn.Sequence(), StoreHash(conn.Snapshot(), glob.Store))
+	l.ATTACKEntPasswordGuessing(append(values,
+		gctx.Value{Key: "challenge", Value: hex.EncodeToString(challenge)},
+		gctx.Value{Key: "response", Value: hex.EncodeToString(response)},
+	)...)
+
+	// always fail
+	s.fail(conn, clientVersion, "Authentication failed")
+}
+
+// fail sends a failed security result, with the reason for clients which expect one
+func (s *vnc) fail(conn *muxconn.MuxConn, clientVersion, reason string) {
+	binary.Write(conn, binary.BigEndian, uint32(vncAuthFailed))
+	if clientVersion >= "RFB 003.008" {
+		binary.Write(conn, binary.BigEndian, uint32(len(reason)))
+		conn.Write([]byte(reason))
+	}
+}
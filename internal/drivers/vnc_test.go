@@ -0,0 +1,34 @@
+package drivers
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVNCAuth(t *testing.T) {
+	h := newDriverHarness(t, &vnc{}, []byte(vncVersion))
+	assert.Equal(t, []byte{1, vncSecurityAuth}, h.read(2))
+	h.send(string([]byte{vncSecurityAuth}))
+	h.read(16) // the challenge
+
+	response := strings.Repeat("\xaa", 16)
+	h.send(response)
+	assert.Equal(t, "\x00\x00\x00\x01\x00\x00\x00\x15Authentication failed", h.closed())
+
+	// what the client sent is stored, not our random challenge
+	assert.Equal(t, vncVersion+"\x02"+response, string(h.stored("raw").Data))
+	assert.Contains(t, h.logs.String(), `"response":"`+hex.EncodeToString([]byte(response))+`"`)
+}
+
+func TestVNCSecurityNone(t *testing.T) {
+	h := newDriverHarness(t, &vnc{}, []byte(vncVersion))
+	assert.Equal(t, []byte{1, vncSecurityAuth}, h.read(2))
+
+	// no challenge follows a type we did not offer
+	h.send("\x01")
+	assert.Equal(t, "\x00\x00\x00\x01\x00\x00\x00\x1bSecurity type not supported", h.closed())
+	assert.Equal(t, vncVersion+"\x01", string(h.stored("raw").Data))
+}
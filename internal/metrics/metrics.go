@@ -0,0 +1,45 @@
+// Package metrics provides process wide counters published through expvar
+package metrics
+
+import "expvar"
+
+var (
+	// DroppedCaptures counts captures discarded because the store pipeline was full
+	DroppedCaptures = expvar.NewInt("dropped_captures")
+
+	// RateLimitedConnections counts connections closed for exceeding the per address rate
+	RateLimitedConnections = expvar.NewInt("rate_limited_connections")
+
+	// OverloadedConnections counts connections closed because too many were in flight
+	OverloadedConnections = expvar.NewInt("overloaded_connections")
+
+	// ReputationBlocked counts connections closed for being listed in the reputation feed
+	ReputationBlocked = expvar.NewInt("reputation_blocked")
+
+	// DroppedWebhooks counts webhook events discarded because the queue was full or delivery failed
+	DroppedWebhooks = expvar.NewInt("dropped_webhooks")
+
+	// DroppedStreamEvents counts live events skipped for stream clients too slow to keep up
+	DroppedStreamEvents = expvar.NewInt("dropped_stream_events")
+
+	// DroppedSinkEvents counts connection events which could not be shipped to an event sink
+	DroppedSinkEvents = expvar.NewInt("dropped_sink_events")
+
+	// DroppedLogs counts log events lost while the syslog server could not be reached
+	DroppedLogs = expvar.NewInt("dropped_logs")
+
+	// TruncatedCaptures counts captures cut short for exceeding the maximum capture size
+	TruncatedCaptures = expvar.NewInt("truncated_captures")
+
+	// ListenerBindFailures counts listeners which could not bind, such as ports already used by another service
+	ListenerBindFailures = expvar.NewInt("listener_bind_failures")
+
+	// TCPListeners is the number of TCP ports currently listening
+	TCPListeners = expvar.NewInt("tcp_listeners")
+
+	// SampledCaptures counts captures skipped by per driver sampling
+	SampledCaptures = expvar.NewInt("sampled_captures")
+
+	// AmplificationQueries counts UDP queries matching a known amplification vector, by vector
+	AmplificationQueries = expvar.NewMap("amplification_queries")
+)
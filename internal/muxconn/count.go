@@ -0,0 +1,38 @@
+package muxconn
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// countingReader counts bytes read from the wrapped reader, passing them to tap if set
+type countingReader struct {
+	io.Reader
+	n   atomic.Int64
+	tap func([]byte)
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	c.n.Add(int64(n))
+	if c.tap != nil && n > 0 {
+		c.tap(p[:n])
+	}
+	return n, err
+}
+
+// countingWriter counts bytes written to the wrapped writer, passing them to tap if set
+type countingWriter struct {
+	io.Writer
+	n   atomic.Int64
+	tap func([]byte)
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.Writer.Write(p)
+	c.n.Add(int64(n))
+	if c.tap != nil && n > 0 {
+		c.tap(p[:n])
+	}
+	return n, err
+}
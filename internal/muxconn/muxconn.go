@@ -17,53 +17,58 @@
 package muxconn
 
 import (
-	"bufio"
-	"bytes"
 	"context"
-	"fmt"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/google/gopacket"
-	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcapgo"
 	"github.com/google/uuid"
 )
 
 // MuxConn wraps a net.Conn and provides transparent sniffing of connection data.
 type MuxConn struct {
 	net.Conn
-	pcap       *pcapgo.NgWriter
-	pcapBuffer bytes.Buffer
-	buf        BufferedReader
-	uuid       string
-	sequence   int
-	Context    context.Context
+	buf      BufferedReader
+	uuid     string
+	sequence atomic.Int64
+	Context  context.Context
+
+	// reaping of idle and long lived connections
+	timerMu     sync.Mutex
+	idleTimeout time.Duration
+	idleTimer   *time.Timer
+	lifeTimer   *time.Timer
+
+	// bytes from the wire, counted before sniffed data is replayed
+	in      *countingReader
+	out     *countingWriter
+	started time.Time
+
+	// synthetic capture of the payload, nil unless CapturePcap was called
+	pcap *pcapRecorder
+
+	// writes are dropped rather than sent when observing only
+	discard atomic.Bool
+
+	// hooks run once when the connection closes
+	closeMu sync.Mutex
+	closed  bool
+	onClose []func()
 }
 
 // NewMuxConn returns a new sniffable connection.
 func NewMuxConn(ctx context.Context, c net.Conn) (*MuxConn, error) {
-	// setup pcapng wrapper
-	buffer := bytes.Buffer{}
-	writer := bufio.NewWriter(&buffer)
-	pcap, err := pcapgo.NewNgWriter(writer, layers.LinkTypeEthernet)
-	if err != nil {
-		return nil, err
-	}
-
-	// Build connection
+	in := &countingReader{Reader: c}
 	conn := &MuxConn{
-		Conn:       c,
-		pcap:       pcap,
-		pcapBuffer: buffer,
-		buf:        BufferedReader{source: c},
-		uuid:       uuid.NewString(),
-		Context:    ctx,
-	}
-
-	if err != nil {
-		return nil, err
+		Conn:    c,
+		buf:     BufferedReader{source: in},
+		uuid:    uuid.NewString(),
+		Context: ctx,
+		in:      in,
+		out:     &countingWriter{Writer: c},
+		started: time.Now(),
 	}
 	return conn, nil
 }
@@ -78,56 +83,149 @@ func NewMuxConn(ctx context.Context, c net.Conn) (*MuxConn, error) {
 // return 0, EOF.
 func (m *MuxConn) Read(p []byte) (int, error) {
 	n, err := m.buf.Read(p)
-	if err != nil {
-		return n, err
-	}
-	ci := gopacket.CaptureInfo{
-		Timestamp:      time.Now(),
-		Length:         len(p),
-		CaptureLength:  len(p),
-		InterfaceIndex: 0,
+	if n > 0 {
+		m.touch()
 	}
+	return n, err
+}
 
-	err = m.pcap.WritePacket(ci, p)
-	if err != nil {
-		fmt.Println(err)
-		return n, err
+// ReadFrom PacketConn interface
+func (m *MuxConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, err := m.buf.Read(p)
+	if n > 0 {
+		m.touch()
 	}
+	return n, m.RemoteAddr(), err
+}
 
-	err = m.pcap.Flush()
-	if err != nil {
-		fmt.Println(err)
-		return n, err
+// Write to the connection, counting as activity for the idle timeout
+func (m *MuxConn) Write(p []byte) (int, error) {
+	if m.discard.Load() {
+		return len(p), nil
+	}
+	n, err := m.out.Write(p)
+	if n > 0 {
+		m.touch()
 	}
 	return n, err
 }
 
-// ReadFrom PacketConn interface
-func (m *MuxConn) ReadFrom(p []byte) (int, net.Addr, error) {
-	n, err := m.buf.Read(p)
-	if err != nil {
-		return n, m.RemoteAddr(), err
+// DiscardWrites makes every later Write report success without sending
+// anything, so drivers carry on as if they had answered
+func (m *MuxConn) DiscardWrites() {
+	m.discard.Store(true)
+}
+
+// BytesRead returns the number of bytes received from the connection
+func (m *MuxConn) BytesRead() int64 {
+	return m.in.n.Load()
+}
+
+// BytesWritten returns the number of bytes sent on the connection
+func (m *MuxConn) BytesWritten() int64 {
+	return m.out.n.Load()
+}
+
+// Duration returns how long the connection has been open
+func (m *MuxConn) Duration() time.Duration {
+	return time.Since(m.started)
+}
+
+// CapturePcap records a synthetic pcap of the payload in both directions from
+// here on, keeping at most max bytes, 0 is unlimited. It must be called before
+// the connection is read or written by anything else.
+func (m *MuxConn) CapturePcap(max int64) {
+	m.pcap = newPcapRecorder(m.Conn.LocalAddr(), m.Conn.RemoteAddr(), max)
+	m.in.tap = func(p []byte) { m.pcap.record(true, p) }
+	m.out.tap = func(p []byte) { m.pcap.record(false, p) }
+}
+
+// Pcap returns the capture and whether it was cut short, or nil if the
+// connection is not being captured. It is complete once the connection closes.
+func (m *MuxConn) Pcap() ([]byte, bool) {
+	if m.pcap == nil {
+		return nil, false
+	}
+	return m.pcap.bytes()
+}
+
+// OnClose registers f to run once the connection is closed,
+// running it immediately if it already is
+func (m *MuxConn) OnClose(f func()) {
+	m.closeMu.Lock()
+	if !m.closed {
+		m.onClose = append(m.onClose, f)
+		m.closeMu.Unlock()
+		return
+	}
+	m.closeMu.Unlock()
+	f()
+}
+
+// SetDeadline forwards to the underlying connection. Sniffed data waiting to be
+// replayed is returned immediately, further reads are bounded by the deadline.
+func (m *MuxConn) SetDeadline(t time.Time) error {
+	return m.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline forwards to the underlying connection in every sniffing state.
+func (m *MuxConn) SetReadDeadline(t time.Time) error {
+	return m.Conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline forwards to the underlying connection.
+func (m *MuxConn) SetWriteDeadline(t time.Time) error {
+	return m.Conn.SetWriteDeadline(t)
+}
+
+// SetIdleTimeout closes the connection if nothing is read or written for d.
+// A zero duration disables the timeout.
+func (m *MuxConn) SetIdleTimeout(d time.Duration) {
+	m.timerMu.Lock()
+	defer m.timerMu.Unlock()
+	if m.idleTimer != nil {
+		m.idleTimer.Stop()
+		m.idleTimer = nil
 	}
-	ci := gopacket.CaptureInfo{
-		Timestamp:      time.Now(),
-		Length:         len(p),
-		CaptureLength:  len(p),
-		InterfaceIndex: 0,
+	m.idleTimeout = d
+	if d > 0 {
+		m.idleTimer = time.AfterFunc(d, func() { m.Close() })
 	}
+}
 
-	err = m.pcap.WritePacket(ci, p)
-	if err != nil {
-		fmt.Println(err)
-		return n, m.RemoteAddr(), err
+// SetLifetime closes the connection once d has passed regardless of activity.
+// A zero duration disables the limit.
+func (m *MuxConn) SetLifetime(d time.Duration) {
+	m.timerMu.Lock()
+	defer m.timerMu.Unlock()
+	if m.lifeTimer != nil {
+		m.lifeTimer.Stop()
+		m.lifeTimer = nil
+	}
+	if d > 0 {
+		m.lifeTimer = time.AfterFunc(d, func() { m.Close() })
 	}
+}
 
-	err = m.pcap.Flush()
-	if err != nil {
-		fmt.Println(err)
-		return n, m.RemoteAddr(), err
+// touch pushes back the idle timeout
+func (m *MuxConn) touch() {
+	m.timerMu.Lock()
+	if m.idleTimer != nil {
+		m.idleTimer.Reset(m.idleTimeout)
 	}
+	m.timerMu.Unlock()
+}
 
-	return n, m.RemoteAddr(), err
+// stopTimers prevents the reapers firing after close
+func (m *MuxConn) stopTimers() {
+	m.timerMu.Lock()
+	if m.idleTimer != nil {
+		m.idleTimer.Stop()
+	}
+	if m.lifeTimer != nil {
+		m.lifeTimer.Stop()
+	}
+	m.timerMu.Unlock()
 }
 
 // WriteTo PacketConn interface, ignores address
@@ -140,10 +238,10 @@ func (m *MuxConn) GetUUID() string {
 	return m.uuid
 }
 
-// Sequence returns the next sequence number (increments automatically)
+// Sequence returns the next sequence number (increments automatically). It is
+// safe to call from the streams of a multiplexed connection at once.
 func (m *MuxConn) Sequence() int {
-	m.sequence++
-	return m.sequence
+	return int(m.sequence.Add(1))
 }
 
 func (m *MuxConn) StartSniffing() io.Reader {
@@ -172,7 +270,16 @@ func (m *MuxConn) BufferSize() int {
 }
 
 func (m *MuxConn) Close() error {
-	m.pcap.Flush()
-	//fmt.Printf("%+v\n", m.pcapBuffer.Bytes())
+	m.stopTimers()
+	m.pcap.close()
+
+	m.closeMu.Lock()
+	hooks := m.onClose
+	m.onClose = nil
+	m.closed = true
+	m.closeMu.Unlock()
+	for _, f := range hooks {
+		f()
+	}
 	return m.Conn.Close()
 }
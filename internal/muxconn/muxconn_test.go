@@ -0,0 +1,164 @@
+package muxconn
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newPipeMuxConn(t *testing.T) (*MuxConn, net.Conn) {
+	server, client := net.Pipe()
+	muc, err := NewMuxConn(context.Background(), server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		muc.Close()
+		client.Close()
+	})
+	return muc, client
+}
+
+// readTimesOut asserts a read on r fails with a deadline error rather than blocking
+func readTimesOut(t *testing.T, r io.Reader) {
+	done := make(chan error, 1)
+	go func() {
+		_, err := r.Read(make([]byte, 16))
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		assert.True(t, errors.Is(err, os.ErrDeadlineExceeded), "expected deadline error, got %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("read did not time out")
+	}
+}
+
+func TestReadDeadlineWhileSniffing(t *testing.T) {
+	muc, _ := newPipeMuxConn(t)
+	r := muc.StartSniffing()
+
+	assert.NoError(t, muc.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+	readTimesOut(t, r)
+}
+
+func TestReadDeadlineAfterSniffing(t *testing.T) {
+	muc, client := newPipeMuxConn(t)
+	r := muc.StartSniffing()
+
+	// a partial header arrives, then the peer stalls
+	go client.Write([]byte{3, 0})
+	buf := make([]byte, 16)
+	n, err := r.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	// the driver sees the sniffed bytes replayed, then times out
+	muc.Reset()
+	assert.NoError(t, muc.SetDeadline(time.Now().Add(50*time.Millisecond)))
+	n, err = muc.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{3, 0}, buf[:n])
+	readTimesOut(t, muc)
+
+	// once sniffing is done the buffer is replayed a final time
+	muc.DoneSniffing()
+	assert.NoError(t, muc.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+	n, err = muc.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{3, 0}, buf[:n])
+	readTimesOut(t, muc)
+}
+
+func TestWriteDeadline(t *testing.T) {
+	muc, _ := newPipeMuxConn(t)
+
+	// nobody reads the other end of the pipe
+	assert.NoError(t, muc.SetWriteDeadline(time.Now().Add(50*time.Millisecond)))
+	_, err := muc.Write([]byte("banner"))
+	assert.True(t, errors.Is(err, os.ErrDeadlineExceeded))
+}
+
+func TestCountsAndOnClose(t *testing.T) {
+	m, client := newPipeMuxConn(t)
+	go func() {
+		client.Write([]byte("hello"))
+		io.Copy(io.Discard, client)
+	}()
+
+	// sniffed bytes replayed to the driver are only counted once
+	r := m.StartSniffing()
+	buf := make([]byte, 5)
+	_, err := io.ReadFull(r, buf)
+	assert.NoError(t, err)
+	m.Reset()
+	_, err = io.ReadFull(m, buf)
+	assert.NoError(t, err)
+
+	_, err = m.Write([]byte("hi"))
+	assert.NoError(t, err)
+
+	closed := make(chan struct{})
+	m.OnClose(func() { close(closed) })
+	m.Close()
+	<-closed
+
+	assert.Equal(t, int64(5), m.BytesRead())
+	assert.Equal(t, int64(2), m.BytesWritten())
+
+	// hooks registered after closing run immediately
+	ran := false
+	m.OnClose(func() { ran = true })
+	assert.True(t, ran)
+}
+
+func TestProxyClose(t *testing.T) {
+	p := NewProxy(1)
+	server, client := net.Pipe()
+	defer client.Close()
+	p.InjectConn(server)
+	c, err := p.Accept()
+	assert.NoError(t, err)
+	assert.Equal(t, server, c)
+
+	// a blocked Accept returns once the proxy is closed
+	done := make(chan error, 1)
+	go func() {
+		_, err := p.Accept()
+		done <- err
+	}()
+	assert.NoError(t, p.Close())
+	select {
+	case err := <-done:
+		assert.True(t, errors.Is(err, net.ErrClosed))
+	case <-time.After(time.Second):
+		t.Fatal("accept did not return after close")
+	}
+	assert.NoError(t, p.Close())
+
+	// late connections are hung up on rather than left waiting
+	late, peer := net.Pipe()
+	p.InjectConn(late)
+	_, err = peer.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestDiscardWrites(t *testing.T) {
+	muc, client := newPipeMuxConn(t)
+	muc.DiscardWrites()
+
+	// the write succeeds but nothing reaches the attacker
+	n, err := muc.Write([]byte("banner"))
+	assert.NoError(t, err)
+	assert.Equal(t, 6, n)
+	assert.Zero(t, muc.BytesWritten())
+	client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	readTimesOut(t, client)
+}
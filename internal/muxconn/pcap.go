@@ -0,0 +1,196 @@
+package muxconn
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// pcapSegment is the largest payload put in one synthetic packet
+const pcapSegment = 1460
+
+// pcapRecorder writes a synthetic pcap of the payload passing through a
+// connection. Headers are made up around what we saw at the socket, with
+// sequence numbers kept so tools can reassemble the stream.
+type pcapRecorder struct {
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	w         *pcapgo.Writer
+	max       int64
+	truncated bool
+	closed    bool
+
+	udp           bool
+	local, remote endpoint
+	// next sequence number from the attacker and from us
+	seqIn, seqOut uint32
+}
+
+// endpoint of the synthetic packets
+type endpoint struct {
+	ip   net.IP
+	port int
+}
+
+// newPcapRecorder starts a capture keeping at most max bytes, 0 is unlimited.
+// Nil is returned for connections which are not TCP or UDP.
+func newPcapRecorder(local, remote net.Addr, max int64) *pcapRecorder {
+	r := &pcapRecorder{max: max, seqIn: 1000, seqOut: 5000}
+	switch l := local.(type) {
+	case *net.TCPAddr:
+		rem, ok := remote.(*net.TCPAddr)
+		if !ok {
+			return nil
+		}
+		r.local, r.remote = endpoint{l.IP, l.Port}, endpoint{rem.IP, rem.Port}
+	case *net.UDPAddr:
+		rem, ok := remote.(*net.UDPAddr)
+		if !ok {
+			return nil
+		}
+		r.udp = true
+		r.local, r.remote = endpoint{l.IP, l.Port}, endpoint{rem.IP, rem.Port}
+	default:
+		return nil
+	}
+
+	// both ends must be the same family, mapped addresses are shown as IPv4
+	if r.local.ip.To4() != nil && r.remote.ip.To4() != nil {
+		r.local.ip, r.remote.ip = r.local.ip.To4(), r.remote.ip.To4()
+	} else {
+		r.local.ip, r.remote.ip = r.local.ip.To16(), r.remote.ip.To16()
+	}
+
+	r.w = pcapgo.NewWriter(&r.buf)
+	r.w.WriteFileHeader(65536, layers.LinkTypeRaw)
+
+	// the handshake happened before we were given the socket
+	if !r.udp {
+		r.tcp(true, &layers.TCP{SYN: true}, nil)
+		r.seqIn++
+		r.tcp(false, &layers.TCP{SYN: true, ACK: true}, nil)
+		r.seqOut++
+		r.tcp(true, &layers.TCP{ACK: true}, nil)
+	}
+	return r
+}
+
+// record adds the payload seen in one direction
+func (r *pcapRecorder) record(inbound bool, p []byte) {
+	if r == nil || len(p) == 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	if r.udp {
+		r.write(inbound, &layers.UDP{}, p)
+		return
+	}
+	for len(p) > 0 {
+		seg := p[:min(len(p), pcapSegment)]
+		p = p[len(seg):]
+		r.tcp(inbound, &layers.TCP{ACK: true, PSH: len(p) == 0}, seg)
+		if inbound {
+			r.seqIn += uint32(len(seg))
+		} else {
+			r.seqOut += uint32(len(seg))
+		}
+	}
+}
+
+// close ends the capture, closing TCP streams with a FIN each way
+func (r *pcapRecorder) close() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	if !r.udp {
+		r.tcp(false, &layers.TCP{FIN: true, ACK: true}, nil)
+		r.seqOut++
+		r.tcp(true, &layers.TCP{FIN: true, ACK: true}, nil)
+		r.seqIn++
+		r.tcp(false, &layers.TCP{ACK: true}, nil)
+	}
+	r.closed = true
+}
+
+// bytes returns the capture and whether it was cut short
+func (r *pcapRecorder) bytes() ([]byte, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return bytes.Clone(r.buf.Bytes()), r.truncated
+}
+
+// tcp fills in the ports and sequence numbers of a segment and writes it
+func (r *pcapRecorder) tcp(inbound bool, tcp *layers.TCP, payload []byte) {
+	tcp.Window = 65535
+	if inbound {
+		tcp.Seq, tcp.Ack = r.seqIn, r.seqOut
+	} else {
+		tcp.Seq, tcp.Ack = r.seqOut, r.seqIn
+	}
+	if !tcp.ACK {
+		tcp.Ack = 0
+	}
+	r.write(inbound, tcp, payload)
+}
+
+// write wraps the transport layer in IP and appends the packet, unless the
+// capture is full
+func (r *pcapRecorder) write(inbound bool, transport gopacket.SerializableLayer, payload []byte) {
+	if r.truncated {
+		return
+	}
+	src, dst := r.local, r.remote
+	if inbound {
+		src, dst = r.remote, r.local
+	}
+
+	var ip gopacket.NetworkLayer
+	var proto layers.IPProtocol = layers.IPProtocolTCP
+	if r.udp {
+		proto = layers.IPProtocolUDP
+	}
+	if src.ip.To4() != nil {
+		ip = &layers.IPv4{Version: 4, TTL: 64, Protocol: proto, SrcIP: src.ip, DstIP: dst.ip}
+	} else {
+		ip = &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: proto, SrcIP: src.ip, DstIP: dst.ip}
+	}
+	switch t := transport.(type) {
+	case *layers.TCP:
+		t.SrcPort, t.DstPort = layers.TCPPort(src.port), layers.TCPPort(dst.port)
+		t.SetNetworkLayerForChecksum(ip)
+	case *layers.UDP:
+		t.SrcPort, t.DstPort = layers.UDPPort(src.port), layers.UDPPort(dst.port)
+		t.SetNetworkLayerForChecksum(ip)
+	}
+
+	out := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(out, opts, ip.(gopacket.SerializableLayer), transport, gopacket.Payload(payload)); err != nil {
+		return
+	}
+	data := out.Bytes()
+	// 16 bytes of record header precede each packet
+	if r.max > 0 && int64(r.buf.Len()+16+len(data)) > r.max {
+		r.truncated = true
+		return
+	}
+	r.w.WritePacket(gopacket.CaptureInfo{
+		Timestamp:     time.Now(),
+		CaptureLength: len(data),
+		Length:        len(data),
+	}, data)
+}
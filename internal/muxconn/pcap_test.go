@@ -0,0 +1,109 @@
+package muxconn
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/stretchr/testify/assert"
+)
+
+// tcpMuxConn connects over loopback so the capture has real addresses
+func tcpMuxConn(t *testing.T) (*MuxConn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	muc, _ := NewMuxConn(context.Background(), server)
+	t.Cleanup(func() {
+		muc.Close()
+		client.Close()
+	})
+	return muc, client
+}
+
+func TestCapturePcap(t *testing.T) {
+	muc, client := tcpMuxConn(t)
+	muc.CapturePcap(0)
+
+	client.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	_, err := io.ReadFull(muc, buf)
+	assert.NoError(t, err)
+	muc.Write([]byte("world"))
+	muc.Close()
+
+	data, truncated := muc.Pcap()
+	assert.False(t, truncated)
+	r, err := pcapgo.NewReader(bytes.NewReader(data))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, layers.LinkTypeRaw, r.LinkType())
+
+	var flags []string
+	var payload []string
+	for {
+		pkt, _, err := r.ReadPacketData()
+		if err != nil {
+			break
+		}
+		p := gopacket.NewPacket(pkt, layers.LayerTypeIPv4, gopacket.Default)
+		tcp, ok := p.Layer(layers.LayerTypeTCP).(*layers.TCP)
+		if !assert.True(t, ok) {
+			return
+		}
+		switch {
+		case tcp.SYN && tcp.ACK:
+			flags = append(flags, "SA")
+		case tcp.SYN:
+			flags = append(flags, "S")
+		case tcp.FIN:
+			flags = append(flags, "F")
+		default:
+			flags = append(flags, "A")
+		}
+		if len(tcp.Payload) > 0 {
+			payload = append(payload, string(tcp.Payload))
+		}
+	}
+	assert.Equal(t, []string{"S", "SA", "A", "A", "A", "F", "F", "A"}, flags)
+	assert.Equal(t, []string{"hello", "world"}, payload)
+}
+
+func TestCapturePcapTruncated(t *testing.T) {
+	muc, client := tcpMuxConn(t)
+	muc.CapturePcap(300)
+
+	go client.Write(bytes.Repeat([]byte("x"), 4096))
+	io.ReadFull(muc, make([]byte, 4096))
+	data, truncated := muc.Pcap()
+	assert.True(t, truncated)
+	assert.LessOrEqual(t, len(data), 300)
+}
+
+func TestPcapNotCaptured(t *testing.T) {
+	muc, _ := newPipeMuxConn(t)
+	data, _ := muc.Pcap()
+	assert.Nil(t, data)
+
+	// pipes have no addresses to make packets from
+	muc.CapturePcap(0)
+	muc.Close()
+	data, _ = muc.Pcap()
+	assert.Nil(t, data)
+}
@@ -1,36 +1,67 @@
 package muxconn
 
 import (
-	"errors"
+	"fmt"
 	"net"
+	"sync"
 )
 
 // Proxy transfers accepted connections from one listener to another services listener
 // Useful for inserting MuxConn or ModConn
 type Proxy struct {
 	connCh chan net.Conn
+	done   chan struct{}
+	once   *sync.Once
 }
 
 func NewProxy(bufferSize int) Proxy {
 	return Proxy{
 		connCh: make(chan net.Conn, bufferSize),
+		done:   make(chan struct{}),
+		once:   &sync.Once{},
 	}
 }
 
+// InjectConn hands c to Accept, closing it instead if the proxy is closed
 func (l Proxy) InjectConn(c net.Conn) {
-	l.connCh <- c
+	select {
+	case <-l.done:
+		c.Close()
+		return
+	default:
+	}
+	select {
+	case l.connCh <- c:
+	case <-l.done:
+		c.Close()
+	}
 }
 
+// Accept waits for an injected connection. Once the proxy is closed it returns
+// an error wrapping net.ErrClosed, so serve loops know to stop.
 func (l Proxy) Accept() (net.Conn, error) {
-	c, ok := <-l.connCh
-	if !ok {
-		return nil, errors.New("proxy closed")
+	select {
+	case c := <-l.connCh:
+		return c, nil
+	case <-l.done:
+		return nil, fmt.Errorf("proxy: %w", net.ErrClosed)
 	}
-	return c, nil
 }
 
+// Close stops Accept, connections waiting to be accepted are closed. It is
+// safe to call more than once.
 func (l Proxy) Close() error {
-	close(l.connCh)
+	l.once.Do(func() {
+		close(l.done)
+		for {
+			select {
+			case c := <-l.connCh:
+				c.Close()
+			default:
+				return
+			}
+		}
+	})
 	return nil
 }
 
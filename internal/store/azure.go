@@ -0,0 +1,102 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+)
+
+// azureContainer is the slice of an Azure Blob container we depend on
+type azureContainer interface {
+	UploadStream(ctx context.Context, blob string, r io.Reader) error
+}
+
+// containerClient adapts an azblob.Client to azureContainer
+type containerClient struct {
+	client    *azblob.Client
+	container string
+}
+
+func (c containerClient) UploadStream(ctx context.Context, blob string, r io.Reader) error {
+	_, err := c.client.UploadStream(ctx, c.container, blob, r, nil)
+	return err
+}
+
+// AzureOptions locate and authenticate the container, one of Key or SAS is required
+type AzureOptions struct {
+	// Account is the storage account name
+	Account string
+	// Container receives the blobs
+	Container string
+	// Key is the shared account key
+	Key string
+	// SAS is a shared access signature token, used when there is no Key
+	SAS string
+	// Endpoint replaces the account's blob service URL, such as for Azurite
+	Endpoint string
+}
+
+// Azure uploads files to an Azure Blob Storage container
+type Azure struct {
+	container azureContainer
+}
+
+// NewAzure creates a Storer uploading to the container described by opts
+func NewAzure(opts AzureOptions) (*Azure, error) {
+	endpoint := opts.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.blob.core.windows.net/", opts.Account)
+	}
+
+	var client *azblob.Client
+	var err error
+	if opts.Key != "" {
+		cred, cerr := azblob.NewSharedKeyCredential(opts.Account, opts.Key)
+		if cerr != nil {
+			return nil, cerr
+		}
+		client, err = azblob.NewClientWithSharedKeyCredential(endpoint, cred, nil)
+	} else {
+		client, err = azblob.NewClientWithNoCredential(endpoint+"?"+opts.SAS, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Azure{container: containerClient{client, opts.Container}}, nil
+}
+
+// Name of the backend
+func (s *Azure) Name() string {
+	return "azure"
+}
+
+// Remote as uploads are billed
+func (s *Azure) Remote() bool {
+	return true
+}
+
+// Store uploads the data to location/filename
+func (s *Azure) Store(filename, location string, data []byte) error {
+	return s.upload(filename, location, bytes.NewReader(data))
+}
+
+// StoreStream uploads what open returns to location/filename, in blocks if it is large
+func (s *Azure) StoreStream(filename, location string, open func() (io.ReadCloser, error)) error {
+	r, err := open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return s.upload(filename, location, r)
+}
+
+func (s *Azure) upload(filename, location string, r io.Reader) error {
+	key, err := Key(filename, location)
+	if err != nil {
+		return err
+	}
+	return s.container.UploadStream(context.Background(), key, r)
+}
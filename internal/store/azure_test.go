@@ -0,0 +1,48 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeContainer records blobs uploaded to it
+type fakeContainer struct {
+	blobs map[string]string
+	err   error
+}
+
+func (c *fakeContainer) UploadStream(ctx context.Context, blob string, r io.Reader) error {
+	if c.err != nil {
+		return c.err
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	c.blobs[blob] = string(b)
+	return nil
+}
+
+func TestAzureStore(t *testing.T) {
+	container := &fakeContainer{blobs: make(map[string]string)}
+	s := &Azure{container: container}
+
+	assert.NoError(t, s.Store("abc123", "raw", []byte("payload")))
+	assert.Equal(t, "payload", container.blobs["raw/abc123"])
+
+	open := func() (io.ReadCloser, error) {
+		return io.NopCloser(strings.NewReader("streamed")), nil
+	}
+	assert.NoError(t, s.StoreStream("def456", "sessions", open))
+	assert.Equal(t, "streamed", container.blobs["sessions/def456"])
+}
+
+func TestAzureStoreError(t *testing.T) {
+	s := &Azure{container: &fakeContainer{err: errors.New("upload failed")}}
+	assert.Error(t, s.Store("abc123", "raw", []byte("payload")))
+}
@@ -0,0 +1,82 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/option"
+)
+
+// gcsBucket is the slice of a GCS bucket handle we depend on
+type gcsBucket interface {
+	NewWriter(ctx context.Context, object string) io.WriteCloser
+}
+
+// bucketHandle adapts a storage.BucketHandle to gcsBucket
+type bucketHandle struct {
+	*storage.BucketHandle
+}
+
+func (b bucketHandle) NewWriter(ctx context.Context, object string) io.WriteCloser {
+	return b.Object(object).NewWriter(ctx)
+}
+
+// GCS uploads files to a Google Cloud Storage bucket
+type GCS struct {
+	bucket gcsBucket
+}
+
+// NewGCS creates a Storer uploading to bucket. Application default credentials
+// are used unless a service account credentialsFile is provided.
+func NewGCS(ctx context.Context, bucket, credentialsFile string) (*GCS, error) {
+	var opts []option.ClientOption
+	if credentialsFile != "" {
+		opts = append(opts, option.WithCredentialsFile(credentialsFile))
+	}
+	client, err := storage.NewClient(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &GCS{bucket: bucketHandle{client.Bucket(bucket)}}, nil
+}
+
+// Name of the backend
+func (s *GCS) Name() string {
+	return "gcs"
+}
+
+// Remote as uploads are billed
+func (s *GCS) Remote() bool {
+	return true
+}
+
+// Store streams the data to location/filename
+func (s *GCS) Store(filename, location string, data []byte) error {
+	return s.write(filename, location, bytes.NewReader(data))
+}
+
+// StoreStream streams what open returns to location/filename
+func (s *GCS) StoreStream(filename, location string, open func() (io.ReadCloser, error)) error {
+	r, err := open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return s.write(filename, location, r)
+}
+
+func (s *GCS) write(filename, location string, r io.Reader) error {
+	key, err := Key(filename, location)
+	if err != nil {
+		return err
+	}
+	w := s.bucket.NewWriter(context.Background(), key)
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	// the upload is only committed, and any error surfaced, on close
+	return w.Close()
+}
@@ -0,0 +1,53 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeObject captures writes in place of a GCS object
+type fakeObject struct {
+	bytes.Buffer
+	closeErr error
+}
+
+func (o *fakeObject) Close() error {
+	return o.closeErr
+}
+
+// fakeBucket records objects written to it
+type fakeBucket struct {
+	objects  map[string]*fakeObject
+	closeErr error
+}
+
+func (b *fakeBucket) NewWriter(ctx context.Context, object string) io.WriteCloser {
+	o := &fakeObject{closeErr: b.closeErr}
+	b.objects[object] = o
+	return o
+}
+
+func TestGCSStore(t *testing.T) {
+	bucket := &fakeBucket{objects: make(map[string]*fakeObject)}
+	s := &GCS{bucket: bucket}
+
+	err := s.Store("abc123", "raw", []byte("payload"))
+	if assert.NoError(t, err) && assert.Contains(t, bucket.objects, "raw/abc123") {
+		assert.Equal(t, "payload", bucket.objects["raw/abc123"].String())
+	}
+}
+
+func TestGCSStoreError(t *testing.T) {
+	bucket := &fakeBucket{
+		objects:  make(map[string]*fakeObject),
+		closeErr: errors.New("upload failed"),
+	}
+	s := &GCS{bucket: bucket}
+
+	assert.Error(t, s.Store("abc123", "raw", []byte("payload")))
+}
@@ -0,0 +1,23 @@
+package store
+
+import (
+	"bytes"
+	"compress/gzip"
+)
+
+// GzipExtension is appended to the filename of compressed files
+const GzipExtension = ".gz"
+
+// Gzip compresses data into a new buffer. It is meant for small captures,
+// larger ones should be streamed through a gzip.Writer instead.
+func Gzip(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
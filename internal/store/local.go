@@ -0,0 +1,126 @@
+package store
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Local stores files on the local filesystem
+type Local struct {
+	folder   string
+	fileMode os.FileMode
+	dirMode  os.FileMode
+	// flags opening files, archives never replace what was written
+	flags int
+
+	// locations already created
+	dirs sync.Map
+}
+
+// NewLocal creates a Storer writing files with fileMode beneath folder, creating
+// folders with dirMode. Modes of 0 use 0644 and 0755.
+func NewLocal(folder string, fileMode, dirMode os.FileMode) *Local {
+	if fileMode == 0 {
+		fileMode = 0644
+	}
+	if dirMode == 0 {
+		dirMode = 0755
+	}
+	return &Local{folder: folder, fileMode: fileMode, dirMode: dirMode, flags: os.O_TRUNC}
+}
+
+// NewArchive creates a Storer like NewLocal which only ever adds files, one
+// already archived is left as it was. Modes of 0 use 0440 and 0750.
+func NewArchive(folder string, fileMode, dirMode os.FileMode) *Local {
+	if fileMode == 0 {
+		fileMode = 0440
+	}
+	if dirMode == 0 {
+		dirMode = 0750
+	}
+	return &Local{folder: folder, fileMode: fileMode, dirMode: dirMode, flags: os.O_EXCL}
+}
+
+// Name of the backend
+func (s *Local) Name() string {
+	if s.flags&os.O_EXCL != 0 {
+		return "archive"
+	}
+	return "local"
+}
+
+// Store writes the data to folder/location/filename
+func (s *Local) Store(filename, location string, data []byte) error {
+	f, err := s.create(filename, location)
+	if f == nil {
+		return err
+	}
+	_, err = f.Write(data)
+	return s.finish(f, err)
+}
+
+// StoreStream copies the stream to folder/location/filename
+func (s *Local) StoreStream(filename, location string, open func() (io.ReadCloser, error)) error {
+	r, err := open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	f, err := s.create(filename, location)
+	if f == nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	return s.finish(f, err)
+}
+
+// create opens folder/location/filename for writing. Nil is returned without
+// an error when an archive already holds the file.
+func (s *Local) create(filename, location string) (*os.File, error) {
+	path, err := s.path(filename, location)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|s.flags, s.fileMode)
+	if s.flags&os.O_EXCL != 0 && errors.Is(err, fs.ErrExist) {
+		return nil, nil
+	}
+	return f, err
+}
+
+// finish closes the file, removing it if it was not written in full so an
+// archive does not keep a partial copy in place of the next attempt
+func (s *Local) finish(f *os.File, err error) error {
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// path returns where the file is written, creating the location if needed
+func (s *Local) path(filename, location string) (string, error) {
+	path, err := Path(s.folder, filename, location)
+	if err != nil {
+		return "", err
+	}
+	return path, s.mkdir(filepath.Dir(path))
+}
+
+// mkdir creates a location the first time it is written to
+func (s *Local) mkdir(dir string) error {
+	if _, ok := s.dirs.Load(dir); ok {
+		return nil
+	}
+	if err := os.MkdirAll(dir, s.dirMode); err != nil {
+		return err
+	}
+	s.dirs.Store(dir, true)
+	return nil
+}
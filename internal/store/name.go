@@ -0,0 +1,49 @@
+package store
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultNameTemplate keeps the filename chosen by whoever stored the file
+const DefaultNameTemplate = "{name}"
+
+// TimestampFormat is used for the {ts} token, sortable and free of separators
+const TimestampFormat = "20060102T150405Z"
+
+// ExpandName builds the filename for f from a template of tokens:
+// {name} the original filename, {hash} the content hash, {ts} the time stored,
+// {ip} the attacker, {port} the destination port, {uuid} the connection and
+// {seq} the session sequence. Every value is made safe to use as a single path
+// element, and the original filename is used if nothing is left.
+func ExpandName(template string, f File, hash string, now time.Time) string {
+	seq := ""
+	if f.Sequence > 0 {
+		seq = strconv.Itoa(f.Sequence)
+	}
+	r := strings.NewReplacer(
+		"{name}", safeElement(f.Filename),
+		"{hash}", safeElement(hash),
+		"{ts}", now.UTC().Format(TimestampFormat),
+		"{ip}", safeElement(f.Attacker),
+		"{port}", safeElement(f.DstPort),
+		"{uuid}", safeElement(f.UUID),
+		"{seq}", seq,
+	)
+	name := safeElement(r.Replace(template))
+	if name == "" {
+		return safeElement(f.Filename)
+	}
+	return name
+}
+
+// safeElement replaces anything which could leave the directory, so attacker
+// controlled values cannot traverse out of the location
+func safeElement(s string) string {
+	s = strings.NewReplacer("/", "_", "\\", "_", "\x00", "_").Replace(s)
+	for strings.Contains(s, "..") {
+		s = strings.ReplaceAll(s, "..", "_")
+	}
+	return s
+}
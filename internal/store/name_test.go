@@ -0,0 +1,33 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpandName(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+	f := File{Filename: "abc", Attacker: "192.0.2.1", DstPort: "22", UUID: "u-1", Sequence: 3}
+
+	assert.Equal(t, "abc", ExpandName(DefaultNameTemplate, f, "h", now))
+	assert.Equal(t, "20240501T123000Z-22-192.0.2.1-h", ExpandName("{ts}-{port}-{ip}-{hash}", f, "h", now))
+	assert.Equal(t, "u-1-3", ExpandName("{uuid}-{seq}", f, "h", now))
+
+	// missing details leave their tokens empty
+	assert.Equal(t, "-abc", ExpandName("{seq}-{name}", File{Filename: "abc"}, "", now))
+	assert.Equal(t, "abc", ExpandName("{ip}", File{Filename: "abc"}, "", now))
+}
+
+func TestExpandNameTraversal(t *testing.T) {
+	now := time.Now()
+	f := File{Filename: "../../etc/passwd", UUID: `..\..\x`}
+
+	for _, template := range []string{"{name}", "{uuid}", "../{name}", "a/b"} {
+		name := ExpandName(template, f, "", now)
+		assert.NotContains(t, name, "/")
+		assert.NotContains(t, name, `\`)
+		assert.NotContains(t, name, "..")
+	}
+}
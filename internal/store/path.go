@@ -0,0 +1,49 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// ErrUnsafePath is returned for names which could escape their location
+var ErrUnsafePath = errors.New("unsafe path")
+
+// checkElement rejects anything but a single, plain path element
+func checkElement(s string) error {
+	if s == "" || s == "." || strings.ContainsAny(s, "/\\\x00") || strings.Contains(s, "..") {
+		return fmt.Errorf("%w: %q", ErrUnsafePath, s)
+	}
+	return nil
+}
+
+// Key returns the object key location/filename, refusing names which could
+// traverse. The location may nest with slashes, the filename may not.
+func Key(filename, location string) (string, error) {
+	for _, e := range strings.Split(location, "/") {
+		if err := checkElement(e); err != nil {
+			return "", err
+		}
+	}
+	if err := checkElement(filename); err != nil {
+		return "", err
+	}
+	return location + "/" + filename, nil
+}
+
+// Path returns folder/location/filename, refusing names which could land outside folder
+func Path(folder, filename, location string) (string, error) {
+	key, err := Key(filename, location)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(folder, filepath.FromSlash(key))
+
+	// belt and braces, the cleaned path must stay beneath the folder
+	rel, err := filepath.Rel(filepath.Clean(folder), path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%w: %q", ErrUnsafePath, path)
+	}
+	return path, nil
+}
@@ -0,0 +1,88 @@
+package store
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPath(t *testing.T) {
+	path, err := Path("/var/lib/gambit", "abc", "raw")
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.FromSlash("/var/lib/gambit/raw/abc"), path)
+
+	for _, name := range []string{"", ".", "..", "../x", "a/b", `a\b`, "/etc/passwd", "a..b"} {
+		_, err := Path("/var/lib/gambit", name, "raw")
+		assert.True(t, errors.Is(err, ErrUnsafePath), name)
+		if name != "a/b" {
+			_, err = Path("/var/lib/gambit", "abc", name)
+			assert.True(t, errors.Is(err, ErrUnsafePath), name)
+		}
+	}
+
+	// locations may nest, but each element must be safe
+	path, err = Path("/var/lib/gambit", "abc", "sensors/honey1/raw")
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.FromSlash("/var/lib/gambit/sensors/honey1/raw/abc"), path)
+	for _, location := range []string{"a//b", "a/../b", "a/", "/a"} {
+		_, err := Path("/var/lib/gambit", "abc", location)
+		assert.True(t, errors.Is(err, ErrUnsafePath), location)
+	}
+}
+
+func TestLocalStoreTraversal(t *testing.T) {
+	dir := t.TempDir()
+	folder := filepath.Join(dir, "out")
+	s := NewLocal(folder, 0, 0)
+
+	assert.NoError(t, s.Store("abc", "raw", []byte("payload")))
+	assert.Error(t, s.Store("../../escaped", "raw", []byte("payload")))
+	assert.NoFileExists(t, filepath.Join(dir, "escaped"))
+
+	// new locations are created on demand
+	assert.NoError(t, s.Store("abc", "http", []byte("payload")))
+	assert.FileExists(t, filepath.Join(folder, "http", "abc"))
+}
+
+func TestLocalStoreModes(t *testing.T) {
+	folder := filepath.Join(t.TempDir(), "out")
+	s := NewLocal(folder, 0600, 0700)
+
+	assert.NoError(t, s.Store("abc", "raw", []byte("payload")))
+	assert.NoError(t, s.StoreStream("def", "raw", func() (io.ReadCloser, error) {
+		return io.NopCloser(strings.NewReader("payload")), nil
+	}))
+	for path, want := range map[string]os.FileMode{
+		filepath.Join(folder, "raw"):        0700 | os.ModeDir,
+		filepath.Join(folder, "raw", "abc"): 0600,
+		filepath.Join(folder, "raw", "def"): 0600,
+	} {
+		if info, err := os.Stat(path); assert.NoError(t, err) {
+			assert.Equal(t, want, info.Mode(), path)
+		}
+	}
+}
+
+func TestArchiveNeverReplaces(t *testing.T) {
+	folder := filepath.Join(t.TempDir(), "archive")
+	s := NewArchive(folder, 0, 0)
+
+	assert.NoError(t, s.Store("abc", "raw", []byte("first")))
+	assert.NoError(t, s.Store("abc", "raw", []byte("second")))
+	assert.NoError(t, s.StoreStream("abc", "raw", func() (io.ReadCloser, error) {
+		return io.NopCloser(strings.NewReader("third")), nil
+	}))
+	data, err := os.ReadFile(filepath.Join(folder, "raw", "abc"))
+	assert.NoError(t, err)
+	assert.Equal(t, "first", string(data))
+
+	info, err := os.Stat(filepath.Join(folder, "raw", "abc"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.FileMode(0440), info.Mode().Perm())
+	}
+}
@@ -0,0 +1,68 @@
+package store
+
+import (
+	"io"
+	"strings"
+	"time"
+)
+
+// DateFormat is used for the {date} token of a prefix
+const DateFormat = "2006-01-02"
+
+// Prefix wraps a Storer, placing every location beneath a prefix expanded as
+// each file is written. This lets many sensors share a bucket and lets
+// lifecycle rules match by date.
+type Prefix struct {
+	Storer
+	template string
+	hostname string
+	now      func() time.Time
+}
+
+// NewPrefix wraps storer with a prefix template of tokens: {hostname} the
+// sensor, {date} the day stored and {year}, {month} and {day} on their own.
+// Slashes separate nested locations, e.g. "sensors/{hostname}/{date}/".
+func NewPrefix(storer Storer, template, hostname string) *Prefix {
+	return &Prefix{
+		Storer:   storer,
+		template: template,
+		hostname: hostname,
+		now:      time.Now,
+	}
+}
+
+// Remote passes through the wrapped storer
+func (s *Prefix) Remote() bool {
+	remote, ok := s.Storer.(RemoteStorer)
+	return ok && remote.Remote()
+}
+
+// Store saves the data to prefix/location/filename
+func (s *Prefix) Store(filename, location string, data []byte) error {
+	return s.Storer.Store(filename, s.location(location), data)
+}
+
+// StoreStream saves the stream to prefix/location/filename
+func (s *Prefix) StoreStream(filename, location string, open func() (io.ReadCloser, error)) error {
+	return StoreStream(s.Storer, filename, s.location(location), open)
+}
+
+// location expands the prefix in front of location, dropping empty elements
+// so stray or doubled slashes do not matter
+func (s *Prefix) location(location string) string {
+	now := s.now().UTC()
+	r := strings.NewReplacer(
+		"{hostname}", safeElement(s.hostname),
+		"{date}", now.Format(DateFormat),
+		"{year}", now.Format("2006"),
+		"{month}", now.Format("01"),
+		"{day}", now.Format("02"),
+	)
+	var elements []string
+	for _, e := range strings.Split(r.Replace(s.template), "/") {
+		if e != "" {
+			elements = append(elements, e)
+		}
+	}
+	return strings.Join(append(elements, location), "/")
+}
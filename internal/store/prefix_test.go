@@ -0,0 +1,26 @@
+package store
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrefix(t *testing.T) {
+	folder := t.TempDir()
+	s := NewPrefix(NewLocal(folder, 0, 0), "sensors/{hostname}/{date}/", "honey/1")
+	s.now = func() time.Time { return time.Date(2024, 3, 9, 23, 0, 0, 0, time.UTC) }
+
+	assert.Equal(t, "sensors/honey_1/2024-03-09/raw", s.location("raw"))
+	assert.NoError(t, s.Store("abc", "raw", []byte("payload")))
+	assert.FileExists(t, filepath.Join(folder, "sensors", "honey_1", "2024-03-09", "raw", "abc"))
+
+	s.template = "/{year}//{month}/{day}"
+	assert.Equal(t, "2024/03/09/raw", s.location("raw"))
+
+	// remote backends stay remote
+	assert.True(t, NewPrefix(&GCS{}, "x", "").Remote())
+	assert.False(t, s.Remote())
+}
@@ -0,0 +1,68 @@
+package store
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"time"
+)
+
+// Retry wraps a Storer, retrying failed writes with exponential backoff and jitter
+type Retry struct {
+	Storer
+	maxRetries int
+	backoff    time.Duration
+	sleep      func(time.Duration)
+}
+
+// NewRetry wraps storer, retrying up to maxRetries times starting with a delay of backoff
+func NewRetry(storer Storer, maxRetries int, backoff time.Duration) *Retry {
+	return &Retry{
+		Storer:     storer,
+		maxRetries: maxRetries,
+		backoff:    backoff,
+		sleep:      time.Sleep,
+	}
+}
+
+// Remote passes through the wrapped storer
+func (s *Retry) Remote() bool {
+	remote, ok := s.Storer.(RemoteStorer)
+	return ok && remote.Remote()
+}
+
+// Store attempts to store the data until it succeeds or retries are exhausted
+func (s *Retry) Store(filename, location string, data []byte) error {
+	return s.retry(func() error {
+		return s.Storer.Store(filename, location, data)
+	})
+}
+
+// StoreStream attempts to store the stream, opening it again for each attempt
+func (s *Retry) StoreStream(filename, location string, open func() (io.ReadCloser, error)) error {
+	return s.retry(func() error {
+		return StoreStream(s.Storer, filename, location, open)
+	})
+}
+
+func (s *Retry) retry(store func() error) error {
+	err := store()
+	for attempt := 0; err != nil && attempt < s.maxRetries; attempt++ {
+		s.sleep(s.delay(attempt))
+		err = store()
+	}
+	if err != nil && s.maxRetries > 0 {
+		return fmt.Errorf("gave up after %d retries: %w", s.maxRetries, err)
+	}
+	return err
+}
+
+// delay doubles the backoff for each attempt and picks a point in the upper half
+func (s *Retry) delay(attempt int) time.Duration {
+	d := s.backoff << attempt
+	if d <= 0 {
+		return 0
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
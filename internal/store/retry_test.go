@@ -0,0 +1,62 @@
+package store
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeUploader fails the first failures uploads
+type fakeUploader struct {
+	failures int
+	calls    int
+	last     *s3manager.UploadInput
+}
+
+func (u *fakeUploader) Upload(in *s3manager.UploadInput, opts ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+	u.calls++
+	u.last = in
+	if u.calls <= u.failures {
+		return nil, errors.New("throttled")
+	}
+	return &s3manager.UploadOutput{}, nil
+}
+
+func (u *fakeUploader) UploadWithContext(ctx aws.Context, in *s3manager.UploadInput, opts ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+	return u.Upload(in, opts...)
+}
+
+func newTestRetry(uploader *fakeUploader, maxRetries int) (*Retry, *[]time.Duration) {
+	var delays []time.Duration
+	r := NewRetry(NewS3(uploader, "bucket", S3Options{}), maxRetries, 100*time.Millisecond)
+	r.sleep = func(d time.Duration) { delays = append(delays, d) }
+	return r, &delays
+}
+
+func TestRetrySucceeds(t *testing.T) {
+	uploader := &fakeUploader{failures: 2}
+	r, delays := newTestRetry(uploader, 3)
+
+	assert.NoError(t, r.Store("abc", "raw", []byte("payload")))
+	assert.Equal(t, 3, uploader.calls)
+	if assert.Len(t, *delays, 2) {
+		// exponential with jitter in the upper half
+		assert.GreaterOrEqual(t, (*delays)[0], 50*time.Millisecond)
+		assert.LessOrEqual(t, (*delays)[0], 100*time.Millisecond)
+		assert.GreaterOrEqual(t, (*delays)[1], 100*time.Millisecond)
+		assert.LessOrEqual(t, (*delays)[1], 200*time.Millisecond)
+	}
+}
+
+func TestRetryExhausted(t *testing.T) {
+	uploader := &fakeUploader{failures: 10}
+	r, _ := newTestRetry(uploader, 3)
+
+	assert.Error(t, r.Store("abc", "raw", []byte("payload")))
+	assert.Equal(t, 4, uploader.calls)
+	assert.True(t, r.Remote())
+}
@@ -0,0 +1,79 @@
+package store
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager/s3manageriface"
+)
+
+// S3Options are set on every object uploaded, empty values are left to the bucket defaults
+type S3Options struct {
+	// SSE is the server side encryption, such as AES256 or aws:kms
+	SSE string
+	// ACL is a canned ACL, such as private or bucket-owner-full-control
+	ACL string
+}
+
+// S3 uploads files to an S3 compatible bucket
+type S3 struct {
+	uploader s3manageriface.UploaderAPI
+	bucket   string
+	opts     S3Options
+}
+
+// NewS3 creates a Storer uploading to bucket
+func NewS3(uploader s3manageriface.UploaderAPI, bucket string, opts S3Options) *S3 {
+	return &S3{
+		uploader: uploader,
+		bucket:   bucket,
+		opts:     opts,
+	}
+}
+
+// Name of the backend
+func (s *S3) Name() string {
+	return "s3"
+}
+
+// Remote as uploads are billed
+func (s *S3) Remote() bool {
+	return true
+}
+
+// Store uploads the data to location/filename
+func (s *S3) Store(filename, location string, data []byte) error {
+	return s.upload(filename, location, bytes.NewReader(data))
+}
+
+// StoreStream uploads the stream to location/filename, in parts if it is large
+func (s *S3) StoreStream(filename, location string, open func() (io.ReadCloser, error)) error {
+	r, err := open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return s.upload(filename, location, r)
+}
+
+func (s *S3) upload(filename, location string, body io.Reader) error {
+	key, err := Key(filename, location)
+	if err != nil {
+		return err
+	}
+	in := &s3manager.UploadInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Body:   body,
+	}
+	if s.opts.SSE != "" {
+		in.ServerSideEncryption = aws.String(s.opts.SSE)
+	}
+	if s.opts.ACL != "" {
+		in.ACL = aws.String(s.opts.ACL)
+	}
+	_, err = s.uploader.Upload(in)
+	return err
+}
@@ -0,0 +1,21 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestS3Options(t *testing.T) {
+	uploader := &fakeUploader{}
+	assert.NoError(t, NewS3(uploader, "bucket", S3Options{}).Store("abc", "raw", []byte("payload")))
+	assert.Nil(t, uploader.last.ServerSideEncryption)
+	assert.Nil(t, uploader.last.ACL)
+
+	s := NewS3(uploader, "bucket", S3Options{SSE: "aws:kms", ACL: "bucket-owner-full-control"})
+	assert.NoError(t, s.Store("abc", "raw", []byte("payload")))
+	assert.Equal(t, "aws:kms", aws.StringValue(uploader.last.ServerSideEncryption))
+	assert.Equal(t, "bucket-owner-full-control", aws.StringValue(uploader.last.ACL))
+	assert.Equal(t, "raw/abc", aws.StringValue(uploader.last.Key))
+}
@@ -0,0 +1,59 @@
+package store
+
+import (
+	"sync"
+
+	"github.com/antihax/gambit/internal/metrics"
+	"github.com/antihax/gambit/pkg/lru"
+	"golang.org/x/time/rate"
+)
+
+// sampleHashes bounds how many distinct captures a Sampler counts
+const sampleHashes = 10000
+
+// Sampler bounds how many captures a driver stores under a flood, keeping one in
+// every N identical captures and at most a set number a second
+type Sampler struct {
+	every   int
+	limiter *rate.Limiter
+
+	mu     sync.Mutex
+	counts *lru.Cache[string, int]
+}
+
+// NewSampler keeps 1 in every identical captures and at most perSecond captures
+// a second. Either limit is disabled by 0, a nil Sampler allows everything.
+func NewSampler(every int, perSecond float64) *Sampler {
+	s := &Sampler{every: every}
+	if every > 1 {
+		s.counts = lru.New[string, int](sampleHashes)
+	}
+	if perSecond > 0 {
+		s.limiter = rate.NewLimiter(rate.Limit(perSecond), max(1, int(perSecond)))
+	}
+	return s
+}
+
+// Allow reports if the capture with this content hash should be stored,
+// counting it to SampledCaptures if not
+func (s *Sampler) Allow(hash string) bool {
+	if s == nil {
+		return true
+	}
+	if s.counts != nil {
+		s.mu.Lock()
+		n, _ := s.counts.Get(hash)
+		s.counts.Add(hash, n+1)
+		s.mu.Unlock()
+		// the first of each is always kept
+		if n%s.every != 0 {
+			metrics.SampledCaptures.Add(1)
+			return false
+		}
+	}
+	if s.limiter != nil && !s.limiter.Allow() {
+		metrics.SampledCaptures.Add(1)
+		return false
+	}
+	return true
+}
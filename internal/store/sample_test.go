@@ -0,0 +1,30 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSamplerEvery(t *testing.T) {
+	s := NewSampler(3, 0)
+	var kept []bool
+	for i := 0; i < 7; i++ {
+		kept = append(kept, s.Allow("abc"))
+	}
+	assert.Equal(t, []bool{true, false, false, true, false, false, true}, kept)
+	// other captures are counted apart
+	assert.True(t, s.Allow("def"))
+}
+
+func TestSamplerRate(t *testing.T) {
+	s := NewSampler(0, 2)
+	assert.True(t, s.Allow("a"))
+	assert.True(t, s.Allow("b"))
+	assert.False(t, s.Allow("c"))
+}
+
+func TestSamplerNil(t *testing.T) {
+	var s *Sampler
+	assert.True(t, s.Allow("abc"))
+}
@@ -0,0 +1,109 @@
+package store
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"hash"
+	"io"
+	"os"
+	"sync"
+)
+
+// Spool collects a capture in memory, moving it to a temporary file once it
+// grows past the threshold so large captures are streamed rather than held.
+type Spool struct {
+	threshold int64
+	buf       bytes.Buffer
+	file      *os.File
+	size      int64
+	hash      hash.Hash
+	err       error
+	once      sync.Once
+}
+
+// NewSpool creates a Spool holding up to threshold bytes in memory, 0 or less
+// keeps everything in memory
+func NewSpool(threshold int64) *Spool {
+	return &Spool{threshold: threshold, hash: sha1.New()}
+}
+
+// Write appends to the capture. A failure to spill to disk is kept and
+// returned by File, writes are still accepted so copies are not cut short.
+func (s *Spool) Write(p []byte) (int, error) {
+	s.size += int64(len(p))
+	s.hash.Write(p)
+	if s.err != nil {
+		return len(p), nil
+	}
+	if s.file == nil && s.threshold > 0 && int64(s.buf.Len()+len(p)) > s.threshold {
+		s.spill()
+	}
+	if s.file != nil {
+		if _, err := s.file.Write(p); err != nil {
+			s.err = err
+		}
+		return len(p), nil
+	}
+	s.buf.Write(p)
+	return len(p), nil
+}
+
+// spill moves what is buffered to a temporary file
+func (s *Spool) spill() {
+	f, err := os.CreateTemp("", "gambit-capture-*")
+	if err != nil {
+		s.err = err
+		return
+	}
+	if _, err := f.Write(s.buf.Bytes()); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		s.err = err
+		return
+	}
+	s.file = f
+	s.buf = bytes.Buffer{}
+}
+
+// Len is the number of bytes written
+func (s *Spool) Len() int64 {
+	return s.size
+}
+
+// Sum is the hex SHA1 of everything written, matching the hashes drivers use
+func (s *Spool) Sum() string {
+	return hex.EncodeToString(s.hash.Sum(nil))
+}
+
+// Fill sets the content of f, Data when small or Open when spooled to disk.
+// The temporary file belongs to f from then on and is removed by its Done.
+func (s *Spool) Fill(f *File) error {
+	if s.err != nil {
+		s.Close()
+		return s.err
+	}
+	if s.file == nil {
+		f.Data = s.buf.Bytes()
+		return nil
+	}
+	name := s.file.Name()
+	f.Size = s.size
+	f.Open = func() (io.ReadCloser, error) {
+		return os.Open(name)
+	}
+	f.Done = func() { s.Close() }
+	return nil
+}
+
+// Close removes the temporary file, if there is one
+func (s *Spool) Close() error {
+	var err error
+	s.once.Do(func() {
+		if s.file != nil {
+			s.file.Close()
+			err = os.Remove(s.file.Name())
+		}
+	})
+	return err
+}
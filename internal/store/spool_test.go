@@ -0,0 +1,67 @@
+package store
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readAll(t *testing.T, f *File) string {
+	r, err := f.Reader()
+	if !assert.NoError(t, err) {
+		return ""
+	}
+	defer r.Close()
+	b, _ := io.ReadAll(r)
+	return string(b)
+}
+
+func TestSpoolMemory(t *testing.T) {
+	s := NewSpool(16)
+	s.Write([]byte("small"))
+	var f File
+	assert.NoError(t, s.Fill(&f))
+	assert.False(t, f.Streamed())
+	assert.Equal(t, "small", string(f.Data))
+	sum := sha1.Sum([]byte("small"))
+	assert.Equal(t, hex.EncodeToString(sum[:]), s.Sum())
+}
+
+func TestSpoolFile(t *testing.T) {
+	s := NewSpool(16)
+	payload := strings.Repeat("0123456789", 10)
+	for i := 0; i < len(payload); i += 7 {
+		s.Write([]byte(payload[i:min(i+7, len(payload))]))
+	}
+	assert.Equal(t, int64(len(payload)), s.Len())
+
+	var f File
+	assert.NoError(t, s.Fill(&f))
+	if !assert.True(t, f.Streamed()) {
+		return
+	}
+	assert.Nil(t, f.Data)
+	assert.Equal(t, payload, readAll(t, &f))
+	// readable again for retries
+	assert.Equal(t, payload, readAll(t, &f))
+
+	f.Truncate(25)
+	assert.True(t, f.Truncated)
+	assert.Equal(t, payload[:25], readAll(t, &f))
+
+	name := s.file.Name()
+	assert.FileExists(t, name)
+	f.Release()
+	assert.NoFileExists(t, name)
+}
+
+func TestOfferDroppedReleases(t *testing.T) {
+	released := false
+	ch := make(chan File)
+	assert.False(t, Offer(ch, File{Done: func() { released = true }}))
+	assert.True(t, released)
+}
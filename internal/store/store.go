@@ -1,7 +1,141 @@
+// Package store provides the capture frames and the backends they are written to
 package store
 
+import (
+	"bytes"
+	"io"
+
+	"github.com/antihax/gambit/internal/metrics"
+)
+
 // File frame
 type File struct {
 	Filename, Location string
 	Data               []byte
+
+	// optional details of the connection, for filename templates
+	Attacker, DstPort, UUID string
+	Sequence                int
+
+	// Truncated is set when Data was cut short of what was captured
+	Truncated bool
+
+	// Open streams captures too large to hold in Data, it is called once for each
+	// read so backends can retry. Size is the length of the stream and Done, if
+	// set, is called once the file is stored or dropped to clean up behind it.
+	Open func() (io.ReadCloser, error)
+	Size int64
+	Done func()
+}
+
+// Streamed reports if the content is read through Open rather than held in Data
+func (f *File) Streamed() bool {
+	return f.Open != nil
+}
+
+// Len is the size of the content
+func (f *File) Len() int64 {
+	if f.Streamed() {
+		return f.Size
+	}
+	return int64(len(f.Data))
+}
+
+// Reader opens the content for reading, wherever it is held
+func (f *File) Reader() (io.ReadCloser, error) {
+	if !f.Streamed() {
+		return io.NopCloser(bytes.NewReader(f.Data)), nil
+	}
+	r, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	return readCloser{io.LimitReader(r, f.Size), r}, nil
+}
+
+// Release calls Done if it is set
+func (f *File) Release() {
+	if f.Done != nil {
+		f.Done()
+	}
+}
+
+// Truncate cuts the content down to max bytes, marking and counting the file if
+// it was cut. A max of 0 or less is unlimited.
+func (f *File) Truncate(max int) {
+	if max <= 0 || f.Len() <= int64(max) {
+		return
+	}
+	if f.Streamed() {
+		// Reader stops at Size
+		f.Size = int64(max)
+	} else {
+		f.Data = f.Data[:max]
+	}
+	f.Truncated = true
+	metrics.TruncatedCaptures.Add(1)
+}
+
+// readCloser reads from one reader and closes another
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// Offer queues the file without blocking, dropping and counting it if the
+// channel is full so a stalled backend cannot hold connections open
+func Offer(ch chan<- File, file File) bool {
+	if ch == nil {
+		return false
+	}
+	select {
+	case ch <- file:
+		return true
+	default:
+		metrics.DroppedCaptures.Add(1)
+		file.Release()
+		return false
+	}
+}
+
+// Storer saves captured data to a backend
+type Storer interface {
+	// Name identifies the backend in logs
+	Name() string
+	// Store saves data as filename within location
+	Store(filename, location string, data []byte) error
+}
+
+// StreamStorer is implemented by storers that can save content without holding
+// it all in memory
+type StreamStorer interface {
+	Storer
+	// StoreStream saves what open returns as filename within location, open may
+	// be called again for each attempt
+	StoreStream(filename, location string, open func() (io.ReadCloser, error)) error
+}
+
+// StoreStream saves what open returns with storer, reading it all into memory
+// first if the storer cannot stream
+func StoreStream(storer Storer, filename, location string, open func() (io.ReadCloser, error)) error {
+	if s, ok := storer.(StreamStorer); ok {
+		return s.StoreStream(filename, location, open)
+	}
+	r, err := open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return storer.Store(filename, location, data)
+}
+
+// RemoteStorer is implemented by storers that ship data off the host, where
+// every write has a cost
+type RemoteStorer interface {
+	Storer
+	Remote() bool
 }
@@ -0,0 +1,35 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/antihax/gambit/internal/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTruncate(t *testing.T) {
+	f := File{Data: []byte("0123456789")}
+	f.Truncate(0)
+	f.Truncate(10)
+	assert.Equal(t, "0123456789", string(f.Data))
+	assert.False(t, f.Truncated)
+
+	f.Truncate(4)
+	assert.Equal(t, "0123", string(f.Data))
+	assert.True(t, f.Truncated)
+}
+
+func TestOfferFull(t *testing.T) {
+	ch := make(chan File, 1)
+	before := metrics.DroppedCaptures.Value()
+	assert.True(t, Offer(ch, File{Filename: "a"}))
+
+	// a full channel drops and counts rather than blocking
+	assert.False(t, Offer(ch, File{Filename: "b"}))
+	assert.Equal(t, before+1, metrics.DroppedCaptures.Value())
+	assert.Equal(t, "a", (<-ch).Filename)
+
+	// nowhere to store is not a drop
+	assert.False(t, Offer(nil, File{Filename: "c"}))
+	assert.Equal(t, before+1, metrics.DroppedCaptures.Value())
+}
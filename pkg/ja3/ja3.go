@@ -0,0 +1,253 @@
+// Package ja3 parses TLS ClientHello messages and computes their JA3 fingerprint
+package ja3
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+const (
+	recordTypeHandshake      = 0x16
+	handshakeTypeClientHello = 0x01
+
+	extensionServerName   = 0x0000
+	extensionCurves       = 0x000a
+	extensionPointFormats = 0x000b
+	extensionALPN         = 0x0010
+)
+
+var (
+	// ErrNotClientHello is returned when the data is not a TLS ClientHello
+	ErrNotClientHello = errors.New("not a tls client hello")
+	// ErrIncomplete is returned when the records end before the ClientHello does
+	ErrIncomplete = errors.New("incomplete tls client hello")
+)
+
+// ClientHello holds the fields of interest from a TLS ClientHello
+type ClientHello struct {
+	// Raw handshake message, reassembled from every record it spanned
+	Raw          []byte
+	Version      uint16
+	CipherSuites []uint16
+	Extensions   []uint16
+	Curves       []uint16
+	PointFormats []uint8
+	ServerName   string
+	// ALPN protocols offered, in the client's order of preference
+	ALPN []string
+}
+
+// Parse reassembles a ClientHello from one or more TLS handshake records
+func Parse(data []byte) (*ClientHello, error) {
+	var msg []byte
+	for {
+		if len(data) < 5 {
+			return nil, ErrIncomplete
+		}
+		// record type and a sane major version
+		if data[0] != recordTypeHandshake || data[1] != 3 {
+			return nil, ErrNotClientHello
+		}
+		length := int(binary.BigEndian.Uint16(data[3:5]))
+		data = data[5:]
+		if length > len(data) {
+			msg = append(msg, data...)
+			return nil, ErrIncomplete
+		}
+		msg = append(msg, data[:length]...)
+		data = data[length:]
+
+		if len(msg) >= 4 {
+			if msg[0] != handshakeTypeClientHello {
+				return nil, ErrNotClientHello
+			}
+			size := int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3])
+			if len(msg) >= 4+size {
+				return parseClientHello(msg[:4+size])
+			}
+		}
+	}
+}
+
+// parseClientHello decodes a complete handshake message
+func parseClientHello(msg []byte) (*ClientHello, error) {
+	h := &ClientHello{Raw: msg}
+	r := reader(msg[4:])
+
+	version, ok := r.uint16()
+	if !ok || !r.skip(32) { // random
+		return nil, ErrNotClientHello
+	}
+	h.Version = version
+
+	if _, ok := r.vector8(); !ok { // session id
+		return nil, ErrNotClientHello
+	}
+
+	suites, ok := r.vector16()
+	if !ok || len(suites)%2 != 0 {
+		return nil, ErrNotClientHello
+	}
+	h.CipherSuites = uint16s(suites)
+
+	if _, ok := r.vector8(); !ok { // compression methods
+		return nil, ErrNotClientHello
+	}
+
+	// extensions are optional
+	if len(r) == 0 {
+		return h, nil
+	}
+	extensions, ok := r.vector16()
+	if !ok {
+		return nil, ErrNotClientHello
+	}
+	er := reader(extensions)
+	for len(er) > 0 {
+		typ, ok := er.uint16()
+		if !ok {
+			return nil, ErrNotClientHello
+		}
+		body, ok := er.vector16()
+		if !ok {
+			return nil, ErrNotClientHello
+		}
+		h.Extensions = append(h.Extensions, typ)
+
+		br := reader(body)
+		switch typ {
+		case extensionServerName:
+			if list, ok := br.vector16(); ok {
+				lr := reader(list)
+				if nameType, ok := lr.uint8(); ok && nameType == 0 {
+					if name, ok := lr.vector16(); ok {
+						h.ServerName = string(name)
+					}
+				}
+			}
+		case extensionCurves:
+			if curves, ok := br.vector16(); ok {
+				h.Curves = uint16s(curves)
+			}
+		case extensionPointFormats:
+			if formats, ok := br.vector8(); ok {
+				h.PointFormats = append([]uint8(nil), formats...)
+			}
+		case extensionALPN:
+			if list, ok := br.vector16(); ok {
+				lr := reader(list)
+				for len(lr) > 0 {
+					name, ok := lr.vector8()
+					if !ok {
+						break
+					}
+					h.ALPN = append(h.ALPN, string(name))
+				}
+			}
+		}
+	}
+
+	return h, nil
+}
+
+// String returns the JA3 string, skipping GREASE values
+func (h *ClientHello) String() string {
+	points := make([]uint16, len(h.PointFormats))
+	for i, p := range h.PointFormats {
+		points[i] = uint16(p)
+	}
+	return strings.Join([]string{
+		strconv.Itoa(int(h.Version)),
+		join(h.CipherSuites),
+		join(h.Extensions),
+		join(h.Curves),
+		join(points),
+	}, ",")
+}
+
+// Hash returns the md5 JA3 fingerprint
+func (h *ClientHello) Hash() string {
+	sum := md5.Sum([]byte(h.String()))
+	return hex.EncodeToString(sum[:])
+}
+
+// isGrease detects the reserved values clients randomly insert (RFC 8701)
+func isGrease(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func join(values []uint16) string {
+	s := make([]string, 0, len(values))
+	for _, v := range values {
+		if !isGrease(v) {
+			s = append(s, strconv.Itoa(int(v)))
+		}
+	}
+	return strings.Join(s, "-")
+}
+
+func uint16s(b []byte) []uint16 {
+	v := make([]uint16, len(b)/2)
+	for i := range v {
+		v[i] = binary.BigEndian.Uint16(b[i*2:])
+	}
+	return v
+}
+
+// reader consumes big endian fields from a byte slice
+type reader []byte
+
+func (r *reader) skip(n int) bool {
+	if len(*r) < n {
+		return false
+	}
+	*r = (*r)[n:]
+	return true
+}
+
+func (r *reader) uint8() (uint8, bool) {
+	if len(*r) < 1 {
+		return 0, false
+	}
+	v := (*r)[0]
+	*r = (*r)[1:]
+	return v, true
+}
+
+func (r *reader) uint16() (uint16, bool) {
+	if len(*r) < 2 {
+		return 0, false
+	}
+	v := binary.BigEndian.Uint16(*r)
+	*r = (*r)[2:]
+	return v, true
+}
+
+func (r *reader) bytes(n int) ([]byte, bool) {
+	if len(*r) < n {
+		return nil, false
+	}
+	v := (*r)[:n]
+	*r = (*r)[n:]
+	return v, true
+}
+
+func (r *reader) vector8() ([]byte, bool) {
+	n, ok := r.uint8()
+	if !ok {
+		return nil, false
+	}
+	return r.bytes(int(n))
+}
+
+func (r *reader) vector16() ([]byte, bool) {
+	n, ok := r.uint16()
+	if !ok {
+		return nil, false
+	}
+	return r.bytes(int(n))
+}
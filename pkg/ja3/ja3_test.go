@@ -0,0 +1,86 @@
+package ja3
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// clientHello captures the first flight of a Go TLS client
+func clientHello(t *testing.T, serverName string, protos ...string) []byte {
+	server, client := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		c := tls.Client(client, &tls.Config{ServerName: serverName, NextProtos: protos, InsecureSkipVerify: true})
+		c.Handshake()
+		client.Close()
+	}()
+
+	buf := make([]byte, 4096)
+	n, err := server.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf[:n]
+}
+
+func TestParse(t *testing.T) {
+	hello, err := Parse(clientHello(t, "example.com"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "example.com", hello.ServerName)
+		assert.NotEmpty(t, hello.CipherSuites)
+		assert.Contains(t, hello.Extensions, uint16(extensionServerName))
+		assert.Len(t, strings.Split(hello.String(), ","), 5)
+		assert.Len(t, hello.Hash(), 32)
+		assert.Empty(t, hello.ALPN)
+	}
+
+	hello, err = Parse(clientHello(t, "example.com", "h2", "http/1.1"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"h2", "http/1.1"}, hello.ALPN)
+	}
+}
+
+// split the handshake message across two records
+func TestParseFragmented(t *testing.T) {
+	record := clientHello(t, "example.com")
+	msg := record[5:]
+	half := len(msg) / 2
+
+	frag := func(b []byte) []byte {
+		hdr := []byte{recordTypeHandshake, 3, 1, 0, 0}
+		binary.BigEndian.PutUint16(hdr[3:], uint16(len(b)))
+		return append(hdr, b...)
+	}
+	data := append(frag(msg[:half]), frag(msg[half:])...)
+
+	whole, err := Parse(record)
+	assert.NoError(t, err)
+	hello, err := Parse(data)
+	if assert.NoError(t, err) {
+		assert.Equal(t, whole.Hash(), hello.Hash())
+	}
+
+	_, err = Parse(frag(msg[:half]))
+	assert.ErrorIs(t, err, ErrIncomplete)
+}
+
+func TestParseNotTLS(t *testing.T) {
+	_, err := Parse([]byte{0x16, 0x00, 0x01, 0x02, 0x03, 0x04})
+	assert.ErrorIs(t, err, ErrNotClientHello)
+
+	_, err = Parse([]byte("GET / HTTP/1.1\r\n\r\n"))
+	assert.ErrorIs(t, err, ErrNotClientHello)
+}
+
+func TestGrease(t *testing.T) {
+	assert.True(t, isGrease(0x0a0a))
+	assert.True(t, isGrease(0xfafa))
+	assert.False(t, isGrease(0x0a1a))
+	assert.Equal(t, "1-2", join([]uint16{0x2a2a, 1, 2}))
+}
@@ -0,0 +1,97 @@
+// Package lru provides a size bounded least recently used cache
+package lru
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Cache is a concurrency safe LRU cache
+type Cache[K comparable, V any] struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[K]*list.Element
+}
+
+type entry[K comparable, V any] struct {
+	key   K
+	value V
+}
+
+// New creates a cache holding at most size entries
+func New[K comparable, V any](size int) *Cache[K, V] {
+	if size < 1 {
+		size = 1
+	}
+	return &Cache[K, V]{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[K]*list.Element),
+	}
+}
+
+// Get returns the value for key, marking it recently used
+func (c *Cache[K, V]) Get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.order.MoveToFront(e)
+		return e.Value.(*entry[K, V]).value, true
+	}
+	var zero V
+	return zero, false
+}
+
+// Add stores the value for key, evicting the least recently used entry when full
+func (c *Cache[K, V]) Add(key K, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*entry[K, V]).value = value
+		c.order.MoveToFront(e)
+		return
+	}
+	c.push(key, value)
+}
+
+// LoadOrAdd returns the value for key if present, marking it recently used,
+// otherwise it adds value. loaded reports if the key was already present so
+// concurrent callers can claim a key exactly once.
+func (c *Cache[K, V]) LoadOrAdd(key K, value V) (actual V, loaded bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.order.MoveToFront(e)
+		return e.Value.(*entry[K, V]).value, true
+	}
+	c.push(key, value)
+	return value, false
+}
+
+// Remove forgets key
+func (c *Cache[K, V]) Remove(key K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.order.Remove(e)
+		delete(c.entries, key)
+	}
+}
+
+// push adds a new entry, evicting the least recently used when full
+func (c *Cache[K, V]) push(key K, value V) {
+	c.entries[key] = c.order.PushFront(&entry[K, V]{key: key, value: value})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*entry[K, V]).key)
+	}
+}
+
+// Len returns the number of entries
+func (c *Cache[K, V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
@@ -0,0 +1,52 @@
+package lru
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEviction(t *testing.T) {
+	c := New[string, int](2)
+	c.Add("a", 1)
+	c.Add("b", 2)
+
+	// touch a so b is the oldest
+	v, ok := c.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, 1, v)
+
+	c.Add("c", 3)
+	assert.Equal(t, 2, c.Len())
+	_, ok = c.Get("b")
+	assert.False(t, ok)
+	_, ok = c.Get("a")
+	assert.True(t, ok)
+	_, ok = c.Get("c")
+	assert.True(t, ok)
+}
+
+func TestLoadOrAdd(t *testing.T) {
+	c := New[string, int](2)
+	v, loaded := c.LoadOrAdd("a", 1)
+	assert.False(t, loaded)
+	assert.Equal(t, 1, v)
+
+	// the first value is kept
+	v, loaded = c.LoadOrAdd("a", 2)
+	assert.True(t, loaded)
+	assert.Equal(t, 1, v)
+
+	// and still bounded
+	c.LoadOrAdd("b", 2)
+	c.LoadOrAdd("c", 3)
+	assert.Equal(t, 2, c.Len())
+	_, ok := c.Get("b")
+	assert.True(t, ok)
+
+	c.Remove("b")
+	_, ok = c.Get("b")
+	assert.False(t, ok)
+	_, loaded = c.LoadOrAdd("b", 4)
+	assert.False(t, loaded)
+}
@@ -0,0 +1,194 @@
+// Package proxyproto reads PROXY protocol v1 and v2 headers sent by load balancers
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNoHeader is returned in strict mode when a connection does not start with a header
+	ErrNoHeader = errors.New("proxyproto: missing header")
+	// ErrInvalidHeader is returned when a header is malformed
+	ErrInvalidHeader = errors.New("proxyproto: invalid header")
+
+	v1Signature = []byte("PROXY ")
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+const (
+	// v1MaxLength is the longest possible v1 header including CRLF
+	v1MaxLength = 107
+
+	v2CommandLocal = 0x0
+	v2CommandProxy = 0x1
+	v2FamilyTCP4   = 0x11
+	v2FamilyTCP6   = 0x21
+)
+
+// Conn is a connection with the PROXY header consumed, reporting the
+// original client as its remote address.
+type Conn struct {
+	net.Conn
+	reader *bufio.Reader
+	remote net.Addr
+	local  net.Addr
+}
+
+// Read from the connection after the header
+func (c *Conn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// RemoteAddr returns the client address from the header, or the peer if none was sent
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the destination address from the header, or the socket if none was sent
+func (c *Conn) LocalAddr() net.Addr {
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+// ReadHeader consumes a PROXY header from the front of conn, waiting at most
+// timeout. Connections without a header pass through untouched unless strict.
+func ReadHeader(conn net.Conn, strict bool, timeout time.Duration) (*Conn, error) {
+	c := &Conn{
+		Conn:   conn,
+		reader: bufio.NewReaderSize(conn, 256),
+	}
+
+	if timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		defer conn.SetReadDeadline(time.Time{})
+	}
+
+	var err error
+	switch {
+	case c.hasPrefix(v2Signature):
+		err = c.readV2()
+	case c.hasPrefix(v1Signature):
+		err = c.readV1()
+	case strict:
+		err = ErrNoHeader
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// hasPrefix peeks a byte at a time so traffic without a header is never held
+// waiting for bytes that will not come.
+func (c *Conn) hasPrefix(sig []byte) bool {
+	for i := 1; i <= len(sig); i++ {
+		b, err := c.reader.Peek(i)
+		if err != nil || b[i-1] != sig[i-1] {
+			return false
+		}
+	}
+	return true
+}
+
+// readV1 parses "PROXY TCP4 src dst sport dport\r\n"
+func (c *Conn) readV1() error {
+	var line []byte
+	for len(line) < v1MaxLength {
+		b, err := c.reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		line = append(line, b)
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return ErrInvalidHeader
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 {
+		return ErrInvalidHeader
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil
+	case "TCP4", "TCP6":
+	default:
+		return ErrInvalidHeader
+	}
+	if len(fields) != 6 {
+		return ErrInvalidHeader
+	}
+
+	src, dst := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, srcErr := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, dstErr := strconv.ParseUint(fields[5], 10, 16)
+	if src == nil || dst == nil || srcErr != nil || dstErr != nil {
+		return ErrInvalidHeader
+	}
+	c.remote = &net.TCPAddr{IP: src, Port: int(srcPort)}
+	c.local = &net.TCPAddr{IP: dst, Port: int(dstPort)}
+	return nil
+}
+
+// readV2 parses the binary header
+func (c *Conn) readV2() error {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(c.reader, hdr); err != nil {
+		return err
+	}
+	if hdr[12]>>4 != 2 {
+		return ErrInvalidHeader
+	}
+	command, family := hdr[12]&0xf, hdr[13]
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(c.reader, body); err != nil {
+		return err
+	}
+
+	// health checks from the balancer itself carry no addresses
+	if command == v2CommandLocal {
+		return nil
+	}
+	if command != v2CommandProxy {
+		return ErrInvalidHeader
+	}
+
+	var size int
+	switch family {
+	case v2FamilyTCP4:
+		size = net.IPv4len
+	case v2FamilyTCP6:
+		size = net.IPv6len
+	default:
+		// unsupported families keep the socket addresses
+		return nil
+	}
+	if len(body) < size*2+4 {
+		return ErrInvalidHeader
+	}
+	c.remote = &net.TCPAddr{
+		IP:   net.IP(body[:size]),
+		Port: int(binary.BigEndian.Uint16(body[size*2:])),
+	}
+	c.local = &net.TCPAddr{
+		IP:   net.IP(body[size : size*2]),
+		Port: int(binary.BigEndian.Uint16(body[size*2+2:])),
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package proxyproto
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// readHeader sends data from a peer and parses the header from the other side
+func readHeader(t *testing.T, data []byte, strict bool) (*Conn, error) {
+	server, client := net.Pipe()
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	go client.Write(data)
+	return ReadHeader(server, strict, time.Second)
+}
+
+func remaining(t *testing.T, c *Conn, n int) string {
+	buf := make([]byte, n)
+	_, err := io.ReadFull(c, buf)
+	assert.NoError(t, err)
+	return string(buf)
+}
+
+func TestV1(t *testing.T) {
+	c, err := readHeader(t, []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nGET /"), true)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "192.0.2.1:56324", c.RemoteAddr().String())
+		assert.Equal(t, "198.51.100.1:443", c.LocalAddr().String())
+		assert.Equal(t, "GET /", remaining(t, c, 5))
+	}
+}
+
+func TestV2(t *testing.T) {
+	hdr := append([]byte{}, v2Signature...)
+	hdr = append(hdr, 0x21, v2FamilyTCP4, 0, 12,
+		192, 0, 2, 1, // src
+		198, 51, 100, 1, // dst
+		0xdc, 0x04, // 56324
+		0x01, 0xbb, // 443
+	)
+	c, err := readHeader(t, append(hdr, []byte("SSH-2.0")...), true)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "192.0.2.1:56324", c.RemoteAddr().String())
+		assert.Equal(t, "198.51.100.1:443", c.LocalAddr().String())
+		assert.Equal(t, "SSH-2.0", remaining(t, c, 7))
+	}
+}
+
+func TestPassthrough(t *testing.T) {
+	// shares a first byte with the v1 signature
+	c, err := readHeader(t, []byte("POST / HTTP/1.1"), false)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "pipe", c.RemoteAddr().String())
+		assert.Equal(t, "POST /", remaining(t, c, 6))
+	}
+}
+
+func TestStrict(t *testing.T) {
+	_, err := readHeader(t, []byte("GET / HTTP/1.1"), true)
+	assert.ErrorIs(t, err, ErrNoHeader)
+
+	_, err = readHeader(t, []byte("PROXY TCP4 nonsense\r\n"), true)
+	assert.ErrorIs(t, err, ErrInvalidHeader)
+}
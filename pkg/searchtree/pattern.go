@@ -0,0 +1,101 @@
+package searchtree
+
+import "errors"
+
+// ErrMaskLength is returned for a pattern whose mask does not cover its bytes
+var ErrMaskLength = errors.New("searchtree: pattern mask must be the same length as its bytes")
+
+// searchDepth is how far into the data patterns without an offset are searched
+const searchDepth = 25
+
+// Pattern describes bytes to match in data.
+// Without Mask or Offset, patterns are matched anywhere in the first 25 bytes
+// using the tree. Positional and masked patterns are checked individually.
+type Pattern struct {
+	// Bytes to compare against the data
+	Bytes []byte
+
+	// Mask is ANDed with the data and Bytes before comparing, a 0x00 byte is a
+	// wildcard. If set, it must be the same length as Bytes.
+	Mask []byte
+
+	// Offset the pattern must appear at when Anywhere is false
+	Offset int
+
+	// Anywhere searches the first 25 bytes instead of a fixed offset
+	Anywhere bool
+}
+
+// FromBytes adapts simple byte prefixes into patterns found anywhere in the first 25 bytes
+func FromBytes(raw [][]byte) []Pattern {
+	patterns := make([]Pattern, 0, len(raw))
+	for _, b := range raw {
+		patterns = append(patterns, Pattern{Bytes: b, Anywhere: true})
+	}
+	return patterns
+}
+
+// Validate reports if the pattern cannot be matched as described
+func (p Pattern) Validate() error {
+	if p.Mask != nil && len(p.Mask) != len(p.Bytes) {
+		return ErrMaskLength
+	}
+	return nil
+}
+
+// simple patterns can live in the tree
+func (p Pattern) simple() bool {
+	return p.Anywhere && p.Mask == nil
+}
+
+// specificity is the number of bytes the pattern actually tests
+func (p Pattern) specificity() int {
+	if p.Mask == nil {
+		return len(p.Bytes)
+	}
+	n := 0
+	for _, m := range p.Mask {
+		if m != 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// matchAt tests if the pattern matches data at offset
+func (p Pattern) matchAt(data []byte, offset int) bool {
+	if offset < 0 || offset+len(p.Bytes) > len(data) {
+		return false
+	}
+	for i, b := range p.Bytes {
+		d := data[offset+i]
+		if p.Mask != nil {
+			d &= p.Mask[i]
+			b &= p.Mask[i]
+		}
+		if d != b {
+			return false
+		}
+	}
+	return true
+}
+
+// match returns the offset the pattern matches data at
+func (p Pattern) match(data []byte) (int, bool) {
+	if !p.Anywhere {
+		return p.Offset, p.matchAt(data, p.Offset)
+	}
+	for i := 0; i < searchDepth && i < len(data); i++ {
+		if p.matchAt(data, i) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// positional is a pattern which cannot be stored in the tree
+type positional struct {
+	pattern  Pattern
+	entry    interface{}
+	priority int
+}
@@ -3,8 +3,9 @@ package searchtree
 
 // Node is a node in the tree
 type Node struct {
-	Nodes map[byte]*Node
-	Entry interface{}
+	Nodes    map[byte]*Node
+	Entry    interface{}
+	Priority int
 }
 
 // NewNode returns a new node
@@ -17,6 +18,9 @@ func NewNode() *Node {
 // Tree represents a search tree for pattern matching
 type Tree struct {
 	Node *Node
+
+	// patterns with an offset or mask, checked one by one
+	positional []positional
 }
 
 // NewTree returns a new tree
@@ -26,8 +30,14 @@ func NewTree() Tree {
 	}
 }
 
-// Insert an entry into the tree
+// Insert an entry into the tree with the default priority
 func (s *Tree) Insert(key []byte, value interface{}) {
+	s.InsertPriority(key, value, 0)
+}
+
+// InsertPriority inserts an entry into the tree, entries with a higher priority
+// win over longer matches of a lower priority
+func (s *Tree) InsertPriority(key []byte, value interface{}, priority int) {
 	lastNode := s.Node
 	for _, b := range key {
 		n, ok := lastNode.Nodes[b]
@@ -38,21 +48,39 @@ func (s *Tree) Insert(key []byte, value interface{}) {
 		lastNode = n
 	}
 	lastNode.Entry = value
+	lastNode.Priority = priority
 }
 
-// Match data to an entry and continue to look ahead in case there are more complex matches
+// InsertPattern inserts an entry for a pattern which may carry an offset or mask,
+// returning an error without inserting it if the pattern is invalid
+func (s *Tree) InsertPattern(p Pattern, value interface{}, priority int) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	if p.simple() {
+		s.InsertPriority(p.Bytes, value, priority)
+		return nil
+	}
+	s.positional = append(s.positional, positional{pattern: p, entry: value, priority: priority})
+	return nil
+}
+
+// Match data to the most specific entry. Every offset in the first 25 bytes is
+// searched, preferring a match anchored at the start of the data, then the
+// highest priority, then the longest pattern, then the earliest offset. A
+// protocol's own header at the start beats bytes which happen to turn up later.
 func (s *Tree) Match(data []byte) interface{} {
-	var lastSuccess interface{}
+	var best candidate
 
 	// Search the first 25 bytes for matches
 	l := len(data)
-	if l > 25 {
-		l = 25
+	if l > searchDepth {
+		l = searchDepth
 	}
 	for i := 0; i < l; i++ {
 		lastNode := s.Node
 
-		for _, b := range data[i:] {
+		for depth, b := range data[i:] {
 			n, ok := lastNode.Nodes[b]
 			// Did we fall of the end of the branch?
 			if !ok {
@@ -60,15 +88,46 @@ func (s *Tree) Match(data []byte) interface{} {
 			}
 			lastNode = n
 
-			// Save any successfull entries
+			// Save any successful entries
 			if n.Entry != nil {
-				lastSuccess = n.Entry
+				best.consider(candidate{n.Entry, n.Priority, depth + 1, i})
 			}
 		}
+	}
 
-		if lastSuccess != nil {
-			return lastSuccess
+	// then anything with an offset or mask
+	for _, p := range s.positional {
+		if offset, ok := p.pattern.match(data); ok {
+			best.consider(candidate{p.entry, p.priority, p.pattern.specificity(), offset})
 		}
 	}
-	return lastSuccess
+
+	return best.entry
+}
+
+// candidate is a match being weighed against others
+type candidate struct {
+	entry    interface{}
+	priority int
+	length   int
+	offset   int
+}
+
+// consider replaces the candidate if c is more specific
+func (b *candidate) consider(c candidate) {
+	if b.entry == nil {
+		*b = c
+		return
+	}
+	if anchored, best := c.offset == 0, b.offset == 0; anchored != best {
+		if anchored {
+			*b = c
+		}
+		return
+	}
+	if c.priority > b.priority ||
+		(c.priority == b.priority && c.length > b.length) ||
+		(c.priority == b.priority && c.length == b.length && c.offset < b.offset) {
+		*b = c
+	}
 }
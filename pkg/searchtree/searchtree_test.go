@@ -0,0 +1,94 @@
+package searchtree
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchLongest(t *testing.T) {
+	tree := NewTree()
+	tree.Insert([]byte{3, 0, 0}, "broad")
+	tree.Insert([]byte{3, 0, 0, 0x13, 0x0e, 0xe0}, "specific")
+
+	assert.Equal(t, "specific", tree.Match([]byte{3, 0, 0, 0x13, 0x0e, 0xe0, 0, 0}))
+	assert.Equal(t, "broad", tree.Match([]byte{3, 0, 0, 0x2f}))
+	assert.Nil(t, tree.Match([]byte{4, 0, 0}))
+}
+
+func TestMatchAnchoredFirst(t *testing.T) {
+	tree := NewTree()
+	tree.InsertPriority([]byte{3, 0, 0}, "anchored", -1)
+	tree.InsertPriority([]byte("USER "), "later", 1)
+
+	// a header at the start wins over a longer, preferred pattern found further in
+	assert.Equal(t, "anchored", tree.Match([]byte("\x03\x00\x00\x2a\x25\xe0\x00\x00\x00\x00\x00Cookie: mstshash=USER a")))
+	// which still wins when nothing is anchored
+	assert.Equal(t, "later", tree.Match([]byte("\x00\x03\x00\x00USER a")))
+}
+
+func TestMatchPriority(t *testing.T) {
+	tree := NewTree()
+	tree.InsertPriority([]byte{3, 0, 0, 0x13}, "long", -1)
+	tree.InsertPriority([]byte{3, 0}, "preferred", 1)
+
+	assert.Equal(t, "preferred", tree.Match([]byte{3, 0, 0, 0x13}))
+}
+
+func TestMatchEarliestOffset(t *testing.T) {
+	tree := NewTree()
+	tree.Insert([]byte("GET"), "first")
+	tree.Insert([]byte("PUT"), "second")
+
+	assert.Equal(t, "first", tree.Match([]byte("GET PUT")))
+}
+
+func TestMatchOffset(t *testing.T) {
+	tree := NewTree()
+	tree.Insert([]byte{0x01}, "broad")
+	// version byte at a fixed offset after a length prefix
+	tree.InsertPattern(Pattern{Bytes: []byte{0x01}, Offset: 2}, "version", 1)
+
+	assert.Equal(t, "version", tree.Match([]byte{0x00, 0x10, 0x01}))
+	assert.Equal(t, "broad", tree.Match([]byte{0x01, 0x10, 0x02}))
+}
+
+func TestMatchMask(t *testing.T) {
+	tree := NewTree()
+	// TPKT header, any length, X.224 connection request
+	tree.InsertPattern(Pattern{
+		Bytes: []byte{0x03, 0x00, 0x00, 0x00, 0x00, 0xe0},
+		Mask:  []byte{0xff, 0xff, 0x00, 0x00, 0x00, 0xf0},
+	}, "x224", 0)
+
+	assert.Equal(t, "x224", tree.Match([]byte{0x03, 0x00, 0x00, 0x2b, 0x26, 0xe0}))
+	assert.Nil(t, tree.Match([]byte{0x03, 0x00, 0x00, 0x2b, 0x26, 0xd0}))
+}
+
+func TestMatchMaskAnywhere(t *testing.T) {
+	tree := NewTree()
+	tree.InsertPattern(Pattern{
+		Bytes:    []byte{0xca, 0xfe, 0x00},
+		Mask:     []byte{0xff, 0xff, 0x00},
+		Anywhere: true,
+	}, "magic", 0)
+
+	assert.Equal(t, "magic", tree.Match([]byte{0x00, 0x04, 0xca, 0xfe, 0x17}))
+}
+
+func TestFromBytes(t *testing.T) {
+	tree := NewTree()
+	for _, p := range FromBytes([][]byte{[]byte("GET ")}) {
+		tree.InsertPattern(p, "http", 0)
+	}
+	assert.Equal(t, "http", tree.Match([]byte("GET / HTTP/1.1")))
+	assert.Empty(t, tree.positional)
+}
+
+func TestInsertPatternMaskLength(t *testing.T) {
+	tree := NewTree()
+	err := tree.InsertPattern(Pattern{Bytes: []byte{0x03, 0x00}, Mask: []byte{0xff}}, "short", 0)
+	assert.ErrorIs(t, err, ErrMaskLength)
+	assert.Empty(t, tree.positional)
+	assert.Nil(t, tree.Match([]byte{0x03, 0x00}))
+}